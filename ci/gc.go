@@ -7,7 +7,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
 	"path"
 	"slices"
@@ -17,7 +17,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/nix-community/go-nix/pkg/narinfo"
 	"google.golang.org/protobuf/proto"
@@ -35,9 +34,10 @@ type (
 		stage   func(string)
 		summary *strings.Builder
 		zp      *common.ZstdCtxPool
-		s3      *s3.Client
-		bucket  string
+		store   gcStore
 		age     time.Duration
+		diffAge time.Duration
+		diffMax int64
 		lim     struct{ trace, chunk, list, del, batch int }
 
 		toDelete     sync.Map
@@ -50,28 +50,41 @@ type (
 		goodNar      sync.Map
 		goodManifest sync.Map
 		goodChunk    sync.Map
+		goodPack     sync.Map
 	}
 
 	GCConfig struct {
 		Bucket string
-		MaxAge time.Duration
+		S3     manifester.S3Config
+		// local chunk store directory, used instead of Bucket if set
+		LocalDir string
+		MaxAge   time.Duration
+		// max age for diff cache entries, defaults to MaxAge
+		DiffCacheMaxAge time.Duration
+		// max total size of diff cache entries, oldest are removed first. zero for no limit.
+		DiffCacheMaxSize int64
 	}
 )
 
 func GCLocal(ctx context.Context, cfg GCConfig) error {
 	var sb strings.Builder
-	s3, err := getS3Cli()
-	if err != nil {
+	var store gcStore
+	if cfg.LocalDir != "" {
+		store = &localGCStore{dir: cfg.LocalDir}
+	} else if s3, err := manifester.NewS3Client(ctx, cfg.S3); err != nil {
 		return err
+	} else {
+		store = &s3GCStore{s3: s3, bucket: cfg.Bucket}
 	}
 	gc := gc{
 		now:     time.Now(),
 		stage:   func(s string) { log.Println("======================", "STAGE", s) },
 		summary: &sb,
 		zp:      common.GetZstdCtxPool(),
-		s3:      s3,
-		bucket:  cfg.Bucket,
+		store:   store,
 		age:     cfg.MaxAge,
+		diffAge: cmp.Or(cfg.DiffCacheMaxAge, cfg.MaxAge),
+		diffMax: cfg.DiffCacheMaxSize,
 		lim: struct{ trace, chunk, list, del, batch int }{
 			trace: 10,
 			chunk: 3,
@@ -98,38 +111,21 @@ func (gc *gc) writeBuildRoot(ctx context.Context, br *pb.BuildRoot, key string)
 		return err
 	}
 
-	key = manifester.BuildRootPath[1:] + key
 	z := gc.zp.Get()
 	defer gc.zp.Put(z)
 	d, err := z.Compress(nil, data)
 	if err != nil {
 		return err
 	}
-	_, err = gc.s3.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:          &gc.bucket,
-		Key:             &key,
-		Body:            bytes.NewReader(d),
-		CacheControl:    aws.String("public, max-age=31536000"),
-		ContentType:     aws.String("application/octet-stream"),
-		ContentEncoding: aws.String("zstd"),
-	})
-	return err
+	return gc.store.put(ctx, manifester.BuildRootPath[1:]+key, d)
 }
 
 func (gc *gc) readOne(ctx context.Context, key string, dst []byte) ([]byte, error) {
-	res, err := gc.s3.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &gc.bucket,
-		Key:    &key,
-	})
+	body, compressed, err := gc.store.get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-	if aws.ToString(res.ContentEncoding) == "zstd" {
+	if compressed {
 		z := gc.zp.Get()
 		defer gc.zp.Put(z)
 		if dst == nil {
@@ -148,27 +144,8 @@ func (gc *gc) readOne(ctx context.Context, key string, dst []byte) ([]byte, erro
 	return body, nil
 }
 
-func (gc *gc) listPrefix(ctx context.Context, prefix string, f func(s3types.Object) error) error {
-	var token *string
-	for {
-		res, err := gc.s3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-			Bucket:            &gc.bucket,
-			Prefix:            aws.String(prefix),
-			ContinuationToken: token,
-		})
-		if err != nil {
-			return err
-		}
-		for _, c := range res.Contents {
-			if err := f(c); err != nil {
-				return err
-			}
-		}
-		if res.NextContinuationToken == nil {
-			return nil
-		}
-		token = res.NextContinuationToken
-	}
+func isNotFound(err error) bool {
+	return manifester.IsS3NotFound(err) || errors.Is(err, fs.ErrNotExist)
 }
 
 func (gc *gc) run(ctx context.Context) error {
@@ -199,10 +176,10 @@ func (gc *gc) del(path string, size int64) {
 func (gc *gc) loadRoots(ctx context.Context) ([]string, error) {
 	gc.stage("GC LOAD ROOTS")
 	var roots []string
-	err := gc.listPrefix(ctx, manifester.BuildRootPath[1:], func(o s3types.Object) error {
-		key := aws.ToString(o.Key)
+	err := gc.store.list(ctx, manifester.BuildRootPath[1:], func(o gcObject) error {
+		key := o.key
 		gc.totalCount.Add(1)
-		gc.totalSize.Add(aws.ToInt64(o.Size))
+		gc.totalSize.Add(o.size)
 		base := path.Base(key)
 		parts := strings.Split(base, "@") // "build", time, relid, styx commit
 		keep := false
@@ -218,7 +195,7 @@ func (gc *gc) loadRoots(ctx context.Context) ([]string, error) {
 			roots = append(roots, base)
 		}
 		if !keep {
-			gc.del(key, aws.ToInt64(o.Size))
+			gc.del(key, o.size)
 		}
 		return nil
 	})
@@ -265,7 +242,7 @@ func (gc *gc) traceSph(eg *errgroup.Group, sph string) error {
 	key := "nixcache/" + sph + ".narinfo"
 	b, err := gc.readOne(eg, key, nil)
 	if err != nil {
-		if manifester.IsS3NotFound(err) {
+		if isNotFound(err) {
 			return nil // ignore if not found
 		}
 		return err
@@ -288,7 +265,7 @@ func (gc *gc) traceManifest(eg *errgroup.Group, mc string) error {
 
 	b, err := gc.readOne(eg, key, nil)
 	if err != nil {
-		if manifester.IsS3NotFound(err) {
+		if isNotFound(err) {
 			return nil // ignore if not found
 		}
 		return err
@@ -345,24 +322,24 @@ func (gc *gc) list(ctx context.Context) error {
 	eg.SetLimit(cmp.Or(gc.lim.list, 5))
 	eg.Go(func() error {
 		var count, size int64
-		err := gc.listPrefix(eg, "nixcache/", func(o s3types.Object) error {
+		err := gc.store.list(eg, "nixcache/", func(o gcObject) error {
 			count++
-			key := aws.ToString(o.Key)
-			size += aws.ToInt64(o.Size)
+			key := o.key
+			size += o.size
 			if rest, ok := strings.CutPrefix(key, "nixcache/nar/"); ok {
 				if _, ok := gc.goodNar.Load(rest); !ok {
-					gc.del(key, aws.ToInt64(o.Size))
+					gc.del(key, o.size)
 				}
 			} else if rest, ok := strings.CutSuffix(key, ".narinfo"); ok {
 				rest = strings.TrimPrefix(rest, "nixcache/")
 				if _, ok := gc.goodNi.Load(rest); !ok {
-					gc.del(key, aws.ToInt64(o.Size))
+					gc.del(key, o.size)
 				}
 			} else if key == "nixcache/nix-cache-info" {
 				// leave
 			} else {
 				gc.logln("unexpected file in nix cache", key)
-				gc.del(key, aws.ToInt64(o.Size))
+				gc.del(key, o.size)
 			}
 			return nil
 		})
@@ -372,12 +349,57 @@ func (gc *gc) list(ctx context.Context) error {
 	})
 	eg.Go(func() error {
 		var count, size int64
-		err := gc.listPrefix(eg, manifester.ManifestCachePath[1:], func(o s3types.Object) error {
+		err := gc.store.list(eg, manifester.ManifestCachePath[1:], func(o gcObject) error {
 			count++
-			key := aws.ToString(o.Key)
-			size += aws.ToInt64(o.Size)
+			key := o.key
+			size += o.size
 			if _, ok := gc.goodManifest.Load(path.Base(key)); !ok {
-				gc.del(key, aws.ToInt64(o.Size))
+				gc.del(key, o.size)
+			}
+			return nil
+		})
+		gc.totalCount.Add(count)
+		gc.totalSize.Add(size)
+		return err
+	})
+	eg.Go(func() error { return gc.listPacks(eg) })
+	eg.Go(func() error {
+		// diff cache entries aren't referenced by anything, just expire them by age and size
+		var count, size int64
+		var keep []gcObject
+		err := gc.store.list(eg, manifester.DiffCachePath[1:], func(o gcObject) error {
+			count++
+			size += o.size
+			if gc.now.Sub(o.mtime) > gc.diffAge {
+				gc.del(o.key, o.size)
+			} else {
+				keep = append(keep, o)
+			}
+			return nil
+		})
+		gc.totalCount.Add(count)
+		gc.totalSize.Add(size)
+		if err != nil || gc.diffMax <= 0 {
+			return err
+		}
+		slices.SortFunc(keep, func(a, b gcObject) int { return b.mtime.Compare(a.mtime) })
+		var keepSize int64
+		for _, o := range keep {
+			if keepSize += o.size; keepSize > gc.diffMax {
+				gc.del(o.key, o.size)
+			}
+		}
+		return nil
+	})
+	eg.Go(func() error {
+		// precomputed diffs serve upgrades to releases that are still around, so keep them as
+		// long as build roots
+		var count, size int64
+		err := gc.store.list(eg, manifester.PrecomputedDiffPath[1:], func(o gcObject) error {
+			count++
+			size += o.size
+			if gc.now.Sub(o.mtime) > gc.age {
+				gc.del(o.key, o.size)
 			}
 			return nil
 		})
@@ -385,22 +407,21 @@ func (gc *gc) list(ctx context.Context) error {
 		gc.totalSize.Add(size)
 		return err
 	})
-	for _, pchar := range "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_" {
-		pchar := pchar
+	for _, prefix := range gc.store.chunkPrefixes() {
 		eg.Go(func() error {
 			var count, size int64
-			err := gc.listPrefix(eg, manifester.ChunkReadPath[1:]+string(pchar), func(o s3types.Object) error {
+			err := gc.store.list(eg, manifester.ChunkReadPath[1:]+prefix, func(o gcObject) error {
 				count++
-				key := aws.ToString(o.Key)
-				size += aws.ToInt64(o.Size)
+				key := o.key
+				size += o.size
 				gc.totalCount.Add(1)
-				gc.totalSize.Add(aws.ToInt64(o.Size))
+				gc.totalSize.Add(o.size)
 				b, err := base64.RawURLEncoding.DecodeString(path.Base(key))
 				if err != nil {
 					gc.logln("unexpected file in chunk store", key)
-					gc.del(key, aws.ToInt64(o.Size))
+					gc.del(key, o.size)
 				} else if _, ok := gc.goodChunk.Load(cdig.FromBytes(b)); !ok {
-					gc.del(key, aws.ToInt64(o.Size))
+					gc.del(key, o.size)
 				}
 				return nil
 			})
@@ -412,6 +433,59 @@ func (gc *gc) list(ctx context.Context) error {
 	return eg.Wait()
 }
 
+// A pack is live if any chunk in it is live. We don't rewrite packs to remove dead chunks.
+func (gc *gc) listPacks(eg *errgroup.Group) error {
+	var count, size, livePacks, deadPacks, deadChunks int64
+	err := gc.store.list(eg, manifester.PackIndexPath[1:], func(o gcObject) error {
+		count++
+		key := o.key
+		size += o.size
+		var idx pb.PackIndex
+		if b, err := gc.readOne(eg, key, nil); err != nil {
+			return err
+		} else if err = proto.Unmarshal(b, &idx); err != nil {
+			gc.logln("bad pack index", key, err)
+			gc.del(key, o.size)
+			return nil
+		}
+		live := false
+		for _, dig := range cdig.FromSliceAlias(idx.Digests) {
+			if _, ok := gc.goodChunk.Load(dig); ok {
+				live = true
+			} else {
+				deadChunks++
+			}
+		}
+		if live {
+			livePacks++
+			gc.goodPack.Store(path.Base(key), struct{}{})
+		} else {
+			deadPacks++
+			gc.del(key, o.size)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// packs without a live index are dead (including ones without any index)
+	err = gc.store.list(eg, manifester.PackPath[1:], func(o gcObject) error {
+		count++
+		key := o.key
+		size += o.size
+		if _, ok := gc.goodPack.Load(path.Base(key)); !ok {
+			gc.del(key, o.size)
+		}
+		return nil
+	})
+	gc.totalCount.Add(count)
+	gc.totalSize.Add(size)
+	if livePacks+deadPacks > 0 {
+		gc.logf("packs : %9d live, %9d dead, %9d dead chunks", livePacks, deadPacks, deadChunks)
+	}
+	return err
+}
+
 func (gc *gc) remove(ctx context.Context) error {
 	gc.stage("GC REMOVE")
 
@@ -419,7 +493,7 @@ func (gc *gc) remove(ctx context.Context) error {
 	gc.logf("remove: %9d objects, %14d bytes", gc.delCount.Load(), gc.delSize.Load())
 	gc.logf("keep  : %9d objects, %14d bytes", gc.totalCount.Load()-gc.delCount.Load(), gc.totalSize.Load()-gc.delSize.Load())
 
-	delerrors := 0
+	var delerrors atomic.Int64
 	eg := errgroup.WithContext(ctx)
 	eg.SetLimit(cmp.Or(gc.lim.del, 20))
 	bsize := cmp.Or(gc.lim.batch, 100)
@@ -428,16 +502,11 @@ func (gc *gc) remove(ctx context.Context) error {
 		if len(batch) == 0 {
 			return
 		}
-		del := makeBatchDelete(batch)
+		keys := slices.Clone(batch)
 		batch = batch[:0]
 		eg.Go(func() error {
-			res, err := gc.s3.DeleteObjects(eg, &s3.DeleteObjectsInput{
-				Bucket: &gc.bucket,
-				Delete: del,
-			})
-			if res != nil {
-				delerrors += len(res.Errors)
-			}
+			n, err := gc.store.delete(eg, keys)
+			delerrors.Add(int64(n))
 			return err
 		})
 	}
@@ -450,14 +519,13 @@ func (gc *gc) remove(ctx context.Context) error {
 	})
 	flush()
 	err := eg.Wait()
-	if delerrors > 0 {
-		gc.logf("delete errors: %d", delerrors)
+	if n := delerrors.Load(); n > 0 {
+		gc.logf("delete errors: %d", n)
 	}
 	return err
 }
 
 func makeBatchDelete(keys []string) *s3types.Delete {
-	keys = slices.Clone(keys)
 	objs := make([]s3types.ObjectIdentifier, len(keys))
 	for i := range keys {
 		objs[i].Key = &keys[i]
@@ -0,0 +1,122 @@
+package ci
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/common/fakes3"
+	"github.com/dnr/styx/manifester"
+	"github.com/dnr/styx/pb"
+)
+
+func TestGC(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		dir := t.TempDir()
+		testGC(t,
+			manifester.ChunkStoreWriteConfig{ChunkLocalDir: dir},
+			GCConfig{LocalDir: dir},
+			func(key string) bool { _, err := os.Stat((&localGCStore{dir: dir}).fn(key)); return err == nil },
+			func(key string, tm time.Time) { os.Chtimes((&localGCStore{dir: dir}).fn(key), tm, tm) },
+		)
+	})
+	t.Run("s3", func(t *testing.T) {
+		srv := fakes3.New("styx")
+		defer srv.Close()
+		srv.AccessKey = "minio-key"
+		t.Setenv("AWS_ACCESS_KEY_ID", "minio-key")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "minio-secret")
+		s3cfg := manifester.S3Config{Endpoint: srv.URL, PathStyle: true, Credentials: "env"}
+		testGC(t,
+			manifester.ChunkStoreWriteConfig{ChunkBucket: "styx", S3: s3cfg},
+			GCConfig{Bucket: "styx", S3: s3cfg},
+			func(key string) bool { return slices.Contains(srv.Keys("styx"), key) },
+			func(key string, tm time.Time) { srv.SetMtime("styx", key, tm) },
+		)
+	})
+}
+
+func testGC(
+	t *testing.T,
+	cscfg manifester.ChunkStoreWriteConfig,
+	gccfg GCConfig,
+	exists func(key string) bool,
+	setMtime func(key string, tm time.Time),
+) {
+	ctx := context.Background()
+	cs, err := manifester.NewChunkStoreWrite(cscfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(path, key string, data []byte) {
+		if _, err := cs.PutIfNotExists(ctx, path, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	live := cdig.Sum("sha256", []byte("live"))
+	dead := cdig.Sum("sha256", []byte("dead"))
+	put(manifester.ChunkReadPath, live.String(), []byte("live"))
+	put(manifester.ChunkReadPath, dead.String(), []byte("dead"))
+
+	m, _ := proto.Marshal(&pb.Manifest{
+		Meta:    &pb.ManifestMeta{Narinfo: &pb.NarInfo{StorePath: "/nix/store/00000000000000000000000000000000-x"}},
+		Entries: []*pb.Entry{{Path: "/", Type: pb.EntryType_REGULAR, Size: 4, Digests: live[:]}},
+	})
+	sm, _ := proto.Marshal(&pb.SignedMessage{Msg: &pb.Entry{InlineData: m, Size: int64(len(m))}})
+	put(manifester.ManifestCachePath, "v1-live", sm)
+	put(manifester.ManifestCachePath, "v1-dead", sm)
+
+	now := time.Now()
+	root, _ := proto.Marshal(&pb.BuildRoot{Manifest: []string{"v1-live"}})
+	freshRoot := "manifest@" + now.Format(time.RFC3339) + "@m@m"
+	staleRoot := "manifest@" + now.Add(-48*time.Hour).Format(time.RFC3339) + "@m@m"
+	put(manifester.BuildRootPath, freshRoot, root)
+	put(manifester.BuildRootPath, staleRoot, root)
+
+	put(manifester.DiffCachePath, "d1-new", []byte("diff"))
+	put(manifester.DiffCachePath, "d1-old", []byte("diff"))
+	setMtime("diffcache/d1-old", now.Add(-2*time.Hour))
+	// over the size limit, oldest go first
+	big := make([]byte, 200)
+	rand.Read(big)
+	put(manifester.DiffCachePath, "d1-big", big)
+	setMtime("diffcache/d1-big", now.Add(-time.Minute))
+
+	// precomputed diffs live as long as build roots
+	put(manifester.PrecomputedDiffPath, "p1-new", big)
+	setMtime("precomputed/p1-new", now.Add(-2*time.Hour))
+	put(manifester.PrecomputedDiffPath, "p1-old", []byte("diff"))
+	setMtime("precomputed/p1-old", now.Add(-48*time.Hour))
+
+	gccfg.MaxAge = 24 * time.Hour
+	gccfg.DiffCacheMaxAge = time.Hour
+	gccfg.DiffCacheMaxSize = 100
+	if err := GCLocal(ctx, gccfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{
+		"chunk/" + live.String(): true,
+		"chunk/" + dead.String(): false,
+		"manifest/v1-live":       true,
+		"manifest/v1-dead":       false,
+		"buildroot/" + freshRoot: true,
+		"buildroot/" + staleRoot: false,
+		"diffcache/d1-new":       true,
+		"diffcache/d1-old":       false,
+		"diffcache/d1-big":       false,
+		"precomputed/p1-new":     true,
+		"precomputed/p1-old":     false,
+	} {
+		if got := exists(key); got != want {
+			t.Errorf("%s: exists %v, want %v", key, got, want)
+		}
+	}
+}
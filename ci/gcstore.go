@@ -0,0 +1,184 @@
+package ci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/dnr/styx/manifester"
+)
+
+type (
+	// gcStore is the storage that gc works on. Keys are s3-style: path without leading
+	// slash + key, e.g. "chunk/<digest>" or "manifest/<cache key>".
+	gcStore interface {
+		// calls f for each object whose key starts with prefix
+		list(ctx context.Context, prefix string, f func(gcObject) error) error
+		// returns raw object data and whether it's zstd-compressed
+		get(ctx context.Context, key string) ([]byte, bool, error)
+		// data should already be zstd-compressed
+		put(ctx context.Context, key string, data []byte) error
+		// returns number of keys that failed to delete
+		delete(ctx context.Context, keys []string) (int, error)
+		// prefixes to list chunks with in parallel
+		chunkPrefixes() []string
+	}
+
+	gcObject struct {
+		key   string
+		size  int64
+		mtime time.Time
+	}
+
+	s3GCStore struct {
+		s3     *s3.Client
+		bucket string
+	}
+
+	localGCStore struct {
+		dir string
+	}
+)
+
+func (s *s3GCStore) list(ctx context.Context, prefix string, f func(gcObject) error) error {
+	var token *string
+	for {
+		res, err := s.s3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &s.bucket,
+			Prefix:            aws.String(prefix),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return err
+		}
+		for _, c := range res.Contents {
+			o := gcObject{key: aws.ToString(c.Key), size: aws.ToInt64(c.Size), mtime: aws.ToTime(c.LastModified)}
+			if err := f(o); err != nil {
+				return err
+			}
+		}
+		if res.NextContinuationToken == nil {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *s3GCStore) get(ctx context.Context, key string) ([]byte, bool, error) {
+	res, err := s.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return body, aws.ToString(res.ContentEncoding) == "zstd", err
+}
+
+func (s *s3GCStore) put(ctx context.Context, key string, data []byte) error {
+	_, err := s.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		Body:            bytes.NewReader(data),
+		CacheControl:    aws.String("public, max-age=31536000"),
+		ContentType:     aws.String("application/octet-stream"),
+		ContentEncoding: aws.String("zstd"),
+	})
+	return err
+}
+
+func (s *s3GCStore) delete(ctx context.Context, keys []string) (int, error) {
+	res, err := s.s3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: &s.bucket,
+		Delete: makeBatchDelete(keys),
+	})
+	if res != nil {
+		return len(res.Errors), err
+	}
+	return 0, err
+}
+
+func (s *s3GCStore) chunkPrefixes() []string {
+	out := make([]string, 0, 64)
+	for _, pchar := range "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_" {
+		out = append(out, string(pchar))
+	}
+	return out
+}
+
+// maps an s3-style key to a file in the local chunk store
+func (s *localGCStore) fn(key string) string {
+	top, rest, _ := strings.Cut(key, "/")
+	return manifester.LocalStorePath(s.dir, "/"+top+"/", rest)
+}
+
+func (s *localGCStore) list(ctx context.Context, prefix string, f func(gcObject) error) error {
+	top, rest, _ := strings.Cut(prefix, "/")
+	dir := path.Dir(s.fn(top + "/x"))
+	ents, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		name := ent.Name()
+		if !ent.Type().IsRegular() || !strings.HasPrefix(name, rest) ||
+			strings.HasPrefix(name, ".") || strings.Contains(name, ".tmp") {
+			continue
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := ent.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		o := gcObject{key: top + "/" + name, size: info.Size(), mtime: info.ModTime()}
+		if err := f(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *localGCStore) get(ctx context.Context, key string) ([]byte, bool, error) {
+	b, err := os.ReadFile(s.fn(key))
+	// local files don't record content encoding, everything but packs is compressed
+	return b, !strings.HasPrefix(key, manifester.PackPath[1:]), err
+}
+
+func (s *localGCStore) put(ctx context.Context, key string, data []byte) error {
+	fn := s.fn(key)
+	if err := os.MkdirAll(path.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return manifester.WriteFileAtomic(fn, data)
+}
+
+func (s *localGCStore) delete(ctx context.Context, keys []string) (int, error) {
+	errs := 0
+	for _, key := range keys {
+		if err := os.Remove(s.fn(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs++
+		}
+	}
+	return errs, nil
+}
+
+func (s *localGCStore) chunkPrefixes() []string {
+	// one directory, listing it more than once doesn't help
+	return []string{""}
+}
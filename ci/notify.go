@@ -73,7 +73,8 @@ Manifests: {{.req.ManifestStats.Manifests | fmt}}
 Chunks: {{.req.ManifestStats.NewChunks | fmt}} new ⁄ {{.req.ManifestStats.TotalChunks | fmt}} total
 Bytes: {{.req.ManifestStats.NewUncmpBytes | fmt}} new ⁄ {{.req.ManifestStats.TotalUncmpBytes | fmt}} total
 Compressed bytes: {{.req.ManifestStats.NewCmpBytes | fmt}} new
-
+{{with .req.DiffStats}}{{if .Pairs}}Precomputed diffs: {{.Diffs | fmt}} new ⁄ {{.Existing | fmt}} existing ⁄ {{.Errors | fmt}} errors, {{.DiffBytes | fmt}} ⁄ {{.ReqBytes | fmt}} bytes
+{{end}}{{end}}
 Packages:
 {{range .diff -}}
 {{.}}
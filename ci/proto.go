@@ -30,6 +30,7 @@ type (
 		LastRelID      string   `json:",omitempty"` // "nixos-23.11.7609.5c2ec3a5c2ee"
 		LastStyxCommit string   `json:",omitempty"`
 		PrevNames      []string `json:",omitempty"`
+		PrevRoot       string   `json:",omitempty"` // build root key of last build
 		LastGC         int64    `json:",omitempty"` // unix seconds
 	}
 
@@ -66,6 +67,8 @@ type (
 		FakeError     string
 		Names         []string
 		ManifestStats manifester.Stats
+		DiffStats     manifester.PrecomputeStats
+		RootKey       string `json:",omitempty"`
 		NewLastGC     int64  `json:",omitempty"`
 		GCSummary     string `json:",omitempty"`
 	}
@@ -82,6 +85,7 @@ type (
 		BuildElapsed        time.Duration
 		PrevNames, NewNames []string
 		ManifestStats       manifester.Stats
+		DiffStats           manifester.PrecomputeStats
 		GCSummary           string `json:",omitempty"`
 	}
 )
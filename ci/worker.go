@@ -34,6 +34,7 @@ import (
 	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/worker"
 	"go.temporal.io/sdk/workflow"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/common/errgroup"
@@ -107,6 +108,12 @@ const (
 	// gc
 	gcInterval = 7 * 24 * time.Hour
 	gcMaxAge   = 210 * 24 * time.Hour
+	gcDiffAge  = 30 * 24 * time.Hour // diff cache entries are only useful near a release
+	gcDiffMax  = 50 << 30
+
+	// precompute diffs
+	precomputeZstdLevel = 9
+	precomputeParallel  = 20
 )
 
 var globalScaler atomic.Pointer[scaler]
@@ -153,7 +160,7 @@ func RunWorker(ctx context.Context, cfg WorkerConfig) error {
 			return err
 		}
 		w = worker.New(c, heavyTaskQueue, worker.Options{})
-		s3cli, err := getS3Cli()
+		s3cli, err := manifester.NewS3Client(context.Background(), cfg.CSWCfg.S3)
 		if err != nil {
 			return err
 		}
@@ -256,6 +263,7 @@ func ci(ctx workflow.Context, args *CiArgs) error {
 		l.Info("build succeeded", "relid", args.LastRelID, "styx", args.LastStyxCommit)
 		prevNames := args.PrevNames
 		args.PrevNames = bres.Names
+		args.PrevRoot = bres.RootKey
 		if bres.NewLastGC > 0 {
 			args.LastGC = bres.NewLastGC
 		}
@@ -269,6 +277,7 @@ func ci(ctx workflow.Context, args *CiArgs) error {
 			PrevNames:     prevNames,
 			NewNames:      bres.Names,
 			ManifestStats: bres.ManifestStats,
+			DiffStats:     bres.DiffStats,
 			GCSummary:     bres.GCSummary,
 		})
 	}
@@ -704,9 +713,10 @@ func (a *heavyActivities) HeavyBuild(ctx context.Context, req *buildReq) (retBui
 		stage:   stage,
 		summary: &gcSummary,
 		zp:      a.zp,
-		s3:      a.s3cli,
-		bucket:  a.cfg.CSWCfg.ChunkBucket,
+		store:   &s3GCStore{s3: a.s3cli, bucket: a.cfg.CSWCfg.ChunkBucket},
 		age:     gcMaxAge,
+		diffAge: gcDiffAge,
+		diffMax: gcDiffMax,
 	}
 
 	stage("WRITE ROOT")
@@ -731,6 +741,18 @@ func (a *heavyActivities) HeavyBuild(ctx context.Context, req *buildReq) (retBui
 		return nil, err
 	}
 
+	// precompute diffs
+
+	var diffStats manifester.PrecomputeStats
+	if req.Args.PrevRoot != "" {
+		stage("PRECOMPUTE DIFFS")
+		diffStats, err = a.precomputeDiffs(ctx, &gc, req.Args.PrevRoot, mcacheForRoot)
+		if err != nil {
+			// not fatal, daemons can still get diffs computed on demand
+			l.Error("precompute diffs error", "error", err)
+		}
+	}
+
 	// gc
 
 	newLastGC := req.Args.LastGC
@@ -746,11 +768,31 @@ func (a *heavyActivities) HeavyBuild(ctx context.Context, req *buildReq) (retBui
 	return &buildRes{
 		Names:         names,
 		ManifestStats: a.b.Stats(),
+		DiffStats:     diffStats,
+		RootKey:       brkey,
 		NewLastGC:     newLastGC,
 		GCSummary:     gcSummary.String(),
 	}, nil
 }
 
+func (a *heavyActivities) precomputeDiffs(ctx context.Context, gc *gc, prevRoot string, next []string) (manifester.PrecomputeStats, error) {
+	var root pb.BuildRoot
+	if b, err := gc.readOne(ctx, manifester.BuildRootPath[1:]+prevRoot, nil); err != nil {
+		return manifester.PrecomputeStats{}, err
+	} else if err = proto.Unmarshal(b, &root); err != nil {
+		return manifester.PrecomputeStats{}, err
+	}
+	srv, err := manifester.NewManifestServer(manifester.Config{
+		ChunkDiffZstdLevel: precomputeZstdLevel,
+		ChunkDiffParallel:  precomputeParallel,
+		ChunkDiffTryAll:    true, // we have time to find the smallest
+	}, a.b)
+	if err != nil {
+		return manifester.PrecomputeStats{}, err
+	}
+	return srv.PrecomputeUpgradeDiffs(ctx, root.Manifest, next, runtime.NumCPU())
+}
+
 func makeNixexprsUrl(channel, relid string) string {
 	// turn "nixos-23.11", "nixos-23.11.7609.5c2ec3a5c2ee" into
 	// "https://releases.nixos.org/nixos/23.11/nixos-23.11.7609.5c2ec3a5c2ee/nixexprs.tar.xz"
@@ -824,14 +866,6 @@ var getSSMCli = sync.OnceValues(func() (*ssm.Client, error) {
 	return ssm.NewFromConfig(awscfg), nil
 })
 
-var getS3Cli = sync.OnceValues(func() (*s3.Client, error) {
-	awscfg, err := getAwsCfg()
-	if err != nil {
-		return nil, err
-	}
-	return s3.NewFromConfig(awscfg), nil
-})
-
 func (pi *pathInfoJson) fromPublicCache() bool {
 	for _, s := range pi.Signatures {
 		if strings.HasPrefix(s, "cache.nixos.org-1:") {
@@ -8,6 +8,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/dnr/styx/ci"
+	"github.com/dnr/styx/manifester"
 )
 
 func withWorkerConfig(c *cobra.Command) runE {
@@ -28,10 +29,14 @@ func withWorkerConfig(c *cobra.Command) runE {
 	// manifest builder cfg
 	c.Flags().StringArrayVar(&cfg.ManifestPubKeys, "nix_pubkey", nil, "verify narinfo with this public key")
 	c.Flags().StringArrayVar(&cfg.ManifestSignKeySSM, "styx_signkey_ssm", nil, "sign manifest with key from SSM")
+	c.Flags().Int64Var(&cfg.MBCfg.PackSize, "pack_size", 0, "write chunks into packs of this size (0 to write separately)")
+	c.Flags().StringVar(&cfg.MBCfg.ChunkAlgo, "chunk_algo", "", "chunking algorithm for file data (empty for fixed, or \"fastcdc\")")
+	c.Flags().StringVar(&cfg.MBCfg.DigestAlgo, "digest_algo", "", "digest algorithm (empty for default, \"sha256\", or \"blake3\")")
 
 	// chunk store write config
 	c.Flags().StringVar(&cfg.CSWCfg.ChunkBucket, "chunkbucket", "", "s3 bucket to put chunks")
 	c.Flags().IntVar(&cfg.CSWCfg.ZstdEncoderLevel, "zstd_level", 9, "encoder level for zstd chunks")
+	manifester.AddS3Flags(c.Flags(), &cfg.CSWCfg.S3)
 
 	return func(c *cobra.Command, args []string) error {
 		store(c, cfg)
@@ -70,7 +75,11 @@ func withStartConfig(c *cobra.Command) runE {
 func withGCConfig(c *cobra.Command) runE {
 	var cfg ci.GCConfig
 	c.Flags().StringVar(&cfg.Bucket, "bucket", "styx-1", "s3 bucket")
+	manifester.AddS3Flags(c.Flags(), &cfg.S3)
+	c.Flags().StringVar(&cfg.LocalDir, "local_dir", "", "local chunk store directory (instead of bucket)")
 	c.Flags().DurationVar(&cfg.MaxAge, "max_age", 30*24*time.Hour, "gc age")
+	c.Flags().DurationVar(&cfg.DiffCacheMaxAge, "diff_cache_max_age", 0, "gc age for diff cache (default max_age)")
+	c.Flags().Int64Var(&cfg.DiffCacheMaxSize, "diff_cache_max_size", 0, "max total size of diff cache, oldest removed first (0 for no limit)")
 	return func(c *cobra.Command, args []string) error {
 		store(c, cfg)
 		return nil
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnr/styx/common/client"
+	"github.com/dnr/styx/daemon"
+)
+
+type duArgs struct {
+	json bool
+}
+
+func withDuArgs(c *cobra.Command) runE {
+	var args duArgs
+	c.Flags().BoolVar(&args.json, "json", false, "print json")
+	return func(c *cobra.Command, _ []string) error {
+		store(c, &args)
+		return nil
+	}
+}
+
+func runDu(c *cobra.Command, args []string) error {
+	dargs := get[*duArgs](c)
+	cli := get[*client.StyxClient](c)
+
+	var req daemon.DuReq
+	for _, arg := range args {
+		arg = strings.TrimPrefix(arg, "/nix/store/")
+		arg, _, _ = strings.Cut(arg, "-")
+		req.Images = append(req.Images, arg)
+	}
+	var raw json.RawMessage
+	status, err := cli.Call(daemon.DuPath, &req, &raw)
+	if err != nil {
+		return err
+	} else if status != http.StatusOK {
+		var st daemon.Status
+		_ = json.Unmarshal(raw, &st)
+		return fmt.Errorf("du failed: %d %s", status, st.Error)
+	} else if dargs.json {
+		_, err = os.Stdout.Write(append(raw, '\n'))
+		return err
+	}
+	var res daemon.DuResp
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FREED\tEXCLUSIVE\tSHARED\tIMAGE\tNAR\tSTORE PATH")
+	line := func(di *daemon.DuImage, name string) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			formatBytes(di.FreedBytes),
+			formatBytes(di.ExclusiveBytes),
+			formatBytes(di.SharedBytes),
+			formatBytes(di.ImageSize),
+			formatBytes(di.NarSize),
+			name)
+	}
+	for _, di := range res.Images {
+		line(di, di.StorePath)
+	}
+	if res.Set != nil {
+		line(res.Set, fmt.Sprintf("(%d images together)", len(res.Images)))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	cache := res.Cache
+	used := cache.SlabBytes + cache.ImageBytes
+	fmt.Printf("\ncache: %d images, %s chunk data + %s images = %s",
+		cache.Images, formatBytes(cache.SlabBytes), formatBytes(cache.ImageBytes), formatBytes(used))
+	if cache.UnownedBytes > 0 {
+		fmt.Printf(" (%s unowned)", formatBytes(cache.UnownedBytes))
+	}
+	fmt.Println()
+	if cache.NarSize > 0 {
+		fmt.Printf("plain store: %s, saving %s (%d%%)\n",
+			formatBytes(cache.NarSize), formatBytes(cache.NarSize-used), (cache.NarSize-used)*100/cache.NarSize)
+	}
+	return nil
+}
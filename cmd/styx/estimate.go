@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnr/styx/common/client"
+	"github.com/dnr/styx/daemon"
+)
+
+type estimateArgs struct {
+	req  daemon.EstimateReq
+	all  bool
+	json bool
+}
+
+func withEstimateArgs(c *cobra.Command) runE {
+	var args estimateArgs
+	c.Flags().StringVar(&args.req.Upstream, "upstream", "https://cache.nixos.org/", "binary cache to get manifests for")
+	c.Flags().BoolVar(&args.req.Closure, "closure", true, "include references of store paths")
+	c.Flags().BoolVar(&args.all, "all", false, "show paths that don't need any downloads")
+	c.Flags().BoolVar(&args.json, "json", false, "print json")
+	return func(c *cobra.Command, _ []string) error {
+		store(c, &args)
+		return nil
+	}
+}
+
+func runEstimate(c *cobra.Command, args []string) error {
+	eargs := get[*estimateArgs](c)
+	cli := get[*client.StyxClient](c)
+
+	eargs.req.StorePaths = args
+	var raw json.RawMessage
+	status, err := cli.Call(daemon.EstimatePath, &eargs.req, &raw)
+	if err != nil {
+		return err
+	} else if status != http.StatusOK {
+		var st daemon.Status
+		_ = json.Unmarshal(raw, &st)
+		return fmt.Errorf("estimate failed: %d %s", status, st.Error)
+	} else if eargs.json {
+		_, err = os.Stdout.Write(append(raw, '\n'))
+		return err
+	}
+	var res daemon.EstimateResp
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIFF (MAX)\tFETCH (MAX)\tPRESENT\tNAR FILE\tSTORE PATH\tBASE")
+	var errs int
+	for _, p := range res.Paths {
+		switch {
+		case p.Error != "":
+			errs++
+			fmt.Fprintf(tw, "-\t-\t-\t-\t%s\terror: %s\n", p.StorePath, p.Error)
+		case p.Installed:
+			if eargs.all {
+				fmt.Fprintf(tw, "-\t-\t-\t-\t%s\t(installed)\n", p.StorePath)
+			}
+		case p.DiffBytes+p.FetchBytes > 0 || eargs.all:
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				formatBytes(p.DiffBytes),
+				formatBytes(p.FetchBytes),
+				formatBytes(p.PresentBytes),
+				formatBytes(p.FileSize),
+				p.StorePath,
+				p.Base)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	t := res.Total
+	fmt.Printf("\n%d paths, %d installed", len(res.Paths), res.Installed)
+	if errs > 0 {
+		fmt.Printf(", %d errors", errs)
+	}
+	fmt.Println()
+	fmt.Printf("diffable:  up to %s in %d chunks", formatBytes(t.DiffBytes), t.DiffChunks)
+	if t.Recompress > 0 {
+		fmt.Printf(" (%d files with recompression)", t.Recompress)
+	}
+	fmt.Println()
+	fmt.Printf("fetch:     up to %s in %d chunks\n", formatBytes(t.FetchBytes), t.FetchChunks)
+	fmt.Printf("present:   %s\n", formatBytes(t.PresentBytes))
+	fmt.Printf("manifests: %s\n", formatBytes(t.ManifestBytes))
+	fmt.Printf("(upper bounds: sizes are uncompressed chunk data; diffs and compressed chunks are usually much smaller on the wire)\n")
+	fmt.Printf("nix would download %s (nar size %s)\n", formatBytes(t.FileSize), formatBytes(t.NarSize))
+	return nil
+}
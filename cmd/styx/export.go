@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnr/styx/common/client"
+	"github.com/dnr/styx/daemon"
+)
+
+func withExportReq(c *cobra.Command) runE {
+	var req daemon.ExportReq
+	c.Flags().IntVar(&req.ZstdLevel, "zstd_level", 3, "compression level for export")
+	return func(c *cobra.Command, args []string) error {
+		store(c, &req)
+		return nil
+	}
+}
+
+func runExport(c *cobra.Command, args []string) error {
+	var out io.Writer = os.Stdout
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	_, err := get[*client.StyxClient](c).CallStream(daemon.ExportPath, get[*daemon.ExportReq](c), out)
+	return err
+}
+
+type importArgs struct {
+	cachePath string
+}
+
+func withImportArgs(c *cobra.Command) runE {
+	var args importArgs
+	c.Flags().StringVar(&args.cachePath, "cache", "/var/cache/styx", "path to local cache (must not be initialized)")
+	return func(c *cobra.Command, _ []string) error {
+		store(c, &args)
+		return nil
+	}
+}
+
+func runImport(c *cobra.Command, args []string) error {
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	stats, err := daemon.Import(get[*importArgs](c).cachePath, in)
+	log.Printf("import: %d slabs, %d chunks, %d bytes, %d bad chunks, %d images unmounted",
+		stats.Slabs, stats.Chunks, stats.Bytes, stats.BadChunks, stats.Unmounted)
+	return err
+}
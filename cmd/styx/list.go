@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnr/styx/common/client"
+	"github.com/dnr/styx/daemon"
+	"github.com/dnr/styx/pb"
+)
+
+type listArgs struct {
+	req  daemon.ListReq
+	all  bool
+	json bool
+}
+
+func withListArgs(c *cobra.Command) runE {
+	var args listArgs
+	c.Flags().StringArrayVar(&args.req.States, "state", nil, "only show images in this state (may be repeated)")
+	c.Flags().StringVar(&args.req.Name, "name", "", "only show store paths containing this string")
+	c.Flags().StringVar(&args.req.Sort, "sort", "name", "sort by name, size, fetch, or state")
+	c.Flags().IntVar(&args.req.Limit, "limit", 0, "show at most this many images (0 for all)")
+	c.Flags().BoolVar(&args.json, "json", false, "print json")
+	return func(c *cobra.Command, _ []string) error {
+		args.all = args.req.Limit == 0
+		store(c, &args)
+		return nil
+	}
+}
+
+// listImages calls the list endpoint, following pages if all is set.
+func listImages(cli *client.StyxClient, req daemon.ListReq, all bool) ([]*daemon.ListImage, error) {
+	var out []*daemon.ListImage
+	for {
+		var raw json.RawMessage
+		status, err := cli.Call(daemon.ListPath, &req, &raw)
+		if err != nil {
+			return nil, err
+		} else if status != http.StatusOK {
+			var st daemon.Status
+			_ = json.Unmarshal(raw, &st)
+			return nil, fmt.Errorf("list failed: %d %s", status, st.Error)
+		}
+		var res daemon.ListResp
+		if err := json.Unmarshal(raw, &res); err != nil {
+			return nil, err
+		}
+		out = append(out, res.Images...)
+		req.Offset += len(res.Images)
+		if !all || len(res.Images) == 0 || req.Offset >= res.Total {
+			return out, nil
+		}
+	}
+}
+
+func runList(c *cobra.Command, _ []string) error {
+	args := get[*listArgs](c)
+	imgs, err := listImages(get[*client.StyxClient](c), args.req, args.all)
+	if err != nil {
+		return err
+	}
+	if args.json {
+		return json.NewEncoder(os.Stdout).Encode(imgs)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tIMAGE\tPRESENT\tCHUNKS\tFETCHED\tSTORE PATH")
+	for _, img := range imgs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\t%s\t%s\n",
+			img.MountState,
+			formatBytes(img.ImageSize),
+			formatPresent(img.PresentBytes, img.TotalBytes),
+			img.PresentChunks, img.TotalChunks,
+			formatFetch(img.LastFetch),
+			img.StorePath)
+	}
+	return tw.Flush()
+}
+
+type statusArgs struct {
+	json bool
+}
+
+func withStatusArgs(c *cobra.Command) runE {
+	var args statusArgs
+	c.Flags().BoolVar(&args.json, "json", false, "print json")
+	return func(c *cobra.Command, _ []string) error {
+		store(c, &args)
+		return nil
+	}
+}
+
+type statusSummary struct {
+	Images        int
+	States        map[string]int
+	ImageSize     int64
+	TotalChunks   int
+	PresentChunks int
+	TotalBytes    int64
+	PresentBytes  int64
+}
+
+func runStatus(c *cobra.Command, args []string) error {
+	sargs := get[*statusArgs](c)
+	cli := get[*client.StyxClient](c)
+
+	if len(args) > 0 {
+		sph := strings.TrimPrefix(args[0], "/nix/store/")
+		sph, _, _ = strings.Cut(sph, "-")
+		imgs, err := listImages(cli, daemon.ListReq{Name: sph}, true)
+		if err != nil {
+			return err
+		} else if len(imgs) == 0 {
+			return errors.New("image not found")
+		}
+		if sargs.json {
+			return json.NewEncoder(os.Stdout).Encode(imgs[0])
+		}
+		img := imgs[0]
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "store path:\t%s\n", img.StorePath)
+		fmt.Fprintf(tw, "upstream:\t%s\n", img.Upstream)
+		fmt.Fprintf(tw, "state:\t%s\n", img.MountState)
+		if img.MountPoint != "" {
+			fmt.Fprintf(tw, "mount point:\t%s\n", img.MountPoint)
+		}
+		if img.LastMountError != "" {
+			fmt.Fprintf(tw, "last error:\t%s\n", img.LastMountError)
+		}
+		if img.IsBare {
+			fmt.Fprintf(tw, "bare:\ttrue\n")
+		}
+		fmt.Fprintf(tw, "image size:\t%s\n", formatBytes(img.ImageSize))
+		fmt.Fprintf(tw, "present:\t%s\n", formatPresent(img.PresentBytes, img.TotalBytes))
+		fmt.Fprintf(tw, "chunks:\t%d/%d\n", img.PresentChunks, img.TotalChunks)
+		fmt.Fprintf(tw, "last fetch:\t%s\n", formatFetch(img.LastFetch))
+		return tw.Flush()
+	}
+
+	imgs, err := listImages(cli, daemon.ListReq{}, true)
+	if err != nil {
+		return err
+	}
+	sum := statusSummary{States: make(map[string]int)}
+	for _, img := range imgs {
+		sum.Images++
+		sum.States[img.MountState]++
+		sum.ImageSize += img.ImageSize
+		sum.TotalChunks += img.TotalChunks
+		sum.PresentChunks += img.PresentChunks
+		sum.TotalBytes += img.TotalBytes
+		sum.PresentBytes += img.PresentBytes
+	}
+	if sargs.json {
+		return json.NewEncoder(os.Stdout).Encode(sum)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "images:\t%d\n", sum.Images)
+	for i := range int32(len(pb.MountState_name)) {
+		st := pb.MountState(i).String()
+		if n := sum.States[st]; n > 0 {
+			fmt.Fprintf(tw, "  %s:\t%d\n", strings.ToLower(st), n)
+		}
+	}
+	fmt.Fprintf(tw, "image size:\t%s\n", formatBytes(sum.ImageSize))
+	fmt.Fprintf(tw, "present:\t%s\n", formatPresent(sum.PresentBytes, sum.TotalBytes))
+	fmt.Fprintf(tw, "chunks:\t%d/%d\n", sum.PresentChunks, sum.TotalChunks)
+	return tw.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	} else if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatPresent(present, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%s/%s (%d%%)", formatBytes(present), formatBytes(total), present*100/total)
+}
+
+func formatFetch(t int64) string {
+	if t == 0 {
+		return "never"
+	}
+	ago := time.Since(time.Unix(t, 0))
+	switch {
+	case ago < time.Minute:
+		return "just now"
+	case ago < time.Hour:
+		return fmt.Sprintf("%dm ago", int(ago.Minutes()))
+	case ago < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(ago.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(ago.Hours()/24))
+	}
+}
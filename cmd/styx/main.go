@@ -1,10 +1,15 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/nix-community/go-nix/pkg/narinfo/signature"
 	"github.com/spf13/cobra"
@@ -12,6 +17,7 @@ import (
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/common/client"
 	"github.com/dnr/styx/common/systemd"
+	"github.com/dnr/styx/common/tracing"
 	"github.com/dnr/styx/daemon"
 	"github.com/dnr/styx/manifester"
 )
@@ -22,6 +28,7 @@ func withChunkStoreWrite(c *cobra.Command) runE {
 	c.Flags().StringVar(&cscfg.ChunkBucket, "chunkbucket", "", "s3 bucket to put chunks")
 	c.Flags().StringVar(&cscfg.ChunkLocalDir, "chunklocaldir", "", "local directory to put chunks")
 	c.Flags().IntVar(&cscfg.ZstdEncoderLevel, "chunk_store_zstd_level", 5, "encoder level for zstd chunks")
+	manifester.AddS3Flags(c.Flags(), &cscfg.S3)
 
 	return func(c *cobra.Command, args []string) error {
 		cs, err := manifester.NewChunkStoreWrite(cscfg)
@@ -39,6 +46,9 @@ func withManifestBuilder(c *cobra.Command) runE {
 	pubkeys := c.Flags().StringArray("nix_pubkey",
 		[]string{"cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="},
 		"verify narinfo with this public key")
+	c.Flags().Int64Var(&mbcfg.PackSize, "pack_size", 0, "write chunks into packs of this size (0 to write separately)")
+	c.Flags().StringVar(&mbcfg.ChunkAlgo, "chunk_algo", "", "chunking algorithm for file data (empty for fixed, or \"fastcdc\", which only cuts at 4KiB-aligned offsets)")
+	c.Flags().StringVar(&mbcfg.DigestAlgo, "digest_algo", "", "digest algorithm (empty for default, \"sha256\", or \"blake3\")")
 
 	return chainRunE(
 		withChunkStoreWrite(c),
@@ -72,6 +82,18 @@ func withDaemonConfig(c *cobra.Command) runE {
 	c.Flags().IntVar(&cfg.ErofsBlockShift, "block_shift", 12, "block size bits for local fs images")
 	// c.Flags().IntVar(&cfg.SmallFileCutoff, "small_file_cutoff", 224, "cutoff for embedding small files in images")
 	c.Flags().IntVar(&cfg.Workers, "workers", 16, "worker goroutines for cachefilesd serving")
+	c.Flags().IntVar(&cfg.MaxWorkers, "max_workers", 64, "start extra workers up to this many when all are busy")
+	c.Flags().DurationVar(&cfg.ReadTimeout, "read_timeout", 2*time.Minute, "fail kernel reads that take longer than this (0 for no limit)")
+	c.Flags().StringVar(&cfg.Embedded.ChunkDir, "embedded_chunk_dir", "",
+		"build manifests in-process into this local chunk store instead of using a remote manifester "+
+			"(chunks are stored both here, compressed, and in the cache)")
+	c.Flags().StringVar(&cfg.Embedded.SignKeyFile, "embedded_signkey", "",
+		"sign embedded manifests with key from this file (public key must be passed to init)")
+	c.Flags().StringArrayVar(&cfg.Embedded.NixPubKeys, "embedded_nix_pubkey",
+		[]string{"cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="},
+		"verify narinfo for embedded manifests with this public key")
+	c.Flags().StringArrayVar(&cfg.Embedded.AllowedUpstreams, "embedded_allowed_upstream", nil,
+		"allowed http upstream binary caches for embedded manifests (file:// is always allowed)")
 
 	return func(c *cobra.Command, args []string) error {
 		store(c, cfg)
@@ -79,6 +101,39 @@ func withDaemonConfig(c *cobra.Command) runE {
 	}
 }
 
+type tracingShutdown func(context.Context) error
+
+func withTracing(service string) func(*cobra.Command) runE {
+	return func(c *cobra.Command) runE {
+		endpoint := c.Flags().String("otlp_endpoint", "",
+			"export OpenTelemetry traces to this OTLP/HTTP endpoint (e.g. http://localhost:4318)")
+		return func(c *cobra.Command, args []string) error {
+			shutdown, err := tracing.Setup(c.Context(), tracing.Config{Endpoint: *endpoint, Service: service})
+			if err != nil {
+				return err
+			}
+			store(c, tracingShutdown(shutdown))
+			return nil
+		}
+	}
+}
+
+// waitShutdown waits for a server to return an error on errc or for a shutdown signal, then
+// flushes traces.
+func waitShutdown(c *cobra.Command, errc <-chan error) error {
+	ctx, stop := signal.NotifyContext(c.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		log.Print("got shutdown signal")
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return cmp.Or(err, get[tracingShutdown](c)(flushCtx))
+}
+
 func withInitReq(c *cobra.Command) runE {
 	var req daemon.InitReq
 
@@ -111,6 +166,11 @@ func withManifesterConfig(c *cobra.Command) runE {
 		[]string{"cache.nixos.org"}, "allowed upstream binary caches")
 	c.Flags().IntVar(&cfg.ChunkDiffZstdLevel, "chunk_diff_zstd_level", 3, "encoder level for chunk diffs")
 	c.Flags().IntVar(&cfg.ChunkDiffParallel, "chunk_diff_parallel", 60, "parallelism for loading chunks for diff")
+	c.Flags().BoolVar(&cfg.ChunkDiffTryAll, "chunk_diff_try_all", false, "try all accepted delta algorithms and use the smallest")
+	c.Flags().IntVar(&cfg.DiffCacheMaxBytes, "diff_cache_max_bytes", 0, "cache computed diffs up to this size in chunk store (0 to disable)")
+	c.Flags().IntVar(&cfg.ManifestBatchParallel, "manifest_batch_parallel", 8, "parallelism for building manifests in batch requests")
+	c.Flags().StringArrayVar(&cfg.NixCacheUpstreams, "nix_cache_upstream", nil,
+		"serve nix binary cache (narinfo and nar) for manifests built from this upstream")
 
 	return func(c *cobra.Command, args []string) error {
 		store(c, cfg)
@@ -184,6 +244,26 @@ func withDebugReq(c *cobra.Command) runE {
 	}
 }
 
+func withMaterializeReq(c *cobra.Command) runE {
+	var req daemon.MaterializeReq
+	c.Flags().BoolVar(&req.Update, "update", false, "update existing dest, only writing files that changed")
+	return func(c *cobra.Command, args []string) error {
+		req.Upstream, req.StorePath, req.DestPath = args[0], args[1], args[2]
+		store(c, &req)
+		return nil
+	}
+}
+
+func withInspectImageReq(c *cobra.Command) runE {
+	var req daemon.InspectImageReq
+	c.Flags().BoolVar(&req.IncludeChunks, "chunks", false, "include chunk locations and digests")
+	return func(c *cobra.Command, args []string) error {
+		req.StorePath = args[0]
+		store(c, &req)
+		return nil
+	}
+}
+
 func withRepairReq(c *cobra.Command) runE {
 	var req daemon.RepairReq
 	var remreq daemon.MountReq
@@ -215,12 +295,13 @@ func main() {
 		cmd(
 			&cobra.Command{Use: "daemon", Short: "act as local daemon"},
 			withDaemonConfig,
+			withTracing("styx-daemon"),
 			func(c *cobra.Command, args []string) error {
-				err := daemon.NewServer(get[daemon.Config](c)).Start()
-				if err != nil {
-					return err
+				errc := make(chan error, 1)
+				if err := daemon.NewServer(get[daemon.Config](c)).Start(); err != nil {
+					errc <- err
 				}
-				return <-make(chan error) // block forever
+				return waitShutdown(c, errc) // otherwise run until signal
 			},
 		),
 		cmd(
@@ -230,6 +311,7 @@ func main() {
 			},
 			withManifesterConfig,
 			withManifestBuilder,
+			withTracing("styx-manifester"),
 			func(c *cobra.Command, args []string) error {
 				cfg := get[manifester.Config](c)
 				mb := get[*manifester.ManifestBuilder](c)
@@ -237,8 +319,29 @@ func main() {
 				if err != nil {
 					return err
 				}
-				return m.Run()
+				errc := make(chan error, 1)
+				go func() { errc <- m.Run() }()
+				return waitShutdown(c, errc)
 			},
+			cmd(
+				&cobra.Command{
+					Use:   "prewarm [store path...]",
+					Short: "builds and caches manifests for store paths ahead of time",
+				},
+				withManifestBuilder,
+				withPrewarmArgs,
+				runPrewarm,
+			),
+		),
+		cmd(
+			&cobra.Command{
+				Use:   "publish <store path...>",
+				Short: "uploads paths from the local nix store to a styx chunk store",
+				Args:  cobra.MinimumNArgs(1),
+			},
+			withManifestBuilder,
+			withPublishArgs,
+			runPublish,
 		),
 		cmd(
 			&cobra.Command{
@@ -291,14 +394,10 @@ func main() {
 				Args:  cobra.ExactArgs(3),
 			},
 			withStyxClient,
+			withMaterializeReq,
 			func(c *cobra.Command, args []string) error {
 				return get[*client.StyxClient](c).CallAndPrint(
-					daemon.MaterializePath, &daemon.MaterializeReq{
-						Upstream:  args[0],
-						StorePath: args[1],
-						DestPath:  args[2],
-					},
-				)
+					daemon.MaterializePath, get[*daemon.MaterializeReq](c))
 			},
 		),
 		cmd(
@@ -346,6 +445,77 @@ func main() {
 					daemon.DebugPath, get[*daemon.DebugReq](c))
 			},
 		),
+		cmd(
+			&cobra.Command{
+				Use:   "inflight",
+				Short: "lists kernel reads that are waiting for data (client)",
+			},
+			withStyxClient,
+			func(c *cobra.Command, args []string) error {
+				return get[*client.StyxClient](c).CallAndPrint(
+					daemon.InflightPath, &daemon.InflightReq{})
+			},
+		),
+		cmd(
+			&cobra.Command{
+				Use:   "list",
+				Short: "lists images known to the daemon (client)",
+			},
+			withStyxClient,
+			withListArgs,
+			runList,
+		),
+		cmd(
+			&cobra.Command{
+				Use:   "status [store path]",
+				Short: "shows summary of images, or details of one image (client)",
+				Args:  cobra.MaximumNArgs(1),
+			},
+			withStyxClient,
+			withStatusArgs,
+			runStatus,
+		),
+		cmd(
+			&cobra.Command{
+				Use:   "du [store path...]",
+				Short: "shows disk usage of images, split into shared and exclusive data (client)",
+			},
+			withStyxClient,
+			withDuArgs,
+			runDu,
+		),
+		cmd(
+			&cobra.Command{
+				Use:   "estimate <store path>...",
+				Short: "estimates what mounting store paths (and their closure) would download (client)",
+				Args:  cobra.MinimumNArgs(1),
+			},
+			withStyxClient,
+			withEstimateArgs,
+			runEstimate,
+		),
+		cmd(
+			&cobra.Command{
+				Use:   "trace",
+				Short: "streams slab reads with the files they belong to (client)",
+			},
+			withStyxClient,
+			withTraceArgs,
+			runTrace,
+		),
+		cmd(
+			&cobra.Command{
+				Use:   "inspect-image <store path>",
+				Short: "dumps the contents of a built image (client)",
+				Args:  cobra.ExactArgs(1),
+			},
+			withStyxClient,
+			withInspectImageReq,
+			func(c *cobra.Command, args []string) error {
+				return get[*client.StyxClient](c).CallAndPrint(
+					daemon.InspectPath, get[*daemon.InspectImageReq](c))
+			},
+		),
 		cmd(
 			&cobra.Command{
 				Use:   "repair",
@@ -358,6 +528,25 @@ func main() {
 					daemon.RepairPath, get[*daemon.RepairReq](c))
 			},
 		),
+		cmd(
+			&cobra.Command{
+				Use:   "export [file]",
+				Short: "writes a snapshot of the local cache to a file or stdout (client)",
+				Args:  cobra.MaximumNArgs(1),
+			},
+			withStyxClient,
+			withExportReq,
+			runExport,
+		),
+		cmd(
+			&cobra.Command{
+				Use:   "import <file>",
+				Short: "restores a snapshot into an empty local cache (run before starting daemon)",
+				Args:  cobra.ExactArgs(1),
+			},
+			withImportArgs,
+			runImport,
+		),
 		internalCmd(),
 	)
 	if err := root.Execute(); err != nil {
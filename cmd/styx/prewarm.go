@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/manifester"
+)
+
+type prewarmArgs struct {
+	upstream string
+	from     []string
+	name     string
+	parallel int
+}
+
+func withPrewarmArgs(c *cobra.Command) runE {
+	var args prewarmArgs
+	c.Flags().StringVar(&args.upstream, "upstream", "https://cache.nixos.org/", "binary cache to build manifests from")
+	c.Flags().StringArrayVar(&args.from, "from", nil,
+		"read store paths from file, url, or - (nix path-info --json output or store-paths file, may be xz-compressed)")
+	c.Flags().StringVar(&args.name, "name", "manual", "name to include in build root key")
+	c.Flags().IntVar(&args.parallel, "parallel", runtime.NumCPU(), "manifests to build in parallel")
+	return func(c *cobra.Command, _ []string) error {
+		store(c, &args)
+		return nil
+	}
+}
+
+func runPrewarm(c *cobra.Command, args []string) error {
+	pargs := get[*prewarmArgs](c)
+	paths, err := manifester.ParsePrewarmPaths([]byte(strings.Join(args, "\n")))
+	if err != nil {
+		return err
+	}
+	for _, src := range pargs.from {
+		more, err := readPrewarmSource(src)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, more...)
+	}
+	if len(paths) == 0 {
+		return errors.New("no store paths given")
+	}
+	mb := get[*manifester.ManifestBuilder](c)
+	stats, err := mb.Prewarm(c.Context(), pargs.upstream, paths, pargs.name, pargs.parallel)
+	log.Printf("prewarm: %d paths, %d existing, %d built, %d errors", stats.Paths, stats.Existing, stats.Built, stats.Errors)
+	if err != nil {
+		return err
+	}
+	log.Println("prewarm: wrote build root", stats.RootKey)
+	return nil
+}
+
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+// reads store paths from a file, url, or "-" for stdin. xz-compressed data (like a channel's
+// store-paths.xz) is decompressed.
+func readPrewarmSource(src string) ([]string, error) {
+	var data []byte
+	var err error
+	if src == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		var res *http.Response
+		if res, err = http.Get(src); err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("http error for %s: %s", src, res.Status)
+		}
+		data, err = io.ReadAll(res.Body)
+	} else {
+		data, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, xzMagic) {
+		cmd := exec.Command(common.XzBin, "-d")
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stderr = os.Stderr
+		if data, err = cmd.Output(); err != nil {
+			return nil, fmt.Errorf("decompress %s: %w", src, err)
+		}
+	}
+	return manifester.ParsePrewarmPaths(data)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnr/styx/manifester"
+)
+
+type publishArgs struct {
+	upstream  string
+	recursive bool
+	name      string
+	parallel  int
+}
+
+func withPublishArgs(c *cobra.Command) runE {
+	var args publishArgs
+	c.Flags().StringVar(&args.upstream, "upstream", "", "upstream that daemons will mount these paths with (required)")
+	c.Flags().BoolVarP(&args.recursive, "recursive", "r", false, "publish closures of the given paths")
+	c.Flags().StringVar(&args.name, "name", "manual", "name to include in build root key")
+	c.Flags().IntVar(&args.parallel, "parallel", runtime.NumCPU(), "manifests to build in parallel")
+	return func(c *cobra.Command, _ []string) error {
+		if args.upstream == "" {
+			return errors.New("--upstream is required")
+		}
+		store(c, &args)
+		return nil
+	}
+}
+
+func runPublish(c *cobra.Command, args []string) error {
+	pargs := get[*publishArgs](c)
+	paths, err := manifester.ParsePrewarmPaths([]byte(strings.Join(args, "\n")))
+	if err != nil {
+		return err
+	}
+	mb := get[*manifester.ManifestBuilder](c)
+	stats, err := mb.Publish(c.Context(), pargs.upstream, paths, pargs.recursive, pargs.name, pargs.parallel)
+	log.Printf("publish: %d paths, %d existing, %d built, %d errors", stats.Paths, stats.Existing, stats.Built, stats.Errors)
+	if err != nil {
+		return err
+	}
+	log.Println("publish: wrote build root", stats.RootKey)
+	if stats.Errors > 0 {
+		return errors.New("some paths failed to publish")
+	}
+	return nil
+}
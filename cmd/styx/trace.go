@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnr/styx/common/client"
+	"github.com/dnr/styx/daemon"
+)
+
+type traceArgs struct {
+	req  daemon.TraceReq
+	json bool
+}
+
+func withTraceArgs(c *cobra.Command) runE {
+	var args traceArgs
+	c.Flags().StringArrayVar(&args.req.Images, "image", nil, "only show reads from this store path (may be repeated)")
+	c.Flags().BoolVar(&args.json, "json", false, "print raw json events")
+	return func(c *cobra.Command, _ []string) error {
+		for i, img := range args.req.Images {
+			img = strings.TrimPrefix(img, "/nix/store/")
+			img, _, _ = strings.Cut(img, "-")
+			args.req.Images[i] = img
+		}
+		store(c, &args)
+		return nil
+	}
+}
+
+func runTrace(c *cobra.Command, _ []string) error {
+	args := get[*traceArgs](c)
+	cli := get[*client.StyxClient](c)
+	if args.json {
+		_, err := cli.CallStream(daemon.TracePath, &args.req, os.Stdout)
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := cli.CallStream(daemon.TracePath, &args.req, pw)
+		pw.CloseWithError(err)
+	}()
+	dec := json.NewDecoder(pr)
+	for {
+		var ev daemon.TraceEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if ev.Dropped > 0 {
+			fmt.Printf("(dropped %d events)\n", ev.Dropped)
+		}
+		result := "miss " + ev.Op
+		if ev.Hit {
+			result = "hit  " + ev.Op
+		}
+		if ev.Error != "" {
+			result = "ERR  " + ev.Op
+		}
+		target := fmt.Sprintf("slab %d @ %d", ev.Slab, ev.Addr)
+		if ev.StorePath != "" {
+			target = fmt.Sprintf("%s%s [%d]", ev.StorePath, ev.Path, ev.Chunk)
+		}
+		fmt.Printf("%s %-11s %6dms %7d %s", ev.Time.Format("15:04:05.000"), result, ev.LatencyMs, ev.Bytes, target)
+		if ev.Error != "" {
+			fmt.Printf(": %s", ev.Error)
+		}
+		fmt.Println()
+	}
+}
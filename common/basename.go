@@ -0,0 +1,74 @@
+package common
+
+import (
+	"errors"
+	"strings"
+)
+
+// Diff base selection by store path name. This is used by the daemon catalog and also by CI
+// to guess which diffs daemons will ask for.
+//
+// The "name" part of store paths sometimes has a nice pname-version split like
+// "rsync-3.2.6". But also can be something like "rtl8723bs-firmware-2017-04-06-xz" or
+// "sane-desc-generate-entries-unsupported-scanners.patch" or
+// "python3.10-websocket-client-1.4.1" or "lz4-1.9.4-dev" or of course just "source".
+//
+// So given another store path name, how do we find suitable candidates? We're looking for
+// something where just the version has changed, or maybe an exact match of the name. Let's
+// look at segments separated by dashes.  We can definitely reject anything that doesn't
+// share at least one segment. We should also reject anything that doesn't have the same
+// number of segments, since those are probably other outputs or otherwise separate things.
+// Then we can pick one that has the most segments in common.
+
+// DiffBasePrefix returns the prefix that all base candidates for reqName must have.
+func DiffBasePrefix(reqName string) (string, error) {
+	if len(reqName) == 0 {
+		return "", errors.New("store path hash not found")
+	} else if len(reqName) < 3 {
+		return "", errors.New("name too short")
+	} else if reqName == "source" {
+		// TODO: need contents similarity for this one
+		return "", errors.New("can't handle 'source'")
+	}
+	if firstDash := strings.IndexByte(reqName, '-'); firstDash >= 0 {
+		return reqName[:firstDash+1], nil
+	}
+	return reqName, nil
+}
+
+// DiffBaseScore returns how good name is as a diff base for reqName, or -1 if it can't be
+// used at all. Name should already have the prefix returned by DiffBasePrefix. On ties,
+// callers should prefer later (probably more recent) names.
+func DiffBaseScore[S ~string | ~[]byte](reqName string, name S) int {
+	nameDashes := 0
+	for i := range len(name) {
+		if name[i] == '-' {
+			nameDashes++
+		}
+	}
+	if nameDashes != strings.Count(reqName, "-") {
+		return -1
+	}
+	i := 0
+	for ; i < len(reqName) && i < len(name) && reqName[i] == name[i]; i++ {
+	}
+	return i
+}
+
+// DiffBaseName picks the best diff base for reqName among candidates (which don't need to
+// have the prefix). Returns "" if there's no usable base.
+func DiffBaseName(reqName string, candidates []string) string {
+	start, err := DiffBasePrefix(reqName)
+	if err != nil {
+		return ""
+	}
+	best, bestName := 0, ""
+	for _, name := range candidates {
+		if !strings.HasPrefix(name, start) {
+			continue
+		} else if score := DiffBaseScore(reqName, name); score >= best {
+			best, bestName = score, name
+		}
+	}
+	return bestName
+}
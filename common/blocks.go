@@ -1,5 +1,7 @@
 package common
 
+import "github.com/dnr/styx/pb"
+
 func AppendBlocksList(blocks []uint16, size int64, blockShift BlkShift) []uint16 {
 	nChunks := ChunkShift.Blocks(size)
 	allButLast := TruncU16(ChunkShift.Size() >> blockShift)
@@ -10,3 +12,22 @@ func AppendBlocksList(blocks []uint16, size int64, blockShift BlkShift) []uint16
 	blocks = append(blocks, TruncU16(blockShift.Blocks(lastChunkLen)))
 	return blocks
 }
+
+// Like AppendBlocksList but uses explicit chunk sizes if the entry has them.
+func AppendEntryBlocksList(blocks []uint16, e *pb.Entry, blockShift BlkShift) []uint16 {
+	if len(e.ChunkSize) == 0 {
+		return AppendBlocksList(blocks, e.Size, blockShift)
+	}
+	for _, size := range e.ChunkSize {
+		blocks = append(blocks, TruncU16(blockShift.Blocks(int64(size))))
+	}
+	return blocks
+}
+
+// Size of chunk i of an entry.
+func EntryChunkSize(e *pb.Entry, i int, isLast bool) int64 {
+	if len(e.ChunkSize) > 0 {
+		return int64(e.ChunkSize[i])
+	}
+	return ChunkShift.FileChunkSize(e.Size, isLast)
+}
@@ -6,12 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"unsafe"
+
+	"lukechampine.com/blake3"
 )
 
 const (
 	Bytes = 24
 	Bits  = Bytes << 3
-	Algo  = "sha256"
+
+	// digest algorithms (GlobalParams.DigestAlgo). both are truncated to Bytes.
+	Sha256 = "sha256"
+	Blake3 = "blake3"
 )
 
 type (
@@ -22,19 +27,30 @@ var Zero CDig
 
 var ErrInvalid = errors.New("invalid base64 digest")
 
-func Sum(b []byte) CDig {
-	h := sha256.New()
-	h.Write(b)
-	var full [sha256.Size]byte
-	return FromBytes(h.Sum(full[:0]))
+func ValidAlgo(algo string) bool {
+	return algo == Sha256 || algo == Blake3
+}
+
+// algo must be valid (check with ValidAlgo first).
+func Sum(algo string, b []byte) CDig {
+	switch algo {
+	case Sha256:
+		full := sha256.Sum256(b)
+		return FromBytes(full[:])
+	case Blake3:
+		full := blake3.Sum256(b)
+		return FromBytes(full[:])
+	default:
+		panic("unknown digest algo " + algo)
+	}
 }
 
 func (dig CDig) String() string {
 	return base64.RawURLEncoding.EncodeToString(dig[:])
 }
 
-func (dig CDig) Check(b []byte) error {
-	if got := Sum(b); got != dig {
+func (dig CDig) Check(algo string, b []byte) error {
+	if got := Sum(algo, b); got != dig {
 		return fmt.Errorf("chunk digest mismatch %x != %x", got, dig)
 	}
 	return nil
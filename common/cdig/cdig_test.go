@@ -29,3 +29,14 @@ func TestSlice(t *testing.T) {
 	b2 := ToSliceAlias(s2)
 	require.True(t, bytes.Equal(b2, b))
 }
+
+func TestSum(t *testing.T) {
+	r := require.New(t)
+	// truncated known values for empty input
+	r.Equal("47DEQpj8HBSa-_TImW-5JCeuQeRkm5NM", Sum(Sha256, nil).String())
+	r.Equal("rxNJufX5oaagQE3qNtzJSZvLJcmtwRK3", Sum(Blake3, nil).String())
+
+	dig := Sum(Blake3, []byte("hello"))
+	r.NoError(dig.Check(Blake3, []byte("hello")))
+	r.Error(dig.Check(Sha256, []byte("hello")))
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -46,6 +47,32 @@ func (c *StyxClient) Call(path string, req, res any) (int, error) {
 	return httpRes.StatusCode, json.NewDecoder(httpRes.Body).Decode(res)
 }
 
+// CallStream is like Call but for requests that return a stream instead of json. On success
+// the response body is copied to w.
+func (c *StyxClient) CallStream(path string, req any, w io.Writer) (int, error) {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   "_",
+		Path:   path,
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	httpRes, err := c.cli.Post(u.String(), "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return 0, err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		var res struct{ Error string }
+		_ = json.NewDecoder(httpRes.Body).Decode(&res)
+		return httpRes.StatusCode, fmt.Errorf("%s: %s", httpRes.Status, res.Error)
+	}
+	_, err = io.Copy(w, httpRes.Body)
+	return httpRes.StatusCode, err
+}
+
 func (c *StyxClient) CallAndPrint(path string, req any) error {
 	var res any
 	status, err := c.Call(path, req, &res)
@@ -14,5 +14,16 @@ var (
 	ManifestContext     = "styx-manifest-1"
 	DaemonParamsContext = "styx-daemon-params-1"
 
+	// Default digest algo for new params (cdig.Sha256)
 	DigestAlgo = "sha256"
 )
+
+const (
+	// Chunk algorithms (GlobalParams.ChunkAlgo). Fixed is the default.
+	ChunkAlgoFixed   = ""
+	ChunkAlgoFastCDC = "fastcdc"
+
+	// Content-defined chunk boundaries are aligned to this so that chunks can be mapped into
+	// erofs images. Must be at least the largest erofs block size.
+	CdcAlignShift BlkShift = 12
+)
@@ -0,0 +1,234 @@
+// Package fakes3 is a minimal in-memory s3-compatible server for tests. It supports
+// path-style addressing only (like most MinIO deployments) and the operations styx uses:
+// get (with ranges), head, put, list v2, and batch delete.
+package fakes3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	Server struct {
+		*httptest.Server
+		// if set, requests must be signed with this access key
+		AccessKey string
+		// allow unsigned gets, like a bucket with a public read policy
+		PublicRead bool
+		// max keys per list page, to exercise pagination
+		PageSize int
+
+		lock    sync.Mutex
+		objects map[string]*object // bucket + "/" + key
+		buckets map[string]bool
+	}
+
+	object struct {
+		data     []byte
+		encoding string
+		cacheCtl string
+		mtime    time.Time
+	}
+
+	listResult struct {
+		XMLName               xml.Name      `xml:"ListBucketResult"`
+		Name                  string        `xml:"Name"`
+		Prefix                string        `xml:"Prefix"`
+		KeyCount              int           `xml:"KeyCount"`
+		MaxKeys               int           `xml:"MaxKeys"`
+		IsTruncated           bool          `xml:"IsTruncated"`
+		NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+		Contents              []listContent `xml:"Contents"`
+	}
+	listContent struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int64  `xml:"Size"`
+	}
+
+	deleteReq struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+)
+
+// New starts a server with the given buckets.
+func New(buckets ...string) *Server {
+	s := &Server{
+		PageSize: 1000,
+		objects:  make(map[string]*object),
+		buckets:  make(map[string]bool),
+	}
+	for _, b := range buckets {
+		s.buckets[b] = true
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Keys returns all keys in a bucket, sorted.
+func (s *Server) Keys(bucket string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.keysLocked(bucket)
+}
+
+// SetMtime changes the modification time of an object.
+func (s *Server) SetMtime(bucket, key string, t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if o := s.objects[bucket+"/"+key]; o != nil {
+		o.mtime = t
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	public := s.PublicRead && auth == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+	if s.AccessKey != "" && !public && !strings.Contains(auth, "Credential="+s.AccessKey+"/") {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !s.buckets[bucket] {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet && q.Get("list-type") == "2":
+		s.list(w, bucket, q.Get("prefix"), q.Get("continuation-token"))
+	case key == "" && r.Method == http.MethodPost && q.Has("delete"):
+		s.delete(w, r, bucket)
+	case key != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.get(w, r, bucket+"/"+key)
+	case key != "" && r.Method == http.MethodPut:
+		s.put(w, r, bucket+"/"+key)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, k string) {
+	s.lock.Lock()
+	o := s.objects[k]
+	s.lock.Unlock()
+	if o == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Last-Modified", o.mtime.UTC().Format(http.TimeFormat))
+	if o.encoding != "" {
+		h.Set("Content-Encoding", o.encoding)
+	}
+	if o.cacheCtl != "" {
+		h.Set("Cache-Control", o.cacheCtl)
+	}
+	data, status := o.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start > end || start >= len(data) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		end = min(end, len(data)-1)
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data, status = data[start:end+1], http.StatusPartialContent
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, k string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	s.lock.Lock()
+	s.objects[k] = &object{
+		data:     data,
+		encoding: r.Header.Get("Content-Encoding"),
+		cacheCtl: r.Header.Get("Cache-Control"),
+		mtime:    time.Now(),
+	}
+	s.lock.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) list(w http.ResponseWriter, bucket, prefix, token string) {
+	res := listResult{Name: bucket, Prefix: prefix, MaxKeys: s.PageSize}
+	s.lock.Lock()
+	for _, key := range s.keysLocked(bucket) {
+		if !strings.HasPrefix(key, prefix) || key <= token {
+			continue
+		} else if len(res.Contents) >= s.PageSize {
+			res.IsTruncated = true
+			res.NextContinuationToken = res.Contents[len(res.Contents)-1].Key
+			break
+		}
+		o := s.objects[bucket+"/"+key]
+		res.Contents = append(res.Contents, listContent{
+			Key:          key,
+			LastModified: o.mtime.UTC().Format(time.RFC3339Nano),
+			Size:         int64(len(o.data)),
+		})
+	}
+	s.lock.Unlock()
+	res.KeyCount = len(res.Contents)
+	writeXML(w, res)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, bucket string) {
+	var req deleteReq
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	s.lock.Lock()
+	for _, o := range req.Objects {
+		delete(s.objects, bucket+"/"+o.Key)
+	}
+	s.lock.Unlock()
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+	}{})
+}
+
+func (s *Server) keysLocked(bucket string) []string {
+	var out []string
+	for k := range s.objects {
+		if key, ok := strings.CutPrefix(k, bucket+"/"); ok {
+			out = append(out, key)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/nix-community/go-nix/pkg/narinfo/signature"
 	"google.golang.org/protobuf/proto"
 
+	"github.com/dnr/styx/common/cdig"
 	"github.com/dnr/styx/pb"
 )
 
@@ -82,7 +83,7 @@ func VerifyMessageAsEntry(keys []signature.PublicKey, expectedContext string, b
 		sigs[i].Data = sm.Signature[i]
 	}
 
-	fingerprint := entryFingerprint(sm.Msg)
+	fingerprint := entryFingerprint(sm.Msg, sm.Params)
 	if !signature.VerifyFirst(fingerprint, sigs, keys) {
 		return nil, nil, fmt.Errorf("signature verification failed")
 	}
@@ -111,7 +112,7 @@ func SignMessageAsEntry(keys []signature.SecretKey, params *pb.GlobalParams, e *
 		Signature: make([][]byte, len(keys)),
 	}
 
-	fingerprint := entryFingerprint(sm.Msg)
+	fingerprint := entryFingerprint(sm.Msg, sm.Params)
 	for i, k := range keys {
 		sig, err := k.Sign(rand.Reader, fingerprint)
 		if err != nil {
@@ -124,8 +125,8 @@ func SignMessageAsEntry(keys []signature.SecretKey, params *pb.GlobalParams, e *
 	return proto.Marshal(sm)
 }
 
-func entryFingerprint(e *pb.Entry) string {
-	// TODO: do we need to include params here?
+func entryFingerprint(e *pb.Entry, params *pb.GlobalParams) string {
+	// TODO: do we need to include other params here?
 	var sb strings.Builder
 	sb.Grow(40 + len(e.Path) + len(e.InlineData) + len(e.Digests))
 	sb.WriteString("styx-signed-message-1")
@@ -142,6 +143,12 @@ func entryFingerprint(e *pb.Entry) string {
 	} else {
 		sb.WriteByte(2)
 		sb.Write(e.Digests)
+		// digests are only meaningful with the algo. only include non-default algo so that
+		// existing signatures stay valid.
+		if algo := params.GetDigestAlgo(); algo != "" && algo != cdig.Sha256 {
+			sb.WriteByte(0)
+			sb.WriteString(algo)
+		}
 	}
 	return sb.String()
 }
@@ -0,0 +1,51 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPropagation(t *testing.T) {
+	r := require.New(t)
+	exp := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	defer otel.SetTracerProvider(prev)
+	_, err := Setup(context.Background(), Config{})
+	r.NoError(err)
+
+	srv := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, span := Start(req.Context(), "inner")
+		span.End()
+	})))
+	defer srv.Close()
+
+	ctx, span := Start(context.Background(), "client")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/thing", nil)
+	r.NoError(err)
+	Inject(ctx, req.Header)
+	res, err := http.DefaultClient.Do(req)
+	r.NoError(err)
+	res.Body.Close()
+	End(span, errors.New("oops"))
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exp.GetSpans() {
+		spans[s.Name] = s
+	}
+	client, server, inner := spans["client"], spans["GET /thing"], spans["inner"]
+	r.Equal(client.SpanContext.TraceID(), server.SpanContext.TraceID())
+	r.Equal(client.SpanContext.SpanID(), server.Parent.SpanID())
+	r.Equal(server.SpanContext.SpanID(), inner.Parent.SpanID())
+	r.Equal(codes.Error, client.Status.Code)
+	r.Equal(codes.Unset, inner.Status.Code)
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/nix-community/go-nix/pkg/nixbase32"
 	"github.com/nix-community/go-nix/pkg/storepath"
 	"go.etcd.io/bbolt"
+
+	"github.com/dnr/styx/common"
 )
 
 const (
@@ -74,34 +76,9 @@ func (s *Server) catalogFindBase(tx *bbolt.Tx, reqHashPrefix SphPrefix) (catalog
 }
 
 func (s *Server) catalogFindBaseFromHashAndName(tx *bbolt.Tx, reqHash Sph, reqName string) (catalogResult, error) {
-	if len(reqName) == 0 {
-		return catalogResult{}, errors.New("store path hash not found")
-	} else if len(reqName) < 3 {
-		return catalogResult{}, errors.New("name too short")
-	} else if reqName == "source" {
-		// TODO: need contents similarity for this one
-		return catalogResult{}, errors.New("can't handle 'source'")
-	}
-
-	// The "name" part of store paths sometimes has a nice pname-version split like
-	// "rsync-3.2.6". But also can be something like "rtl8723bs-firmware-2017-04-06-xz" or
-	// "sane-desc-generate-entries-unsupported-scanners.patch" or
-	// "python3.10-websocket-client-1.4.1" or "lz4-1.9.4-dev" or of course just "source".
-	//
-	// So given another store path name, how do we find suitable candidates? We're looking for
-	// something where just the version has changed, or maybe an exact match of the name. Let's
-	// look at segments separated by dashes.  We can definitely reject anything that doesn't
-	// share at least one segment. We should also reject anything that doesn't have the same
-	// number of segments, since those are probably other outputs or otherwise separate things.
-	// Then we can pick one that has the most segments in common.
-
-	firstDash := strings.IndexByte(reqName, '-')
-	numDashes := strings.Count(reqName, "-")
-	var start string
-	if firstDash < 0 {
-		start = reqName
-	} else {
-		start = reqName[:firstDash+1]
+	start, err := common.DiffBasePrefix(reqName)
+	if err != nil {
+		return catalogResult{}, err
 	}
 	startb := []byte(start)
 
@@ -117,9 +94,9 @@ func (s *Server) catalogFindBaseFromHashAndName(tx *bbolt.Tx, reqHash Sph, reqNa
 			continue // this is a bug
 		}
 		sph := SphFromBytes(hash)
-		if sph != reqHash && bytes.Count(name, []byte{'-'}) == numDashes {
+		if sph != reqHash {
 			// take last best instead of first since it's probably more recent
-			if match := matchLen(reqName, name); match >= bestmatch {
+			if match := common.DiffBaseScore(reqName, name); match >= bestmatch {
 				bestmatch = match
 				bestname = string(name)
 				besthash = sph
@@ -138,10 +115,3 @@ func (s *Server) catalogFindBaseFromHashAndName(tx *bbolt.Tx, reqHash Sph, reqNa
 		reqHash:  reqHash,
 	}, nil
 }
-
-func matchLen(a string, b []byte) int {
-	i := 0
-	for ; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
-	}
-	return i
-}
@@ -13,13 +13,15 @@ const (
 )
 
 var (
-	metaBucket     = []byte("meta")
-	chunkBucket    = []byte("chunk")
-	slabBucket     = []byte("slab")
-	imageBucket    = []byte("image")
-	manifestBucket = []byte("manifest")
-	catalogFBucket = []byte("catalogf") // name + hash -> [sysid]
-	catalogRBucket = []byte("catalogr") // hash -> name
+	metaBucket         = []byte("meta")
+	chunkBucket        = []byte("chunk")
+	slabBucket         = []byte("slab")
+	imageBucket        = []byte("image")
+	manifestBucket     = []byte("manifest")
+	catalogFBucket     = []byte("catalogf")     // name + hash -> [sysid]
+	catalogRBucket     = []byte("catalogr")     // hash -> name
+	packLocBucket      = []byte("packloc")      // digest -> pack location (if using packs)
+	materializedBucket = []byte("materialized") // dest path -> hash of last materialize
 
 	metaSchema = []byte("schema")
 	metaParams = []byte("params")
@@ -12,7 +12,6 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"slices"
 	"strconv"
@@ -24,6 +23,7 @@ import (
 	"github.com/lunixbochs/struc"
 	"github.com/nix-community/go-nix/pkg/narinfo/signature"
 	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/semaphore"
 	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
@@ -31,6 +31,7 @@ import (
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/common/cdig"
 	"github.com/dnr/styx/common/systemd"
+	"github.com/dnr/styx/common/tracing"
 	"github.com/dnr/styx/erofs"
 	"github.com/dnr/styx/manifester"
 	"github.com/dnr/styx/pb"
@@ -56,6 +57,8 @@ const (
 	presentMask        = 1 << 31
 	reservedBlocks     = 4 // reserved at beginning of slab
 	manifestSlabOffset = 10000
+
+	extraWorkerIdle = time.Minute
 )
 
 type (
@@ -87,6 +90,9 @@ type (
 		// connect context for mount request to cachefiles request
 		mountCtxMap common.SimpleSyncMap[string, context.Context]
 
+		// last fetch time that we wrote to the db for each image
+		fetchMap common.SimpleSyncMap[SphPrefix, time.Time]
+
 		// keeps track of pending diff/fetch state
 		// note: we open a read-only transaction inside of diffLock.
 		// therefore we must not try to lock diffLock while in a read or write tx.
@@ -95,6 +101,26 @@ type (
 		recentReads map[string]*recentRead
 		diffSem     *semaphore.Weighted
 
+		workers atomic.Int32 // current cachefiles workers
+
+		// reads from the kernel that haven't been completed yet
+		inflightLock sync.Mutex
+		inflight     map[uint32]*inflightRead // msg id -> read
+
+		trace tracer
+
+		// collects concurrent manifest requests to send as a batch
+		manifestBatchLock     sync.Mutex
+		manifestBatch         []*pendingManifest // waiting to be sent
+		manifestBatchInflight int                // requests or batches in flight
+		noManifestBatch       atomic.Bool        // set if manifester doesn't support batch requests
+		noChunkDiffV2         atomic.Bool        // set if differ doesn't support v2 protocol
+
+		// negative cache for precomputed diffs, see tryPrecomputed
+		precomputedHits      atomic.Int64
+		precomputedMisses    atomic.Int64
+		precomputedSkipUntil atomic.Int64 // unix nanos
+
 		shutdownChan chan struct{}
 		shutdownWait sync.WaitGroup
 	}
@@ -105,6 +131,9 @@ type (
 		params pb.DaemonParams
 		csread manifester.ChunkStoreRead
 		mcread manifester.ChunkStoreRead
+		pdread manifester.ChunkStoreRead
+		psread manifester.PackStoreRead
+		noDiff bool // chunks are local, read them directly
 	}
 
 	openFileState struct {
@@ -132,9 +161,19 @@ type (
 		// SmallFileCutoff int
 
 		Workers int
+		// Start extra workers up to this many when all are busy. Extra workers exit after
+		// being idle for a while.
+		MaxWorkers int
+		// Give up on a kernel read from a slab after this long. Zero means no limit.
+		ReadTimeout time.Duration
+
+		// Build manifests in-process instead of using a remote manifester.
+		Embedded EmbeddedConfig
 
 		IsTesting bool
 		FdStore   systemd.FdStore
+		// Defaults to the real kernel.
+		Kernel Kernel
 	}
 )
 
@@ -145,6 +184,10 @@ var errAlreadyMountedElsewhere = errors.New("already mounted on another mountpoi
 // init stuff
 
 func NewServer(cfg Config) *Server {
+	if cfg.Kernel == nil {
+		cfg.Kernel = realKernel{}
+	}
+	cfg.MaxWorkers = max(cfg.MaxWorkers, cfg.Workers)
 	return &Server{
 		cfg:          &cfg,
 		blockShift:   common.BlkShift(cfg.ErofsBlockShift),
@@ -157,9 +200,11 @@ func NewServer(cfg Config) *Server {
 		presentMap:   *common.NewSimpleSyncMap[erofs.SlabLoc, struct{}](),
 		readKnownMap: *common.NewSimpleSyncMap[erofs.SlabLoc, struct{}](),
 		mountCtxMap:  *common.NewSimpleSyncMap[string, context.Context](),
+		fetchMap:     *common.NewSimpleSyncMap[SphPrefix, time.Time](),
 		diffMap:      make(map[erofs.SlabLoc]reqOp),
 		recentReads:  make(map[string]*recentRead),
 		diffSem:      semaphore.NewWeighted(int64(cfg.Workers)),
+		inflight:     make(map[uint32]*inflightRead),
 		shutdownChan: make(chan struct{}),
 	}
 }
@@ -168,16 +213,49 @@ func (s *Server) p() *postinit {
 	return s.post.Load()
 }
 
+// only call after init
+func (s *Server) digestAlgo() string {
+	return s.p().params.Params.DigestAlgo
+}
+
 func (s *Server) postInit(params *pb.DaemonParams, keys []signature.PublicKey) error {
-	post := &postinit{
-		keys:   keys,
-		csread: manifester.NewChunkStoreReadUrl(params.ChunkReadUrl, manifester.ChunkReadPath),
-		mcread: manifester.NewChunkStoreReadUrl(params.ManifestCacheUrl, manifester.ManifestCachePath),
-	}
+	post := &postinit{keys: keys}
 	proto.Merge(&post.params, params)
+	stopEmbedded := func() {}
+	if s.cfg.Embedded.enabled() {
+		u, stop, err := s.startEmbedded(post.params.Params, keys)
+		if err != nil {
+			return fmt.Errorf("embedded manifester: %w", err)
+		}
+		stopEmbedded = stop
+		// only in memory, the params in the db are unchanged
+		post.params.ManifesterUrl = u
+		post.params.ManifestCacheUrl = u
+		post.params.ChunkReadUrl = u
+		post.params.ChunkDiffUrl = u
+	}
+	post.csread = manifester.NewChunkStoreReadUrl(post.params.ChunkReadUrl, manifester.ChunkReadPath)
+	post.mcread = manifester.NewChunkStoreReadUrl(post.params.ManifestCacheUrl, manifester.ManifestCachePath)
+	post.pdread = manifester.NewChunkStoreReadUrl(post.params.ChunkReadUrl, manifester.PrecomputedDiffPath)
+	post.psread = manifester.NewPackStoreReadUrl(post.params.ChunkReadUrl)
+	if s.cfg.Embedded.enabled() {
+		dir := s.cfg.Embedded.ChunkDir
+		post.csread = manifester.NewChunkStoreReadLocal(dir, manifester.ChunkReadPath)
+		post.mcread = manifester.NewChunkStoreReadLocal(dir, manifester.ManifestCachePath)
+		post.noDiff = !s.cfg.Embedded.UseDiffs
+	}
 	if !s.post.CompareAndSwap(nil, post) {
+		stopEmbedded()
 		return errors.New("postInit got conflict")
 	}
+	if s.cfg.Embedded.enabled() {
+		s.shutdownWait.Add(1)
+		go func() {
+			defer s.shutdownWait.Done()
+			<-s.shutdownChan
+			stopEmbedded()
+		}()
+	}
 	return nil
 }
 
@@ -271,6 +349,10 @@ func (s *Server) openDb() (err error) {
 			return err
 		} else if _, err = tx.CreateBucketIfNotExists(catalogRBucket); err != nil {
 			return err
+		} else if _, err = tx.CreateBucketIfNotExists(packLocBucket); err != nil {
+			return err
+		} else if _, err = tx.CreateBucketIfNotExists(materializedBucket); err != nil {
+			return err
 		} else if err = checkSchemaVer(mb); err != nil {
 			return err
 		} else if err = loadParams(mb); err != nil {
@@ -281,7 +363,7 @@ func (s *Server) openDb() (err error) {
 }
 
 func (s *Server) setupEnv() error {
-	return exec.Command(common.ModprobeBin, "cachefiles").Run()
+	return s.cfg.Kernel.Setup()
 }
 
 func (s *Server) setupManifestSlab() error {
@@ -305,41 +387,23 @@ func (s *Server) setupManifestSlab() error {
 	return nil
 }
 
-func (s *Server) openDevNode() (int, error) {
-	fd, err := unix.Open(s.cfg.DevPath, unix.O_RDWR, 0600)
-	if err == unix.ENOENT {
-		_ = unix.Mknod(s.cfg.DevPath, 0600|unix.S_IFCHR, 10<<8+122)
-		fd, err = unix.Open(s.cfg.DevPath, unix.O_RDWR, 0600)
-	}
-	if err != nil {
-		return 0, err
-	} else if _, err = unix.Write(fd, []byte("dir "+s.cfg.CachePath)); err != nil {
-		unix.Close(fd)
-		return 0, err
-	} else if _, err = unix.Write(fd, []byte("tag "+s.cfg.CacheTag)); err != nil {
-		unix.Close(fd)
-		return 0, err
-	} else if _, err = unix.Write(fd, []byte("bind ondemand")); err != nil {
-		unix.Close(fd)
-		return 0, err
-	}
-	return fd, nil
-}
-
 func (s *Server) setupDevNode() error {
 	fd, err := s.cfg.FdStore.GetFd(savedFdName)
 	if err == nil {
-		if _, err = unix.Write(fd, []byte("restore")); err != nil {
-			s.cfg.FdStore.RemoveFd(savedFdName)
-			unix.Close(fd)
-			return err
+		// "restore" makes the kernel resend requests that the previous daemon read but didn't
+		// complete. objects whose fds we lost will get reopened on their next read.
+		if _, err = unix.Write(fd, []byte("restore")); err == nil {
+			s.devnode.Store(int32(fd))
+			log.Println("restored cachefiles device")
+			return nil
 		}
-		s.devnode.Store(int32(fd))
-		log.Println("restored cachefiles device")
-		return nil
+		// probably kernel < 6.8. existing mounts won't work but we can start fresh.
+		log.Println("restoring cachefiles device failed, opening new one:", err)
+		s.cfg.FdStore.RemoveFd(savedFdName)
+		unix.Close(fd)
 	}
 
-	fd, err = s.openDevNode()
+	fd, err = s.cfg.Kernel.OpenDevNode(s.cfg.DevPath, s.cfg.CachePath, s.cfg.CacheTag)
 	if err != nil {
 		return err
 	}
@@ -389,6 +453,13 @@ func (s *Server) startSocketServer() (err error) {
 	mux.HandleFunc(GcPath, jsonmw(s.handleGcReq))
 	mux.HandleFunc(DebugPath, jsonmw(s.handleDebugReq))
 	mux.HandleFunc(RepairPath, jsonmw(s.handleRepairReq))
+	mux.HandleFunc(ExportPath, s.handleExport)
+	mux.HandleFunc(InspectPath, jsonmw(s.handleInspectImageReq))
+	mux.HandleFunc(InflightPath, jsonmw(s.handleInflightReq))
+	mux.HandleFunc(TracePath, s.handleTrace)
+	mux.HandleFunc(ListPath, jsonmw(s.handleListReq))
+	mux.HandleFunc(DuPath, jsonmw(s.handleDuReq))
+	mux.HandleFunc(EstimatePath, jsonmw(s.handleEstimateReq))
 	mux.HandleFunc("/pprof/", pprof.Index)
 	mux.HandleFunc("/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/pprof/profile", pprof.Profile)
@@ -397,7 +468,7 @@ func (s *Server) startSocketServer() (err error) {
 	s.shutdownWait.Add(1)
 	go func() {
 		defer s.shutdownWait.Done()
-		srv := &http.Server{Handler: mux}
+		srv := &http.Server{Handler: tracing.Handler(mux)}
 		go srv.Serve(l)
 		<-s.shutdownChan
 		log.Printf("stopping http server")
@@ -482,6 +553,8 @@ func jsonmw[reqT, resT any](f func(context.Context, *reqT) (*resT, error)) func(
 }
 
 func (s *Server) handleInitReq(ctx context.Context, r *InitReq) (*Status, error) {
+	// urls aren't needed in embedded mode
+	embedded := s.cfg.Embedded.enabled()
 	if s.p() != nil {
 		// TODO: add ability to modify some params
 		return nil, mwErr(http.StatusConflict, "already initialized")
@@ -489,13 +562,13 @@ func (s *Server) handleInitReq(ctx context.Context, r *InitReq) (*Status, error)
 		return nil, mwErrE(http.StatusBadRequest, err)
 	} else if len(r.PubKeys) == 0 {
 		return nil, mwErr(http.StatusBadRequest, "missing public keys")
-	} else if r.Params.ManifesterUrl == "" {
+	} else if !embedded && r.Params.ManifesterUrl == "" {
 		return nil, mwErr(http.StatusBadRequest, "missing manifester url")
-	} else if r.Params.ManifestCacheUrl == "" {
+	} else if !embedded && r.Params.ManifestCacheUrl == "" {
 		return nil, mwErr(http.StatusBadRequest, "missing manifest cache url")
-	} else if r.Params.ChunkReadUrl == "" {
+	} else if !embedded && r.Params.ChunkReadUrl == "" {
 		return nil, mwErr(http.StatusBadRequest, "missing chunk read url")
-	} else if r.Params.ChunkDiffUrl == "" {
+	} else if !embedded && r.Params.ChunkDiffUrl == "" {
 		return nil, mwErr(http.StatusBadRequest, "missing chunk diff url")
 	} else if keys, err := common.LoadPubKeys(r.PubKeys); err != nil {
 		return nil, mwErrE(http.StatusBadRequest, err)
@@ -555,6 +628,7 @@ func (s *Server) handleMountReq(ctx context.Context, r *MountReq) (*Status, erro
 		img.MountState = pb.MountState_Requested
 		img.MountPoint = r.MountPoint
 		img.LastMountError = ""
+		img.LastFetch = time.Now().Unix()
 		haveImageSize = img.ImageSize
 		haveIsBare = img.IsBare
 		return nil
@@ -597,15 +671,15 @@ func (s *Server) tryMount(ctx context.Context, req *MountReq, haveImageSize int6
 	}
 
 	var mountErr error
-	opts := fmt.Sprintf("domain_id=%s,fsid=%s", s.cfg.CacheDomain, cookie)
+	k := s.cfg.Kernel
 
 	if mountCtx.imageData != nil {
 		// first mount somewhere private, then unmount to force cachefiles to flush the image to disk.
 		// this is gross, there should be a better way to control cachefiles flushing.
 		firstMp := filepath.Join(s.cfg.CachePath, "initial", cookie)
 		_ = os.MkdirAll(firstMp, 0o755)
-		mountErr = unix.Mount("none", firstMp, "erofs", 0, opts)
-		_ = unix.Unmount(firstMp, 0)
+		mountErr = k.Mount(s.cfg.CacheDomain, cookie, firstMp)
+		_ = k.Unmount(firstMp)
 		_ = os.Remove(firstMp)
 	}
 
@@ -623,17 +697,17 @@ func (s *Server) tryMount(ctx context.Context, req *MountReq, haveImageSize int6
 			// mount to private dir
 			privateMp := filepath.Join(s.cfg.CachePath, "bare", cookie)
 			_ = os.MkdirAll(privateMp, 0o755)
-			mountErr = unix.Mount("none", privateMp, "erofs", 0, opts)
+			mountErr = k.Mount(s.cfg.CacheDomain, cookie, privateMp)
 			if mountErr == nil {
 				// now bind the bare file where it should go
-				mountErr = unix.Mount(privateMp+erofs.BarePath, req.MountPoint, "none", unix.MS_BIND, "")
+				mountErr = k.BindMount(privateMp+erofs.BarePath, req.MountPoint)
 			}
 			// whether we succeeded or failed, unmount the original and clean up
-			_ = unix.Unmount(privateMp, 0)
+			_ = k.Unmount(privateMp)
 			_ = os.Remove(privateMp)
 		} else {
 			_ = os.MkdirAll(req.MountPoint, 0o755)
-			mountErr = unix.Mount("none", req.MountPoint, "erofs", 0, opts)
+			mountErr = k.Mount(s.cfg.CacheDomain, cookie, req.MountPoint)
 		}
 	}
 
@@ -679,7 +753,7 @@ func (s *Server) handleUmountReq(ctx context.Context, r *UmountReq) (*Status, er
 		return nil, err
 	}
 
-	umountErr := unix.Unmount(mp, 0)
+	umountErr := s.cfg.Kernel.Unmount(mp)
 
 	if umountErr == nil {
 		_ = s.imageTx(sph, func(img *pb.DbImage) error {
@@ -730,7 +804,7 @@ func (s *Server) restoreMounts() {
 		return nil
 	})
 	for _, img := range toRestore {
-		if mounted, err := isErofsMount(img.MountPoint); err == nil && mounted {
+		if mounted, err := s.cfg.Kernel.IsMounted(img.MountPoint); err == nil && mounted {
 			// log.Print("restoring: ", img.StorePath, " already mounted on ", img.MountPoint)
 			continue
 		}
@@ -756,6 +830,9 @@ func (s *Server) Start() error {
 	if err := s.openDb(); err != nil {
 		return err
 	}
+	if err := s.prunePackLocs(); err != nil {
+		log.Print("error pruning pack locations: ", err)
+	}
 	if err := s.setupManifestSlab(); err != nil {
 		return err
 	}
@@ -820,13 +897,7 @@ func (s *Server) cachefilesServer() {
 
 	wchan := make(chan []byte)
 	for i := 0; i < s.cfg.Workers; i++ {
-		s.shutdownWait.Add(1)
-		go func() {
-			defer s.shutdownWait.Done()
-			for msg := range wchan {
-				s.handleMessage(msg)
-			}
-		}()
+		s.startWorker(wchan, false)
 	}
 
 	fds := make([]unix.PollFd, 1)
@@ -878,7 +949,16 @@ func (s *Server) cachefilesServer() {
 			}
 			readAfterPoll = true
 			errors = 0
-			wchan <- buf[:n]
+			select {
+			case wchan <- buf[:n]:
+			default:
+				// all workers are busy, probably waiting on slow chunk requests. start
+				// another so that reads that don't need the network aren't stuck behind them.
+				if int(s.workers.Load()) < s.cfg.MaxWorkers {
+					s.startWorker(wchan, true)
+				}
+				wchan <- buf[:n]
+			}
 		}
 	}
 
@@ -886,6 +966,38 @@ func (s *Server) cachefilesServer() {
 	close(wchan)
 }
 
+func (s *Server) startWorker(wchan chan []byte, extra bool) {
+	s.workers.Add(1)
+	if extra {
+		s.stats.extraWorkers.Add(1)
+	}
+	s.shutdownWait.Add(1)
+	go func() {
+		defer s.shutdownWait.Done()
+		defer s.workers.Add(-1)
+		if !extra {
+			for msg := range wchan {
+				s.handleMessage(msg)
+			}
+			return
+		}
+		idle := time.NewTimer(extraWorkerIdle)
+		defer idle.Stop()
+		for {
+			select {
+			case msg, ok := <-wchan:
+				if !ok {
+					return
+				}
+				s.handleMessage(msg)
+				idle.Reset(extraWorkerIdle)
+			case <-idle.C:
+				return
+			}
+		}
+	}()
+}
+
 func (s *Server) handleMessage(buf []byte) (retErr error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -1011,13 +1123,30 @@ func (s *Server) handleOpenSlabImage(msgId, objectId, fd, flags uint32, id uint1
 }
 
 func (s *Server) handleOpenImage(msgId, objectId, fd, flags uint32, cookie string) (int64, error) {
-	ctx, _ := s.mountCtxMap.Get(cookie)
-	if ctx == nil {
-		return 0, fmt.Errorf("missing context in handleOpenImage for %s", cookie)
-	}
-	mountCtx, _ := fromMountCtx(ctx)
-	if mountCtx == nil {
-		return 0, fmt.Errorf("missing context in handleOpenImage for %s", cookie)
+	var imageData []byte
+	var imageSize int64
+	if ctx, _ := s.mountCtxMap.Get(cookie); ctx != nil {
+		mountCtx, _ := fromMountCtx(ctx)
+		if mountCtx == nil {
+			return 0, fmt.Errorf("missing context in handleOpenImage for %s", cookie)
+		}
+		imageData, imageSize = mountCtx.imageData, mountCtx.imageSize
+	} else {
+		// no mount in progress: this is a reopen after a restore, so the image should be
+		// written already.
+		var img pb.DbImage
+		err := s.db.View(func(tx *bbolt.Tx) error {
+			if v := tx.Bucket(imageBucket).Get([]byte(cookie)); v != nil {
+				return proto.Unmarshal(v, &img)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		} else if img.ImageSize == 0 {
+			return 0, fmt.Errorf("missing context in handleOpenImage for %s", cookie)
+		}
+		imageSize = img.ImageSize
 	}
 
 	s.stateLock.Lock()
@@ -1025,10 +1154,10 @@ func (s *Server) handleOpenImage(msgId, objectId, fd, flags uint32, cookie strin
 	state := &openFileState{
 		writeFd:   fd,
 		tp:        typeImage,
-		imageData: mountCtx.imageData,
+		imageData: imageData,
 	}
 	s.cacheState[objectId] = state
-	return mountCtx.imageSize, nil
+	return imageSize, nil
 }
 
 func (s *Server) handleClose(msgId, objectId uint32) error {
@@ -1040,6 +1169,14 @@ func (s *Server) handleClose(msgId, objectId uint32) error {
 		log.Println("missing state for close")
 		return nil
 	}
+	if state.tp == typeSlab && s.stateBySlab[state.slabId] != state {
+		// the slab was opened again before we got this close (e.g. the remount in
+		// mountSlabImage). the new object owns the read fds and slab image mount.
+		delete(s.cacheState, objectId)
+		s.stateLock.Unlock()
+		_ = unix.Close(int(state.writeFd))
+		return nil
+	}
 	if state.tp == typeSlab {
 		delete(s.stateBySlab, state.slabId)
 	}
@@ -1069,7 +1206,7 @@ func (s *Server) closeState(state *openFileState, slabFds slabFds) {
 	}
 	if state.tp == typeSlab {
 		mp := filepath.Join(s.cfg.CachePath, slabImagePrefix+strconv.Itoa(int(state.slabId)))
-		_ = unix.Unmount(mp, 0)
+		_ = s.cfg.Kernel.Unmount(mp)
 	}
 }
 
@@ -1079,13 +1216,17 @@ func (s *Server) handleRead(msgId, objectId uint32, ln, off uint64) (retErr erro
 	s.stateLock.Unlock()
 
 	if state == nil {
-		panic("missing state")
+		// we can't complete this without an fd. after a restore, the kernel will resend it
+		// for the reopened object.
+		return fmt.Errorf("read for unknown object %d", objectId)
 	}
 
+	ir := s.startInflight(msgId, objectId, state, ln, off)
+	defer s.endInflight(msgId)
+
 	defer func() {
-		_, _, e1 := unix.Syscall(unix.SYS_IOCTL, uintptr(state.writeFd), CACHEFILES_IOC_READ_COMPLETE, uintptr(msgId))
-		if e1 != 0 && retErr == nil {
-			retErr = fmt.Errorf("ioctl error %d", e1)
+		if err := s.cfg.Kernel.ReadComplete(state.writeFd, msgId); err != nil && retErr == nil {
+			retErr = err
 		}
 	}()
 
@@ -1098,7 +1239,7 @@ func (s *Server) handleRead(msgId, objectId uint32, ln, off uint64) (retErr erro
 		return s.handleReadSlabImage(state, ln, off)
 	case typeSlab:
 		// log.Printf("read slab %5d: %2dk @ %#x", objectId, ln>>10, off)
-		return s.handleReadSlab(state, ln, off)
+		return s.handleReadSlab(state, ir, ln, off)
 	default:
 		panic("bad state type")
 	}
@@ -1133,7 +1274,7 @@ func (s *Server) handleReadSlabImage(state *openFileState, ln, off uint64) error
 	return err
 }
 
-func (s *Server) handleReadSlab(state *openFileState, ln, off uint64) (retErr error) {
+func (s *Server) handleReadSlab(state *openFileState, ir *inflightRead, ln, off uint64) (retErr error) {
 	s.stats.slabReads.Add(1)
 	defer func() {
 		if retErr != nil {
@@ -1183,30 +1324,51 @@ func (s *Server) handleReadSlab(state *openFileState, ln, off uint64) (retErr er
 		return err
 	}
 
+	loc := erofs.SlabLoc{slabId, addr}
+	s.setInflightChunk(ir, loc, digest, sphps)
+
 	ctx := context.Background()
-	return s.requestChunk(ctx, erofs.SlabLoc{slabId, addr}, digest, sphps)
+	if s.cfg.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.ReadTimeout)
+		defer cancel()
+	}
+	ctx, span := tracing.Start(ctx, "read slab",
+		attribute.Int("slab", int(slabId)), attribute.Int64("addr", int64(addr)), attribute.Int64("len", int64(ln)))
+	defer func() { tracing.End(span, retErr) }()
+	var info chunkReqInfo
+	err = s.requestChunk(ctx, loc, digest, sphps, &info)
+	s.traceRead(ir, loc, sphps, &info, err)
+	if err == nil {
+		s.noteFetch(sphps)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.stats.slabReadTimeouts.Add(1)
+		return fmt.Errorf("read of chunk %s at %v timed out after %v", digest, loc, s.cfg.ReadTimeout)
+	}
+	return err
 }
 
 func (s *Server) mountSlabImage(slabId uint16) error {
 	fsid := slabImagePrefix + strconv.Itoa(int(slabId))
 	mountPoint := filepath.Join(s.cfg.CachePath, fsid)
 	logMsg := "opened slab image file for"
+	k := s.cfg.Kernel
 
-	if mounted, err := isErofsMount(mountPoint); err != nil || !mounted {
+	if mounted, err := k.IsMounted(mountPoint); err != nil || !mounted {
 		if err = os.MkdirAll(mountPoint, 0755); err != nil {
 			return fmt.Errorf("error mkdir on slab image mountpoint %s: %w", mountPoint, err)
 		}
-		opts := fmt.Sprintf("domain_id=%s,fsid=%s", s.cfg.CacheDomain, fsid)
-		if err = unix.Mount("none", mountPoint, "erofs", 0, opts); err != nil {
+		if err = k.Mount(s.cfg.CacheDomain, fsid, mountPoint); err != nil {
 			return fmt.Errorf("error mounting slab image %s on %s: %w", fsid, mountPoint, err)
 		}
 		// unmount and mount again to force slab to be flushed to disk.
 		// if anything else is mounted already this won't work, though it won't hurt either.
 		// in that case, we assume this happened the first time.
-		if err = unix.Unmount(mountPoint, 0); err != nil {
+		if err = k.Unmount(mountPoint); err != nil {
 			return fmt.Errorf("error unmounting slab image %s on %s: %w", fsid, mountPoint, err)
 		}
-		if err = unix.Mount("none", mountPoint, "erofs", 0, opts); err != nil {
+		if err = k.Mount(s.cfg.CacheDomain, fsid, mountPoint); err != nil {
 			return fmt.Errorf("error mounting slab image %s on %s: %w", fsid, mountPoint, err)
 		}
 		logMsg = "mounted and " + logMsg
@@ -1214,14 +1376,14 @@ func (s *Server) mountSlabImage(slabId uint16) error {
 
 	slabFd, err := s.openSlabImageFile(mountPoint)
 	if err != nil {
-		_ = unix.Unmount(mountPoint, 0)
+		_ = k.Unmount(mountPoint)
 		return fmt.Errorf("error opening slab image file %s: %w", mountPoint, err)
 	}
 
 	cacheFd, err := s.openSlabBackingFile(slabId)
 	if err != nil {
 		_ = unix.Close(slabFd)
-		_ = unix.Unmount(mountPoint, 0)
+		_ = k.Unmount(mountPoint)
 		return fmt.Errorf("error opening slab backing file %s: %w", mountPoint, err)
 	}
 
@@ -1235,7 +1397,7 @@ func (s *Server) mountSlabImage(slabId uint16) error {
 
 func (s *Server) openSlabImageFile(mountPoint string) (int, error) {
 	slabFile := filepath.Join(mountPoint, "slab")
-	slabFd, err := unix.Open(slabFile, unix.O_RDONLY, 0)
+	slabFd, err := s.cfg.Kernel.OpenFile(slabFile)
 	if err != nil {
 		return 0, err
 	}
@@ -1277,6 +1439,29 @@ func addrFromKey(b []byte) uint32 {
 	return binary.BigEndian.Uint32(b)
 }
 
+// forEachChunk calls f for each chunk in slab bucket sb, in address order, with its size in
+// blocks and whether it's present.
+func forEachChunk(sb *bbolt.Bucket, f func(addr, blocks uint32, present bool)) {
+	// present keys sort after all chunk keys, so walk them with a second cursor
+	cur, pcur := sb.Cursor(), sb.Cursor()
+	pk, _ := pcur.Seek(addrKey(presentMask))
+	for k, _ := cur.First(); k != nil && k[0]&0x80 == 0; {
+		nextK, _ := cur.Next()
+		addr := addrFromKey(k)
+		var nextAddr uint32
+		if nextK != nil && nextK[0]&0x80 == 0 {
+			nextAddr = addrFromKey(nextK)
+		} else {
+			nextAddr = common.TruncU32(sb.Sequence())
+		}
+		for pk != nil && addrFromKey(pk)&^presentMask < addr {
+			pk, _ = pcur.Next()
+		}
+		f(addr, nextAddr-addr, pk != nil && addrFromKey(pk)&^presentMask == addr)
+		k = nextK
+	}
+}
+
 func locValue(id uint16, addr uint32, sph Sph) []byte {
 	loc := make([]byte, 6+sphPrefixBytes)
 	binary.LittleEndian.PutUint16(loc, id)
@@ -53,7 +53,7 @@ func (s *Server) handleDebugReq(ctx context.Context, r *DebugReq) (*DebugResp, e
 					digests := cdig.FromSliceAlias(ent.Digests)
 					tchunks += len(digests)
 					for i := range digests {
-						chunkSize := common.ChunkShift.FileChunkSize(ent.Size, i == len(digests)-1)
+						chunkSize := common.EntryChunkSize(ent, i, i == len(digests)-1)
 						blocks := s.blockShift.Blocks(chunkSize)
 						tblocks += int(blocks)
 						if _, present := s.digestPresent(tx, digests[i]); present {
@@ -97,34 +97,19 @@ func (s *Server) handleDebugReq(ctx context.Context, r *DebugReq) (*DebugResp, e
 			slabroot := tx.Bucket(slabBucket)
 			cur := slabroot.Cursor()
 			for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
-				blockSizes := make(map[uint32]uint32)
-				sb := slabroot.Bucket(k)
 				si := DebugSlabInfo{
 					Index:         binary.BigEndian.Uint16(k),
 					ChunkSizeDist: make(map[uint32]int),
 				}
-				scur := sb.Cursor()
-				for sk, _ := scur.First(); sk != nil; {
-					nextSk, _ := scur.Next()
-					addr := addrFromKey(sk)
-					if addr&presentMask == 0 {
-						var nextAddr uint32
-						if nextSk != nil && nextSk[0]&0x80 == 0 {
-							nextAddr = addrFromKey(nextSk)
-						} else {
-							nextAddr = common.TruncU32(sb.Sequence())
-						}
-						blockSize := uint32(nextAddr - addr)
-						blockSizes[addr] = blockSize
-						si.Stats.TotalChunks++
-						si.Stats.TotalBlocks += int(blockSize)
-						si.ChunkSizeDist[blockSize]++
-					} else {
+				forEachChunk(slabroot.Bucket(k), func(addr, blocks uint32, present bool) {
+					si.Stats.TotalChunks++
+					si.Stats.TotalBlocks += int(blocks)
+					si.ChunkSizeDist[blocks]++
+					if present {
 						si.Stats.PresentChunks++
-						si.Stats.PresentBlocks += int(blockSizes[addr&^presentMask])
+						si.Stats.PresentBlocks += int(blocks)
 					}
-					sk = nextSk
-				}
+				})
 				res.Slabs = append(res.Slabs, &si)
 			}
 		}
@@ -1,8 +1,11 @@
 package daemon
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,11 +19,13 @@ import (
 
 	"github.com/DataDog/zstd"
 	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/common/tracing"
 	"github.com/dnr/styx/erofs"
 	"github.com/dnr/styx/manifester"
 	"github.com/dnr/styx/pb"
@@ -29,8 +34,12 @@ import (
 const (
 	recentReadExpiry = 30 * time.Second
 
+	// after this many misses with no hits, stop looking for precomputed diffs for a while
+	precomputedMissLimit = 20
+	precomputedRetry     = time.Hour
+
 	// only public so they can be referenced by tests
-	InitOpSize = 8
+	InitOpSize = 8   // must match manifester.PrecomputeOpSize
 	MaxOpSize  = 128 // must be ≤ manifester.ChunkDiffMaxDigests
 	MaxDiffOps = 8
 	MaxSources = 3
@@ -44,20 +53,29 @@ type (
 	}
 
 	reqOp interface {
-		wait() error
+		ctl() *opCtl
 	}
 
-	singleOp struct {
+	// common to single and diff ops
+	opCtl struct {
 		err  error         // result. only written by start, read by wait
 		done chan struct{} // closed by start after writing err
 
+		// ops get their own context so they can outlive the read that started them. they're
+		// canceled when the last waiter gives up.
+		cancel  context.CancelFunc
+		waiters int // under diffLock
+	}
+
+	singleOp struct {
+		opCtl
+
 		loc    erofs.SlabLoc
 		digest cdig.CDig
 	}
 
 	diffOp struct {
-		err  error         // result. only written by start, read by wait
-		done chan struct{} // closed by start after writing err
+		opCtl
 
 		baseDigests, reqDigests     []cdig.CDig
 		baseInfo, reqInfo           []info
@@ -82,6 +100,15 @@ type (
 		maxOpSize   int
 		maxOps      int
 		sourcesLeft int
+		plan        *opPlan // if set, only plan ops, don't touch diffMap
+	}
+
+	// opPlan lets an opSet plan ops without starting them, e.g. for estimates. it can have
+	// images that aren't stored locally, and chunks that planned ops would fetch count as
+	// present.
+	opPlan struct {
+		images  map[Sph][]*pb.Entry
+		fetched map[cdig.CDig]struct{}
 	}
 
 	info struct {
@@ -93,9 +120,25 @@ type (
 		when  time.Time
 		reads int
 	}
+
+	// what requestChunk did, for tracing
+	chunkReqInfo struct {
+		op     string // "single", "diff", or "batch"
+		joined bool   // waited on an op that was already running
+	}
 )
 
-func (s *Server) requestChunk(ctx context.Context, loc erofs.SlabLoc, digest cdig.CDig, sphps []SphPrefix) error {
+// info is optional
+func (s *Server) requestChunk(
+	ctx context.Context,
+	loc erofs.SlabLoc,
+	digest cdig.CDig,
+	sphps []SphPrefix,
+	info *chunkReqInfo,
+) (retErr error) {
+	ctx, span := tracing.Start(ctx, "request chunk", attribute.String("digest", digest.String()))
+	defer func() { tracing.End(span, retErr) }()
+
 	if _, ok := s.readKnownMap.Get(loc); ok {
 		// We think we have this chunk and are trying to use it as a base, but we got asked for
 		// it again. This shouldn't happen, but at least try to recover by doing a single read
@@ -105,10 +148,14 @@ func (s *Server) requestChunk(ctx context.Context, loc erofs.SlabLoc, digest cdi
 	}
 
 	var op reqOp
+	joined := false
 
 	s.diffLock.Lock()
 	if op = s.diffMap[loc]; op != nil {
 		// being request already, wait on this one
+		joined = true
+	} else if s.p().noDiff {
+		// single read below
 	} else if len(sphps) == 0 {
 		log.Print("missing sph references")
 	} else {
@@ -125,7 +172,7 @@ func (s *Server) requestChunk(ctx context.Context, loc erofs.SlabLoc, digest cdi
 
 			// note that op is left as diffMap[loc] to wait on
 			for _, startOp := range set.ops {
-				go s.startDiffOp(ctx, startOp)
+				go s.startDiffOp(startOp.start(ctx), startOp)
 			}
 			if extra := len(set.ops) - 1; extra > 0 {
 				s.stats.extraReqs.Add(int64(extra))
@@ -134,19 +181,24 @@ func (s *Server) requestChunk(ctx context.Context, loc erofs.SlabLoc, digest cdi
 	}
 	if op == nil {
 		sop := s.buildSingleOp(loc, digest)
-		go s.startSingleOp(ctx, sop)
+		go s.startSingleOp(sop.start(ctx), sop)
 		op = sop
 	}
+	op.ctl().waiters++
+	span.SetAttributes(attribute.String("op", opKind(op)), attribute.Bool("joined", joined))
+	if info != nil {
+		info.op, info.joined = opKind(op), joined
+	}
 	s.diffLock.Unlock()
 
 	// TODO: consider racing the diff against a single chunk read (with small delay)
 	// return when either is done
 
-	err := op.wait()
-	if err != nil {
+	err := s.waitOp(ctx, op)
+	if err != nil && ctx.Err() == nil {
 		if _, ok := op.(*singleOp); !ok {
 			log.Printf("diff failed (%v), doing plain read", err)
-			return s.requestChunk(ctx, loc, digest, nil)
+			return s.requestChunk(ctx, loc, digest, nil, info)
 		}
 	}
 
@@ -158,17 +210,14 @@ func (s *Server) requestPrefetch(ctx context.Context, reqs []cdig.CDig) error {
 	if err != nil {
 		return err
 	}
+	var firstErr error
 	for _, op := range ops {
-		if err := op.wait(); err != nil {
+		if err := s.waitOp(ctx, op); err != nil {
 			log.Printf("prefetch request failed (%v)", err)
+			firstErr = cmp.Or(firstErr, err)
 		}
 	}
-	for _, op := range ops {
-		if err := op.wait(); err != nil {
-			return err
-		}
-	}
-	return nil
+	return firstErr
 }
 
 func (s *Server) buildAndStartPrefetch(ctx context.Context, reqs []cdig.CDig) ([]reqOp, error) {
@@ -196,10 +245,18 @@ func (s *Server) buildAndStartPrefetch(ctx context.Context, reqs []cdig.CDig) ([
 			if _, ok := have[op]; !ok {
 				have[op] = struct{}{}
 				allOps = append(allOps, op)
+				op.ctl().waiters++
 			}
 			continue
 		} else if s.locPresent(tx, l) {
 			continue
+		} else if s.p().noDiff {
+			op := s.buildSingleOp(l, req)
+			go s.startSingleOp(op.start(ctx), op)
+			have[op] = struct{}{}
+			allOps = append(allOps, op)
+			op.ctl().waiters++
+			continue
 		}
 		// build new requests
 		sphps := splitSphs(loc[6:])
@@ -216,9 +273,10 @@ func (s *Server) buildAndStartPrefetch(ctx context.Context, reqs []cdig.CDig) ([
 		} else {
 			have[op] = struct{}{}
 			allOps = append(allOps, op)
+			op.ctl().waiters++
 		}
 		for _, startOp := range set.ops {
-			go s.startDiffOp(ctx, startOp)
+			go s.startDiffOp(startOp.start(ctx), startOp)
 		}
 		if extra := len(set.ops) - 1; extra > 0 {
 			s.stats.extraReqs.Add(int64(extra))
@@ -264,7 +322,7 @@ func (s *Server) readChunks(
 		}
 
 		// request first missing one. the differ will do some readahead.
-		err := s.requestChunk(ctx, locs[firstMissing], digests[firstMissing], sphps)
+		err := s.requestChunk(ctx, locs[firstMissing], digests[firstMissing], sphps, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -289,7 +347,13 @@ func (s *Server) readSingle(ctx context.Context, loc erofs.SlabLoc, digest cdig.
 	buf := s.chunkPool.Get(int(common.ChunkShift.Size()))
 	defer s.chunkPool.Put(buf)
 
-	chunk, err := s.p().csread.Get(ctx, digest.String(), buf[:0])
+	var chunk []byte
+	var err error
+	if pl, ok := s.getPackLoc(digest); ok {
+		chunk, err = s.p().psread.GetChunk(ctx, pl.Pack, pl.Offset, pl.Length, buf[:0])
+	} else {
+		chunk, err = s.p().csread.Get(ctx, digest.String(), buf[:0])
+	}
 	if err != nil {
 		return fmt.Errorf("chunk read error: %w", err)
 	} else if len(chunk) > len(buf) || &buf[0] != &chunk[0] {
@@ -303,13 +367,129 @@ func (s *Server) readSingle(ctx context.Context, loc erofs.SlabLoc, digest cdig.
 	return nil
 }
 
+func (s *Server) getPackLoc(digest cdig.CDig) (pl manifester.PackChunkLoc, ok bool) {
+	_ = s.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(packLocBucket).Get(digest[:]); len(v) > 12 {
+			pl.Length = binary.LittleEndian.Uint32(v)
+			pl.Offset = int64(binary.LittleEndian.Uint64(v[4:]))
+			pl.Pack = string(v[12:])
+			ok = true
+		}
+		return nil
+	})
+	return
+}
+
+// records pack locations of chunks that we don't have yet. entries are removed when the chunk
+// becomes present (see gotNewChunk and prunePackLocs).
+func (s *Server) putPackLocs(tx *bbolt.Tx, pls map[cdig.CDig]manifester.PackChunkLoc) error {
+	plb, cb := tx.Bucket(packLocBucket), tx.Bucket(chunkBucket)
+	for dig, pl := range pls {
+		if v := cb.Get(dig[:]); v != nil && s.locPresent(tx, loadLoc(v)) {
+			continue
+		}
+		v := binary.LittleEndian.AppendUint32(nil, pl.Length)
+		v = binary.LittleEndian.AppendUint64(v, uint64(pl.Offset))
+		v = append(v, pl.Pack...)
+		if err := plb.Put(dig[:], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removes pack locations of chunks that are present or that we don't know about anymore.
+func (s *Server) prunePackLocs() error {
+	var pruned int
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		plb, cb := tx.Bucket(packLocBucket), tx.Bucket(chunkBucket)
+		var stale [][]byte
+		cur := plb.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			if v := cb.Get(k); v == nil || s.locPresent(tx, loadLoc(v)) {
+				stale = append(stale, k)
+			}
+		}
+		for _, k := range stale {
+			if err := plb.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(stale)
+		return nil
+	})
+	if pruned > 0 {
+		log.Printf("pruned %d pack locations", pruned)
+	}
+	return err
+}
+
+// op control
+
+func (c *opCtl) ctl() *opCtl { return c }
+
+// start sets up the op's context. call under diffLock before starting the op.
+func (c *opCtl) start(ctx context.Context) context.Context {
+	ctx, c.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	return ctx
+}
+
+// waitOp waits for an op that the caller added itself to the waiters of. if ctx is done first
+// and there are no other waiters, the op is canceled and removed from diffMap so that a later
+// read starts a new one.
+func (s *Server) waitOp(ctx context.Context, op reqOp) error {
+	c := op.ctl()
+	select {
+	case <-c.done:
+		s.diffLock.Lock()
+		c.waiters--
+		s.diffLock.Unlock()
+		return c.err
+	case <-ctx.Done():
+	}
+
+	s.diffLock.Lock()
+	defer s.diffLock.Unlock()
+	if c.waiters--; c.waiters > 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-c.done:
+		// finished anyway
+	default:
+		for loc, o := range s.diffMap {
+			if o == op {
+				delete(s.diffMap, loc)
+			}
+		}
+		c.cancel()
+		s.stats.canceledOps.Add(1)
+	}
+	return ctx.Err()
+}
+
+// call under diffLock
+func opKind(op reqOp) string {
+	switch op := op.(type) {
+	case *singleOp:
+		return "single"
+	case *diffOp:
+		if op.hasBase() {
+			return "diff"
+		}
+		return "batch"
+	default:
+		return "unknown"
+	}
+}
+
 // call with diffLock held
 func (s *Server) buildSingleOp(
 	loc erofs.SlabLoc,
 	targetDigest cdig.CDig,
 ) *singleOp {
 	op := &singleOp{
-		done:   make(chan struct{}),
+		opCtl:  opCtl{done: make(chan struct{})},
 		loc:    loc,
 		digest: targetDigest,
 	}
@@ -336,9 +516,12 @@ func (s *Server) startSingleOp(ctx context.Context, op *singleOp) {
 
 		// wake up waiters
 		close(op.done)
+		op.cancel()
 	}()
 
 	s.stats.singleReqs.Add(1)
+	ctx, span := tracing.Start(ctx, "single op")
+	defer func() { tracing.End(span, op.err) }()
 	if op.err = s.diffSem.Acquire(ctx, 1); op.err == nil {
 		defer s.diffSem.Release(1)
 		op.err = s.readSingle(ctx, op.loc, op.digest)
@@ -376,6 +559,7 @@ func (s *Server) startDiffOp(ctx context.Context, op *diffOp) {
 
 		// wake up waiters
 		close(op.done)
+		op.cancel()
 	}()
 
 	if !op.hasBase() {
@@ -383,6 +567,11 @@ func (s *Server) startDiffOp(ctx context.Context, op *diffOp) {
 	} else {
 		s.stats.diffReqs.Add(1)
 	}
+	ctx, span := tracing.Start(ctx, "diff op",
+		attribute.Int("bases", len(op.baseDigests)),
+		attribute.Int("reqs", len(op.reqDigests)),
+		attribute.StringSlice("recompress", op.recompress))
+	defer func() { tracing.End(span, op.err) }()
 	if op.err = s.diffSem.Acquire(ctx, 1); op.err == nil {
 		defer s.diffSem.Release(1)
 		op.err = s.doDiffOp(ctx, op)
@@ -390,14 +579,9 @@ func (s *Server) startDiffOp(ctx context.Context, op *diffOp) {
 }
 
 func (s *Server) doDiffOp(ctx context.Context, op *diffOp) error {
-	diff, err := s.getChunkDiff(ctx, op.baseDigests, op.reqDigests, op.recompress)
-	if err != nil {
-		return fmt.Errorf("getChunkDiff error: %w", err)
-	}
-	defer diff.Close()
-
 	var p int64
 	var baseData []byte
+	var err error
 
 	if op.hasBase() {
 		baseData = make([]byte, op.baseTotalSize)
@@ -415,30 +599,45 @@ func (s *Server) doDiffOp(ctx context.Context, op *diffOp) error {
 		}
 	}
 
-	// decompress from diff
-	diffCounter := countReader{r: diff}
-	reqData, err := io.ReadAll(zstd.NewReaderPatcher(&diffCounter, baseData))
-	if err != nil {
-		return fmt.Errorf("expandChunkDiff error: %w", err)
+	var reqData []byte
+	var st *manifester.ChunkDiffStats
+	var diffBytes int64
+	got := false
+	if op.mayBePrecomputed() && s.tryPrecomputed() {
+		reqData, st, diffBytes, err = s.getPrecomputedDiff(ctx, op, baseData)
+		got = err == nil
+	}
+	if !got && !s.noChunkDiffV2.Load() {
+		reqData, st, diffBytes, err = s.getChunkDiffV2(ctx, op, baseData)
+		if status, ok := err.(common.HttpError); ok && status == http.StatusNotFound {
+			log.Printf("chunk differ does not support v2 protocol, falling back")
+			s.noChunkDiffV2.Store(true)
+		} else if err != nil {
+			return err
+		} else {
+			got = true
+		}
+	}
+	if !got {
+		reqData, st, diffBytes, err = s.getChunkDiffV1(ctx, op, baseData)
+		if err != nil {
+			return err
+		}
 	}
 	if !op.hasBase() {
-		s.stats.batchBytes.Add(diffCounter.c)
+		s.stats.batchBytes.Add(diffBytes)
 	} else {
-		s.stats.diffBytes.Add(diffCounter.c)
+		s.stats.diffBytes.Add(diffBytes)
+	}
+	if st != nil {
+		s.stats.countDeltaAlgo(st.DeltaAlgo)
+		if st.Cached {
+			s.stats.diffCacheHits.Add(1)
+		}
 	}
 
-	var statsBytes []byte
 	if len(op.recompress) > 0 {
-		// reqData contains the concatenation of _un_compressed data plus stats.
-		// we need to recompress the data but not the stats, so strip off the stats.
-		// note: this only works since stats are only ints. if we have nested objects or
-		// strings we'll need a more complicated parser.
-		statsStart := bytes.LastIndexByte(reqData, '{')
-		if statsStart < 0 {
-			return fmt.Errorf("diff data has bad stats")
-		}
-		statsBytes = reqData[statsStart:]
-		reqData, err = doDiffRecompress(ctx, reqData[:statsStart], op.recompress)
+		reqData, err = doDiffRecompress(ctx, reqData, op.recompress)
 		if err != nil {
 			return fmt.Errorf("recompress error: %w", err)
 		}
@@ -464,27 +663,205 @@ func (s *Server) doDiffOp(ctx context.Context, op *diffOp) error {
 		p += int64(i.size)
 	}
 
-	// rest is json stats
-	var st manifester.ChunkDiffStats
-	if statsBytes == nil {
-		// if we didn't recompress, stats follow immediately after data.
-		statsBytes = reqData[p:]
-	}
-	if err = json.Unmarshal(statsBytes, &st); err == nil {
-		if st.BaseChunks > 0 {
-			log.Printf("diff [%d:%d <~ %d:%d] = %d (%.1f%%)",
-				st.ReqChunks, st.ReqBytes, st.BaseChunks, st.BaseBytes,
-				st.DiffBytes, 100*float64(st.DiffBytes)/float64(st.ReqBytes))
-		} else {
-			log.Printf("batch [%d:%d] = %d (%.1f%%)",
-				st.ReqChunks, st.ReqBytes,
-				st.DiffBytes, 100*float64(st.DiffBytes)/float64(st.ReqBytes))
+	if st == nil {
+		// already logged
+	} else if st.BaseChunks > 0 {
+		log.Printf("diff [%d:%d <~ %d:%d] = %d (%.1f%%) %s",
+			st.ReqChunks, st.ReqBytes, st.BaseChunks, st.BaseBytes,
+			st.DiffBytes, 100*float64(st.DiffBytes)/float64(st.ReqBytes), st.DeltaAlgo)
+	} else {
+		log.Printf("batch [%d:%d] = %d (%.1f%%)",
+			st.ReqChunks, st.ReqBytes,
+			st.DiffBytes, 100*float64(st.DiffBytes)/float64(st.ReqBytes))
+	}
+
+	return nil
+}
+
+// Returns (un-recompressed) data, stats if available, and compressed size.
+func (s *Server) getChunkDiffV1(
+	ctx context.Context, op *diffOp, baseData []byte,
+) ([]byte, *manifester.ChunkDiffStats, int64, error) {
+	diff, algo, err := s.getChunkDiff(ctx, op.baseDigests, op.reqDigests, op.recompress)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("getChunkDiff error: %w", err)
+	}
+	defer diff.Close()
+
+	var reqData, statsBytes []byte
+	var diffBytes int64
+	if algo == "" {
+		// old server: zstd stream with stats included at the end
+		algo = manifester.DeltaZstd
+		diffCounter := countReader{r: diff}
+		reqData, err = io.ReadAll(zstd.NewReaderPatcher(&diffCounter, baseData))
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("expandChunkDiff error: %w", err)
+		}
+		diffBytes = diffCounter.c
+
+		if len(op.recompress) > 0 {
+			// reqData contains the concatenation of _un_compressed data plus stats.
+			// we need to recompress the data but not the stats, so strip off the stats.
+			// note: this only works since stats are only ints. if we have nested objects or
+			// strings we'll need a more complicated parser.
+			statsStart := bytes.LastIndexByte(reqData, '{')
+			if statsStart < 0 {
+				return nil, nil, 0, fmt.Errorf("diff data has bad stats")
+			}
+			reqData, statsBytes = reqData[:statsStart], reqData[statsStart:]
+		} else if len(reqData) > int(op.reqTotalSize) {
+			// if we didn't recompress, stats follow immediately after data.
+			reqData, statsBytes = reqData[:op.reqTotalSize], reqData[op.reqTotalSize:]
 		}
 	} else {
+		body, err := io.ReadAll(diff)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("read chunk diff error: %w", err)
+		}
+		diffBytes = int64(len(body))
+		deltaLen, n := binary.Uvarint(body)
+		if n <= 0 || deltaLen > uint64(len(body)-n) {
+			return nil, nil, 0, fmt.Errorf("chunk diff has bad delta length")
+		}
+		delta := body[n : n+int(deltaLen)]
+		statsBytes = body[n+int(deltaLen):]
+		reqData, err = manifester.DeltaDecode(algo, baseData, delta)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("expandChunkDiff error (%s): %w", algo, err)
+		}
+	}
+
+	var st manifester.ChunkDiffStats
+	if err = json.Unmarshal(statsBytes, &st); err != nil {
 		log.Println("diff data has bad stats", err)
+		return reqData, nil, diffBytes, nil
 	}
+	st.DeltaAlgo = algo
+	return reqData, &st, diffBytes, nil
+}
 
-	return nil
+// Returns (un-recompressed) data, stats, and compressed size.
+// Returns common.HttpError(404) if the server doesn't support v2.
+func (s *Server) getChunkDiffV2(
+	ctx context.Context, op *diffOp, baseData []byte,
+) (_ []byte, _ *manifester.ChunkDiffStats, _ int64, retErr error) {
+	ctx, span := tracing.Start(ctx, "chunk diff")
+	defer func() { tracing.End(span, retErr) }()
+
+	r := &pb.ChunkDiffReq{
+		Version:    manifester.ChunkDiffVersion,
+		DeltaAlgos: manifester.DeltaAlgos(),
+		Op: []*pb.ChunkDiffOp{{
+			Bases: cdig.ToSliceAlias(op.baseDigests),
+			Reqs:  cdig.ToSliceAlias(op.reqDigests),
+		}},
+	}
+	if len(op.recompress) > 0 {
+		r.Op[0].ExpandBeforeDiff = op.recompress[0]
+	}
+	reqBytes, err := proto.Marshal(r)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	u := strings.TrimSuffix(s.p().params.ChunkDiffUrl, "/") + manifester.ChunkDiffV2Path
+	res, err := retryHttpRequest(ctx, http.MethodPost, u, "application/x-protobuf", reqBytes)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer res.Body.Close()
+
+	// we only send one op so all frames are for op 0
+	br := bufio.NewReader(res.Body)
+	var delta []byte
+	var algo string
+	var diffBytes int64
+	var stats *pb.ChunkDiffStats
+	for stats == nil {
+		f, n, err := manifester.ReadChunkDiffFrame(br)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("read chunk diff frame error: %w", err)
+		} else if f.Error != "" {
+			return nil, nil, 0, fmt.Errorf("chunk diff error: %s", f.Error)
+		} else if f.Op != 0 {
+			return nil, nil, 0, fmt.Errorf("chunk diff frame for unexpected op %d", f.Op)
+		}
+		diffBytes += int64(n)
+		algo = cmp.Or(f.DeltaAlgo, algo)
+		delta = append(delta, f.Data...)
+		stats = f.Stats
+	}
+	span.SetAttributes(attribute.String("algo", algo), attribute.Int64("diff_bytes", diffBytes), attribute.Bool("cached", stats.Cached))
+
+	_, dspan := tracing.Start(ctx, "apply delta")
+	reqData, err := manifester.DeltaDecode(algo, baseData, delta)
+	tracing.End(dspan, err)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("expandChunkDiff error (%s): %w", algo, err)
+	}
+	return reqData, &manifester.ChunkDiffStats{
+		BaseChunks: int(stats.BaseChunks),
+		BaseBytes:  int(stats.BaseBytes),
+		ReqChunks:  int(stats.ReqChunks),
+		ReqBytes:   int(stats.ReqBytes),
+		DiffBytes:  int(stats.DiffBytes),
+		DlTotalMs:  stats.DlTotalMs,
+		ZstdMs:     stats.EncodeMs,
+		DeltaAlgo:  algo,
+		Cached:     stats.Cached,
+	}, diffBytes, nil
+}
+
+// Returns (un-recompressed) data, stats, and compressed size, if this diff was precomputed.
+func (s *Server) getPrecomputedDiff(
+	ctx context.Context, op *diffOp, baseData []byte,
+) ([]byte, *manifester.ChunkDiffStats, int64, error) {
+	bases, reqs := cdig.ToSliceAlias(op.baseDigests), cdig.ToSliceAlias(op.reqDigests)
+	var expand string
+	if len(op.recompress) > 0 {
+		expand = op.recompress[0]
+	}
+	key := manifester.PrecomputedDiffKey(bases, reqs, expand)
+	b, err := s.p().pdread.Get(ctx, key, nil)
+	if err != nil {
+		s.notePrecomputedMiss()
+		return nil, nil, 0, err
+	}
+	s.precomputedHits.Add(1)
+	var ent pb.ChunkDiffCacheEntry
+	if err = proto.Unmarshal(b, &ent); err != nil {
+		return nil, nil, 0, err
+	}
+	reqData, err := manifester.DeltaDecode(ent.DeltaAlgo, baseData, ent.Delta)
+	if err != nil {
+		log.Printf("precomputed diff %s error (%s): %v", key, ent.DeltaAlgo, err)
+		return nil, nil, 0, err
+	}
+	return reqData, &manifester.ChunkDiffStats{
+		BaseChunks: len(op.baseDigests),
+		BaseBytes:  len(baseData),
+		ReqChunks:  len(op.reqDigests),
+		ReqBytes:   len(reqData),
+		DiffBytes:  len(ent.Delta),
+		DeltaAlgo:  ent.DeltaAlgo,
+		Cached:     true,
+	}, int64(len(ent.Delta)), nil
+}
+
+// tryPrecomputed returns false if we should skip looking for precomputed diffs because the
+// server doesn't seem to have any. once we've seen one, we always look.
+func (s *Server) tryPrecomputed() bool {
+	if s.precomputedHits.Load() > 0 {
+		return true
+	}
+	return time.Now().UnixNano() >= s.precomputedSkipUntil.Load()
+}
+
+func (s *Server) notePrecomputedMiss() {
+	if s.precomputedHits.Load() == 0 && s.precomputedMisses.Add(1)%precomputedMissLimit == 0 {
+		log.Printf("no precomputed diffs found in %d tries, not looking for %v", precomputedMissLimit, precomputedRetry)
+		s.precomputedSkipUntil.Store(time.Now().Add(precomputedRetry).UnixNano())
+	}
 }
 
 func (s *Server) getWriteFdForSlab(slabId uint16) (int, error) {
@@ -492,13 +869,17 @@ func (s *Server) getWriteFdForSlab(slabId uint16) (int, error) {
 	defer s.stateLock.Unlock()
 	if state := s.stateBySlab[slabId]; state != nil {
 		return int(state.writeFd), nil
+	} else if fds := s.readfdBySlab[slabId]; fds.cacheFd > 0 {
+		// after a restore, the slab isn't opened again until the kernel needs a read from it.
+		// writing the backing file directly is the same as writing through the object.
+		return fds.cacheFd, nil
 	}
 	return 0, errors.New("slab not loaded or missing write fd")
 }
 
 // gotNewChunk may reslice b up to block size and zero up to the new size!
 func (s *Server) gotNewChunk(loc erofs.SlabLoc, digest cdig.CDig, b []byte) error {
-	if err := digest.Check(b); err != nil {
+	if err := digest.Check(s.digestAlgo(), b); err != nil {
 		return err
 	}
 
@@ -541,8 +922,11 @@ func (s *Server) gotNewChunk(loc erofs.SlabLoc, digest cdig.CDig, b []byte) erro
 			sb := tx.Bucket(slabBucket).Bucket(slabKey(loc.SlabId))
 			if sb == nil {
 				return errors.New("missing slab bucket")
+			} else if err := sb.Put(addrKey(presentMask|loc.Addr), []byte{}); err != nil {
+				return err
 			}
-			return sb.Put(addrKey(presentMask|loc.Addr), []byte{})
+			// we won't read it remotely again
+			return tx.Bucket(packLocBucket).Delete(digest[:])
 		})
 		if err == nil {
 			s.presentMap.Del(loc)
@@ -552,21 +936,26 @@ func (s *Server) gotNewChunk(loc erofs.SlabLoc, digest cdig.CDig, b []byte) erro
 	return nil
 }
 
-func (s *Server) getChunkDiff(ctx context.Context, bases, reqs []cdig.CDig, recompress []string) (io.ReadCloser, error) {
-	r := manifester.ChunkDiffReq{Bases: cdig.ToSliceAlias(bases), Reqs: cdig.ToSliceAlias(reqs)}
+// returns the delta algo used, or "" if the server used the old format
+func (s *Server) getChunkDiff(ctx context.Context, bases, reqs []cdig.CDig, recompress []string) (io.ReadCloser, string, error) {
+	r := manifester.ChunkDiffReq{
+		Bases:      cdig.ToSliceAlias(bases),
+		Reqs:       cdig.ToSliceAlias(reqs),
+		DeltaAlgos: manifester.DeltaAlgos(),
+	}
 	if len(recompress) > 0 {
 		r.ExpandBeforeDiff = recompress[0]
 	}
 	reqBytes, err := json.Marshal(r)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	u := strings.TrimSuffix(s.p().params.ChunkDiffUrl, "/") + manifester.ChunkDiffPath
 	res, err := retryHttpRequest(ctx, http.MethodPost, u, "application/json", reqBytes)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return res.Body, nil
+	return res.Body, res.Header.Get(manifester.ChunkDiffAlgoHeader), nil
 }
 
 // note: called with read-only tx
@@ -711,18 +1100,8 @@ func (s *Server) pruneRecentReads() {
 
 // single op
 
-func (op *singleOp) wait() error {
-	<-op.done
-	return op.err
-}
-
 // diff op
 
-func (op *diffOp) wait() error {
-	<-op.done
-	return op.err
-}
-
 func (op *diffOp) hasBase() bool {
 	return len(op.baseInfo) > 0
 }
@@ -731,6 +1110,13 @@ func (op *diffOp) hasReq() bool {
 	return len(op.reqInfo) > 0
 }
 
+// whole-file recompress diffs and diffs the size of a first read may have been precomputed
+// (see manifester/precompute.go)
+func (op *diffOp) mayBePrecomputed() bool {
+	return op.hasBase() && (len(op.recompress) > 0 ||
+		len(op.reqInfo) <= manifester.PrecomputeOpSize && len(op.baseInfo) <= manifester.PrecomputeOpSize)
+}
+
 func (op *diffOp) resetDiff() {
 	op.baseDigests = nil
 	op.reqDigests = nil
@@ -801,8 +1187,8 @@ func (set *opSet) markUsing(dig cdig.CDig) {
 
 func (set *opSet) newOp() {
 	op := &diffOp{
-		done: make(chan struct{}),
-		rrs:  set.rrs,
+		opCtl: opCtl{done: make(chan struct{})},
+		rrs:   set.rrs,
 	}
 	set.ops = append(set.ops, op)
 	set.op = op
@@ -881,14 +1267,14 @@ func (set *opSet) buildExtendDiff(
 
 	var baseIter digestIterator
 	if res.usingBase() {
-		baseEntries, err := set.s.getDigestsFromImage(tx, res.baseHash, isManifest)
+		baseEntries, err := set.getDigests(tx, res.baseHash, isManifest)
 		if err != nil {
 			log.Println("failed to get digests for", res.baseHash, res.baseName)
 			return
 		}
 		baseIter = newDigestIterator(baseEntries)
 	}
-	reqEntries, err := set.s.getDigestsFromImage(tx, res.reqHash, isManifest)
+	reqEntries, err := set.getDigests(tx, res.reqHash, isManifest)
 	if err != nil {
 		log.Println("failed to get digests for", res.reqHash, res.reqName)
 		return
@@ -918,7 +1304,9 @@ func (set *opSet) buildExtendDiff(
 				set.log(res, args[0], true)
 				return
 			} else {
-				log.Println("skipping recompress:", err)
+				if set.plan == nil {
+					log.Println("skipping recompress:", err)
+				}
 				set.op.resetDiff()
 			}
 		}
@@ -945,12 +1333,14 @@ func (set *opSet) buildExtendDiff(
 	for {
 		reqDigest := reqIter.digest()
 		if reqDigest != cdig.Zero && !set.fullReq() && !set.isUsing(reqDigest) {
-			reqLoc, reqPresent := set.s.digestPresent(tx, reqDigest)
-			if !reqPresent && reqLoc.Addr > 0 && set.s.diffMap[reqLoc] == nil {
+			reqLoc, reqPresent := set.digestPresent(tx, reqDigest)
+			if !reqPresent && set.canRequest(reqLoc) {
 				set.markUsing(reqDigest)
 				set.checkReq()
 				set.op.addReq(reqDigest, reqIter.size(), reqLoc)
-				set.s.diffMap[reqLoc] = set.op
+				if set.plan == nil {
+					set.s.diffMap[reqLoc] = set.op
+				}
 				changed = true
 			}
 		}
@@ -958,7 +1348,7 @@ func (set *opSet) buildExtendDiff(
 		// fill base only if room in this op, don't make more ops just for base
 		baseDigest := baseIter.digest()
 		if baseDigest != cdig.Zero && len(set.op.baseInfo) < set.maxOpSize && !set.isUsing(baseDigest) {
-			baseLoc, basePresent := set.s.digestPresent(tx, baseDigest)
+			baseLoc, basePresent := set.digestPresent(tx, baseDigest)
 			if basePresent {
 				set.markUsing(baseDigest)
 				set.op.addBase(baseDigest, baseIter.size(), baseLoc)
@@ -983,10 +1373,50 @@ func (set *opSet) buildExtendDiff(
 	}
 	set.sourcesLeft--
 
-	log.Print(readLog)
+	if set.plan == nil {
+		log.Print(readLog)
+	}
 	set.log(res, "", firstOp)
 }
 
+// planDiff plans the ops that reading targetDigest from the image in res would start, like
+// buildDiff does for images in the catalog. res may have no base. set.plan must be set.
+func (set *opSet) planDiff(tx *bbolt.Tx, targetDigest cdig.CDig, res catalogResult) {
+	if res.usingBase() {
+		set.buildExtendDiff(tx, targetDigest, res, false)
+	}
+	if !set.op.hasReq() {
+		res.baseName, res.baseHash = "", Sph{}
+		set.buildExtendDiff(tx, targetDigest, res, false)
+	}
+}
+
+func (set *opSet) getDigests(tx *bbolt.Tx, sph Sph, isManifest bool) ([]*pb.Entry, error) {
+	if set.plan != nil && !isManifest {
+		if ents, ok := set.plan.images[sph]; ok {
+			return ents, nil
+		}
+	}
+	return set.s.getDigestsFromImage(tx, sph, isManifest)
+}
+
+func (set *opSet) digestPresent(tx *bbolt.Tx, digest cdig.CDig) (erofs.SlabLoc, bool) {
+	loc, present := set.s.digestPresent(tx, digest)
+	if !present && set.plan != nil {
+		_, present = set.plan.fetched[digest]
+	}
+	return loc, present
+}
+
+// returns true if a missing chunk at loc can be added to an op
+func (set *opSet) canRequest(loc erofs.SlabLoc) bool {
+	if set.plan != nil {
+		// may not be allocated yet, and nothing is in flight
+		return true
+	}
+	return loc.Addr > 0 && set.s.diffMap[loc] == nil
+}
+
 func (set *opSet) buildRecompress(
 	tx *bbolt.Tx,
 	res catalogResult,
@@ -1003,8 +1433,8 @@ func (set *opSet) buildRecompress(
 	baseEnt := baseIter.ent()
 	for baseIter.toFileStart(); baseIter.ent() == baseEnt; baseIter.next(1) {
 		baseDigest := baseIter.digest()
-		baseLoc, basePresent := set.s.digestPresent(tx, baseDigest)
-		if baseLoc.Addr == 0 {
+		baseLoc, basePresent := set.digestPresent(tx, baseDigest)
+		if baseLoc.Addr == 0 && set.plan == nil {
 			return errors.New("digest in entry of base digest is not mapped")
 		} else if !basePresent {
 			// Base is not present, don't bother with recompress (data is already compressed).
@@ -1017,7 +1447,7 @@ func (set *opSet) buildRecompress(
 	for reqIter.toFileStart(); reqIter.ent() == reqEnt; reqIter.next(1) {
 		reqDigest := reqIter.digest()
 		reqLoc := set.s.digestLoc(tx, reqDigest)
-		if reqLoc.Addr == 0 {
+		if reqLoc.Addr == 0 && set.plan == nil {
 			return errors.New("digest in entry of req digest is not mapped")
 		}
 		set.op.addReq(reqDigest, reqIter.size(), reqLoc)
@@ -1027,7 +1457,7 @@ func (set *opSet) buildRecompress(
 	// whole file so we may include chunks we already have, or are already being diffed
 	// (though that's very unlikely). In that case just leave the existing entry.
 	for _, i := range set.op.reqInfo {
-		if set.s.diffMap[i.loc] == nil {
+		if set.plan == nil && set.s.diffMap[i.loc] == nil {
 			set.s.diffMap[i.loc] = set.op
 		}
 	}
@@ -1040,6 +1470,9 @@ func (set *opSet) log(
 	recompress string,
 	firstOp bool,
 ) {
+	if set.plan != nil {
+		return
+	}
 	var sb strings.Builder
 
 	if !firstOp {
@@ -1119,7 +1552,7 @@ func (i *digestIterator) size() int32 {
 	if ent == nil {
 		return -1
 	}
-	return int32(common.ChunkShift.FileChunkSize(ent.Size, i.d+cdig.Bytes >= len(ent.Digests)))
+	return int32(common.EntryChunkSize(ent, i.d/cdig.Bytes, i.d+cdig.Bytes >= len(ent.Digests)))
 }
 
 // moves forward n chunks. returns true if valid.
@@ -1,12 +1,17 @@
 package daemon
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/erofs"
+	"github.com/dnr/styx/manifester"
 	"github.com/dnr/styx/pb"
 	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
 )
 
 var d1 = "0123456789ytrewq6789poiu"
@@ -109,3 +114,98 @@ func TestDigestIterator_ToFileStart(t *testing.T) {
 	r.Equal(fb(d3), i.digest())
 	r.EqualValues(common.ChunkShift.Size(), i.size())
 }
+
+func TestDigestIterator_ChunkSize(t *testing.T) {
+	r := require.New(t)
+	i := newDigestIterator([]*pb.Entry{
+		&pb.Entry{
+			Path:      "/cdc",
+			Size:      8192 + 12288 + 77,
+			Digests:   []byte(d1 + d2 + d3),
+			ChunkSize: []uint32{8192, 12288, 77},
+		},
+	})
+
+	r.EqualValues(8192, i.size())
+	r.NotNil(i.next(1))
+	r.EqualValues(12288, i.size())
+	r.NotNil(i.next(1))
+	r.Equal(fb(d3), i.digest())
+	r.EqualValues(77, i.size())
+	r.Nil(i.next(1))
+}
+
+func TestWaitOpCancel(t *testing.T) {
+	r := require.New(t)
+	s := &Server{diffMap: make(map[erofs.SlabLoc]reqOp)}
+	loc := erofs.SlabLoc{SlabId: 1, Addr: 100}
+	op := s.buildSingleOp(loc, cdig.CDig{})
+	opCtx := op.start(context.Background())
+	op.waiters = 2
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	cancel1()
+	r.ErrorIs(s.waitOp(ctx1, op), context.Canceled)
+	r.NoError(opCtx.Err(), "still has a waiter")
+	r.Equal(reqOp(op), s.diffMap[loc])
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel2()
+	r.ErrorIs(s.waitOp(ctx2, op), context.DeadlineExceeded)
+	r.ErrorIs(opCtx.Err(), context.Canceled, "last waiter gave up")
+	r.NotContains(s.diffMap, loc)
+	r.EqualValues(1, s.stats.canceledOps.Load())
+}
+
+func TestPrecomputedNegativeCache(t *testing.T) {
+	r := require.New(t)
+	s := &Server{}
+	for range precomputedMissLimit - 1 {
+		r.True(s.tryPrecomputed())
+		s.notePrecomputedMiss()
+	}
+	r.True(s.tryPrecomputed())
+	s.notePrecomputedMiss()
+	r.False(s.tryPrecomputed(), "skip after limit misses")
+
+	// once we've seen one, always look
+	s.precomputedHits.Add(1)
+	r.True(s.tryPrecomputed())
+}
+
+func TestPrunePackLocs(t *testing.T) {
+	r := require.New(t)
+	s := NewServer(Config{CachePath: t.TempDir(), ErofsBlockShift: 12, Workers: 1})
+	r.NoError(s.openDb())
+	defer s.db.Close()
+
+	present := cdig.Sum(cdig.Sha256, []byte("present"))
+	missing := cdig.Sum(cdig.Sha256, []byte("missing"))
+	unknown := cdig.Sum(cdig.Sha256, []byte("unknown"))
+	pls := make(map[cdig.CDig]manifester.PackChunkLoc)
+	for _, d := range []cdig.CDig{present, missing, unknown} {
+		pls[d] = manifester.PackChunkLoc{Pack: "p1", Offset: 10, Length: 20}
+	}
+	r.NoError(s.db.Update(func(tx *bbolt.Tx) error {
+		cb := tx.Bucket(chunkBucket)
+		sb, err := tx.Bucket(slabBucket).CreateBucket(slabKey(0))
+		r.NoError(err)
+		for addr, d := range map[uint32]cdig.CDig{1: present, 2: missing} {
+			r.NoError(cb.Put(d[:], locValue(0, addr, Sph{})))
+			r.NoError(sb.Put(addrKey(addr), d[:]))
+		}
+		r.NoError(sb.Put(addrKey(1|presentMask), []byte{}))
+		r.NoError(s.putPackLocs(tx, pls))
+		// pretend it was recorded before the chunk arrived
+		return tx.Bucket(packLocBucket).Put(present[:], []byte("stale entry xx"))
+	}))
+
+	r.NoError(s.prunePackLocs())
+	for d, want := range map[cdig.CDig]bool{present: false, missing: true, unknown: false} {
+		pl, ok := s.getPackLoc(d)
+		r.Equal(want, ok, d.String())
+		if want {
+			r.Equal(pls[d], pl)
+		}
+	}
+}
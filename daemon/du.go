@@ -0,0 +1,135 @@
+package daemon
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"log"
+	"net/http"
+	"slices"
+
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/erofs"
+	"github.com/dnr/styx/pb"
+)
+
+func (s *Server) handleDuReq(ctx context.Context, r *DuReq) (*DuResp, error) {
+	// allow this even before "initialized"
+
+	res := &DuResp{}
+	return res, s.db.View(func(tx *bbolt.Tx) error {
+		// images, by sph prefix since that's what chunks refer to
+		bySphp := make(map[SphPrefix]*DuImage)
+		cur := tx.Bucket(imageBucket).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			var img pb.DbImage
+			if err := proto.Unmarshal(v, &img); err != nil {
+				log.Print("unmarshal error iterating images", err)
+				continue
+			}
+			sph, _, err := ParseSph(string(k))
+			if err != nil {
+				continue
+			}
+			di := &DuImage{StorePath: img.StorePath, ImageSize: img.ImageSize}
+			if m, err := s.getManifestLocal(tx, k); err == nil {
+				di.NarSize = m.Meta.GetNarinfo().GetNarSize()
+			}
+			bySphp[SphPrefixFromBytes(sph[:])] = di
+			res.Cache.Images++
+			res.Cache.NarSize += di.NarSize
+			res.Cache.ImageBytes += di.ImageSize
+		}
+
+		// which images were requested
+		inSet := make(map[*DuImage]bool)
+		for _, img := range r.Images {
+			sph, _, err := ParseSph(img)
+			if err != nil {
+				return err
+			}
+			di := bySphp[SphPrefixFromBytes(sph[:])]
+			if di == nil {
+				return mwErr(http.StatusNotFound, "image %s not found", img)
+			}
+			inSet[di] = true
+		}
+		var set DuImage
+
+		// walk present chunks in all slabs
+		cb, slabroot := tx.Bucket(chunkBucket), tx.Bucket(slabBucket)
+		var owners []*DuImage
+		scur := slabroot.Cursor()
+		for sk, _ := scur.First(); sk != nil; sk, _ = scur.Next() {
+			sb := slabroot.Bucket(sk)
+			slabId := binary.BigEndian.Uint16(sk)
+			forEachChunk(sb, func(addr, blocks uint32, present bool) {
+				if !present {
+					// might not be recorded in the db yet
+					_, present = s.presentMap.Get(erofs.SlabLoc{SlabId: slabId, Addr: addr})
+				}
+				if !present || blocks == 0 {
+					return
+				}
+				size := int64(blocks) << s.blockShift
+				res.Cache.SlabBytes += size
+
+				// find images that use this chunk
+				owners = owners[:0]
+				if digest := sb.Get(addrKey(addr)); digest != nil {
+					if loc := cb.Get(digest); len(loc) >= 6 {
+						for _, sphp := range splitSphs(loc[6:]) {
+							if di := bySphp[sphp]; di != nil && !slices.Contains(owners, di) {
+								owners = append(owners, di)
+							}
+						}
+					}
+				}
+
+				var setOwners int
+				for _, di := range owners {
+					di.PresentBytes += size
+					if len(owners) == 1 {
+						di.ExclusiveBytes += size
+					} else {
+						di.SharedBytes += size
+					}
+					if inSet[di] {
+						setOwners++
+					}
+				}
+				if len(owners) == 0 {
+					res.Cache.UnownedBytes += size
+				} else if setOwners > 0 {
+					set.PresentBytes += size
+					if setOwners == len(owners) {
+						set.ExclusiveBytes += size
+					} else {
+						set.SharedBytes += size
+					}
+				}
+			})
+		}
+
+		for _, di := range bySphp {
+			di.FreedBytes = di.ExclusiveBytes + di.ImageSize
+			if len(inSet) == 0 || inSet[di] {
+				res.Images = append(res.Images, di)
+			}
+			if inSet[di] {
+				set.ImageSize += di.ImageSize
+				set.NarSize += di.NarSize
+			}
+		}
+		slices.SortFunc(res.Images, func(a, b *DuImage) int {
+			return cmp.Or(cmp.Compare(b.FreedBytes, a.FreedBytes), cmp.Compare(a.StorePath, b.StorePath))
+		})
+		if len(inSet) > 1 {
+			set.FreedBytes = set.ExclusiveBytes + set.ImageSize
+			res.Set = &set
+		}
+		return nil
+	})
+}
@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/manifester"
+	"github.com/dnr/styx/pb"
+)
+
+// Embedded manifesting: instead of talking to a remote manifester and chunk store, the daemon
+// builds manifests itself (from file:// or local network binary caches) into a local chunk
+// store directory, with a manifester running in-process on loopback. Chunks that aren't
+// present are read directly from the chunk store directory, without chunk diffs (they would
+// only cost cpu here).
+//
+// Note that this stores every chunk twice: zstd-compressed in the chunk store directory, and
+// uncompressed in the daemon's slabs once it's read. Nothing removes chunks from the chunk
+// store directory, so expect it to grow to about the compressed size of everything built.
+
+type EmbeddedConfig struct {
+	// Local chunk store directory. Embedded mode is enabled if this is set.
+	ChunkDir string
+	// Request chunk diffs from the embedded manifester, as with a remote one. This is mostly
+	// useful for testing.
+	UseDiffs bool
+	// File with key to sign manifests. Its public key must be one of the init public keys.
+	SignKeyFile string
+	// Verify narinfo from upstreams with these keys.
+	NixPubKeys []string
+	// Hosts of http(s) upstreams we may build from. file:// upstreams are always allowed.
+	AllowedUpstreams []string
+}
+
+func (c *EmbeddedConfig) enabled() bool {
+	return c.ChunkDir != ""
+}
+
+// Starts the embedded manifester and returns its url.
+func (s *Server) startEmbedded(params *pb.GlobalParams, keys []signature.PublicKey) (string, func(), error) {
+	cfg := &s.cfg.Embedded
+	if cfg.SignKeyFile == "" {
+		return "", nil, errors.New("embedded mode requires a signing key")
+	}
+	signKeys, err := common.LoadSecretKeys([]string{cfg.SignKeyFile})
+	if err != nil {
+		return "", nil, err
+	}
+	pub := signKeys[0].ToPublicKey()
+	if !slices.ContainsFunc(keys, func(k signature.PublicKey) bool { return k.String() == pub.String() }) {
+		return "", nil, fmt.Errorf("embedded signing key %s is not a trusted public key", pub.Name)
+	}
+	nixKeys, err := common.LoadPubKeys(cfg.NixPubKeys)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cs, err := manifester.NewChunkStoreWrite(manifester.ChunkStoreWriteConfig{ChunkLocalDir: cfg.ChunkDir})
+	if err != nil {
+		return "", nil, err
+	}
+	mb, err := manifester.NewManifestBuilder(manifester.ManifestBuilderConfig{
+		PublicKeys:  nixKeys,
+		SigningKeys: signKeys,
+		ChunkAlgo:   params.ChunkAlgo,
+		DigestAlgo:  params.DigestAlgo,
+	}, cs)
+	if err != nil {
+		return "", nil, err
+	}
+	m, err := manifester.NewManifestServer(manifester.Config{
+		AllowedUpstreams:      cfg.AllowedUpstreams,
+		AllowFileUpstreams:    true,
+		ChunkDiffZstdLevel:    1, // over loopback, speed matters more than size
+		ChunkDiffParallel:     s.cfg.Workers,
+		ManifestBatchParallel: 4,
+	}, mb)
+	if err != nil {
+		return "", nil, err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	go m.Serve(l)
+	u := "http://" + l.Addr().String()
+	log.Println("embedded manifester using", cfg.ChunkDir, "on", u)
+	return u, func() { l.Close() }, nil
+}
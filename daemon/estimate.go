@@ -0,0 +1,303 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/common/errgroup"
+	"github.com/dnr/styx/pb"
+)
+
+// manifests to fetch in parallel for an estimate
+const estimateParallel = 16
+
+type (
+	estimateEnt struct {
+		est *EstimateEntry
+		sph Sph
+		m   *pb.Manifest
+	}
+
+	estimatePlan struct {
+		opPlan
+		names []catalogResult // earlier paths in the request (only reqName and reqHash)
+	}
+)
+
+// handleEstimateReq figures out what mounting or materializing the requested store paths would
+// download, without downloading any chunk data or changing anything locally. it plans diff ops
+// the same way prefetch does, in dry-run mode. earlier paths in the request can be bases for
+// later ones, and chunks they would fetch count as present.
+func (s *Server) handleEstimateReq(ctx context.Context, r *EstimateReq) (*EstimateResp, error) {
+	if s.p() == nil {
+		return nil, mwErr(http.StatusPreconditionFailed, "styx is not initialized, call 'styx init --params=...'")
+	}
+	upstream := r.Upstream
+	if !strings.HasSuffix(upstream, "/") {
+		upstream += "/"
+	}
+
+	res := &EstimateResp{}
+	seen := make(map[string]bool)
+	plan := &estimatePlan{opPlan: opPlan{
+		images:  make(map[Sph][]*pb.Entry),
+		fetched: make(map[cdig.CDig]struct{}),
+	}}
+	var level []string
+	add := func(sp string) {
+		sp = strings.TrimPrefix(sp, storepath.StoreDir+"/")
+		if !seen[sp] {
+			seen[sp] = true
+			level = append(level, sp)
+		}
+	}
+	for _, sp := range r.StorePaths {
+		if !reStorePath.MatchString(strings.TrimPrefix(sp, storepath.StoreDir+"/")) {
+			return nil, mwErr(http.StatusBadRequest, "invalid store path or missing name: %q", sp)
+		}
+		add(sp)
+	}
+
+	// go one level of references at a time so we can fetch manifests in parallel but
+	// still count shared chunks in a stable order
+	for len(level) > 0 {
+		ents := make([]estimateEnt, len(level))
+		eg := errgroup.WithContext(ctx)
+		eg.SetLimit(estimateParallel)
+		for i, sp := range level {
+			eg.Go(func() error {
+				ents[i] = s.estimateFetch(eg, upstream, sp)
+				return nil
+			})
+		}
+		eg.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		level = nil
+		err := s.db.View(func(tx *bbolt.Tx) error {
+			for _, ent := range ents {
+				if ent.m != nil {
+					s.estimateChunks(tx, ent, plan)
+					if r.Closure {
+						for _, ref := range ent.m.Meta.GetNarinfo().GetReferences() {
+							add(ref)
+						}
+					}
+				}
+				res.Paths = append(res.Paths, ent.est)
+				if ent.est.Installed {
+					res.Installed++
+				} else {
+					res.Total.add(ent.est)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// checks whether sp is installed already, and if not, gets its manifest
+func (s *Server) estimateFetch(ctx context.Context, upstream, sp string) estimateEnt {
+	ent := estimateEnt{est: &EstimateEntry{StorePath: sp}}
+	sph, sphStr, err := ParseSph(sp)
+	if err != nil {
+		ent.est.Error = err.Error()
+		return ent
+	}
+	ent.sph = sph
+
+	var haveManifest bool
+	_ = s.db.View(func(tx *bbolt.Tx) error {
+		var img pb.DbImage
+		if v := tx.Bucket(imageBucket).Get([]byte(sphStr)); v != nil {
+			_ = proto.Unmarshal(v, &img)
+		}
+		switch img.MountState {
+		case pb.MountState_Mounted, pb.MountState_Materialized:
+			ent.est.Installed = true
+		default:
+			if m, err := s.getManifestLocal(tx, []byte(sphStr)); err == nil {
+				ent.m, haveManifest = m, true
+			}
+		}
+		return nil
+	})
+	if !ent.est.Installed {
+		// maybe it's in the store some other way
+		_, err := os.Lstat(filepath.Join(storepath.StoreDir, sp))
+		ent.est.Installed = err == nil
+	}
+	if ent.est.Installed {
+		ent.m = nil
+		return ent
+	}
+
+	if !haveManifest {
+		var size int64
+		ent.m, size, err = s.estimateRemoteManifest(ctx, upstream, sp, sphStr)
+		if err != nil {
+			ent.est.Error = err.Error()
+			return ent
+		}
+		ent.est.ManifestBytes = size
+	}
+	ni := ent.m.Meta.GetNarinfo()
+	ent.est.NarSize, ent.est.FileSize = ni.GetNarSize(), ni.GetFileSize()
+	return ent
+}
+
+// like the first part of getManifestAndBuildImage, but doesn't store anything. returns the
+// manifest and the number of bytes we fetched.
+func (s *Server) estimateRemoteManifest(ctx context.Context, upstream, sp, sphStr string) (*pb.Manifest, int64, error) {
+	envelopeBytes, err := s.getManifestFromManifester(ctx, upstream, sphStr, 0, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	entry, _, err := common.VerifyMessageAsEntry(s.p().keys, common.ManifestContext, envelopeBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+	if storePath := strings.TrimPrefix(entry.Path, common.ManifestContext+"/"); storePath != sp {
+		return nil, 0, fmt.Errorf("envelope storepath != requested storepath: %q != %q", storePath, sp)
+	}
+	size := int64(len(envelopeBytes))
+
+	data := entry.InlineData
+	if len(data) == 0 {
+		for _, d := range cdig.FromSliceAlias(entry.Digests) {
+			chunk, err := s.p().csread.Get(ctx, d.String(), nil)
+			if err != nil {
+				return nil, 0, fmt.Errorf("manifest chunk read error: %w", err)
+			}
+			data = append(data, chunk...)
+		}
+		if int64(len(data)) != entry.Size {
+			return nil, 0, errors.New("manifest chunks don't match size")
+		}
+		size += entry.Size
+	}
+
+	var m pb.Manifest
+	if err = proto.Unmarshal(data, &m); err != nil {
+		return nil, 0, fmt.Errorf("manifest unmarshal error: %w", err)
+	}
+	return &m, size, nil
+}
+
+// sorts chunks in ent into present, diffable, and fetch by planning the ops that prefetching
+// each missing chunk would start (see buildAndStartPrefetch), without starting them.
+func (s *Server) estimateChunks(tx *bbolt.Tx, ent estimateEnt, plan *estimatePlan) {
+	est := ent.est
+	_, spName, _ := strings.Cut(est.StorePath, "-")
+	res := s.estimateBase(tx, plan, ent.sph, spName)
+	if res.usingBase() {
+		est.Base = res.baseHash.String() + "-" + res.baseName
+	}
+	plan.images[ent.sph] = ent.m.Entries
+
+	for _, e := range ent.m.Entries {
+		digests := cdig.FromSliceAlias(e.Digests)
+		for i, d := range digests {
+			if _, ok := plan.fetched[d]; ok {
+				est.PresentBytes += common.EntryChunkSize(e, i, i == len(digests)-1)
+				continue
+			} else if _, present := s.digestPresent(tx, d); present {
+				est.PresentBytes += common.EntryChunkSize(e, i, i == len(digests)-1)
+				continue
+			}
+
+			set := newOpSet(s)
+			set.plan = &plan.opPlan
+			set.maxOpSize = MaxOpSize
+			set.planDiff(tx, d, res)
+			for _, op := range set.ops {
+				for idx, info := range op.reqInfo {
+					plan.fetched[op.reqDigests[idx]] = struct{}{}
+					if op.hasBase() {
+						est.DiffBytes += int64(info.size)
+						est.DiffChunks++
+					} else {
+						est.FetchBytes += int64(info.size)
+						est.FetchChunks++
+					}
+				}
+				if len(op.recompress) > 0 {
+					est.Recompress++
+				}
+			}
+			if _, ok := plan.fetched[d]; !ok {
+				// shouldn't happen, but count it anyway
+				plan.fetched[d] = struct{}{}
+				est.FetchBytes += common.EntryChunkSize(e, i, i == len(digests)-1)
+				est.FetchChunks++
+			}
+		}
+	}
+
+	plan.names = append(plan.names, catalogResult{reqName: spName, reqHash: ent.sph})
+}
+
+// like catalogFindBaseFromHashAndName, but also considers earlier paths in the request, as
+// if they were in the catalog already. returns a result without a base if none was found.
+func (s *Server) estimateBase(tx *bbolt.Tx, plan *estimatePlan, reqHash Sph, reqName string) catalogResult {
+	res, err := s.catalogFindBaseFromHashAndName(tx, reqHash, reqName)
+	if err != nil {
+		res = catalogResult{reqName: reqName, reqHash: reqHash}
+	}
+	start, err := common.DiffBasePrefix(reqName)
+	if err != nil {
+		return res
+	}
+	var bestmatch int
+	if res.usingBase() {
+		bestmatch = common.DiffBaseScore(reqName, res.baseName)
+	}
+	for _, c := range plan.names {
+		if c.reqHash == reqHash || !strings.HasPrefix(c.reqName, start) {
+			continue
+		}
+		match := common.DiffBaseScore(reqName, c.reqName)
+		if match < bestmatch {
+			continue
+		} else if match == bestmatch && res.usingBase() &&
+			catalogKey(c.reqName, c.reqHash) < catalogKey(res.baseName, res.baseHash) {
+			continue // break ties the same way the catalog does: last in key order
+		}
+		bestmatch = match
+		res.baseName, res.baseHash = c.reqName, c.reqHash
+	}
+	return res
+}
+
+func catalogKey(name string, sph Sph) string {
+	return name + "\x00" + string(sph[:])
+}
+
+func (t *EstimateEntry) add(est *EstimateEntry) {
+	t.ManifestBytes += est.ManifestBytes
+	t.DiffBytes += est.DiffBytes
+	t.FetchBytes += est.FetchBytes
+	t.PresentBytes += est.PresentBytes
+	t.DiffChunks += est.DiffChunks
+	t.FetchChunks += est.FetchChunks
+	t.Recompress += est.Recompress
+	t.NarSize += est.NarSize
+	t.FileSize += est.FileSize
+}
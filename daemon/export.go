@@ -0,0 +1,597 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DataDog/zstd"
+	"go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/pb"
+)
+
+// Export and import of cache snapshots, for seeding new machines.
+//
+// An export is a zstd-compressed stream of records: the db (copied to a temp file in a single
+// short read transaction, so it's consistent), then for each slab, its backing file (with
+// cachefiles xattrs so the kernel accepts it on the new machine) followed by the data of each
+// present chunk. Blocks that aren't present aren't included.
+//
+// Import happens before the daemon starts on an empty cache dir. It writes chunk data into
+// sparse backing files, verifying each chunk against its digest, and rebuilds presence info
+// in the db from the chunks that verified. Image files aren't exported, so mounted images are
+// marked unmounted and have to be mounted again.
+
+const exportMagic = "styx-export-v1\n"
+
+const (
+	exportRecEnd byte = iota
+	exportRecDb
+	exportRecDir   // relpath, xattrs
+	exportRecFile  // slab id, relpath, size, xattrs
+	exportRecChunk // slab id, addr, data
+)
+
+// only these xattrs are copied
+const cachefilesXattrPrefix = "trusted.CacheFiles."
+
+// limits on import so a bad export can't make us allocate too much
+const (
+	exportMaxStr   = 1 << 16
+	exportMaxChunk = 1 << common.ChunkShift
+)
+
+type (
+	ExportStats struct {
+		Slabs  int
+		Chunks int
+		Bytes  int64
+	}
+
+	ImportStats struct {
+		Slabs     int
+		Chunks    int
+		Bytes     int64
+		BadChunks int // failed verification or unknown
+		Unmounted int // images that were mounted in the export
+	}
+
+	exportWriter struct {
+		w   *bufio.Writer
+		err error
+	}
+
+	exportReader struct {
+		r   *bufio.Reader
+		err error
+	}
+)
+
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	var req ExportReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&Status{Success: false, Error: err.Error()})
+		return
+	} else if s.p() == nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(&Status{Success: false, Error: "styx is not initialized"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	zw := zstd.NewWriterLevel(w, req.ZstdLevel)
+	stats, err := s.export(zw)
+	if err == nil {
+		err = zw.Close()
+	}
+	// if we failed partway through, the stream won't have an end record and import will fail
+	if err != nil {
+		log.Println("export error:", err)
+		return
+	}
+	log.Printf("export: %d slabs, %d chunks, %d bytes", stats.Slabs, stats.Chunks, stats.Bytes)
+}
+
+func (s *Server) export(out io.Writer) (ExportStats, error) {
+	var stats ExportStats
+
+	// copy the db first so we don't hold a transaction open while writing to a slow reader.
+	// also remember how far each slab was allocated, so we only export chunks that the copy
+	// knows about.
+	dbf, err := os.CreateTemp(s.cfg.CachePath, "export-*.db")
+	if err != nil {
+		return stats, err
+	}
+	defer os.Remove(dbf.Name())
+	defer dbf.Close()
+	var slabIds []uint16
+	slabSeqs := make(map[uint16]uint32)
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		slabroot := tx.Bucket(slabBucket)
+		cur := slabroot.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			slabId := binary.BigEndian.Uint16(k)
+			slabIds = append(slabIds, slabId)
+			slabSeqs[slabId] = common.TruncU32(slabroot.Bucket(k).Sequence())
+		}
+		_, err := tx.WriteTo(dbf)
+		return err
+	})
+	if err != nil {
+		return stats, err
+	}
+	dbSize, err := dbf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return stats, err
+	} else if _, err = dbf.Seek(0, io.SeekStart); err != nil {
+		return stats, err
+	}
+
+	ew := &exportWriter{w: bufio.NewWriterSize(out, 1<<20)}
+	ew.bytes([]byte(exportMagic))
+	ew.u8(uint8(s.blockShift))
+	ew.u8(exportRecDb)
+	ew.u64(uint64(dbSize))
+	if ew.err == nil {
+		_, ew.err = io.CopyN(ew.w, dbf, dbSize)
+	}
+
+	dirsDone := make(map[string]bool)
+	for _, slabId := range slabIds {
+		if ew.err != nil {
+			break
+		}
+		relPath := s.slabRelPath(slabId)
+		f, err := os.Open(filepath.Join(s.cfg.CachePath, relPath))
+		if err != nil {
+			log.Println("export: skipping slab", slabId, err)
+			continue
+		}
+		err = s.exportSlab(ew, slabId, slabSeqs[slabId], relPath, f, dirsDone, &stats)
+		f.Close()
+		if err != nil {
+			return stats, err
+		}
+	}
+	ew.u8(exportRecEnd)
+	if ew.err == nil {
+		ew.err = ew.w.Flush()
+	}
+	return stats, ew.err
+}
+
+func (s *Server) exportSlab(
+	ew *exportWriter,
+	slabId uint16,
+	seq uint32, // only chunks below this were allocated when we copied the db
+	relPath string,
+	f *os.File,
+	dirsDone map[string]bool,
+	stats *ExportStats,
+) error {
+	// parent dirs of cachefiles objects have xattrs too
+	var dirs []string
+	for d := filepath.Dir(relPath); d != "."; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if d := dirs[i]; !dirsDone[d] {
+			dirsDone[d] = true
+			ew.u8(exportRecDir)
+			ew.str(d)
+			ew.xattrs(filepath.Join(s.cfg.CachePath, d))
+		}
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	ew.u8(exportRecFile)
+	ew.u16(slabId)
+	ew.str(relPath)
+	ew.u64(uint64(st.Size()))
+	ew.xattrs(f.Name())
+	stats.Slabs++
+
+	// get present chunks in a short transaction, then read data without one
+	type chunk struct{ addr, blocks uint32 }
+	var chunks []chunk
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		sb := tx.Bucket(slabBucket).Bucket(slabKey(slabId))
+		if sb == nil {
+			return nil
+		}
+		forEachChunk(sb, func(addr, blocks uint32, present bool) {
+			if present && blocks > 0 && addr < seq {
+				chunks = append(chunks, chunk{addr: addr, blocks: blocks})
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, c := range chunks {
+		if ew.err != nil {
+			break
+		}
+		size := int(c.blocks) << s.blockShift
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := f.ReadAt(buf, int64(c.addr)<<s.blockShift); err != nil && err != io.EOF {
+			return fmt.Errorf("reading slab %d addr %d: %w", slabId, c.addr, err)
+		}
+		ew.u8(exportRecChunk)
+		ew.u16(slabId)
+		ew.u32(c.addr)
+		ew.u32(uint32(size))
+		ew.bytes(buf)
+		stats.Chunks++
+		stats.Bytes += int64(size)
+	}
+	return ew.err
+}
+
+// path of slab data relative to cache dir
+func (s *Server) slabRelPath(slabId uint16) string {
+	if slabId == manifestSlabOffset {
+		return manifestSlabPrefix + fmt.Sprint(slabId)
+	}
+	tag, _ := s.SlabInfo(slabId)
+	return fscachePath(s.cfg.CacheDomain, tag)
+}
+
+// Import restores an export into cachePath, which must not have a db yet. The daemon must not
+// be running.
+func Import(cachePath string, in io.Reader) (ImportStats, error) {
+	var stats ImportStats
+	dbPath := filepath.Join(cachePath, dbFilename)
+	if _, err := os.Stat(dbPath); err == nil {
+		return stats, fmt.Errorf("%s already exists, import needs an empty cache", dbPath)
+	}
+	if err := os.MkdirAll(cachePath, 0700); err != nil {
+		return stats, err
+	}
+
+	zr := zstd.NewReader(in)
+	defer zr.Close()
+	er := &exportReader{r: bufio.NewReaderSize(zr, 1<<20)}
+	if magic := er.bytes(len(exportMagic)); er.err != nil || string(magic) != exportMagic {
+		return stats, errors.New("not a styx export")
+	}
+	blockShift := common.BlkShift(er.u8())
+
+	// write db to a temp name so a failed import doesn't leave a db behind
+	if er.u8() != exportRecDb {
+		return stats, errors.New("export missing db")
+	}
+	tmpDbPath := dbPath + ".import"
+	dbf, err := os.OpenFile(tmpDbPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return stats, err
+	}
+	defer os.Remove(tmpDbPath)
+	if dbSize := er.u64(); dbSize > math.MaxInt64 {
+		err = errors.New("bad db size in export")
+	} else {
+		_, err = io.CopyN(dbf, er.r, int64(dbSize))
+	}
+	if err = errors.Join(er.err, err, dbf.Close()); err != nil {
+		return stats, err
+	}
+	db, err := bbolt.Open(tmpDbPath, 0644, &bbolt.Options{NoFreelistSync: true, FreelistType: bbolt.FreelistMapType})
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+
+	var digestAlgo string
+	err = db.View(func(tx *bbolt.Tx) error {
+		var dp pb.DbParams
+		if b := tx.Bucket(metaBucket).Get(metaParams); b == nil {
+			return errors.New("exported db is not initialized")
+		} else if err := proto.Unmarshal(b, &dp); err != nil {
+			return err
+		}
+		digestAlgo = dp.Params.GetParams().GetDigestAlgo()
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	files := make(map[uint16]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	present := make(map[uint16][]uint32)
+
+	for done := false; !done; {
+		switch rec := er.u8(); {
+		case er.err != nil:
+			return stats, fmt.Errorf("truncated export: %w", er.err)
+		case rec == exportRecEnd:
+			done = true
+		case rec == exportRecDir:
+			p, err := importPath(cachePath, er.str())
+			if err != nil {
+				return stats, err
+			} else if err = os.MkdirAll(p, 0700); err != nil {
+				return stats, err
+			} else if err = er.setXattrs(p); err != nil {
+				return stats, err
+			}
+		case rec == exportRecFile:
+			slabId := er.u16()
+			p, err := importPath(cachePath, er.str())
+			if err != nil {
+				return stats, err
+			} else if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+				return stats, err
+			}
+			f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return stats, err
+			}
+			files[slabId] = f
+			if err = f.Truncate(int64(er.u64())); err != nil {
+				return stats, err
+			} else if err = er.setXattrs(p); err != nil {
+				return stats, err
+			}
+			stats.Slabs++
+		case rec == exportRecChunk:
+			slabId, addr := er.u16(), er.u32()
+			data := er.bytesMax(er.u32(), exportMaxChunk)
+			f := files[slabId]
+			if er.err != nil {
+				continue // caught at top of loop
+			} else if f == nil {
+				return stats, fmt.Errorf("chunk for unknown slab %d", slabId)
+			}
+			var digest cdig.CDig
+			db.View(func(tx *bbolt.Tx) error {
+				if sb := tx.Bucket(slabBucket).Bucket(slabKey(slabId)); sb != nil {
+					if v := sb.Get(addrKey(addr)); len(v) >= cdig.Bytes {
+						digest = cdig.FromBytes(v)
+					}
+				}
+				return nil
+			})
+			if digest == (cdig.CDig{}) || !verifyBlockChunk(digestAlgo, digest, data, int(blockShift.Size())) {
+				log.Println("import: bad chunk in slab", slabId, "at", addr)
+				stats.BadChunks++
+				continue
+			}
+			if _, err := f.WriteAt(data, int64(addr)<<blockShift); err != nil {
+				return stats, err
+			}
+			present[slabId] = append(present[slabId], addr)
+			stats.Chunks++
+			stats.Bytes += int64(len(data))
+		default:
+			return stats, fmt.Errorf("unknown export record type %d", rec)
+		}
+	}
+
+	for _, f := range files {
+		if err := f.Sync(); err != nil {
+			return stats, err
+		}
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		// rebuild presence from what we actually wrote
+		slabroot := tx.Bucket(slabBucket)
+		cur := slabroot.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			sb := slabroot.Bucket(k)
+			var toDelete [][]byte
+			scur := sb.Cursor()
+			for sk, _ := scur.Seek(addrKey(presentMask)); sk != nil; sk, _ = scur.Next() {
+				toDelete = append(toDelete, bytes.Clone(sk))
+			}
+			for _, sk := range toDelete {
+				if err := sb.Delete(sk); err != nil {
+					return err
+				}
+			}
+			for _, addr := range present[binary.BigEndian.Uint16(k)] {
+				if err := sb.Put(addrKey(addr|presentMask), []byte{}); err != nil {
+					return err
+				}
+			}
+		}
+
+		// we don't have image files, so nothing is mounted
+		ib := tx.Bucket(imageBucket)
+		icur := ib.Cursor()
+		var toUpdate [][2][]byte
+		for k, v := icur.First(); k != nil; k, v = icur.Next() {
+			var img pb.DbImage
+			if err := proto.Unmarshal(v, &img); err != nil {
+				return err
+			}
+			switch img.MountState {
+			case pb.MountState_Requested, pb.MountState_Mounted, pb.MountState_MountError, pb.MountState_UnmountRequested:
+				img.MountState = pb.MountState_Unmounted
+				img.MountPoint = ""
+				img.ImageSize = 0
+				nv, err := proto.Marshal(&img)
+				if err != nil {
+					return err
+				}
+				toUpdate = append(toUpdate, [2][]byte{bytes.Clone(k), nv})
+				stats.Unmounted++
+			}
+		}
+		for _, kv := range toUpdate {
+			if err := ib.Put(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	} else if err = db.Close(); err != nil {
+		return stats, err
+	}
+	return stats, os.Rename(tmpDbPath, dbPath)
+}
+
+func importPath(cachePath, relPath string) (string, error) {
+	if !filepath.IsLocal(relPath) {
+		return "", fmt.Errorf("bad path in export %q", relPath)
+	}
+	return filepath.Join(cachePath, relPath), nil
+}
+
+// Chunks in slabs are padded with zeros to a block boundary, so we don't know their exact
+// length. Try the full length first (most chunks are full size), then each length that only
+// drops trailing zeros.
+func verifyBlockChunk(algo string, digest cdig.CDig, data []byte, blockSize int) bool {
+	if cdig.Sum(algo, data) == digest {
+		return true
+	}
+	for l := max(len(bytes.TrimRight(data, "\x00")), len(data)-blockSize+1); l < len(data); l++ {
+		if cdig.Sum(algo, data[:l]) == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// writer/reader helpers
+
+func (ew *exportWriter) bytes(b []byte) {
+	if ew.err == nil {
+		_, ew.err = ew.w.Write(b)
+	}
+}
+
+func (ew *exportWriter) u8(v uint8)   { ew.bytes([]byte{v}) }
+func (ew *exportWriter) u16(v uint16) { ew.bytes(binary.LittleEndian.AppendUint16(nil, v)) }
+func (ew *exportWriter) u32(v uint32) { ew.bytes(binary.LittleEndian.AppendUint32(nil, v)) }
+func (ew *exportWriter) u64(v uint64) { ew.bytes(binary.LittleEndian.AppendUint64(nil, v)) }
+
+func (ew *exportWriter) str(s string) {
+	ew.u32(uint32(len(s)))
+	ew.bytes([]byte(s))
+}
+
+func (ew *exportWriter) xattrs(path string) {
+	var names []string
+	if sz, err := unix.Listxattr(path, nil); err == nil && sz > 0 {
+		buf := make([]byte, sz)
+		if sz, err = unix.Listxattr(path, buf); err == nil {
+			for _, n := range strings.Split(string(buf[:sz]), "\x00") {
+				if strings.HasPrefix(n, cachefilesXattrPrefix) {
+					names = append(names, n)
+				}
+			}
+		}
+	}
+	var vals [][]byte
+	for _, n := range names {
+		if sz, err := unix.Getxattr(path, n, nil); err == nil {
+			val := make([]byte, sz)
+			if sz, err = unix.Getxattr(path, n, val); err == nil {
+				vals = append(vals, val[:sz])
+				continue
+			}
+		}
+		vals = append(vals, nil)
+	}
+	ew.u32(uint32(len(names)))
+	for i, n := range names {
+		ew.str(n)
+		ew.str(string(vals[i]))
+	}
+}
+
+func (er *exportReader) bytes(n int) []byte {
+	if er.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	_, er.err = io.ReadFull(er.r, b)
+	return b
+}
+
+// like bytes but fails instead of allocating more than max
+func (er *exportReader) bytesMax(n uint32, max int) []byte {
+	if er.err == nil && int64(n) > int64(max) {
+		er.err = fmt.Errorf("export record too large: %d > %d", n, max)
+	}
+	return er.bytes(int(n))
+}
+
+func (er *exportReader) u8() uint8 {
+	if b := er.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (er *exportReader) u16() uint16 {
+	if b := er.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (er *exportReader) u32() uint32 {
+	if b := er.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (er *exportReader) u64() uint64 {
+	if b := er.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (er *exportReader) str() string {
+	return string(er.bytesMax(er.u32(), exportMaxStr))
+}
+
+func (er *exportReader) setXattrs(path string) error {
+	n := int(er.u32())
+	for i := 0; i < n; i++ {
+		name, val := er.str(), er.str()
+		if er.err != nil {
+			return er.err
+		} else if !strings.HasPrefix(name, cachefilesXattrPrefix) {
+			continue
+		} else if err := unix.Setxattr(path, name, []byte(val), 0); err != nil {
+			return fmt.Errorf("setting %s on %s: %w", name, path, err)
+		}
+	}
+	return er.err
+}
@@ -0,0 +1,118 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DataDog/zstd"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/pb"
+)
+
+func TestExportImport(t *testing.T) {
+	r := require.New(t)
+	cfg := Config{
+		CachePath:       t.TempDir(),
+		CacheDomain:     "styx",
+		ErofsBlockShift: 12,
+		Workers:         1,
+	}
+	s := NewServer(cfg)
+	r.NoError(s.openDb())
+	defer s.db.Close()
+
+	// two present chunks (one ending in zeros), one present but corrupted, one missing
+	chunkA := make([]byte, 5000)
+	rand.Read(chunkA[:4990])
+	chunkB := make([]byte, 4096)
+	rand.Read(chunkB)
+	chunkC := []byte("corrupted")
+	chunkD := []byte("not present")
+	backing := filepath.Join(cfg.CachePath, fscachePath(cfg.CacheDomain, "_slab_0"))
+	r.NoError(os.MkdirAll(filepath.Dir(backing), 0700))
+	slabData := make([]byte, 5<<12)
+	copy(slabData[0:], chunkA)
+	copy(slabData[2<<12:], chunkB)
+	copy(slabData[3<<12:], "CORRUPTED")
+	r.NoError(os.WriteFile(backing, slabData[:4<<12], 0600))
+
+	r.NoError(s.db.Update(func(tx *bbolt.Tx) error {
+		dp, _ := proto.Marshal(&pb.DbParams{Params: &pb.DaemonParams{Params: &pb.GlobalParams{DigestAlgo: cdig.Sha256}}})
+		r.NoError(tx.Bucket(metaBucket).Put(metaParams, dp))
+		sb, err := tx.Bucket(slabBucket).CreateBucket(slabKey(0))
+		r.NoError(err)
+		for addr, data := range map[uint32][]byte{0: chunkA, 2: chunkB, 3: chunkC, 4: chunkD} {
+			d := cdig.Sum(cdig.Sha256, data)
+			r.NoError(sb.Put(addrKey(addr), d[:]))
+		}
+		for _, addr := range []uint32{0, 2, 3} {
+			r.NoError(sb.Put(addrKey(addr|presentMask), []byte{}))
+		}
+		r.NoError(sb.SetSequence(5))
+		img, _ := proto.Marshal(&pb.DbImage{StorePath: "x", MountState: pb.MountState_Mounted, MountPoint: "/x", ImageSize: 123})
+		return tx.Bucket(imageBucket).Put([]byte("x"), img)
+	}))
+
+	var buf bytes.Buffer
+	zw := zstd.NewWriter(&buf)
+	stats, err := s.export(zw)
+	r.NoError(err)
+	r.NoError(zw.Close())
+	r.Equal(ExportStats{Slabs: 1, Chunks: 3, Bytes: 4 << 12}, stats)
+
+	dest := t.TempDir()
+	istats, err := Import(dest, &buf)
+	r.NoError(err)
+	r.Equal(ImportStats{Slabs: 1, Chunks: 2, Bytes: 3 << 12, BadChunks: 1, Unmounted: 1}, istats)
+
+	got, err := os.ReadFile(filepath.Join(dest, fscachePath(cfg.CacheDomain, "_slab_0")))
+	r.NoError(err)
+	r.Equal(4<<12, len(got))
+	r.Equal(chunkA, got[:len(chunkA)])
+	r.Equal(chunkB, got[2<<12:3<<12])
+	r.Equal(make([]byte, 1<<12), got[3<<12:]) // corrupted chunk not written
+
+	db, err := bbolt.Open(filepath.Join(dest, dbFilename), 0644, nil)
+	r.NoError(err)
+	defer db.Close()
+	r.NoError(db.View(func(tx *bbolt.Tx) error {
+		sb := tx.Bucket(slabBucket).Bucket(slabKey(0))
+		for addr, want := range map[uint32]bool{0: true, 2: true, 3: false, 4: false} {
+			r.Equal(want, sb.Get(addrKey(addr|presentMask)) != nil, "addr %d", addr)
+		}
+		var img pb.DbImage
+		r.NoError(proto.Unmarshal(tx.Bucket(imageBucket).Get([]byte("x")), &img))
+		r.Equal(pb.MountState_Unmounted, img.MountState)
+		return nil
+	}))
+
+	// refuses to overwrite
+	_, err = Import(dest, bytes.NewReader(nil))
+	r.Error(err)
+
+	// rejects huge sizes instead of trying to allocate or copy them
+	var bad bytes.Buffer
+	zw = zstd.NewWriter(&bad)
+	ew := &exportWriter{w: bufio.NewWriter(zw)}
+	ew.bytes([]byte(exportMagic))
+	ew.u8(12)
+	ew.u8(exportRecDb)
+	ew.u64(math.MaxUint64)
+	r.NoError(ew.w.Flush())
+	r.NoError(zw.Close())
+	_, err = Import(t.TempDir(), &bad)
+	r.ErrorContains(err, "bad db size")
+
+	er := &exportReader{r: bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))}
+	er.str()
+	r.ErrorContains(er.err, "too large")
+}
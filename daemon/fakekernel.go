@@ -0,0 +1,584 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lunixbochs/struc"
+	"golang.org/x/sys/unix"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/erofs"
+	"github.com/dnr/styx/pb"
+)
+
+// FakeKernel simulates cachefiles (in on-demand mode) and erofs in userspace, so the daemon
+// can be tested without root or kernel support. Use one per daemon.
+//
+// It talks to the daemon over a socketpair with the same messages as the real device. Backing
+// files are kept in the cache directory with the same layout as cachefiles, and missing data
+// is found with SEEK_HOLE like cachefiles does, so the cache directory has to be on a
+// filesystem that supports that. Mounted images are parsed with erofs.ImageReader. Files in
+// them can't be accessed through the filesystem, use ReadFile instead, which turns file reads
+// into slab reads and sends READ requests for missing data.
+type (
+	FakeKernel struct {
+		// how long to wait for the daemon to reply to a request
+		Timeout time.Duration
+
+		sendLock sync.Mutex
+		fd       int // our end of the socketpair
+
+		lock      sync.Mutex
+		cachePath string
+		lastId    uint32                  // for messages and objects
+		objects   map[string]*fakeObject  // by domain/fsid
+		mounts    map[string]*fakeMount   // by mount point
+		waiting   map[uint32]*fakeRequest // by msg id
+	}
+
+	fakeObject struct {
+		domain, fsid string
+		id           uint32 // changes on reopen
+		refs         int
+		ready        chan struct{} // closed when first open is done
+		err          error
+		f            *os.File
+		size         int64
+		opened       bool
+		reopen       bool // daemon lost its fd, open again before next read
+		openLock     sync.Mutex
+	}
+
+	fakeRequest struct {
+		opCode uint32
+		obj    *fakeObject
+		read   cachefiles_read
+		ch     chan int64 // copen size or read completion
+	}
+
+	fakeMount struct {
+		objs []*fakeObject // image, then devices. slab ids in ents are indexes into this.
+		blk  common.BlkShift
+		ents map[string]*erofs.ImageEntry
+		root string // for bind mounts
+	}
+)
+
+var _ Kernel = (*FakeKernel)(nil)
+
+func NewFakeKernel() *FakeKernel {
+	return &FakeKernel{
+		Timeout: 30 * time.Second,
+		fd:      -1,
+		objects: make(map[string]*fakeObject),
+		mounts:  make(map[string]*fakeMount),
+		waiting: make(map[uint32]*fakeRequest),
+	}
+}
+
+func (k *FakeKernel) Setup() error { return nil }
+
+func (k *FakeKernel) OpenDevNode(devPath, cachePath, tag string) (int, error) {
+	// seqpacket preserves message boundaries, like reads and writes on the device
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	k.lock.Lock()
+	k.cachePath = cachePath
+	k.lock.Unlock()
+	k.sendLock.Lock()
+	k.fd = fds[0]
+	k.sendLock.Unlock()
+	go k.readReplies(fds[0])
+	return fds[1], nil
+}
+
+func (k *FakeKernel) readReplies(fd int) {
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil || n == 0 {
+			break // daemon closed the device
+		}
+		cmd := string(buf[:n])
+		if rest, ok := strings.CutPrefix(cmd, "copen "); ok {
+			var msgId uint32
+			var size int64
+			if _, err := fmt.Sscanf(rest, "%d,%d", &msgId, &size); err == nil {
+				k.complete(msgId, size)
+			}
+		} else if cmd == "restore" {
+			go k.restore()
+		}
+	}
+
+	k.sendLock.Lock()
+	unix.Close(k.fd)
+	k.fd = -1
+	k.sendLock.Unlock()
+
+	k.lock.Lock()
+	for msgId, req := range k.waiting {
+		req.ch <- -int64(unix.EIO)
+		delete(k.waiting, msgId)
+	}
+	k.lock.Unlock()
+}
+
+// after a restore, the daemon has lost its fds (it probably restarted). like the kernel, get
+// objects reopened before their next read and resend requests that weren't completed.
+func (k *FakeKernel) restore() {
+	k.lock.Lock()
+	for _, o := range k.objects {
+		if o.opened {
+			o.reopen = true
+		}
+	}
+	reqs := maps.Clone(k.waiting)
+	k.lock.Unlock()
+	for msgId, req := range reqs {
+		go func() {
+			if err := k.deliver(msgId, req); err != nil {
+				k.complete(msgId, -int64(unix.EIO))
+			}
+		}()
+	}
+}
+
+func (k *FakeKernel) complete(msgId uint32, v int64) bool {
+	k.lock.Lock()
+	req := k.waiting[msgId]
+	delete(k.waiting, msgId)
+	k.lock.Unlock()
+	if req != nil {
+		req.ch <- v
+	}
+	return req != nil
+}
+
+func (k *FakeKernel) send(msgId, opCode, objectId uint32, data any) error {
+	var b bytes.Buffer
+	if err := struc.Pack(&b, &cachefiles_msg{MsgId: msgId, OpCode: opCode, ObjectId: objectId}); err != nil {
+		return err
+	} else if data != nil {
+		if err := struc.Pack(&b, data); err != nil {
+			return err
+		}
+	}
+	msg := b.Bytes()
+	binary.LittleEndian.PutUint32(msg[8:], uint32(len(msg)))
+
+	k.sendLock.Lock()
+	defer k.sendLock.Unlock()
+	if k.fd < 0 {
+		return unix.EBADF
+	} else if err := unix.Sendto(k.fd, msg, 0, nil); err != nil {
+		return err
+	}
+	// an empty message after each one ends the daemon's read loop, like an empty read from
+	// the device when there are no more requests
+	return unix.Sendto(k.fd, nil, 0, nil)
+}
+
+// sends a request and waits for the reply
+func (k *FakeKernel) request(req *fakeRequest) (int64, error) {
+	req.ch = make(chan int64, 1)
+	k.lock.Lock()
+	k.lastId++
+	msgId := k.lastId
+	k.waiting[msgId] = req
+	k.lock.Unlock()
+
+	if err := k.deliver(msgId, req); err != nil {
+		k.complete(msgId, 0)
+		return 0, err
+	}
+	select {
+	case v := <-req.ch:
+		return v, nil
+	case <-time.After(k.Timeout):
+		k.complete(msgId, 0)
+		return 0, unix.ETIMEDOUT
+	}
+}
+
+func (k *FakeKernel) deliver(msgId uint32, req *fakeRequest) error {
+	o := req.obj
+	switch req.opCode {
+	case CACHEFILES_OP_OPEN:
+		// the daemon gets its own fd, like the anonymous fd from the kernel
+		dfd, err := unix.Dup(int(o.f.Fd()))
+		if err != nil {
+			return err
+		}
+		k.lock.Lock()
+		id := o.id
+		k.lock.Unlock()
+		err = k.send(msgId, CACHEFILES_OP_OPEN, id, &cachefiles_open{
+			Fd:        uint32(dfd),
+			VolumeKey: []byte("erofs," + o.domain + "\x00"),
+			CookieKey: []byte(o.fsid),
+		})
+		if err != nil {
+			unix.Close(dfd)
+		}
+		return err
+	case CACHEFILES_OP_READ:
+		if err := k.reopen(o); err != nil {
+			return err
+		}
+		k.lock.Lock()
+		id := o.id
+		k.lock.Unlock()
+		return k.send(msgId, CACHEFILES_OP_READ, id, &req.read)
+	default:
+		return unix.EINVAL
+	}
+}
+
+func (k *FakeKernel) ReadComplete(fd, msgId uint32) error {
+	if !k.complete(msgId, 0) {
+		return unix.EINVAL
+	}
+	return nil
+}
+
+// objects
+
+func (k *FakeKernel) acquire(domain, fsid string) (*fakeObject, error) {
+	key := domain + "/" + fsid
+	k.lock.Lock()
+	if o := k.objects[key]; o != nil {
+		o.refs++
+		k.lock.Unlock()
+		<-o.ready
+		return common.ValOrErr(o, o.err)
+	}
+	k.lastId++
+	o := &fakeObject{domain: domain, fsid: fsid, id: k.lastId, refs: 1, ready: make(chan struct{})}
+	k.objects[key] = o
+	cachePath := k.cachePath
+	k.lock.Unlock()
+
+	o.err = k.open(o, filepath.Join(cachePath, fscachePath(domain, fsid)))
+	close(o.ready)
+	if o.err != nil {
+		k.lock.Lock()
+		delete(k.objects, key)
+		k.lock.Unlock()
+	}
+	return common.ValOrErr(o, o.err)
+}
+
+func (k *FakeKernel) open(o *fakeObject, backingPath string) error {
+	if err := os.MkdirAll(filepath.Dir(backingPath), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(backingPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	o.f = f
+	size, err := k.request(&fakeRequest{opCode: CACHEFILES_OP_OPEN, obj: o})
+	if err == nil && size < 0 {
+		// daemon closes its fd on error
+		err = unix.Errno(-size)
+	}
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	k.lock.Lock()
+	o.size, o.opened = size, true
+	k.lock.Unlock()
+	return nil
+}
+
+// reopen sends a new OPEN with a new object id if the daemon lost its fd
+func (k *FakeKernel) reopen(o *fakeObject) error {
+	o.openLock.Lock()
+	defer o.openLock.Unlock()
+	k.lock.Lock()
+	need := o.reopen
+	if need {
+		k.lastId++
+		o.id = k.lastId
+	}
+	k.lock.Unlock()
+	if !need {
+		return nil
+	}
+	size, err := k.request(&fakeRequest{opCode: CACHEFILES_OP_OPEN, obj: o})
+	if err != nil {
+		return err
+	} else if size < 0 {
+		return unix.Errno(-size)
+	}
+	k.lock.Lock()
+	o.reopen = false
+	k.lock.Unlock()
+	return nil
+}
+
+func (k *FakeKernel) release(objs []*fakeObject) {
+	var closed []*fakeObject
+	var msgIds, objectIds []uint32
+	k.lock.Lock()
+	for _, o := range objs {
+		if o.refs--; o.refs == 0 {
+			delete(k.objects, o.domain+"/"+o.fsid)
+			closed = append(closed, o)
+			k.lastId++
+			msgIds = append(msgIds, k.lastId)
+			objectIds = append(objectIds, o.id)
+		}
+	}
+	k.lock.Unlock()
+
+	for i, o := range closed {
+		// close has no reply
+		_ = k.send(msgIds[i], CACHEFILES_OP_CLOSE, objectIds[i], nil)
+		o.f.Close()
+	}
+}
+
+// ensure sends READ requests for missing data in [off, off+n) of o.
+func (k *FakeKernel) ensure(o *fakeObject, off, n int64) error {
+	fd := int(o.f.Fd())
+	end := min(off+n, o.size)
+	for off < end {
+		hole, err := unix.Seek(fd, off, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		} else if hole >= end {
+			return nil
+		}
+		data, err := unix.Seek(fd, hole, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			data = end
+		} else if err != nil {
+			return err
+		}
+		// don't ask for more than a chunk at once
+		ln := min(data, end, (hole>>common.ChunkShift+1)<<common.ChunkShift) - hole
+		read := cachefiles_read{Off: uint64(hole), Len: uint64(ln)}
+		if res, err := k.request(&fakeRequest{opCode: CACHEFILES_OP_READ, obj: o, read: read}); err != nil {
+			return err
+		} else if res < 0 {
+			return unix.Errno(-res)
+		}
+		if after, err := unix.Seek(fd, hole, unix.SEEK_HOLE); err != nil {
+			return err
+		} else if after == hole {
+			return unix.EIO // daemon didn't write anything
+		}
+		off = hole
+	}
+	return nil
+}
+
+// mounts
+
+func (k *FakeKernel) Mount(domain, fsid, mountPoint string) error {
+	if st, err := os.Stat(mountPoint); err != nil {
+		return err
+	} else if !st.IsDir() {
+		return unix.ENOTDIR
+	}
+	img, err := k.acquire(domain, fsid)
+	if err != nil {
+		return err
+	}
+	objs := []*fakeObject{img}
+	m, err := k.load(domain, &objs)
+	if err == nil {
+		k.lock.Lock()
+		if k.mounts[mountPoint] != nil {
+			err = unix.EBUSY
+		} else {
+			k.mounts[mountPoint] = m
+		}
+		k.lock.Unlock()
+	}
+	if err != nil {
+		k.release(objs)
+	}
+	return err
+}
+
+func (k *FakeKernel) load(domain string, objs *[]*fakeObject) (*fakeMount, error) {
+	img := (*objs)[0]
+	// erofs reads metadata as it needs it, but the daemon writes whole images anyway
+	if err := k.ensure(img, 0, img.size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, img.size)
+	if _, err := img.f.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	ir, err := erofs.NewImageReader(data, func(tag string) (uint16, error) {
+		dev, err := k.acquire(domain, tag)
+		if err != nil {
+			return 0, err
+		}
+		*objs = append(*objs, dev)
+		return uint16(len(*objs) - 1), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ents, err := ir.Entries()
+	if err != nil {
+		return nil, err
+	}
+	m := &fakeMount{
+		objs: *objs,
+		blk:  ir.BlockShift(),
+		ents: make(map[string]*erofs.ImageEntry),
+		root: "/",
+	}
+	if ir.IsBare() {
+		// put back what Entries hides
+		m.ents["/"] = &erofs.ImageEntry{Path: "/", Type: pb.EntryType_DIRECTORY}
+		ents[0].Path = erofs.BarePath
+	}
+	for _, e := range ents {
+		m.ents[e.Path] = e
+	}
+	return m, nil
+}
+
+// returns the mount containing p and the path within it. call with lock held.
+func (k *FakeKernel) find(p string) (*fakeMount, string) {
+	var best string
+	var m *fakeMount
+	for mp, mm := range k.mounts {
+		if underDir(p, mp) && len(mp) >= len(best) {
+			best, m = mp, mm
+		}
+	}
+	if m == nil {
+		return nil, ""
+	}
+	return m, path.Join(m.root, p[len(best):])
+}
+
+func (k *FakeKernel) BindMount(src, target string) error {
+	if _, err := os.Stat(target); err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	m, rel := k.find(src)
+	if m == nil {
+		return unix.EINVAL // only supports binding from fake mounts
+	} else if m.ents[rel] == nil {
+		return unix.ENOENT
+	} else if k.mounts[target] != nil {
+		return unix.EBUSY
+	}
+	for _, o := range m.objs {
+		o.refs++
+	}
+	k.mounts[target] = &fakeMount{objs: m.objs, blk: m.blk, ents: m.ents, root: rel}
+	return nil
+}
+
+func (k *FakeKernel) Unmount(mountPoint string) error {
+	k.lock.Lock()
+	m := k.mounts[mountPoint]
+	delete(k.mounts, mountPoint)
+	k.lock.Unlock()
+	if m == nil {
+		return unix.EINVAL
+	}
+	k.release(m.objs)
+	return nil
+}
+
+func (k *FakeKernel) IsMounted(p string) (bool, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.mounts[p] != nil, nil
+}
+
+func (k *FakeKernel) OpenFile(p string) (int, error) {
+	k.lock.Lock()
+	m, rel := k.find(p)
+	k.lock.Unlock()
+	if m == nil {
+		return unix.Open(p, unix.O_RDONLY, 0)
+	}
+	e := m.ents[rel]
+	if e == nil {
+		return 0, unix.ENOENT
+	} else if e.Extent == nil || e.Extent.Addr != 0 {
+		return 0, unix.EINVAL // only slab image files are supported
+	}
+	// the daemon only reads data it knows is present from these, so it doesn't matter that
+	// reads won't send requests
+	return unix.Dup(int(m.objs[e.Extent.SlabId].f.Fd()))
+}
+
+// ReadFile reads a regular file in a fake mount, sending READ requests for missing data.
+func (k *FakeKernel) ReadFile(p string) ([]byte, error) {
+	k.lock.Lock()
+	m, rel := k.find(p)
+	k.lock.Unlock()
+	if m == nil {
+		return nil, fmt.Errorf("%s is not in a fake mount", p)
+	}
+	e := m.ents[rel]
+	switch {
+	case e == nil:
+		return nil, unix.ENOENT
+	case e.Type == pb.EntryType_DIRECTORY:
+		return nil, unix.EISDIR
+	case e.Type != pb.EntryType_REGULAR:
+		return nil, unix.EINVAL
+	case e.Extent != nil:
+		return k.readDevice(m, *e.Extent, e.Size)
+	case e.Chunks == nil:
+		return e.Data, nil
+	}
+	out := make([]byte, 0, e.Size)
+	for i, loc := range e.Chunks {
+		b, err := k.readDevice(m, loc, min(e.ChunkShift.Size(), e.Size-int64(i)<<e.ChunkShift))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+func (k *FakeKernel) readDevice(m *fakeMount, loc erofs.SlabLoc, n int64) ([]byte, error) {
+	if loc.SlabId == 0 || int(loc.SlabId) >= len(m.objs) {
+		return nil, fmt.Errorf("bad device %d", loc.SlabId)
+	}
+	o := m.objs[loc.SlabId]
+	off := int64(loc.Addr) << m.blk
+	if err := k.ensure(o, off, n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := o.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
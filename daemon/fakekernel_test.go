@@ -0,0 +1,785 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/common/tracing"
+	"github.com/dnr/styx/manifester"
+	"github.com/dnr/styx/pb"
+)
+
+type testFdStore map[string]int
+
+func (s testFdStore) Ready() {}
+func (s testFdStore) GetFd(name string) (int, error) {
+	if fd, ok := s[name]; ok {
+		return fd, nil
+	}
+	return 0, errors.New("missing")
+}
+func (s testFdStore) SaveFd(name string, fd int) { s[name] = fd }
+func (s testFdStore) RemoveFd(name string)       { delete(s, name) }
+
+// daemon on a fake kernel with an embedded manifester reading from a file:// binary cache
+type fakeEnv struct {
+	t        *testing.T
+	r        *require.Assertions
+	tmp      string
+	upstream string
+	nixSk    signature.SecretKey
+	pk       signature.PublicKey
+	fk       *FakeKernel
+	cfg      Config
+	refs     map[string][]string // store path -> references for narinfo (set before adding)
+}
+
+func newFakeEnv(t *testing.T) *fakeEnv {
+	r := require.New(t)
+	tmp := t.TempDir()
+	nixSk, nixPk, err := signature.GenerateKeypair("nix-test-1", rand.Reader)
+	r.NoError(err)
+	sk, pk, err := signature.GenerateKeypair("styx-test-1", rand.Reader)
+	r.NoError(err)
+	skFile := filepath.Join(tmp, "sign.secret")
+	r.NoError(os.WriteFile(skFile, []byte(sk.String()), 0600))
+
+	fk := NewFakeKernel()
+	return &fakeEnv{
+		t:        t,
+		r:        r,
+		tmp:      tmp,
+		upstream: filepath.Join(tmp, "upstream"),
+		nixSk:    nixSk,
+		pk:       pk,
+		fk:       fk,
+		refs:     make(map[string][]string),
+		cfg: Config{
+			DevPath:         "/dev/null",
+			CachePath:       filepath.Join(tmp, "cache"),
+			CacheTag:        "styxtest",
+			CacheDomain:     "styxtest",
+			ErofsBlockShift: 12,
+			Workers:         4,
+			Embedded: EmbeddedConfig{
+				ChunkDir:    filepath.Join(tmp, "chunks"),
+				SignKeyFile: skFile,
+				NixPubKeys:  []string{nixPk.String()},
+				UseDiffs:    true,
+			},
+			IsTesting: true,
+			FdStore:   make(testFdStore),
+			Kernel:    fk,
+		},
+	}
+}
+
+// adds a store path to the binary cache. headers are in nar order, with contents for
+// regular files.
+func (e *fakeEnv) addStorePath(sp string, hdrs []*nar.Header, contents [][]byte) {
+	r := e.r
+	var nb bytes.Buffer
+	nw, err := nar.NewWriter(&nb)
+	r.NoError(err)
+	for i, h := range hdrs {
+		r.NoError(nw.WriteHeader(h))
+		if h.Type == nar.TypeRegular {
+			_, err = nw.Write(contents[i])
+			r.NoError(err)
+		}
+	}
+	r.NoError(nw.Close())
+
+	sum := sha256.Sum256(nb.Bytes())
+	nh, err := hash.ParseNixBase32("sha256:" + nixbase32.EncodeToString(sum[:]))
+	r.NoError(err)
+	ni := &narinfo.NarInfo{
+		StorePath:   sp,
+		URL:         "nar/" + sp[11:43] + ".nar",
+		Compression: "none",
+		NarHash:     nh,
+		NarSize:     uint64(nb.Len()),
+		FileHash:    nh,
+		FileSize:    uint64(nb.Len()),
+		References:  e.refs[sp],
+	}
+	sig, err := e.nixSk.Sign(nil, ni.Fingerprint())
+	r.NoError(err)
+	ni.Signatures = append(ni.Signatures, sig)
+	r.NoError(os.MkdirAll(filepath.Join(e.upstream, "nar"), 0755))
+	r.NoError(os.WriteFile(filepath.Join(e.upstream, sp[11:43]+".narinfo"), []byte(ni.String()), 0644))
+	r.NoError(os.WriteFile(filepath.Join(e.upstream, ni.URL), nb.Bytes(), 0644))
+}
+
+func (e *fakeEnv) start() *Server {
+	s := NewServer(e.cfg)
+	e.r.NoError(s.Start())
+	return s
+}
+
+func (e *fakeEnv) init(s *Server) {
+	_, err := s.handleInitReq(context.Background(), &InitReq{
+		PubKeys: []string{e.pk.String()},
+		Params: pb.DaemonParams{Params: &pb.GlobalParams{
+			ChunkShift: int32(common.ChunkShift),
+			DigestAlgo: common.DigestAlgo,
+			DigestBits: cdig.Bits,
+		}},
+	})
+	e.r.NoError(err)
+}
+
+func (e *fakeEnv) mount(s *Server, sp string, bare bool) string {
+	mp := filepath.Join(e.tmp, "mnt", sp[11:])
+	if !bare {
+		e.r.NoError(os.MkdirAll(mp, 0755))
+	}
+	_, err := s.handleMountReq(context.Background(), &MountReq{
+		Upstream:   "file://" + e.upstream + "/",
+		StorePath:  sp[11:],
+		MountPoint: mp,
+	})
+	e.r.NoError(err)
+	return mp
+}
+
+func testRandom(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// adds a small package with one big file
+func (e *fakeEnv) addPkg(sp string, big []byte) {
+	e.addStorePath(sp, []*nar.Header{
+		{Path: "/", Type: nar.TypeDirectory},
+		{Path: "/big", Type: nar.TypeRegular, Size: int64(len(big))},
+		{Path: "/link", Type: nar.TypeSymlink, LinkTarget: "big"},
+		{Path: "/small", Type: nar.TypeRegular, Size: 5, Executable: true},
+	}, [][]byte{nil, big, nil, []byte("hello")})
+}
+
+func TestFakeKernelMount(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+	ctx := context.Background()
+
+	big := testRandom(300000)
+	bare := testRandom(100000)
+	big2 := bytes.Clone(big)
+	copy(big2[150000:], "a small change")
+
+	const (
+		sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+		sp2 = "/nix/store/11111111111111111111111111111111-bare"
+		sp3 = "/nix/store/22222222222222222222222222222222-pkg-1.1"
+	)
+	e.addPkg(sp1, big)
+	e.addStorePath(sp2, []*nar.Header{{Path: "/", Type: nar.TypeRegular, Size: int64(len(bare))}}, [][]byte{bare})
+	e.addPkg(sp3, big2)
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+
+	// directory
+	mp1 := e.mount(s, sp1, false)
+	got, err := e.fk.ReadFile(mp1 + "/small")
+	r.NoError(err)
+	r.Equal("hello", string(got))
+	got, err = e.fk.ReadFile(mp1 + "/big")
+	r.NoError(err)
+	r.Equal(big, got)
+	r.Positive(s.stats.slabReads.Load())
+
+	// bare file, prefetched so reading doesn't need any requests
+	mp2 := e.mount(s, sp2, true)
+	_, err = s.handlePrefetchReq(ctx, &PrefetchReq{Path: "/", StorePath: sp2[11:]})
+	r.NoError(err)
+	reads := s.stats.slabReads.Load()
+	got, err = e.fk.ReadFile(mp2)
+	r.NoError(err)
+	r.Equal(bare, got)
+	r.Equal(reads, s.stats.slabReads.Load())
+
+	// similar package gets a diff
+	mp3 := e.mount(s, sp3, false)
+	got, err = e.fk.ReadFile(mp3 + "/big")
+	r.NoError(err)
+	r.Equal(big2, got)
+	r.Positive(s.stats.diffReqs.Load())
+
+	// unmount
+	_, err = s.handleUmountReq(ctx, &UmountReq{StorePath: sp1[11:]})
+	r.NoError(err)
+	mounted, _ := e.fk.IsMounted(mp1)
+	r.False(mounted)
+	_, err = e.fk.ReadFile(mp1 + "/small")
+	r.Error(err)
+}
+
+func TestFakeKernelEmbeddedLocal(t *testing.T) {
+	e := newFakeEnv(t)
+	e.cfg.Embedded.UseDiffs = false
+	r := e.r
+	ctx := context.Background()
+
+	big := testRandom(300000)
+	big2 := bytes.Clone(big)
+	copy(big2[150000:], "a small change")
+	const (
+		sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+		sp3 = "/nix/store/22222222222222222222222222222222-pkg-1.1"
+	)
+	e.addPkg(sp1, big)
+	e.addPkg(sp3, big2)
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+
+	mp1 := e.mount(s, sp1, false)
+	got, err := e.fk.ReadFile(mp1 + "/big")
+	r.NoError(err)
+	r.Equal(big, got)
+
+	// prefetch and similar package both read chunks directly
+	mp3 := e.mount(s, sp3, false)
+	_, err = s.handlePrefetchReq(ctx, &PrefetchReq{Path: "/", StorePath: sp3[11:]})
+	r.NoError(err)
+	got, err = e.fk.ReadFile(mp3 + "/big")
+	r.NoError(err)
+	r.Equal(big2, got)
+	r.Positive(s.stats.singleReqs.Load())
+	r.Zero(s.stats.diffReqs.Load())
+	r.Zero(s.stats.batchReqs.Load())
+}
+
+func TestFakeKernelRestore(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+
+	const sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+	const sp2 = "/nix/store/11111111111111111111111111111111-other-1.0"
+	big1, big2 := testRandom(200000), testRandom(200000)
+	e.addPkg(sp1, big1)
+	e.addPkg(sp2, big2)
+
+	s := e.start()
+	e.init(s)
+	mp1 := e.mount(s, sp1, false)
+	mp2 := e.mount(s, sp2, false)
+	got, err := e.fk.ReadFile(mp1 + "/big")
+	r.NoError(err)
+	r.Equal(big1, got)
+
+	// "crash": the daemon loses its object fds but the devnode stays in the fd store
+	s.Stop(false)
+
+	// reads wait while the daemon is down
+	type result struct {
+		b   []byte
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		b, err := e.fk.ReadFile(mp2 + "/big")
+		done <- result{b, err}
+	}()
+	select {
+	case <-done:
+		t.Fatal("read finished without daemon")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// restart: outstanding read gets replayed, mounts still work without remounting
+	s = e.start()
+	defer s.Stop(true)
+	res := <-done
+	r.NoError(res.err)
+	r.Equal(big2, res.b)
+
+	got, err = e.fk.ReadFile(mp1 + "/big")
+	r.NoError(err)
+	r.Equal(big1, got)
+	r.Zero(s.stats.slabReadErrs.Load())
+}
+
+func TestFakeKernelTrace(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+
+	const sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+	const sp2 = "/nix/store/11111111111111111111111111111111-other-1.0"
+	big := testRandom(300000)
+	e.addPkg(sp1, big)
+	e.addPkg(sp2, testRandom(1000))
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+	mp1 := e.mount(s, sp1, false)
+
+	all := s.trace.subscribe(s, nil)
+	defer s.trace.unsubscribe(all)
+	other := s.trace.subscribe(s, []string{sp2[11:43]})
+	defer s.trace.unsubscribe(other)
+
+	got, err := e.fk.ReadFile(mp1 + "/big")
+	r.NoError(err)
+	r.Equal(big, got)
+
+	chunks := make(map[int]bool)
+	for len(all.ch) > 0 {
+		ev := all.resolve(s, <-all.ch)
+		r.NotNil(ev)
+		r.Equal(sp1[11:], ev.StorePath)
+		r.Equal("/big", ev.Path)
+		r.Empty(ev.Error)
+		r.NotEmpty(ev.Op)
+		chunks[ev.Chunk] = true
+	}
+	r.True(chunks[0])
+	r.NotZero(len(other.ch))
+	for len(other.ch) > 0 {
+		r.Nil(other.resolve(s, <-other.ch))
+	}
+
+	res, err := s.handleInflightReq(context.Background(), &InflightReq{})
+	r.NoError(err)
+	r.Empty(res.Reads)
+}
+
+func TestFakeKernelList(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+	ctx := context.Background()
+
+	const sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+	const sp2 = "/nix/store/11111111111111111111111111111111-other-1.0"
+	big := testRandom(300000)
+	e.addPkg(sp1, big)
+	e.addPkg(sp2, testRandom(1000))
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+	mp1 := e.mount(s, sp1, false)
+	e.mount(s, sp2, false)
+	_, err := e.fk.ReadFile(mp1 + "/big")
+	r.NoError(err)
+	_, err = s.handleUmountReq(ctx, &UmountReq{StorePath: sp2[11:]})
+	r.NoError(err)
+
+	res, err := s.handleListReq(ctx, &ListReq{})
+	r.NoError(err)
+	r.Equal(2, res.Total)
+	r.Equal(sp2[11:], res.Images[0].StorePath) // "other" sorts before "pkg"
+	r.Equal(sp1[11:], res.Images[1].StorePath)
+	img := res.Images[1]
+	r.Equal("Mounted", img.MountState)
+	r.Equal(mp1, img.MountPoint)
+	r.Positive(img.ImageSize)
+	r.Positive(img.LastFetch)
+	r.Equal(img.TotalChunks, img.PresentChunks)
+	r.GreaterOrEqual(img.PresentBytes, int64(len(big)))
+
+	res, err = s.handleListReq(ctx, &ListReq{Sort: "state", Limit: 1})
+	r.NoError(err)
+	r.Equal(2, res.Total)
+	r.Len(res.Images, 1)
+	r.Equal(sp1[11:], res.Images[0].StorePath)
+
+	res, err = s.handleListReq(ctx, &ListReq{Sort: "state", Offset: 1})
+	r.NoError(err)
+	r.Len(res.Images, 1)
+	r.Equal(sp2[11:], res.Images[0].StorePath)
+
+	res, err = s.handleListReq(ctx, &ListReq{States: []string{"Unmounted"}})
+	r.NoError(err)
+	r.Len(res.Images, 1)
+	r.Equal(sp2[11:], res.Images[0].StorePath)
+
+	res, err = s.handleListReq(ctx, &ListReq{Name: "pkg"})
+	r.NoError(err)
+	r.Len(res.Images, 1)
+	r.Equal(sp1[11:], res.Images[0].StorePath)
+
+	_, err = s.handleListReq(ctx, &ListReq{Sort: "color"})
+	r.Error(err)
+	_, err = s.handleListReq(ctx, &ListReq{States: []string{"Happy"}})
+	r.Error(err)
+}
+
+func TestFakeKernelDu(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+	ctx := context.Background()
+
+	const sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+	const sp2 = "/nix/store/11111111111111111111111111111111-other-1.0"
+	const sp3 = "/nix/store/22222222222222222222222222222222-pkg-1.1"
+	big := testRandom(300000)
+	big3 := bytes.Clone(big)
+	copy(big3[150000:], "a small change")
+	e.addPkg(sp1, big)
+	e.addPkg(sp2, testRandom(200000))
+	e.addPkg(sp3, big3)
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+	for _, sp := range []string{sp1, sp2, sp3} {
+		mp := e.mount(s, sp, false)
+		_, err := e.fk.ReadFile(mp + "/big")
+		r.NoError(err)
+	}
+
+	res, err := s.handleDuReq(ctx, &DuReq{})
+	r.NoError(err)
+	r.Len(res.Images, 3)
+	byPath := make(map[string]*DuImage)
+	for _, di := range res.Images {
+		r.Positive(di.NarSize)
+		r.Equal(di.PresentBytes, di.ExclusiveBytes+di.SharedBytes)
+		r.Equal(di.ExclusiveBytes+di.ImageSize, di.FreedBytes)
+		byPath[di.StorePath] = di
+	}
+	// other has nothing in common with the pkgs
+	other := byPath[sp2[11:]]
+	r.Zero(other.SharedBytes)
+	r.GreaterOrEqual(other.ExclusiveBytes, int64(200000))
+	// most of pkg-1.0 and 1.1 are shared
+	p1, p3 := byPath[sp1[11:]], byPath[sp3[11:]]
+	r.Greater(p1.SharedBytes, p1.ExclusiveBytes)
+	r.Equal(p1.SharedBytes, p3.SharedBytes)
+	r.Equal(res.Cache.SlabBytes, res.Cache.UnownedBytes+p1.PresentBytes+p3.ExclusiveBytes+other.PresentBytes)
+	r.Equal(p1.NarSize+p3.NarSize+other.NarSize, res.Cache.NarSize)
+
+	// removing both pkgs frees the shared part too
+	res, err = s.handleDuReq(ctx, &DuReq{Images: []string{sp1[11:], sp3[11:]}})
+	r.NoError(err)
+	r.Len(res.Images, 2)
+	r.NotNil(res.Set)
+	r.Equal(p1.PresentBytes+p3.ExclusiveBytes, res.Set.ExclusiveBytes)
+	r.Zero(res.Set.SharedBytes)
+
+	_, err = s.handleDuReq(ctx, &DuReq{Images: []string{"33333333333333333333333333333333"}})
+	r.Error(err)
+}
+
+func TestFakeKernelEstimate(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+	ctx := context.Background()
+
+	const sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+	const sp2 = "/nix/store/11111111111111111111111111111111-other-1.0"
+	const sp3 = "/nix/store/22222222222222222222222222222222-pkg-1.1"
+	const sp4 = "/nix/store/33333333333333333333333333333333-other-1.1"
+	big := testRandom(300000)
+	big3 := bytes.Clone(big)
+	copy(big3[150000:], "a small change")
+	other := testRandom(200000)
+	other4 := bytes.Clone(other)
+	copy(other4[100000:], "a small change")
+	e.addPkg(sp1, big)
+	e.addPkg(sp2, other)
+	e.refs[sp3] = []string{sp1[11:], sp2[11:]}
+	e.addPkg(sp3, big3)
+	e.addPkg(sp4, other4)
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+	mp1 := e.mount(s, sp1, false)
+	_, err := e.fk.ReadFile(mp1 + "/big")
+	r.NoError(err)
+	before := s.stats.export()
+
+	res, err := s.handleEstimateReq(ctx, &EstimateReq{
+		Upstream:   "file://" + e.upstream,
+		StorePaths: []string{sp3},
+		Closure:    true,
+	})
+	r.NoError(err)
+	r.Len(res.Paths, 3)
+	r.Equal(1, res.Installed)
+	byPath := make(map[string]*EstimateEntry)
+	for _, p := range res.Paths {
+		r.Empty(p.Error)
+		byPath[p.StorePath] = p
+	}
+	r.True(byPath[sp1[11:]].Installed)
+
+	// pkg-1.1 diffs against pkg-1.0, only the changed chunk is missing
+	p3 := byPath[sp3[11:]]
+	r.Equal(sp1[11:], p3.Base)
+	r.Equal(1, p3.DiffChunks)
+	r.Zero(p3.FetchBytes)
+	r.Greater(p3.PresentBytes, p3.DiffBytes)
+	r.Positive(p3.ManifestBytes)
+	r.Positive(p3.FileSize)
+
+	// other has no base
+	p2 := byPath[sp2[11:]]
+	r.Empty(p2.Base)
+	r.Zero(p2.DiffBytes)
+	r.GreaterOrEqual(p2.FetchBytes, int64(200000))
+
+	r.Equal(p2.FetchBytes, res.Total.FetchBytes)
+	r.Equal(p2.FileSize+p3.FileSize, res.Total.FileSize)
+
+	// nothing was downloaded or recorded
+	after := s.stats.export()
+	r.Equal(before.SingleReqs, after.SingleReqs)
+	r.Equal(before.DiffReqs, after.DiffReqs)
+	r.Equal(before.BatchReqs, after.BatchReqs)
+	list, err := s.handleListReq(ctx, &ListReq{})
+	r.NoError(err)
+	r.Equal(1, list.Total)
+
+	// earlier paths in the request can be bases for later ones
+	res, err = s.handleEstimateReq(ctx, &EstimateReq{
+		Upstream:   "file://" + e.upstream,
+		StorePaths: []string{sp2, sp4},
+	})
+	r.NoError(err)
+	r.Len(res.Paths, 2)
+	r.Empty(res.Paths[0].Base)
+	p4 := res.Paths[1]
+	r.Equal(sp2[11:], p4.Base)
+	r.Equal(1, p4.DiffChunks)
+	r.Zero(p4.FetchBytes)
+	r.Greater(p4.PresentBytes, p4.DiffBytes)
+}
+
+func TestFakeKernelMaterializeUpdate(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+	ctx := context.Background()
+
+	const sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+	const sp3 = "/nix/store/22222222222222222222222222222222-pkg-1.1"
+	big := testRandom(300000)
+	big3 := bytes.Clone(big)
+	copy(big3[150000:], "a small change")
+	e.addPkg(sp1, big)
+	e.addStorePath(sp3, []*nar.Header{
+		{Path: "/", Type: nar.TypeDirectory},
+		{Path: "/big", Type: nar.TypeRegular, Size: int64(len(big3))},
+		{Path: "/new", Type: nar.TypeRegular, Size: 3},
+		{Path: "/small", Type: nar.TypeRegular, Size: 5, Executable: true},
+	}, [][]byte{nil, big3, []byte("new"), []byte("hello")})
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+
+	dest := filepath.Join(e.tmp, "dest")
+	materialize := func(sp string) {
+		_, err := s.handleMaterializeReq(ctx, &MaterializeReq{
+			Upstream:  "file://" + e.upstream + "/",
+			StorePath: sp[11:],
+			DestPath:  dest,
+			Update:    true,
+		})
+		r.NoError(err)
+		_, err = os.Lstat(dest + ".styx-new")
+		r.True(os.IsNotExist(err))
+	}
+
+	// first one has nothing to update
+	materialize(sp1)
+	got, err := os.ReadFile(dest + "/big")
+	r.NoError(err)
+	r.Equal(big, got)
+	small1, err := os.Stat(dest + "/small")
+	r.NoError(err)
+	big1, err := os.Stat(dest + "/big")
+	r.NoError(err)
+
+	// update using recorded manifest
+	materialize(sp3)
+	got, err = os.ReadFile(dest + "/big")
+	r.NoError(err)
+	r.Equal(big3, got)
+	got, err = os.ReadFile(dest + "/new")
+	r.NoError(err)
+	r.Equal("new", string(got))
+	_, err = os.Lstat(dest + "/link")
+	r.True(os.IsNotExist(err))
+	st, err := os.Stat(dest + "/small")
+	r.NoError(err)
+	r.True(os.SameFile(small1, st))
+	r.NotZero(st.Mode() & 0o100)
+	st, err = os.Stat(dest + "/big")
+	r.NoError(err)
+	r.False(os.SameFile(big1, st))
+
+	// update without a record, comparing contents
+	r.NoError(s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(materializedBucket).Delete([]byte(dest))
+	}))
+	materialize(sp1)
+	got, err = os.ReadFile(dest + "/big")
+	r.NoError(err)
+	r.Equal(big, got)
+	target, err := os.Readlink(dest + "/link")
+	r.NoError(err)
+	r.Equal("big", target)
+	_, err = os.Lstat(dest + "/new")
+	r.True(os.IsNotExist(err))
+	st, err = os.Stat(dest + "/small")
+	r.NoError(err)
+	r.True(os.SameFile(small1, st))
+
+	// in place, as for a mount point (chunks are all present from before)
+	destSt, err := os.Stat(dest)
+	r.NoError(err)
+	var m3 *pb.Manifest
+	r.NoError(s.db.View(func(tx *bbolt.Tx) error {
+		m3, err = s.getManifestLocal(tx, []byte(sp3[11:43]))
+		return err
+	}))
+	r.NoError(s.materializeInPlace(dest, m3, s.materializeReuse(dest, m3)))
+	st, err = os.Stat(dest)
+	r.NoError(err)
+	r.True(os.SameFile(destSt, st))
+	got, err = os.ReadFile(dest + "/big")
+	r.NoError(err)
+	r.Equal(big3, got)
+	got, err = os.ReadFile(dest + "/new")
+	r.NoError(err)
+	r.Equal("new", string(got))
+	_, err = os.Lstat(dest + "/link")
+	r.True(os.IsNotExist(err))
+	st, err = os.Stat(dest + "/small")
+	r.NoError(err)
+	r.True(os.SameFile(small1, st))
+	names, err := os.ReadDir(dest)
+	r.NoError(err)
+	r.Len(names, 3)
+}
+
+func TestFakeKernelTracing(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+
+	exp := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	defer otel.SetTracerProvider(prev)
+	_, err := tracing.Setup(context.Background(), tracing.Config{})
+	r.NoError(err)
+
+	const sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+	big := testRandom(300000)
+	e.addPkg(sp1, big)
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+	mp1 := e.mount(s, sp1, false)
+	got, err := e.fk.ReadFile(mp1 + "/big")
+	r.NoError(err)
+	r.Equal(big, got)
+
+	// follow parents from a chunk fetch in the (embedded) manifester back to the kernel read
+	spans := exp.GetSpans()
+	byId := make(map[trace.SpanID]tracetest.SpanStub)
+	for _, s := range spans {
+		byId[s.SpanContext.SpanID()] = s
+	}
+	idx := slices.IndexFunc(spans, func(s tracetest.SpanStub) bool { return s.Name == "get chunk" })
+	r.GreaterOrEqual(idx, 0)
+	var chain []string
+	for s, ok := spans[idx], true; ok; s, ok = byId[s.Parent.SpanID()] {
+		chain = append(chain, s.Name)
+	}
+	r.Equal([]string{
+		"get chunk",
+		"load diff data",
+		"POST " + manifester.ChunkDiffV2Path,
+		"chunk diff",
+		"diff op",
+		"request chunk",
+		"read slab",
+	}, chain)
+}
+
+func TestFakeKernelPrecomputed(t *testing.T) {
+	e := newFakeEnv(t)
+	r := e.r
+	ctx := context.Background()
+	r.Equal(InitOpSize, manifester.PrecomputeOpSize)
+
+	const sp1 = "/nix/store/00000000000000000000000000000000-pkg-1.0"
+	const sp3 = "/nix/store/22222222222222222222222222222222-pkg-1.1"
+	big := testRandom(300000)
+	big3 := bytes.Clone(big)
+	copy(big3[150000:], "a small change")
+	e.addPkg(sp1, big)
+	e.addPkg(sp3, big3)
+
+	s := e.start()
+	defer s.Stop(true)
+	e.init(s)
+	mp := e.mount(s, sp1, false)
+	_, err := e.fk.ReadFile(mp + "/big")
+	r.NoError(err)
+
+	// precompute into the embedded chunk store like ci does after a release
+	cs, err := manifester.NewChunkStoreWrite(manifester.ChunkStoreWriteConfig{ChunkLocalDir: e.cfg.Embedded.ChunkDir})
+	r.NoError(err)
+	signKeys, err := common.LoadSecretKeys([]string{e.cfg.Embedded.SignKeyFile})
+	r.NoError(err)
+	nixKeys, err := common.LoadPubKeys(e.cfg.Embedded.NixPubKeys)
+	r.NoError(err)
+	mb, err := manifester.NewManifestBuilder(manifester.ManifestBuilderConfig{
+		PublicKeys:  nixKeys,
+		SigningKeys: signKeys,
+		DigestAlgo:  common.DigestAlgo,
+	}, cs)
+	r.NoError(err)
+	upstream := "file://" + e.upstream + "/"
+	res1, err := mb.Build(ctx, upstream, sp1[11:43], 0, 0, "", false)
+	r.NoError(err)
+	res3, err := mb.Build(ctx, upstream, sp3[11:43], 0, 0, "", false)
+	r.NoError(err)
+	srv, err := manifester.NewManifestServer(manifester.Config{ChunkDiffParallel: 2}, mb)
+	r.NoError(err)
+	st, err := srv.PrecomputeUpgradeDiffs(ctx, []string{res1.CacheKey}, []string{res3.CacheKey}, 2)
+	r.NoError(err)
+	r.EqualValues(1, st.Pairs)
+	r.EqualValues(1, st.Diffs)
+
+	// reading the changed file uses the precomputed diff
+	mp = e.mount(s, sp3, false)
+	got, err := e.fk.ReadFile(mp + "/big")
+	r.NoError(err)
+	r.Equal(big3, got)
+	r.EqualValues(1, s.precomputedHits.Load())
+}
@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/erofs"
+)
+
+type inflightRead struct {
+	start    time.Time
+	objectId uint32
+	tp       uint16
+	slabId   uint16
+	ln, off  uint64
+
+	// for slab reads, set once we know the chunk. under inflightLock.
+	loc    erofs.SlabLoc
+	digest cdig.CDig
+	sphps  []SphPrefix
+}
+
+func (s *Server) startInflight(msgId, objectId uint32, state *openFileState, ln, off uint64) *inflightRead {
+	ir := &inflightRead{
+		start:    time.Now(),
+		objectId: objectId,
+		tp:       state.tp,
+		slabId:   state.slabId,
+		ln:       ln,
+		off:      off,
+	}
+	s.inflightLock.Lock()
+	s.inflight[msgId] = ir
+	s.inflightLock.Unlock()
+	return ir
+}
+
+func (s *Server) setInflightChunk(ir *inflightRead, loc erofs.SlabLoc, digest cdig.CDig, sphps []SphPrefix) {
+	s.inflightLock.Lock()
+	ir.loc, ir.digest, ir.sphps = loc, digest, sphps
+	s.inflightLock.Unlock()
+}
+
+func (s *Server) endInflight(msgId uint32) {
+	s.inflightLock.Lock()
+	delete(s.inflight, msgId)
+	s.inflightLock.Unlock()
+}
+
+func (s *Server) handleInflightReq(ctx context.Context, r *InflightReq) (*InflightResp, error) {
+	// allow this even before "initialized"
+
+	type chunk struct {
+		loc    erofs.SlabLoc
+		digest cdig.CDig
+		sphps  []SphPrefix
+	}
+	var reads []*InflightRead
+	var chunks []chunk
+	now := time.Now()
+
+	s.inflightLock.Lock()
+	for msgId, ir := range s.inflight {
+		reads = append(reads, &InflightRead{
+			MsgId:    msgId,
+			ObjectId: ir.objectId,
+			Type:     typeName(ir.tp),
+			Slab:     ir.slabId,
+			Offset:   ir.off,
+			Length:   ir.ln,
+			AgeMs:    now.Sub(ir.start).Milliseconds(),
+		})
+		chunks = append(chunks, chunk{ir.loc, ir.digest, ir.sphps})
+	}
+	s.inflightLock.Unlock()
+
+	// find which images and files the chunks belong to
+	idx := newLocIndex(s)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for i, read := range reads {
+			c := chunks[i]
+			if c.digest == (cdig.CDig{}) {
+				continue
+			}
+			read.Digest = c.digest.String()
+			for _, sphp := range c.sphps {
+				sph, name := s.catalogFindName(tx, sphp)
+				read.StorePaths = append(read.StorePaths, sph.String()+"-"+name)
+			}
+			if targets := idx.find(tx, c.loc, c.sphps); len(targets) > 0 {
+				read.Path, read.Chunk = targets[0].path, targets[0].chunk
+			}
+		}
+		return nil
+	})
+
+	// oldest first
+	slices.SortFunc(reads, func(a, b *InflightRead) int { return cmp.Compare(b.AgeMs, a.AgeMs) })
+	return &InflightResp{Reads: reads}, err
+}
+
+func typeName(tp uint16) string {
+	switch tp {
+	case typeImage:
+		return "image"
+	case typeSlabImage:
+		return "slab image"
+	case typeSlab:
+		return "slab"
+	case typeManifestSlab:
+		return "manifest slab"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,113 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/erofs"
+	"github.com/dnr/styx/pb"
+)
+
+func (s *Server) handleInspectImageReq(ctx context.Context, r *InspectImageReq) (*InspectImageResp, error) {
+	if s.p() == nil {
+		return nil, mwErr(http.StatusPreconditionFailed, "styx is not initialized")
+	}
+	_, sphStr, err := ParseSph(strings.TrimPrefix(r.StorePath, storepath.StoreDir+"/"))
+	if err != nil {
+		return nil, err
+	}
+
+	var img pb.DbImage
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(imageBucket).Get([]byte(sphStr))
+		if v == nil {
+			return mwErr(http.StatusNotFound, "image not found")
+		}
+		return proto.Unmarshal(v, &img)
+	})
+	if err != nil {
+		return nil, err
+	} else if img.ImageSize == 0 {
+		return nil, mwErr(http.StatusNotFound, "image was never built (materialized or not mounted?)")
+	}
+
+	// the image is the cachefiles backing file for the mount's fsid
+	f, err := os.Open(filepath.Join(s.cfg.CachePath, fscachePath(s.cfg.CacheDomain, sphStr)))
+	if err != nil {
+		return nil, mwErrE(http.StatusNotFound, err)
+	}
+	defer f.Close()
+	data := make([]byte, img.ImageSize)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("reading image: %w", err)
+	}
+
+	ir, err := erofs.NewImageReader(data, slabIdFromTag)
+	if err != nil {
+		return nil, err
+	}
+	ents, err := ir.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &InspectImageResp{Image: &img, IsBare: ir.IsBare()}
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		for _, e := range ents {
+			ie := &InspectEntry{
+				Path:       e.Path,
+				Type:       e.Type,
+				Executable: e.Executable,
+				Size:       e.Size,
+			}
+			if e.Type == pb.EntryType_SYMLINK {
+				ie.Target = string(e.Data)
+			} else {
+				ie.InImage = len(e.Data)
+			}
+			for _, loc := range e.Chunks {
+				sb := tx.Bucket(slabBucket).Bucket(slabKey(loc.SlabId))
+				if sb == nil {
+					return fmt.Errorf("%s: missing slab %d", e.Path, loc.SlabId)
+				}
+				v := sb.Get(addrKey(loc.Addr))
+				if v == nil {
+					// not the start of a chunk: content-defined chunks have one index per block
+					continue
+				}
+				ie.NumChunks++
+				if r.IncludeChunks {
+					ie.Chunks = append(ie.Chunks, &InspectChunk{
+						Slab:    loc.SlabId,
+						Addr:    loc.Addr,
+						Digest:  cdig.FromBytes(v).String(),
+						Present: s.locPresent(tx, loc),
+					})
+				}
+			}
+			res.Entries = append(res.Entries, ie)
+		}
+		return nil
+	})
+	return common.ValOrErr(res, err)
+}
+
+func slabIdFromTag(tag string) (uint16, error) {
+	idx, ok := strings.CutPrefix(tag, slabPrefix)
+	if !ok {
+		return 0, fmt.Errorf("unknown device tag %q", tag)
+	}
+	id, err := strconv.ParseUint(idx, 10, 16)
+	return uint16(id), err
+}
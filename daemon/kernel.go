@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"fmt"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/erofs"
+)
+
+// Kernel is everything the daemon needs from cachefiles and erofs. The default uses the real
+// kernel (and needs root). FakeKernel simulates both in userspace for tests.
+type Kernel interface {
+	// Setup loads modules or whatever else is needed before opening the device.
+	Setup() error
+	// OpenDevNode opens and binds a cachefiles device in on-demand mode. The daemon polls and
+	// reads the fd for messages (one per read, zero-length read when there are no more) and
+	// writes replies to it.
+	OpenDevNode(devPath, cachePath, tag string) (int, error)
+	// ReadComplete completes a READ request. fd is an anonymous fd for the object.
+	ReadComplete(fd, msgId uint32) error
+	// Mount mounts erofs image fsid from domain on mountPoint.
+	Mount(domain, fsid, mountPoint string) error
+	// BindMount bind-mounts src (possibly in an erofs mount) on target.
+	BindMount(src, target string) error
+	Unmount(mountPoint string) error
+	// IsMounted returns true if an erofs image is mounted on p.
+	IsMounted(p string) (bool, error)
+	// OpenFile opens p (possibly in an erofs mount) read-only.
+	OpenFile(p string) (int, error)
+}
+
+type realKernel struct{}
+
+var _ Kernel = realKernel{}
+
+func (realKernel) Setup() error {
+	return exec.Command(common.ModprobeBin, "cachefiles").Run()
+}
+
+func (realKernel) OpenDevNode(devPath, cachePath, tag string) (int, error) {
+	fd, err := unix.Open(devPath, unix.O_RDWR, 0600)
+	if err == unix.ENOENT {
+		_ = unix.Mknod(devPath, 0600|unix.S_IFCHR, 10<<8+122)
+		fd, err = unix.Open(devPath, unix.O_RDWR, 0600)
+	}
+	if err != nil {
+		return 0, err
+	} else if _, err = unix.Write(fd, []byte("dir "+cachePath)); err != nil {
+		unix.Close(fd)
+		return 0, err
+	} else if _, err = unix.Write(fd, []byte("tag "+tag)); err != nil {
+		unix.Close(fd)
+		return 0, err
+	} else if _, err = unix.Write(fd, []byte("bind ondemand")); err != nil {
+		unix.Close(fd)
+		return 0, err
+	}
+	return fd, nil
+}
+
+func (realKernel) ReadComplete(fd, msgId uint32) error {
+	_, _, e1 := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), CACHEFILES_IOC_READ_COMPLETE, uintptr(msgId))
+	if e1 != 0 {
+		return fmt.Errorf("ioctl error %d", e1)
+	}
+	return nil
+}
+
+func (realKernel) Mount(domain, fsid, mountPoint string) error {
+	opts := fmt.Sprintf("domain_id=%s,fsid=%s", domain, fsid)
+	return unix.Mount("none", mountPoint, "erofs", 0, opts)
+}
+
+func (realKernel) BindMount(src, target string) error {
+	return unix.Mount(src, target, "none", unix.MS_BIND, "")
+}
+
+func (realKernel) Unmount(mountPoint string) error {
+	return unix.Unmount(mountPoint, 0)
+}
+
+func (realKernel) IsMounted(p string) (bool, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(p, &st)
+	return st.Type == erofs.EROFS_MAGIC, err
+}
+
+func (realKernel) OpenFile(p string) (int, error) {
+	return unix.Open(p, unix.O_RDONLY, 0)
+}
@@ -0,0 +1,180 @@
+package daemon
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/pb"
+)
+
+const (
+	listMaxLimit = 1000
+	// only write last fetch time to the db this often per image
+	fetchGranularity = time.Hour
+)
+
+func (s *Server) handleListReq(ctx context.Context, r *ListReq) (*ListResp, error) {
+	// allow this even before "initialized"
+
+	states := make(map[pb.MountState]bool)
+	for _, st := range r.States {
+		v, ok := pb.MountState_value[st]
+		if !ok {
+			return nil, mwErr(http.StatusBadRequest, "unknown mount state %q", st)
+		}
+		states[pb.MountState(v)] = true
+	}
+	cmpf, ok := listSorts[cmp.Or(r.Sort, "name")]
+	if !ok {
+		return nil, mwErr(http.StatusBadRequest, "unknown sort %q", r.Sort)
+	}
+	limit := r.Limit
+	if limit <= 0 || limit > listMaxLimit {
+		limit = listMaxLimit
+	}
+
+	res := &ListResp{}
+	return res, s.db.View(func(tx *bbolt.Tx) error {
+		type listEnt struct {
+			key []byte
+			img *pb.DbImage
+		}
+		var ents []listEnt
+		cur := tx.Bucket(imageBucket).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			var img pb.DbImage
+			if err := proto.Unmarshal(v, &img); err != nil {
+				log.Print("unmarshal error iterating images", err)
+				continue
+			} else if len(states) > 0 && !states[img.MountState] {
+				continue
+			} else if r.Name != "" && !strings.Contains(img.StorePath, r.Name) {
+				continue
+			}
+			ents = append(ents, listEnt{key: k, img: &img})
+		}
+		slices.SortStableFunc(ents, func(a, b listEnt) int { return cmpf(a.img, b.img) })
+
+		res.Total = len(ents)
+		ents = ents[min(max(r.Offset, 0), len(ents)):]
+		ents = ents[:min(limit, len(ents))]
+
+		res.Images = make([]*ListImage, len(ents))
+		for i, ent := range ents {
+			li := &ListImage{
+				StorePath:      ent.img.StorePath,
+				Upstream:       ent.img.Upstream,
+				MountState:     ent.img.MountState.String(),
+				MountPoint:     ent.img.MountPoint,
+				LastMountError: ent.img.LastMountError,
+				IsBare:         ent.img.IsBare,
+				ImageSize:      ent.img.ImageSize,
+				LastFetch:      ent.img.LastFetch,
+			}
+			// we may not have a manifest yet (or anymore), just leave chunk stats empty
+			if m, err := s.getManifestLocal(tx, ent.key); err == nil {
+				st := s.manifestSizeStats(tx, m)
+				li.TotalChunks, li.PresentChunks = st.TotalChunks, st.PresentChunks
+				li.TotalBytes = int64(st.TotalBlocks) << s.blockShift
+				li.PresentBytes = int64(st.PresentBlocks) << s.blockShift
+			}
+			res.Images[i] = li
+		}
+		return nil
+	})
+}
+
+var listSorts = map[string]func(a, b *pb.DbImage) int{
+	"name": cmpName,
+	"size": func(a, b *pb.DbImage) int {
+		// largest first
+		return cmp.Or(cmp.Compare(b.ImageSize, a.ImageSize), cmpName(a, b))
+	},
+	"fetch": func(a, b *pb.DbImage) int {
+		// most recent first
+		return cmp.Or(cmp.Compare(b.LastFetch, a.LastFetch), cmpName(a, b))
+	},
+	"state": func(a, b *pb.DbImage) int {
+		return cmp.Or(cmp.Compare(a.MountState, b.MountState), cmpName(a, b))
+	},
+}
+
+// compare by name part of store path, then hash
+func cmpName(a, b *pb.DbImage) int {
+	ah, an, _ := strings.Cut(a.StorePath, "-")
+	bh, bn, _ := strings.Cut(b.StorePath, "-")
+	return cmp.Or(cmp.Compare(an, bn), cmp.Compare(ah, bh))
+}
+
+func (s *Server) manifestSizeStats(tx *bbolt.Tx, m *pb.Manifest) (st DebugSizeStats) {
+	for _, ent := range m.Entries {
+		digests := cdig.FromSliceAlias(ent.Digests)
+		st.TotalChunks += len(digests)
+		for i := range digests {
+			chunkSize := common.EntryChunkSize(ent, i, i == len(digests)-1)
+			blocks := int(s.blockShift.Blocks(chunkSize))
+			st.TotalBlocks += blocks
+			if _, present := s.digestPresent(tx, digests[i]); present {
+				st.PresentChunks++
+				st.PresentBlocks += blocks
+			}
+		}
+	}
+	return
+}
+
+// noteFetch records that a chunk referenced by these images was just fetched. the kernel
+// doesn't tell us which image the read was for, so this updates every image containing the
+// chunk. to avoid a write on every read, this only updates the db if the last update was more
+// than fetchGranularity ago.
+func (s *Server) noteFetch(sphps []SphPrefix) {
+	now := time.Now()
+	var update []SphPrefix
+	for _, sphp := range sphps {
+		if last, ok := s.fetchMap.Get(sphp); ok && now.Sub(last) < fetchGranularity {
+			continue
+		}
+		s.fetchMap.Put(sphp, now)
+		update = append(update, sphp)
+	}
+	if len(update) == 0 {
+		return
+	}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		ib := tx.Bucket(imageBucket)
+		for _, sphp := range update {
+			sph, _ := s.catalogFindName(tx, sphp)
+			if !bytes.HasPrefix(sph[:], sphp[:]) {
+				continue
+			}
+			key := []byte(sph.String())
+			var img pb.DbImage
+			if v := ib.Get(key); v == nil {
+				continue
+			} else if err := proto.Unmarshal(v, &img); err != nil {
+				return err
+			}
+			img.LastFetch = now.Unix()
+			if buf, err := proto.Marshal(&img); err != nil {
+				return err
+			} else if err := ib.Put(key, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print("error updating last fetch time: ", err)
+	}
+}
@@ -2,6 +2,7 @@ package daemon
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -10,19 +11,25 @@ import (
 	"net/http"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/zstd"
 	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/common/cdig"
 	"github.com/dnr/styx/common/errgroup"
+	"github.com/dnr/styx/common/tracing"
 	"github.com/dnr/styx/manifester"
 	"github.com/dnr/styx/pb"
 )
 
+// manifest requests or batches to have in flight at once
+const manifestBatchParallel = 4
+
 func (s *Server) getManifestAndBuildImage(ctx context.Context, req *MountReq) (*pb.Manifest, []byte, error) {
 	// convert to binary
 	sph, sphStr, err := ParseSph(req.StorePath)
@@ -48,7 +55,8 @@ func (s *Server) getManifestAndBuildImage(ctx context.Context, req *MountReq) (*
 	if smParams != nil {
 		match := smParams.ChunkShift == int32(common.ChunkShift) &&
 			smParams.DigestBits == cdig.Bits &&
-			smParams.DigestAlgo == common.DigestAlgo
+			smParams.DigestAlgo == s.digestAlgo() &&
+			smParams.ChunkAlgo == s.p().params.GetParams().GetChunkAlgo()
 		if !match {
 			return nil, nil, fmt.Errorf("chunked manifest global params mismatch")
 		}
@@ -128,6 +136,17 @@ func (s *Server) getManifestAndBuildImage(ctx context.Context, req *MountReq) (*
 		return nil, nil, fmt.Errorf("narinfo storepath != envelope storepath: %q != %q", niStorePath, storePath)
 	}
 
+	// record pack locations if chunks are in packs
+	if m.PackLocs != nil {
+		pls, err := manifester.PackLocsByDigest(&m)
+		if err != nil {
+			return nil, nil, fmt.Errorf("manifest pack locs error: %w", err)
+		}
+		if err = s.db.Update(func(tx *bbolt.Tx) error { return s.putPackLocs(tx, pls) }); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	// transform manifest into image (allocate chunks)
 	var image bytes.Buffer
 	ctxForChunks := withAllocateCtx(ctx, sph, false)
@@ -140,13 +159,17 @@ func (s *Server) getManifestAndBuildImage(ctx context.Context, req *MountReq) (*
 	return &m, image.Bytes(), nil
 }
 
-func (s *Server) getManifestFromManifester(ctx context.Context, upstream, sph string, narSize int64, tryCache bool) ([]byte, error) {
+func (s *Server) getManifestFromManifester(ctx context.Context, upstream, sph string, narSize int64, tryCache bool) (_ []byte, retErr error) {
+	ctx, span := tracing.Start(ctx, "get manifest", attribute.String("sph", sph))
+	defer func() { tracing.End(span, retErr) }()
+
 	mReq := manifester.ManifestReq{
 		Upstream:      upstream,
 		StorePathHash: sph,
 		ChunkShift:    int(common.ChunkShift),
-		DigestAlgo:    common.DigestAlgo,
+		DigestAlgo:    s.digestAlgo(),
 		DigestBits:    int(cdig.Bits),
+		ChunkAlgo:     s.p().params.GetParams().GetChunkAlgo(),
 		// SmallFileCutoff: s.cfg.SmallFileCutoff,
 	}
 
@@ -156,6 +179,7 @@ func (s *Server) getManifestFromManifester(ctx context.Context, upstream, sph st
 		if b, err := s.p().mcread.Get(ctx, mReq.CacheKey(), nil); err == nil {
 			log.Printf("got manifest for %s from cache", sph)
 			s.stats.manifestCacheHits.Add(1)
+			span.SetAttributes(attribute.Bool("cached", true))
 			return b, nil
 		} else if common.IsContextError(err) {
 			return nil, err
@@ -183,6 +207,10 @@ func (s *Server) getNewManifest(ctx context.Context, url string, req manifester.
 	}
 
 	shards := max(min(int((narSize+shardBy-1)/shardBy), 40), 1)
+	if shards == 1 && !s.noManifestBatch.Load() {
+		return s.getNewManifestBatched(ctx, url, req)
+	}
+
 	log.Printf("requesting manifest for %s with %d shards", req.StorePathHash, shards)
 	egCtx := errgroup.WithContext(ctx)
 
@@ -222,3 +250,175 @@ func (s *Server) getNewManifest(ctx context.Context, url string, req manifester.
 	log.Printf("got manifest for %s in %.2fs with %d shards", req.StorePathHash, elapsed.Seconds(), shards)
 	return shard0, nil
 }
+
+type pendingManifest struct {
+	ctx  context.Context
+	req  manifester.ManifestReq
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+// getNewManifestBatched sends a manifest request right away if fewer than
+// manifestBatchParallel requests or batches are in flight. otherwise it waits for one of them
+// to finish, and sends all requests that came in meanwhile (e.g. from mounting many paths of a
+// closure at once) together.
+func (s *Server) getNewManifestBatched(ctx context.Context, url string, req manifester.ManifestReq) ([]byte, error) {
+	pm := &pendingManifest{ctx: ctx, req: req, done: make(chan struct{})}
+
+	s.manifestBatchLock.Lock()
+	s.manifestBatch = append(s.manifestBatch, pm)
+	start := s.manifestBatchInflight < manifestBatchParallel
+	if start {
+		s.manifestBatchInflight++
+	}
+	s.manifestBatchLock.Unlock()
+
+	if start {
+		go s.sendManifestBatches(url)
+	}
+
+	select {
+	case <-pm.done:
+		return pm.b, pm.err
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// sends pending manifest requests until there are none left
+func (s *Server) sendManifestBatches(url string) {
+	for {
+		s.manifestBatchLock.Lock()
+		batch := s.manifestBatch
+		s.manifestBatch = nil
+		if len(batch) == 0 {
+			s.manifestBatchInflight--
+		}
+		s.manifestBatchLock.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		s.sendManifestBatch(url, batch)
+	}
+}
+
+func (s *Server) sendManifestBatch(url string, batch []*pendingManifest) {
+	if len(batch) == 1 {
+		// no need for batch request
+		pm := batch[0]
+		pm.b, pm.err = s.getNewManifestSingle(pm.ctx, url, pm.req)
+		close(pm.done)
+		return
+	}
+
+	// cancel the batch only if all requesters go away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var live atomic.Int32
+	live.Store(int32(len(batch)))
+	for _, pm := range batch {
+		stop := context.AfterFunc(pm.ctx, func() {
+			if live.Add(-1) == 0 {
+				cancel()
+			}
+		})
+		defer stop()
+	}
+
+	err := s.doManifestBatch(ctx, url, batch)
+
+	var notSupported bool
+	if status, ok := err.(common.HttpError); ok && status == http.StatusNotFound {
+		log.Printf("manifester does not support batch requests, falling back to single")
+		s.noManifestBatch.Store(true)
+		notSupported = true
+	}
+
+	for _, pm := range batch {
+		select {
+		case <-pm.done:
+		default:
+			if notSupported {
+				go func() {
+					pm.b, pm.err = s.getNewManifestSingle(pm.ctx, url, pm.req)
+					close(pm.done)
+				}()
+				continue
+			}
+			pm.err = cmp.Or(err, fmt.Errorf("missing manifest for %s in batch response", pm.req.StorePathHash))
+			close(pm.done)
+		}
+	}
+}
+
+func (s *Server) doManifestBatch(ctx context.Context, url string, batch []*pendingManifest) error {
+	start := time.Now()
+
+	var bReq manifester.ManifestBatchReq
+	for _, pm := range batch {
+		bReq.Reqs = append(bReq.Reqs, pm.req)
+	}
+	reqBytes, err := json.Marshal(bReq)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("requesting batch of %d manifests", len(batch))
+	batchUrl := strings.TrimSuffix(url, manifester.ManifestPath) + manifester.ManifestBatchPath
+	res, err := retryHttpRequest(ctx, http.MethodPost, batchUrl, "application/json", reqBytes)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var bRes manifester.ManifestBatchRes
+		if err := dec.Decode(&bRes); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("manifester batch response error: %w", err)
+		} else if bRes.Index < 0 || bRes.Index >= len(batch) {
+			return fmt.Errorf("manifester batch response has bad index %d", bRes.Index)
+		}
+		pm := batch[bRes.Index]
+		select {
+		case <-pm.done:
+			return fmt.Errorf("manifester batch response has duplicate index %d", bRes.Index)
+		default:
+		}
+		if bRes.Error != "" {
+			pm.err = fmt.Errorf("manifester http error: %w: %s", common.HttpError(bRes.Status), bRes.Error)
+		} else {
+			pm.b, pm.err = zstd.Decompress(nil, bRes.Bytes)
+		}
+		close(pm.done)
+	}
+
+	elapsed := time.Since(start)
+	log.Printf("got batch of %d manifests in %.2fs", len(batch), elapsed.Seconds())
+	return nil
+}
+
+func (s *Server) getNewManifestSingle(ctx context.Context, url string, req manifester.ManifestReq) ([]byte, error) {
+	start := time.Now()
+	log.Printf("requesting manifest for %s", req.StorePathHash)
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := retryHttpRequest(ctx, http.MethodPost, url, "application/json", reqBytes)
+	if err != nil {
+		return nil, fmt.Errorf("manifester http error: %w", err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(zstd.NewReader(res.Body))
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	log.Printf("got manifest for %s in %.2fs", req.StorePathHash, elapsed.Seconds())
+	return b, nil
+}
@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dnr/styx/manifester"
+)
+
+// fake manifester that returns the store path hash as the manifest. single requests block
+// until release is closed.
+type fakeBatchManifester struct {
+	batch   bool // support batch requests
+	release chan struct{}
+	singles atomic.Int32
+	batches atomic.Int32
+	batchSz atomic.Int32
+}
+
+func (f *fakeBatchManifester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case manifester.ManifestPath:
+		var req manifester.ManifestReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.singles.Add(1)
+		<-f.release
+		b, _ := zstd.Compress(nil, []byte(req.StorePathHash))
+		w.Write(b)
+	case manifester.ManifestBatchPath:
+		if !f.batch {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req manifester.ManifestBatchReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.batches.Add(1)
+		f.batchSz.Add(int32(len(req.Reqs)))
+		enc := json.NewEncoder(w)
+		for i := len(req.Reqs) - 1; i >= 0; i-- { // out of order
+			b, _ := zstd.Compress(nil, []byte(req.Reqs[i].StorePathHash))
+			enc.Encode(manifester.ManifestBatchRes{Index: i, Bytes: b})
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func testManifestBatch(t *testing.T, batch bool) (*Server, *fakeBatchManifester) {
+	r := require.New(t)
+	f := &fakeBatchManifester{batch: batch, release: make(chan struct{})}
+	hs := httptest.NewServer(f)
+	defer hs.Close()
+	url := hs.URL + manifester.ManifestPath
+	s := &Server{}
+
+	get := func(sph string, wg *sync.WaitGroup) {
+		defer wg.Done()
+		b, err := s.getNewManifestBatched(context.Background(), url, manifester.ManifestReq{StorePathHash: sph})
+		r.NoError(err)
+		r.Equal(sph, string(b))
+	}
+
+	// first requests go out alone right away
+	var wg sync.WaitGroup
+	for i := range manifestBatchParallel {
+		wg.Add(1)
+		go get(fmt.Sprint("first", i), &wg)
+	}
+	r.Eventually(func() bool { return f.singles.Load() == manifestBatchParallel }, time.Second, time.Millisecond)
+
+	// these wait for one of them
+	sphs := []string{"a", "b", "c", "d"}
+	for _, sph := range sphs {
+		wg.Add(1)
+		go get(sph, &wg)
+	}
+	r.Eventually(func() bool {
+		s.manifestBatchLock.Lock()
+		defer s.manifestBatchLock.Unlock()
+		return len(s.manifestBatch) == len(sphs)
+	}, time.Second, time.Millisecond)
+	r.EqualValues(manifestBatchParallel, f.singles.Load())
+
+	close(f.release)
+	wg.Wait()
+
+	s.manifestBatchLock.Lock()
+	r.Zero(s.manifestBatchInflight)
+	s.manifestBatchLock.Unlock()
+	return s, f
+}
+
+func TestManifestBatch(t *testing.T) {
+	r := require.New(t)
+	s, f := testManifestBatch(t, true)
+	r.EqualValues(manifestBatchParallel, f.singles.Load())
+	r.EqualValues(1, f.batches.Load())
+	r.EqualValues(4, f.batchSz.Load())
+	r.False(s.noManifestBatch.Load())
+}
+
+func TestManifestBatchNotSupported(t *testing.T) {
+	r := require.New(t)
+	s, f := testManifestBatch(t, false)
+	r.EqualValues(manifestBatchParallel+4, f.singles.Load(), "falls back to single requests")
+	r.True(s.noManifestBatch.Load())
+}
@@ -1,6 +1,7 @@
 package daemon
 
 import (
+	"bytes"
 	"cmp"
 	"context"
 	"errors"
@@ -14,6 +15,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"go.etcd.io/bbolt"
 	"golang.org/x/sys/unix"
@@ -37,6 +39,7 @@ func (s *Server) handleMaterializeReq(ctx context.Context, r *MaterializeReq) (*
 	} else if !strings.HasPrefix(r.DestPath, "/") {
 		return nil, mwErr(http.StatusBadRequest, "dest must be absolute path")
 	}
+	r.DestPath = filepath.Clean(r.DestPath)
 
 	_, sphStr, err := ParseSph(r.StorePath)
 	if err != nil {
@@ -89,10 +92,19 @@ func (s *Server) handleMaterializeReq(ctx context.Context, r *MaterializeReq) (*
 		return nil, err
 	}
 
+	// in update mode, find files we can keep first so we only fetch what we'll write
+	var reuse map[string]string
+	if r.Update {
+		reuse = s.materializeReuse(r.DestPath, m)
+	}
+
 	// prefetch all
 	haveReq := make(map[cdig.CDig]struct{})
 	var reqs []cdig.CDig
 	for _, e := range m.Entries {
+		if _, ok := reuse[e.Path]; ok {
+			continue
+		}
 		for _, d := range cdig.FromSliceAlias(e.Digests) {
 			if _, ok := haveReq[d]; !ok {
 				haveReq[d] = struct{}{}
@@ -107,7 +119,19 @@ func (s *Server) handleMaterializeReq(ctx context.Context, r *MaterializeReq) (*
 	}
 
 	// copy to dest
-	err = s.materialize(r.DestPath, m)
+	if r.Update {
+		err = s.materializeUpdate(r.DestPath, m, reuse)
+	} else {
+		err = s.materialize(r.DestPath, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// remember what's there for the next update
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(materializedBucket).Put([]byte(r.DestPath), []byte(sphStr))
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +142,7 @@ func (s *Server) handleMaterializeReq(ctx context.Context, r *MaterializeReq) (*
 			return errors.New("rollback")
 		}
 		img.MountState = pb.MountState_Materialized
+		img.LastFetch = time.Now().Unix()
 		return nil
 	})
 
@@ -125,23 +150,259 @@ func (s *Server) handleMaterializeReq(ctx context.Context, r *MaterializeReq) (*
 }
 
 func (s *Server) materialize(dest string, m *pb.Manifest) error {
+	return s.materializeTree(dest, m, nil)
+}
+
+// materializeReuse finds files in an existing tree at dest that already have the contents
+// of m, and returns their paths by entry path. files are compared against the manifest last
+// materialized at dest if we have it, otherwise by reading them.
+func (s *Server) materializeReuse(dest string, m *pb.Manifest) map[string]string {
+	if _, err := os.Lstat(dest); err != nil {
+		return nil
+	}
+
+	var old map[string]*pb.Entry
+	_ = s.db.View(func(tx *bbolt.Tx) error {
+		sphStr := tx.Bucket(materializedBucket).Get([]byte(dest))
+		if sphStr == nil {
+			return nil
+		}
+		om, err := s.getManifestLocal(tx, sphStr)
+		if err != nil {
+			log.Printf("can't get manifest last materialized at %s, comparing contents: %v", dest, err)
+			return nil
+		}
+		old = make(map[string]*pb.Entry, len(om.Entries))
+		for _, ent := range om.Entries {
+			old[ent.Path] = ent
+		}
+		return nil
+	})
+
+	reuse := make(map[string]string)
+	for _, ent := range m.Entries {
+		if ent.Type != pb.EntryType_REGULAR {
+			continue
+		}
+		if p := filepath.Join(dest, ent.Path); s.materializedSame(p, ent, old) {
+			reuse[ent.Path] = p
+		}
+	}
+	return reuse
+}
+
+// materializeUpdate replaces an existing tree at dest with m. it builds the new tree next to
+// dest, hard-linking files in reuse (from materializeReuse) from the old tree, then swaps it
+// into place. if dest is a mount point, it updates the tree inside dest instead.
+func (s *Server) materializeUpdate(dest string, m *pb.Manifest, reuse map[string]string) error {
+	if _, err := os.Lstat(dest); errors.Is(err, fs.ErrNotExist) {
+		return s.materialize(dest, m)
+	}
+
+	var err error
+	if isMountPoint(dest) {
+		err = s.materializeInPlace(dest, m, reuse)
+	} else {
+		err = s.materializeSwap(dest, m, reuse)
+		if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EBUSY) {
+			// probably a mount point that statx didn't tell us about
+			log.Printf("can't replace %s (%v), updating in place", dest, err)
+			err = s.materializeInPlace(dest, m, reuse)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var files int
+	for _, ent := range m.Entries {
+		if ent.Type == pb.EntryType_REGULAR {
+			files++
+		}
+	}
+	log.Printf("updated %s: %d files unchanged, %d written", dest, len(reuse), files-len(reuse))
+	return nil
+}
+
+func (s *Server) materializeSwap(dest string, m *pb.Manifest, reuse map[string]string) error {
+	stage := dest + ".styx-new"
+	if err := os.RemoveAll(stage); err != nil {
+		return err
+	}
+	if err := s.materializeTree(stage, m, reuse); err != nil {
+		_ = os.RemoveAll(stage)
+		return err
+	}
+
+	err := unix.Renameat2(unix.AT_FDCWD, stage, unix.AT_FDCWD, dest, unix.RENAME_EXCHANGE)
+	if err == unix.EINVAL || err == unix.ENOSYS {
+		// fs doesn't support exchange, fall back to two renames
+		prev := dest + ".styx-old"
+		if err = os.RemoveAll(prev); err == nil {
+			err = os.Rename(dest, prev)
+		}
+		if err == nil {
+			if err = os.Rename(stage, dest); err != nil {
+				_ = os.Rename(prev, dest)
+			} else {
+				stage = prev
+			}
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(stage)
+		return err
+	}
+	// stage has the old tree now
+	if err := os.RemoveAll(stage); err != nil {
+		log.Printf("error removing old tree %s: %v", stage, err)
+	}
+	return nil
+}
+
+// materializeInPlace updates the tree at dest to m without replacing dest itself, for when
+// dest is a mount point. each changed file is written under a temporary name and renamed over
+// the old one, then entries that aren't in m are removed. unlike materializeSwap, the update
+// isn't atomic as a whole.
+func (s *Server) materializeInPlace(dest string, m *pb.Manifest, reuse map[string]string) error {
 	ents := m.Entries
-	locs := make(map[cdig.CDig]erofs.SlabLoc)
-	err := s.db.View(func(tx *bbolt.Tx) error {
-		cb := tx.Bucket(chunkBucket)
-		for it := newDigestIterator(ents); it.ent() != nil; it.next(1) {
-			dig := it.digest()
-			if _, ok := locs[dig]; ok {
+	locs, err := s.materializeLocs(ents, reuse)
+	if err != nil {
+		return err
+	}
+
+	tryClone := true
+	s.stateLock.Lock()
+	readFds := maps.Clone(s.readfdBySlab)
+	s.stateLock.Unlock()
+
+	switch ents[0].Type {
+	case pb.EntryType_REGULAR:
+		// a bare file can't be renamed over either, so just rewrite it
+		if _, ok := reuse[ents[0].Path]; ok {
+			return nil
+		}
+		return s.materializeFile(dest, ents[0], locs, readFds, &tryClone)
+	case pb.EntryType_DIRECTORY:
+		if st, err := os.Lstat(dest); err != nil {
+			return err
+		} else if !st.IsDir() {
+			return fmt.Errorf("can't update %s in place with a directory", dest)
+		}
+	default:
+		return errors.New("bare file can't be symlink")
+	}
+
+	keep := make(map[string]struct{}, len(ents))
+	for _, ent := range ents[1:] {
+		p := filepath.Join(dest, ent.Path)
+		keep[p] = struct{}{}
+		if _, ok := reuse[ent.Path]; ok {
+			continue
+		}
+
+		st, err := os.Lstat(p)
+		exists := err == nil
+		if ent.Type == pb.EntryType_DIRECTORY {
+			if exists && st.IsDir() {
 				continue
+			} else if exists {
+				if err = os.Remove(p); err != nil {
+					return err
+				}
 			}
-			loc := cb.Get(dig[:])
-			if loc == nil {
-				return fmt.Errorf("missing reference for chunk %s", dig)
+			if err = os.Mkdir(p, 0o755); err != nil {
+				return err
 			}
-			locs[dig] = loadLoc(loc)
+			continue
+		}
+
+		tmp := filepath.Join(filepath.Dir(p), ".styx-new-"+filepath.Base(p))
+		_ = os.Remove(tmp)
+		switch ent.Type {
+		case pb.EntryType_REGULAR:
+			err = s.materializeFile(tmp, ent, locs, readFds, &tryClone)
+		case pb.EntryType_SYMLINK:
+			err = os.Symlink(string(ent.InlineData), tmp)
+		default:
+			err = errors.New("unknown entry type in manifest")
+		}
+		if err == nil && exists && st.IsDir() {
+			err = os.RemoveAll(p)
+		}
+		if err == nil {
+			err = os.Rename(tmp, p)
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+
+	// remove everything that's not in m
+	return filepath.WalkDir(dest, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if _, ok := keep[p]; ok || p == dest {
+			return nil
+		} else if err := os.RemoveAll(p); err != nil {
+			return err
+		} else if d.IsDir() {
+			return filepath.SkipDir
 		}
 		return nil
 	})
+}
+
+// returns true if p is the root of a mount (including a bind mount)
+func isMountPoint(p string) bool {
+	var stx unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, p, unix.AT_SYMLINK_NOFOLLOW, 0, &stx)
+	return err == nil && stx.Attributes_mask&unix.STATX_ATTR_MOUNT_ROOT != 0 &&
+		stx.Attributes&unix.STATX_ATTR_MOUNT_ROOT != 0
+}
+
+// returns true if the file at p already has the contents of ent
+func (s *Server) materializedSame(p string, ent *pb.Entry, old map[string]*pb.Entry) bool {
+	st, err := os.Lstat(p)
+	if err != nil || !st.Mode().IsRegular() || st.Size() != ent.Size || (st.Mode()&0o111 != 0) != ent.Executable {
+		return false
+	}
+
+	if old != nil {
+		oent := old[ent.Path]
+		return oent != nil &&
+			oent.Type == pb.EntryType_REGULAR &&
+			bytes.Equal(oent.Digests, ent.Digests) &&
+			bytes.Equal(oent.InlineData, ent.InlineData)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	digs := cdig.FromSliceAlias(ent.Digests)
+	if len(digs) == 0 {
+		b, err := io.ReadAll(f)
+		return err == nil && bytes.Equal(b, ent.InlineData)
+	}
+	buf := s.chunkPool.Get(int(common.ChunkShift.Size()))
+	defer s.chunkPool.Put(buf)
+	for i, dig := range digs {
+		b := buf[:common.EntryChunkSize(ent, i, i == len(digs)-1)]
+		if _, err := io.ReadFull(f, b); err != nil || dig.Check(s.digestAlgo(), b) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// reuse maps entry paths of regular files to existing files with the same contents, to
+// hard-link instead of writing the file. chunks of those files don't have to be present.
+func (s *Server) materializeTree(dest string, m *pb.Manifest, reuse map[string]string) error {
+	ents := m.Entries
+	locs, err := s.materializeLocs(ents, reuse)
 	if err != nil {
 		return err
 	}
@@ -169,6 +430,16 @@ func (s *Server) materialize(dest string, m *pb.Manifest) error {
 				return err
 			}
 		case pb.EntryType_REGULAR:
+			if src, ok := reuse[ent.Path]; ok {
+				if err = os.Link(src, p); err != nil {
+					log.Printf("error linking %s, copying: %v", src, err)
+					err = copyFile(src, p, fs.FileMode(ent.FileMode()))
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
 			if err = s.materializeFile(p, ent, locs, readFds, &tryClone); err != nil {
 				return err
 			}
@@ -187,6 +458,30 @@ func (s *Server) materialize(dest string, m *pb.Manifest) error {
 	return nil
 }
 
+// finds slab locations of all chunks in ents that aren't in reuse
+func (s *Server) materializeLocs(ents []*pb.Entry, reuse map[string]string) (map[cdig.CDig]erofs.SlabLoc, error) {
+	locs := make(map[cdig.CDig]erofs.SlabLoc)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		cb := tx.Bucket(chunkBucket)
+		for it := newDigestIterator(ents); it.ent() != nil; it.next(1) {
+			if _, ok := reuse[it.ent().Path]; ok {
+				continue
+			}
+			dig := it.digest()
+			if _, ok := locs[dig]; ok {
+				continue
+			}
+			loc := cb.Get(dig[:])
+			if loc == nil {
+				return fmt.Errorf("missing reference for chunk %s", dig)
+			}
+			locs[dig] = loadLoc(loc)
+		}
+		return nil
+	})
+	return locs, err
+}
+
 func (s *Server) materializeFile(
 	path string,
 	ent *pb.Entry,
@@ -215,15 +510,18 @@ tryAgain:
 	var buf []byte
 	digs := cdig.FromSliceAlias(ent.Digests)
 	roundedUp := false
+	var fileOff int64
 	for i, dig := range digs {
 		loc := locs[dig]
-		size := common.ChunkShift.FileChunkSize(ent.Size, i == len(digs)-1)
+		size := common.EntryChunkSize(ent, i, i == len(digs)-1)
+		chunkOff := fileOff
+		fileOff += size
 		if *tryClone {
 			if cfd := readFds[loc.SlabId].cacheFd; cfd > 0 {
 				sizeUp := int(s.blockShift.Roundup(size))
 				roundedUp = sizeUp != int(size)
 				roff := int64(loc.Addr) << s.blockShift
-				woff := int64(i) << common.ChunkShift
+				woff := chunkOff
 				var rsize int
 				rsize, err = unix.CopyFileRange(cfd, &roff, int(dst.Fd()), &woff, sizeUp, 0)
 				if err == nil && rsize != sizeUp {
@@ -237,7 +535,7 @@ tryAgain:
 				// 		Src_fd:      int64(cfd),
 				// 		Src_offset:  uint64(loc.Addr) << s.blockShift,
 				// 		Src_length:  uint64(sizeUp),
-				// 		Dest_offset: uint64(i) << common.ChunkShift,
+				// 		Dest_offset: uint64(chunkOff),
 				// 	})
 			} else {
 				err = errCachefdNotFound
@@ -272,3 +570,18 @@ tryAgain:
 	}
 	return nil
 }
+
+func copyFile(src, dst string, mode fs.FileMode) (retErr error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer func() { retErr = cmp.Or(retErr, out.Close()) }()
+	_, err = io.Copy(out, in)
+	return err
+}
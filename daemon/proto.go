@@ -1,6 +1,8 @@
 package daemon
 
 import (
+	"time"
+
 	"go.etcd.io/bbolt"
 
 	"github.com/dnr/styx/pb"
@@ -20,6 +22,13 @@ var (
 	GcPath          = "/gc"
 	DebugPath       = "/debug"
 	RepairPath      = "/repair"
+	ExportPath      = "/export"
+	InspectPath     = "/inspect-image"
+	InflightPath    = "/inflight"
+	TracePath       = "/trace"
+	ListPath        = "/list"
+	DuPath          = "/du"
+	EstimatePath    = "/estimate"
 )
 
 type (
@@ -47,6 +56,8 @@ type (
 		StorePath string
 		DestPath  string
 		NarSize   int64 `json:",omitempty"` // optional
+		// replace an existing tree at DestPath, only writing files that changed
+		Update bool `json:",omitempty"`
 	}
 	// returns Status
 
@@ -74,6 +85,157 @@ type (
 	}
 	// returns Status
 
+	ExportReq struct {
+		ZstdLevel int `json:",omitempty"`
+	}
+	// returns export stream (not json) on success, Status on error
+
+	InspectImageReq struct {
+		StorePath     string
+		IncludeChunks bool `json:",omitempty"`
+	}
+	InspectImageResp struct {
+		Image   *pb.DbImage
+		IsBare  bool
+		Entries []*InspectEntry
+	}
+	InspectEntry struct {
+		Path       string
+		Type       pb.EntryType
+		Executable bool            `json:",omitempty"`
+		Size       int64           `json:",omitempty"`
+		Target     string          `json:",omitempty"` // symlinks only
+		InImage    int             `json:",omitempty"` // bytes of file data stored in image
+		NumChunks  int             `json:",omitempty"`
+		Chunks     []*InspectChunk `json:",omitempty"`
+	}
+	InspectChunk struct {
+		Slab    uint16
+		Addr    uint32
+		Digest  string
+		Present bool
+	}
+
+	InflightReq struct {
+	}
+	InflightResp struct {
+		Reads []*InflightRead // oldest first
+	}
+	InflightRead struct {
+		MsgId    uint32
+		ObjectId uint32
+		Type     string // "slab", "slab image", or "image"
+		Slab     uint16 `json:",omitempty"`
+		Offset   uint64
+		Length   uint64
+		AgeMs    int64
+		// for slab reads, once the chunk is looked up
+		Digest     string   `json:",omitempty"`
+		StorePaths []string `json:",omitempty"`
+		Path       string   `json:",omitempty"` // file in the first store path with this chunk
+		Chunk      int      `json:",omitempty"` // chunk index in Path
+	}
+
+	TraceReq struct {
+		Images []string `json:",omitempty"` // only reads from these images (base32 sph)
+	}
+	// returns a stream of TraceEvents as json, one per line, or Status on error
+	TraceEvent struct {
+		Time      time.Time // when the kernel asked for the read
+		StorePath string    `json:",omitempty"` // hash-name
+		Path      string    `json:",omitempty"` // file within store path
+		Chunk     int       // chunk index within file
+		Slab      uint16
+		Addr      uint32
+		Bytes     int64
+		Hit       bool   `json:",omitempty"` // chunk was already being fetched (read-ahead or another read)
+		Op        string `json:",omitempty"` // "single", "diff", or "batch"
+		LatencyMs int64
+		Error     string `json:",omitempty"`
+		Dropped   int64  `json:",omitempty"` // events dropped before this one because the client was slow
+	}
+
+	ListReq struct {
+		States []string `json:",omitempty"` // only images in these mount states (e.g. "Mounted")
+		Name   string   `json:",omitempty"` // only store paths containing this
+		Sort   string   `json:",omitempty"` // "name" (default), "size", "fetch", or "state"
+		Offset int      `json:",omitempty"`
+		Limit  int      `json:",omitempty"` // default and max 1000
+	}
+	ListResp struct {
+		Images []*ListImage
+		Total  int // number of images matching filters
+	}
+	ListImage struct {
+		StorePath      string
+		Upstream       string
+		MountState     string
+		MountPoint     string `json:",omitempty"`
+		LastMountError string `json:",omitempty"`
+		IsBare         bool   `json:",omitempty"`
+		ImageSize      int64
+		LastFetch      int64 `json:",omitempty"` // unix seconds, see DbImage.LastFetch
+		TotalChunks    int
+		PresentChunks  int
+		TotalBytes     int64 // approximate, in whole blocks
+		PresentBytes   int64
+	}
+
+	DuReq struct {
+		Images []string `json:",omitempty"` // only these images (base32 sph), default all
+	}
+	DuResp struct {
+		Images []*DuImage // most freed bytes first
+		Set    *DuImage   `json:",omitempty"` // requested images together, if more than one
+		Cache  DuCache
+	}
+	DuImage struct {
+		StorePath      string `json:",omitempty"`
+		ImageSize      int64  // erofs image (metadata and small files)
+		NarSize        int64  // from narinfo, zero if unknown
+		PresentBytes   int64  // chunk data in slabs used by this image
+		ExclusiveBytes int64  // chunk data not used by any other image
+		SharedBytes    int64  // chunk data also used by other images
+		FreedBytes     int64  // what removing this image would free: exclusive + image
+	}
+	DuCache struct {
+		Images       int
+		NarSize      int64 // sum of nar sizes, i.e. what these would take in a plain store
+		SlabBytes    int64 // all present chunk data (including manifests)
+		ImageBytes   int64 // sum of erofs image sizes
+		UnownedBytes int64 // chunk data not used by any image we know about
+	}
+
+	EstimateReq struct {
+		Upstream   string
+		StorePaths []string
+		Closure    bool `json:",omitempty"` // also include references, recursively
+	}
+	EstimateResp struct {
+		Paths     []*EstimateEntry
+		Installed int           // paths already mounted, materialized, or in the local store
+		Total     EstimateEntry // sum of paths not installed
+	}
+	EstimateEntry struct {
+		StorePath     string `json:",omitempty"`
+		Installed     bool   `json:",omitempty"`
+		Error         string `json:",omitempty"` // couldn't get manifest
+		Base          string `json:",omitempty"` // diff base that would be used
+		ManifestBytes int64  // manifest data to fetch
+		// chunk data sizes are uncompressed target sizes, so DiffBytes and FetchBytes are upper
+		// bounds on what would be transferred. the split between them comes from the same op
+		// planning that prefetch uses. chunks shared with earlier paths in the request count
+		// as present.
+		PresentBytes int64
+		DiffBytes    int64 // upper bound: missing, in a planned op with a base
+		FetchBytes   int64 // upper bound: missing, in a planned op with no base
+		DiffChunks   int
+		FetchChunks  int
+		Recompress   int   `json:",omitempty"` // files that would be diffed with recompression
+		NarSize      int64 // from narinfo
+		FileSize     int64 // from narinfo (compressed nar)
+	}
+
 	DebugReq struct {
 		IncludeAllImages bool     `json:",omitempty"`
 		IncludeImages    []string `json:",omitempty"` // list of base32 sph
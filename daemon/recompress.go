@@ -7,33 +7,17 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
-	"path"
-	"regexp"
 
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/manifester"
 	"github.com/dnr/styx/pb"
 )
 
-var (
-	reManPage   = regexp.MustCompile(`^/share/man/.*[.]gz$`)
-	reLinuxKoXz = regexp.MustCompile(`^/lib/modules/[^/]+/kernel/.*[.]ko[.]xz$`)
-)
-
-func isManPageGz(ent *pb.Entry) bool {
-	return ent.Type == pb.EntryType_REGULAR && reManPage.MatchString(ent.Path)
-}
-func isLinuxKoXz(ent *pb.Entry) bool {
-	// kheaders.ko.xz is mostly an embedded .tar.xz file (yes, again), so expanding it won't help.
-	return ent.Type == pb.EntryType_REGULAR && reLinuxKoXz.MatchString(ent.Path) &&
-		path.Base(ent.Path) != "kheaders.ko.xz"
-}
-
 func getRecompressArgs(ent *pb.Entry) []string {
-	switch {
-	case isManPageGz(ent):
+	switch manifester.ExpandForEntry(ent) {
+	case manifester.ExpandGz:
 		return []string{manifester.ExpandGz}
-	case isLinuxKoXz(ent):
+	case manifester.ExpandXz:
 		// note: currently largest kernel module on my system (excluding kheaders) is
 		// amdgpu.ko.xz at 3.4mb, 54 chunks (64kb), and expands to 24.4mb, which is
 		// reasonable to pass through the chunk differ.
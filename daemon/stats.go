@@ -1,6 +1,10 @@
 package daemon
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+
+	"github.com/dnr/styx/manifester"
+)
 
 type (
 	daemonStats struct {
@@ -10,6 +14,9 @@ type (
 		manifestErrs      atomic.Int64 // requests for new manifest that got an error
 		slabReads         atomic.Int64 // read requests to slab
 		slabReadErrs      atomic.Int64 // failed read requests to slab
+		slabReadTimeouts  atomic.Int64 // read requests to slab that hit the deadline
+		canceledOps       atomic.Int64 // chunk/diff requests canceled because all readers gave up
+		extraWorkers      atomic.Int64 // workers started beyond the base count
 		singleReqs        atomic.Int64 // chunk request count
 		singleBytes       atomic.Int64 // chunk bytes received (uncompressed)
 		singleErrs        atomic.Int64 // chunk request error count
@@ -21,6 +28,9 @@ type (
 		diffErrs          atomic.Int64 // with-base diff request error count
 		recompressReqs    atomic.Int64 // reqs with recompression
 		extraReqs         atomic.Int64 // extra read-ahead reqs (beyond 1 per read)
+		deltaZstd         atomic.Int64 // diffs/batches that used zstd
+		deltaBsdiff       atomic.Int64 // diffs/batches that used bsdiff
+		diffCacheHits     atomic.Int64 // diffs/batches served from server diff cache
 	}
 
 	Stats struct {
@@ -30,6 +40,9 @@ type (
 		ManifestErrs      int64 // requests for new manifest that got an error
 		SlabReads         int64 // read requests to slab
 		SlabReadErrs      int64 // failed read requests to slab
+		SlabReadTimeouts  int64 // read requests to slab that hit the deadline
+		CanceledOps       int64 // chunk/diff requests canceled because all readers gave up
+		ExtraWorkers      int64 // workers started beyond the base count
 		SingleReqs        int64 // chunk request count
 		SingleBytes       int64 // chunk bytes received (uncompressed)
 		SingleErrs        int64 // chunk request error count
@@ -41,6 +54,9 @@ type (
 		DiffErrs          int64 // with-base diff request error count
 		RecompressReqs    int64 // reqs with recompression
 		ExtraReqs         int64 // extra read-ahead reqs (beyond 1 per read)
+		DeltaZstd         int64 // diffs/batches that used zstd
+		DeltaBsdiff       int64 // diffs/batches that used bsdiff
+		DiffCacheHits     int64 // diffs/batches served from server diff cache
 	}
 )
 
@@ -52,6 +68,9 @@ func (s *daemonStats) export() Stats {
 		ManifestErrs:      s.manifestErrs.Load(),
 		SlabReads:         s.slabReads.Load(),
 		SlabReadErrs:      s.slabReadErrs.Load(),
+		SlabReadTimeouts:  s.slabReadTimeouts.Load(),
+		CanceledOps:       s.canceledOps.Load(),
+		ExtraWorkers:      s.extraWorkers.Load(),
 		SingleReqs:        s.singleReqs.Load(),
 		SingleBytes:       s.singleBytes.Load(),
 		SingleErrs:        s.singleErrs.Load(),
@@ -63,5 +82,17 @@ func (s *daemonStats) export() Stats {
 		DiffErrs:          s.diffErrs.Load(),
 		RecompressReqs:    s.recompressReqs.Load(),
 		ExtraReqs:         s.extraReqs.Load(),
+		DeltaZstd:         s.deltaZstd.Load(),
+		DeltaBsdiff:       s.deltaBsdiff.Load(),
+		DiffCacheHits:     s.diffCacheHits.Load(),
+	}
+}
+
+func (s *daemonStats) countDeltaAlgo(algo string) {
+	switch algo {
+	case manifester.DeltaZstd:
+		s.deltaZstd.Add(1)
+	case manifester.DeltaBsdiff:
+		s.deltaBsdiff.Add(1)
 	}
 }
@@ -0,0 +1,228 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/erofs"
+)
+
+// Live trace of slab reads, mapped back to the files they belong to.
+
+const traceBuffer = 256
+
+type (
+	tracer struct {
+		lock sync.Mutex                  // held while changing subs
+		subs atomic.Pointer[[]*traceSub] // copy on write, loaded without lock on every read
+	}
+
+	traceSub struct {
+		images  []string // base32 sph prefixes to include, empty for all
+		ch      chan *rawTraceEvent
+		dropped atomic.Int64
+		index   *locIndex // only used from the subscriber's goroutine
+	}
+
+	// what the read path sends. subscribers map it to files themselves so the read path
+	// doesn't have to touch the db.
+	rawTraceEvent struct {
+		ev    TraceEvent
+		loc   erofs.SlabLoc
+		sphps []SphPrefix
+	}
+
+	// reverse index from slab locations to files, built from manifests as needed
+	locIndex struct {
+		s      *Server
+		images map[Sph]map[erofs.SlabLoc]locTarget
+	}
+
+	locTarget struct {
+		storePath string // hash-name
+		path      string
+		chunk     int
+	}
+)
+
+func newLocIndex(s *Server) *locIndex {
+	return &locIndex{s: s, images: make(map[Sph]map[erofs.SlabLoc]locTarget)}
+}
+
+// returns files that contain loc, in the order of sphps
+func (idx *locIndex) find(tx *bbolt.Tx, loc erofs.SlabLoc, sphps []SphPrefix) []locTarget {
+	var out []locTarget
+	for _, sphp := range sphps {
+		sph, name := idx.s.catalogFindName(tx, sphp)
+		m, ok := idx.images[sph]
+		if !ok {
+			// leave nil if we can't load the manifest so we don't try again
+			m = idx.build(tx, sph, name)
+			idx.images[sph] = m
+		}
+		if t, ok := m[loc]; ok {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (idx *locIndex) build(tx *bbolt.Tx, sph Sph, name string) map[erofs.SlabLoc]locTarget {
+	manifest, err := idx.s.getManifestLocal(tx, []byte(sph.String()))
+	if err != nil {
+		return nil
+	}
+	storePath := sph.String() + "-" + name
+	m := make(map[erofs.SlabLoc]locTarget)
+	for _, ent := range manifest.Entries {
+		locs, err := idx.s.lookupLocs(tx, cdig.FromSliceAlias(ent.Digests))
+		if err != nil {
+			continue
+		}
+		for i, loc := range locs {
+			if _, ok := m[loc]; !ok {
+				m[loc] = locTarget{storePath: storePath, path: ent.Path, chunk: i}
+			}
+		}
+	}
+	return m
+}
+
+func (t *tracer) subscribe(s *Server, images []string) *traceSub {
+	sub := &traceSub{images: images, ch: make(chan *rawTraceEvent, traceBuffer), index: newLocIndex(s)}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var subs []*traceSub
+	if old := t.subs.Load(); old != nil {
+		subs = slices.Clone(*old)
+	}
+	subs = append(subs, sub)
+	t.subs.Store(&subs)
+	return sub
+}
+
+func (t *tracer) unsubscribe(sub *traceSub) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	subs := slices.DeleteFunc(slices.Clone(*t.subs.Load()), func(o *traceSub) bool { return o == sub })
+	t.subs.Store(&subs)
+}
+
+func (sub *traceSub) wants(storePath string) bool {
+	if len(sub.images) == 0 {
+		return true
+	}
+	for _, img := range sub.images {
+		if strings.HasPrefix(storePath, img) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) traceRead(ir *inflightRead, loc erofs.SlabLoc, sphps []SphPrefix, info *chunkReqInfo, err error) {
+	subs := s.trace.subs.Load()
+	if subs == nil || len(*subs) == 0 {
+		return
+	}
+	raw := &rawTraceEvent{
+		ev: TraceEvent{
+			Time:      ir.start,
+			Slab:      loc.SlabId,
+			Addr:      loc.Addr,
+			Bytes:     int64(ir.ln),
+			Hit:       info.joined,
+			Op:        info.op,
+			LatencyMs: time.Since(ir.start).Milliseconds(),
+		},
+		loc:   loc,
+		sphps: sphps,
+	}
+	if err != nil {
+		raw.ev.Error = err.Error()
+	}
+	for _, sub := range *subs {
+		select {
+		case sub.ch <- raw:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// resolve maps a raw event to the file it belongs to. it returns nil if the event isn't in an
+// image that sub wants.
+func (sub *traceSub) resolve(s *Server, raw *rawTraceEvent) *TraceEvent {
+	var targets []locTarget
+	_ = s.db.View(func(tx *bbolt.Tx) error {
+		targets = sub.index.find(tx, raw.loc, raw.sphps)
+		return nil
+	})
+	var tgt *locTarget
+	for i := range targets {
+		if sub.wants(targets[i].storePath) {
+			tgt = &targets[i]
+			break
+		}
+	}
+	if tgt == nil && len(sub.images) > 0 {
+		return nil
+	}
+	ev := raw.ev
+	if tgt != nil {
+		ev.StorePath, ev.Path, ev.Chunk = tgt.storePath, tgt.path, tgt.chunk
+	}
+	return &ev
+}
+
+func (s *Server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	var req TraceReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&Status{Success: false, Error: err.Error()})
+		return
+	} else if s.p() == nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(&Status{Success: false, Error: "styx is not initialized"})
+		return
+	}
+
+	sub := s.trace.subscribe(s, req.Images)
+	defer s.trace.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case raw := <-sub.ch:
+			ev := sub.resolve(s, raw)
+			if ev == nil {
+				continue
+			}
+			ev.Dropped = sub.dropped.Swap(0)
+			if enc.Encode(ev) != nil {
+				return
+			}
+			if flusher != nil && len(sub.ch) == 0 {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.shutdownChan:
+			return
+		}
+	}
+}
@@ -13,11 +13,10 @@ import (
 
 	"github.com/avast/retry-go/v4"
 	"github.com/nix-community/go-nix/pkg/nixbase32"
-	"golang.org/x/sys/unix"
 
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/common/cdig"
-	"github.com/dnr/styx/erofs"
+	"github.com/dnr/styx/common/tracing"
 	"github.com/dnr/styx/pb"
 )
 
@@ -28,13 +27,17 @@ func verifyParams(p *pb.GlobalParams) error {
 	if p.ChunkShift != int32(common.ChunkShift) {
 		return fmt.Errorf("built-in chunk shift %d != %d; rebuild or use different params",
 			common.ChunkShift, p.ChunkShift)
-	} else if p.DigestAlgo != cdig.Algo {
-		return fmt.Errorf("built-in digest algo %s != %s; rebuild or use different params",
-			cdig.Algo, p.DigestAlgo)
+	} else if !cdig.ValidAlgo(p.DigestAlgo) {
+		return fmt.Errorf("unsupported digest algo %q; rebuild or use different params", p.DigestAlgo)
 	} else if p.DigestBits != cdig.Bits {
 		return fmt.Errorf("built-in digest bits %d != %d; rebuild or use different params",
 			cdig.Bits, p.DigestBits)
 	}
+	switch p.ChunkAlgo {
+	case common.ChunkAlgoFixed, common.ChunkAlgoFastCDC:
+	default:
+		return fmt.Errorf("unsupported chunk algo %q; rebuild or use different params", p.ChunkAlgo)
+	}
 	return nil
 }
 
@@ -73,6 +76,7 @@ func retryHttpRequest(ctx context.Context, method, url, cType string, body []byt
 				return nil, retry.Unrecoverable(err)
 			}
 			req.Header.Set("Content-Type", cType)
+			tracing.Inject(ctx, req.Header)
 			res, err := http.DefaultClient.Do(req)
 			if err == nil && res.StatusCode != http.StatusOK {
 				err = common.HttpError(res.StatusCode)
@@ -116,9 +120,3 @@ func (cr *countReader) Read(p []byte) (int, error) {
 func underDir(p, dir string) bool {
 	return len(p) >= len(dir) && p[:len(dir)] == dir && (len(p) == len(dir) || dir == "/" || p[len(dir)] == '/')
 }
-
-func isErofsMount(p string) (bool, error) {
-	var st unix.Statfs_t
-	err := unix.Statfs(p, &st)
-	return st.Type == erofs.EROFS_MAGIC, err
-}
@@ -56,8 +56,9 @@ func (s *Server) handleVaporizeReq(ctx context.Context, r *VaporizeReq) (*Status
 	m := &pb.Manifest{
 		Params: &pb.GlobalParams{
 			ChunkShift: int32(common.ChunkShift),
-			DigestAlgo: common.DigestAlgo,
+			DigestAlgo: s.digestAlgo(),
 			DigestBits: cdig.Bits,
+			ChunkAlgo:  s.p().params.GetParams().GetChunkAlgo(),
 		},
 		SmallFileCutoff: manifester.DefaultSmallFileCutoff,
 		Meta: &pb.ManifestMeta{
@@ -102,11 +103,12 @@ func (s *Server) handleVaporizeReq(ctx context.Context, r *VaporizeReq) (*Status
 					return err
 				}
 			} else {
-				digests, err := s.vaporizeFile(ctxForChunks, fullPath, ent.Size, &tryClone)
+				digests, sizes, err := s.vaporizeFile(ctxForChunks, fullPath, ent.Size, &tryClone)
 				if err != nil {
 					return err
 				}
 				ent.Digests = cdig.ToSliceAlias(digests)
+				ent.ChunkSize = sizes
 			}
 
 		case fs.ModeDir:
@@ -133,9 +135,15 @@ func (s *Server) handleVaporizeReq(ctx context.Context, r *VaporizeReq) (*Status
 	}
 
 	// get entry for manifest
-	mbcfg := manifester.ManifestBuilderConfig{}
+	mbcfg := manifester.ManifestBuilderConfig{
+		ChunkAlgo:  s.p().params.GetParams().GetChunkAlgo(),
+		DigestAlgo: s.digestAlgo(),
+	}
 	memcs := memChunkStore{m: make(map[cdig.CDig][]byte), blkshift: s.blockShift}
 	mb, err := manifester.NewManifestBuilder(mbcfg, &memcs)
+	if err != nil {
+		return nil, err
+	}
 	args := manifester.BuildArgs{SmallFileCutoff: manifester.SmallManifestCutoff}
 	path := common.ManifestContext + "/" + storePath
 	entry, err := mb.ManifestAsEntry(ctx, &args, path, m)
@@ -176,7 +184,7 @@ func (s *Server) handleVaporizeReq(ctx context.Context, r *VaporizeReq) (*Status
 		Msg: entry,
 		Params: &pb.GlobalParams{
 			ChunkShift: int32(common.ChunkShift),
-			DigestAlgo: common.DigestAlgo,
+			DigestAlgo: s.digestAlgo(),
 			DigestBits: int32(cdig.Bits),
 		},
 	})
@@ -246,36 +254,49 @@ func (s *Server) vaporizeFile(
 	fullPath string,
 	size int64,
 	tryClone *bool,
-) ([]cdig.CDig, error) {
+) ([]cdig.CDig, []uint32, error) {
 	buf := s.chunkPool.Get(int(common.ChunkShift.Size()))
 	defer s.chunkPool.Put(buf)
 
 	f, err := os.Open(fullPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer f.Close()
 
-	// first just read and hash whole file
+	// first just read and hash whole file, cutting chunks the same way the manifester would
+	cdc := s.p().params.GetParams().GetChunkAlgo() == common.ChunkAlgoFastCDC
 	var digests []cdig.CDig
-	for {
-		n, err := f.Read(buf)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
+	var sizes []uint32 // only for cdc
+	var offs []int64
+	for off := int64(0); off < size; {
+		n, err := f.ReadAt(buf[:min(size-off, int64(len(buf)))], off)
+		if err != nil {
+			return nil, nil, err
 		}
-		digests = append(digests, cdig.Sum(buf[:n]))
+		if cdc {
+			n = manifester.CdcCut(buf[:n], common.ChunkShift)
+			sizes = append(sizes, uint32(n))
+		}
+		digests = append(digests, cdig.Sum(s.digestAlgo(), buf[:n]))
+		offs = append(offs, off)
+		off += int64(n)
+	}
+	chunkSize := func(i int) int64 {
+		if cdc {
+			return int64(sizes[i])
+		}
+		return common.ChunkShift.FileChunkSize(size, i == len(digests)-1)
 	}
 
 	// TODO: we could deduplicate chunks within this file.
 	// it's rare for a file to have repeated chunks though, so don't worry about it for now.
 
 	blocks := make([]uint16, 0, len(digests))
-	blocks = common.AppendBlocksList(blocks, size, s.blockShift)
+	blocks = common.AppendEntryBlocksList(blocks, &pb.Entry{Size: size, ChunkSize: sizes}, s.blockShift)
 	locs, wasAllocated, err := s.preallocateBatch(ctx, blocks, digests)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	present := make([]bool, len(locs))
@@ -291,9 +312,9 @@ func (s *Server) vaporizeFile(
 			continue
 		}
 
-		size := common.ChunkShift.FileChunkSize(size, i == len(locs)-1)
+		size := chunkSize(i)
 		rounded := s.blockShift.Roundup(size)
-		roff := int64(i) << common.ChunkShift
+		roff := offs[i]
 		// since the slab file extends beyond the end of our copy, even if it's sparse,
 		// CopyFileRange can only be used to copy whole blocks.
 		// also, if the loc was already allocated (but not present), then it's already linked
@@ -303,7 +324,7 @@ func (s *Server) vaporizeFile(
 			cfd := s.readfdBySlab[loc.SlabId].cacheFd
 			s.stateLock.Unlock()
 			if cfd == 0 {
-				return nil, errCachefdNotFound
+				return nil, nil, errCachefdNotFound
 			}
 			woff := int64(loc.Addr) << s.blockShift
 			rsize, err := unix.CopyFileRange(int(f.Fd()), &roff, cfd, &woff, int(size), 0)
@@ -318,18 +339,18 @@ func (s *Server) vaporizeFile(
 				*tryClone = false
 				// fall back to plain copy
 			default:
-				return nil, err
+				return nil, nil, err
 			}
 		}
 
 		// plain copy. note we write through the writefd instead for consistency.
 		b := buf[:size]
 		if _, err := f.ReadAt(b, roff); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		err := s.gotNewChunk(loc, digests[i], b)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
@@ -339,21 +360,20 @@ func (s *Server) vaporizeFile(
 			continue // don't bother if it was there before we started
 		}
 
-		size := common.ChunkShift.FileChunkSize(size, i == len(locs)-1)
-		b := buf[:size]
+		b := buf[:chunkSize(i)]
 		err := s.getKnownChunk(loc, b)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		got := cdig.Sum(b)
+		got := cdig.Sum(s.digestAlgo(), b)
 		if got != digests[i] {
 			err := fmt.Errorf("digest mismatch after vaporize: %x != %x at %d/%d", got, digests[i], loc.SlabId, loc.Addr)
 			log.Print(err.Error())
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	return common.ValOrErr(digests, s.commitPreallocated(ctx, blocks, digests, locs, wasAllocated))
+	return digests, sizes, s.commitPreallocated(ctx, blocks, digests, locs, wasAllocated)
 }
 
 // two-phase allocate to support vaporize
@@ -55,6 +55,7 @@ type (
 		nid      uint64
 
 		taildataIsChunkIndex bool
+		cdcChunks            bool // chunk index has one entry per block
 
 		batchStart, batchEnd int
 	}
@@ -131,7 +132,12 @@ func (b *Builder) BuildFromManifestWithSlab(
 	const formatInline = (layoutCompact | (EROFS_INODE_FLAT_INLINE << EROFS_I_DATALAYOUT_BIT))
 	const formatChunked = (layoutCompact | (EROFS_INODE_CHUNK_BASED << EROFS_I_DATALAYOUT_BIT))
 
-	chunkedIU, err := inodeChunkInfo(b.blk)
+	chunkedIU, err := inodeChunkInfo(b.blk, common.ChunkShift)
+	if err != nil {
+		return err
+	}
+	// content-defined chunks don't have a fixed size so we use one chunk index per block
+	cdcIU, err := inodeChunkInfo(b.blk, b.blk)
 	if err != nil {
 		return err
 	}
@@ -179,15 +185,20 @@ func (b *Builder) BuildFromManifestWithSlab(
 
 		for _, i := range batchInodes {
 			locs := allLocs[i.batchStart:i.batchEnd]
-			idxs := make([]erofs_inode_chunk_index, len(locs))
+			idxs := make([]erofs_inode_chunk_index, 0, len(locs))
 			for j, loc := range locs {
 				devId, ok := slabmap[loc.SlabId]
 				if !ok {
 					devId = common.TruncU16(len(slabmap))
 					slabmap[loc.SlabId] = devId
 				}
-				idxs[j].DeviceId = devId + 1
-				idxs[j].BlkAddr = loc.Addr
+				if i.cdcChunks {
+					for k := range uint32(batchBlocks[i.batchStart+j]) {
+						idxs = append(idxs, erofs_inode_chunk_index{DeviceId: devId + 1, BlkAddr: loc.Addr + k})
+					}
+				} else {
+					idxs = append(idxs, erofs_inode_chunk_index{DeviceId: devId + 1, BlkAddr: loc.Addr})
+				}
 			}
 			if i.taildata, err = packToBytes(idxs); err != nil {
 				return err
@@ -256,6 +267,14 @@ func (b *Builder) BuildFromManifestWithSlab(
 				i.i.IU = chunkedIU
 
 				nChunks := int(common.ChunkShift.Blocks(e.Size))
+				if len(e.ChunkSize) > 0 {
+					nChunks = len(e.ChunkSize)
+					if err := checkChunkSizes(e); err != nil {
+						return err
+					}
+					i.i.IU = cdcIU
+					i.cdcChunks = true
+				}
 				if len(e.Digests) != nChunks*cdig.Bytes {
 					return fmt.Errorf("digest list wrong size")
 				}
@@ -265,7 +284,7 @@ func (b *Builder) BuildFromManifestWithSlab(
 					}
 				}
 				i.batchStart = len(batchBlocks)
-				batchBlocks = common.AppendBlocksList(batchBlocks, e.Size, b.blk)
+				batchBlocks = common.AppendEntryBlocksList(batchBlocks, e, b.blk)
 				i.batchEnd = len(batchBlocks)
 				batchDigests = append(batchDigests, cdig.FromSliceAlias(e.Digests)...)
 				batchInodes = append(batchInodes, i)
@@ -608,15 +627,32 @@ func writeAndPad(out io.Writer, data []byte, shift common.BlkShift) int64 {
 	return rounded
 }
 
-func inodeChunkInfo(blkbits common.BlkShift) (uint32, error) {
-	if common.ChunkShift-blkbits > EROFS_CHUNK_FORMAT_BLKBITS_MASK {
+func inodeChunkInfo(blkbits, chunkbits common.BlkShift) (uint32, error) {
+	if chunkbits-blkbits > EROFS_CHUNK_FORMAT_BLKBITS_MASK {
 		return 0, fmt.Errorf("chunk size too big")
 	}
 	b, err := packToBytes(erofs_inode_chunk_info{
-		Format: EROFS_CHUNK_FORMAT_INDEXES | uint16(common.ChunkShift-blkbits),
+		Format: EROFS_CHUNK_FORMAT_INDEXES | uint16(chunkbits-blkbits),
 	})
 	if err != nil {
 		return 0, err
 	}
 	return binary.LittleEndian.Uint32(b), nil
 }
+
+// content-defined chunks must end on aligned boundaries (except the last) and add up to the size
+func checkChunkSizes(e *pb.Entry) error {
+	var total int64
+	for j, size := range e.ChunkSize {
+		if size == 0 || int64(size) > common.ChunkShift.Size() {
+			return fmt.Errorf("bad chunk size")
+		} else if j < len(e.ChunkSize)-1 && common.CdcAlignShift.Leftover(int64(size)) != 0 {
+			return fmt.Errorf("unaligned chunk size")
+		}
+		total += int64(size)
+	}
+	if total != e.Size {
+		return fmt.Errorf("chunk sizes don't match file size")
+	}
+	return nil
+}
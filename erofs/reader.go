@@ -0,0 +1,321 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/lunixbochs/struc"
+	"golang.org/x/sys/unix"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/pb"
+)
+
+// A reader for images written by Builder (and slab images). It only supports what we produce:
+// compact or extended inodes, flat (plain or inline) and chunk-based data layouts, with chunk
+// indexes pointing to slab devices, or flat data mapped onto a device.
+
+type (
+	ImageReader struct {
+		data   []byte
+		blk    common.BlkShift
+		super  erofs_super_block
+		devs   []imageDevice // device id - 1
+		isBare bool
+	}
+
+	ImageEntry struct {
+		Path       string
+		Type       pb.EntryType
+		Executable bool
+		Size       int64
+		// data stored in the image (small files, symlink targets)
+		Data []byte
+		// for chunk-based files: location of each chunk index entry. each one covers
+		// ChunkShift bytes of the file (except the last).
+		ChunkShift common.BlkShift
+		Chunks     []SlabLoc
+		// for flat files whose data is on a device (slab images): location of the start.
+		Extent *SlabLoc
+	}
+
+	imageDevice struct {
+		slabId         uint16
+		mapped, blocks uint32
+	}
+
+	imageInode struct {
+		format, mode uint16
+		size         int64
+		iu           uint32
+		end          int64 // offset of end of inode and inline xattrs
+	}
+)
+
+// NewImageReader parses the superblock and device table of an image. slabId maps device
+// tags (from SlabManager.SlabInfo) back to slab ids.
+func NewImageReader(data []byte, slabId func(tag string) (uint16, error)) (*ImageReader, error) {
+	if len(data) < EROFS_SUPER_OFFSET+EROFS_SUPER_SIZE {
+		return nil, errors.New("image too small")
+	}
+	r := &ImageReader{data: data}
+	if err := unpack(data[EROFS_SUPER_OFFSET:], &r.super); err != nil {
+		return nil, err
+	} else if r.super.Magic != EROFS_MAGIC {
+		return nil, fmt.Errorf("bad magic %#x", r.super.Magic)
+	} else if r.super.FeatureIncompat&^(EROFS_FEATURE_INCOMPAT_CHUNKED_FILE|EROFS_FEATURE_INCOMPAT_DEVICE_TABLE) != 0 {
+		return nil, fmt.Errorf("unsupported incompat features %#x", r.super.FeatureIncompat)
+	}
+	r.blk = common.BlkShift(r.super.BlkSzBits)
+	r.isBare = IsBare(data)
+
+	devOff := int(r.super.DevtSlotOff) * EROFS_DEVT_SLOT_SIZE
+	for i := range int(r.super.ExtraDevices) {
+		var dev erofs_deviceslot
+		off := devOff + i*EROFS_DEVT_SLOT_SIZE
+		if off+EROFS_DEVT_SLOT_SIZE > len(data) {
+			return nil, errors.New("device table out of range")
+		} else if err := unpack(data[off:], &dev); err != nil {
+			return nil, err
+		}
+		tag := string(bytes.TrimRight(dev.Tag[:], "\x00"))
+		id, err := slabId(tag)
+		if err != nil {
+			return nil, fmt.Errorf("device %d: %w", i+1, err)
+		}
+		r.devs = append(r.devs, imageDevice{slabId: id, mapped: dev.MappedBlkAddr, blocks: dev.Blocks})
+	}
+	return r, nil
+}
+
+func (r *ImageReader) BlockShift() common.BlkShift { return r.blk }
+func (r *ImageReader) IsBare() bool                { return r.isBare }
+
+// Entries returns all entries in the image in the same order as a manifest (depth-first,
+// sorted by name). For bare images, it returns the single file with path "/".
+func (r *ImageReader) Entries() ([]*ImageEntry, error) {
+	var out []*ImageEntry
+	err := r.walk(uint64(r.super.RootNid), "/", &out, 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.isBare {
+		if len(out) != 2 || out[1].Path != BarePath {
+			return nil, errors.New("bare image has unexpected contents")
+		}
+		out = out[1:]
+		out[0].Path = "/"
+	}
+	return out, nil
+}
+
+func (r *ImageReader) walk(nid uint64, p string, out *[]*ImageEntry, depth int) error {
+	if depth > 1000 {
+		return errors.New("directory too deep")
+	}
+	ino, err := r.inode(nid)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	e := &ImageEntry{Path: p, Size: ino.size}
+	*out = append(*out, e)
+
+	switch ino.mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		e.Type = pb.EntryType_DIRECTORY
+		e.Size = 0
+		data, err := r.flatData(ino)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		ents, err := r.dirents(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		for _, ent := range ents {
+			if ent.name == "." || ent.name == ".." {
+				continue
+			}
+			if err := r.walk(ent.nid, path.Join(p, ent.name), out, depth+1); err != nil {
+				return err
+			}
+		}
+	case unix.S_IFREG:
+		e.Type = pb.EntryType_REGULAR
+		e.Executable = ino.mode&0o111 != 0
+		if (ino.format>>EROFS_I_DATALAYOUT_BIT)&EROFS_I_DATALAYOUT_MASK == EROFS_INODE_CHUNK_BASED {
+			e.ChunkShift, e.Chunks, err = r.chunks(ino)
+		} else if loc, ok := r.deviceExtent(ino); ok {
+			e.Extent = &loc
+		} else {
+			e.Data, err = r.flatData(ino)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	case unix.S_IFLNK:
+		e.Type = pb.EntryType_SYMLINK
+		if e.Data, err = r.flatData(ino); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported mode %#o", p, ino.mode)
+	}
+	return nil
+}
+
+func (r *ImageReader) inode(nid uint64) (*imageInode, error) {
+	off := int64(nid) << EROFS_NID_SHIFT
+	if off+EROFS_COMPACT_INODE_SIZE > int64(len(r.data)) {
+		return nil, fmt.Errorf("inode %d out of range", nid)
+	}
+	var ino imageInode
+	var xattrCount uint16
+	if r.data[off]&EROFS_I_VERSION_MASK == EROFS_INODE_LAYOUT_COMPACT {
+		var c erofs_inode_compact
+		if err := unpack(r.data[off:], &c); err != nil {
+			return nil, err
+		}
+		ino = imageInode{format: c.IFormat, mode: c.IMode, size: int64(c.ISize), iu: c.IU}
+		xattrCount = c.IXattrICount
+		ino.end = off + EROFS_COMPACT_INODE_SIZE
+	} else {
+		if off+EROFS_EXTENDED_INODE_SIZE > int64(len(r.data)) {
+			return nil, fmt.Errorf("inode %d out of range", nid)
+		}
+		var x erofs_inode_extended
+		if err := unpack(r.data[off:], &x); err != nil {
+			return nil, err
+		}
+		ino = imageInode{format: x.IFormat, mode: x.IMode, size: int64(x.ISize), iu: x.IU}
+		xattrCount = x.IXattrICount
+		ino.end = off + EROFS_EXTENDED_INODE_SIZE
+	}
+	if xattrCount > 0 {
+		// 12 byte header + 4 bytes for each additional count
+		ino.end += 12 + 4*int64(xattrCount-1)
+	}
+	return &ino, nil
+}
+
+// data of a flat (plain or inline) inode
+func (r *ImageReader) flatData(ino *imageInode) ([]byte, error) {
+	layout := (ino.format >> EROFS_I_DATALAYOUT_BIT) & EROFS_I_DATALAYOUT_MASK
+	var full, tail int64
+	switch layout {
+	case EROFS_INODE_FLAT_PLAIN:
+		full = ino.size
+	case EROFS_INODE_FLAT_INLINE:
+		tail = r.blk.Leftover(ino.size)
+		full = ino.size - tail
+	default:
+		return nil, fmt.Errorf("unsupported data layout %d", layout)
+	}
+	out := make([]byte, 0, ino.size)
+	if full > 0 {
+		start := int64(ino.iu) << r.blk
+		if start+full > int64(len(r.data)) {
+			return nil, errors.New("data blocks out of range")
+		}
+		out = append(out, r.data[start:start+full]...)
+	}
+	if tail > 0 {
+		if ino.end+tail > int64(len(r.data)) {
+			return nil, errors.New("tail data out of range")
+		}
+		out = append(out, r.data[ino.end:ino.end+tail]...)
+	}
+	return out, nil
+}
+
+// flat plain data in the global block address range of a device
+func (r *ImageReader) deviceExtent(ino *imageInode) (SlabLoc, bool) {
+	if (ino.format>>EROFS_I_DATALAYOUT_BIT)&EROFS_I_DATALAYOUT_MASK != EROFS_INODE_FLAT_PLAIN {
+		return SlabLoc{}, false
+	}
+	for _, dev := range r.devs {
+		if dev.mapped > 0 && ino.iu >= dev.mapped && ino.iu-dev.mapped < dev.blocks {
+			return SlabLoc{SlabId: dev.slabId, Addr: ino.iu - dev.mapped}, true
+		}
+	}
+	return SlabLoc{}, false
+}
+
+func (r *ImageReader) chunks(ino *imageInode) (common.BlkShift, []SlabLoc, error) {
+	var info erofs_inode_chunk_info
+	if err := unpack(binary.LittleEndian.AppendUint32(nil, ino.iu), &info); err != nil {
+		return 0, nil, err
+	} else if info.Format&EROFS_CHUNK_FORMAT_INDEXES == 0 {
+		return 0, nil, errors.New("chunk block map without indexes not supported")
+	}
+	chunkShift := r.blk + common.BlkShift(info.Format&EROFS_CHUNK_FORMAT_BLKBITS_MASK)
+	n := chunkShift.Blocks(ino.size)
+	// indexes are 8-byte aligned after the inode
+	start := (ino.end + 7) &^ 7
+	if start+n*8 > int64(len(r.data)) {
+		return 0, nil, errors.New("chunk indexes out of range")
+	}
+	locs := make([]SlabLoc, n)
+	for i := range locs {
+		var idx erofs_inode_chunk_index
+		if err := unpack(r.data[start+int64(i)*8:], &idx); err != nil {
+			return 0, nil, err
+		} else if idx.BlkAddr == ^uint32(0) {
+			return 0, nil, errors.New("holes not supported")
+		} else if idx.DeviceId == 0 || int(idx.DeviceId) > len(r.devs) {
+			return 0, nil, fmt.Errorf("bad device id %d", idx.DeviceId)
+		}
+		locs[i] = SlabLoc{SlabId: r.devs[idx.DeviceId-1].slabId, Addr: idx.BlkAddr}
+	}
+	return chunkShift, locs, nil
+}
+
+type imageDirent struct {
+	name string
+	nid  uint64
+}
+
+func (r *ImageReader) dirents(data []byte) ([]imageDirent, error) {
+	const direntSize = 12
+	var out []imageDirent
+	for len(data) > 0 {
+		blk := data[:min(int64(len(data)), r.blk.Size())]
+		data = data[len(blk):]
+		var first erofs_dirent
+		if len(blk) < direntSize {
+			return nil, errors.New("short directory block")
+		} else if err := unpack(blk, &first); err != nil {
+			return nil, err
+		}
+		n := int(first.NameOff) / direntSize
+		if n == 0 || n*direntSize > len(blk) {
+			return nil, errors.New("bad dirent count")
+		}
+		ents := make([]erofs_dirent, n)
+		for i := range ents {
+			if err := unpack(blk[i*direntSize:], &ents[i]); err != nil {
+				return nil, err
+			}
+		}
+		for i, ent := range ents {
+			end := len(blk)
+			if i < n-1 {
+				end = int(ents[i+1].NameOff)
+			}
+			if int(ent.NameOff) > end || end > len(blk) {
+				return nil, errors.New("bad dirent name offset")
+			}
+			// last name in a block may be followed by padding
+			name := bytes.TrimRight(blk[ent.NameOff:end], "\x00")
+			out = append(out, imageDirent{name: string(name), nid: ent.Nid})
+		}
+	}
+	return out, nil
+}
+
+func unpack(b []byte, v any) error {
+	return struc.UnpackWithOptions(bytes.NewReader(b), v, &_popts)
+}
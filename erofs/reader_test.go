@@ -0,0 +1,147 @@
+package erofs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/pb"
+)
+
+// allocates chunks sequentially, switching slabs every few chunks to get multiple devices
+type testSlabManager struct {
+	next    SlabLoc
+	n       int
+	digests map[SlabLoc]cdig.CDig
+}
+
+func (sm *testSlabManager) VerifyParams(common.BlkShift) error { return nil }
+
+func (sm *testSlabManager) AllocateBatch(ctx context.Context, blocks []uint16, digests []cdig.CDig) ([]SlabLoc, error) {
+	out := make([]SlabLoc, len(blocks))
+	for i := range blocks {
+		if sm.n++; sm.n%3 == 0 {
+			sm.next = SlabLoc{SlabId: sm.next.SlabId + 1}
+		}
+		out[i] = sm.next
+		sm.digests[sm.next] = digests[i]
+		sm.next.Addr += uint32(blocks[i])
+	}
+	return out, nil
+}
+
+func (sm *testSlabManager) SlabInfo(slabId uint16) (string, uint32) {
+	return fmt.Sprintf("slab-%d", slabId), 1 << 28
+}
+
+func testSlabId(tag string) (uint16, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(tag, "slab-"))
+	return uint16(id), err
+}
+
+func testDigests(n int, seed string) []byte {
+	var out []byte
+	for i := range n {
+		d := cdig.Sum(cdig.Sha256, []byte(fmt.Sprint(seed, i)))
+		out = append(out, d[:]...)
+	}
+	return out
+}
+
+// converts image entries back to manifest entries
+func testToManifest(sm *testSlabManager, ents []*ImageEntry, orig []*pb.Entry) []*pb.Entry {
+	var out []*pb.Entry
+	for i, ie := range ents {
+		e := &pb.Entry{Path: ie.Path, Type: ie.Type, Executable: ie.Executable, Size: ie.Size}
+		if ie.Type != pb.EntryType_DIRECTORY {
+			e.InlineData = ie.Data
+		}
+		if len(ie.Chunks) > 0 {
+			e.ChunkSize = orig[i].ChunkSize
+			for _, loc := range ie.Chunks {
+				// with per-block indexes, only the first block of each chunk has a digest
+				if d, ok := sm.digests[loc]; ok {
+					e.Digests = append(e.Digests, d[:]...)
+				}
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func TestImageRoundTrip(t *testing.T) {
+	r := require.New(t)
+	for _, tc := range []struct {
+		name    string
+		entries []*pb.Entry
+	}{
+		{"tree", []*pb.Entry{
+			{Path: "/", Type: pb.EntryType_DIRECTORY},
+			{Path: "/bin", Type: pb.EntryType_DIRECTORY},
+			{Path: "/bin/prog", Type: pb.EntryType_REGULAR, Executable: true, Size: 3*common.ChunkShift.Size() + 1000, Digests: testDigests(4, "prog")},
+			{Path: "/bin/sh", Type: pb.EntryType_SYMLINK, Size: 4, InlineData: []byte("prog")},
+			{Path: "/empty", Type: pb.EntryType_REGULAR},
+			{Path: "/lib", Type: pb.EntryType_DIRECTORY},
+			{Path: "/lib/cdc", Type: pb.EntryType_REGULAR, Size: 50000, Digests: testDigests(2, "cdc"), ChunkSize: []uint32{20480, 29520}},
+			{Path: "/lib/small", Type: pb.EntryType_REGULAR, Size: 11, InlineData: []byte("hello world")},
+		}},
+		{"manyfiles", func() []*pb.Entry {
+			ents := []*pb.Entry{{Path: "/", Type: pb.EntryType_DIRECTORY}}
+			for i := range 300 {
+				data := []byte(fmt.Sprint("file number ", i))
+				ents = append(ents, &pb.Entry{Path: fmt.Sprintf("/file-with-a-long-name-%04d", i), Type: pb.EntryType_REGULAR, Size: int64(len(data)), InlineData: data})
+			}
+			return ents
+		}()},
+		{"bare", []*pb.Entry{
+			{Path: "/", Type: pb.EntryType_REGULAR, Size: 70000, Digests: testDigests(2, "bare")},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := &testSlabManager{digests: make(map[SlabLoc]cdig.CDig)}
+			m := &pb.Manifest{Entries: tc.entries}
+			var img bytes.Buffer
+			r.NoError(NewBuilder(BuilderConfig{BlockShift: 12}).BuildFromManifestWithSlab(context.Background(), m, &img, sm))
+
+			ir, err := NewImageReader(img.Bytes(), testSlabId)
+			r.NoError(err)
+			r.Equal(tc.name == "bare", ir.IsBare())
+			ents, err := ir.Entries()
+			r.NoError(err)
+			r.Equal(len(tc.entries), len(ents))
+			got := testToManifest(sm, ents, tc.entries)
+			for i := range got {
+				want := tc.entries[i]
+				r.Equal(want.Path, got[i].Path)
+				r.Equal(want.Type, got[i].Type, want.Path)
+				r.Equal(want.Executable, got[i].Executable, want.Path)
+				r.Equal(want.Size, got[i].Size, want.Path)
+				r.Equal(string(want.InlineData), string(got[i].InlineData), want.Path)
+				r.Equal(want.Digests, got[i].Digests, want.Path)
+			}
+		})
+	}
+}
+
+func TestSlabImageReader(t *testing.T) {
+	r := require.New(t)
+	buf := make([]byte, 4096)
+	r.NoError(SlabImageRead("slab-7", 1<<30, 12, 0, buf))
+
+	ir, err := NewImageReader(buf, testSlabId)
+	r.NoError(err)
+	ents, err := ir.Entries()
+	r.NoError(err)
+	r.Equal(2, len(ents))
+	r.Equal("/slab", ents[1].Path)
+	r.Equal(int64(1<<30), ents[1].Size)
+	r.Equal(&SlabLoc{SlabId: 7, Addr: 0}, ents[1].Extent)
+}
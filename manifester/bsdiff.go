@@ -0,0 +1,349 @@
+package manifester
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// bsdiff-style delta, based on Colin Percival's bsdiff 4.3. This does much better than plain
+// zstd on executables where a small code change shifts many relative addresses, since those
+// turn into mostly-zero bytes in the diff stream.
+//
+// Patch format (all uncompressed, caller compresses):
+//   uvarint: number of control entries
+//   each control entry: uvarint diff length, uvarint extra length, varint seek
+//   diff bytes (new-old bytewise), then extra bytes (copied as-is)
+
+var errBadBsdiff = errors.New("bad bsdiff patch")
+
+func bsdiffEncode(old, new []byte) ([]byte, error) {
+	if len(old) >= math.MaxInt32 || len(new) >= math.MaxInt32 {
+		return nil, errors.New("bsdiff input too large")
+	}
+	I := qsufsort(old)
+
+	var ctrl, db, eb []byte
+	var nctrl uint64
+	oldsize, newsize := len(old), len(new)
+
+	var scan, pos, ln int
+	var lastscan, lastpos, lastoffset int
+	for scan < newsize {
+		oldscore := 0
+		scan += ln
+		for scsc := scan; scan < newsize; scan++ {
+			ln, pos = bsSearch(I, old, new[scan:], 0, oldsize)
+			for ; scsc < scan+ln; scsc++ {
+				if scsc+lastoffset < oldsize && old[scsc+lastoffset] == new[scsc] {
+					oldscore++
+				}
+			}
+			if (ln == oldscore && ln != 0) || ln > oldscore+8 {
+				break
+			}
+			if scan+lastoffset < oldsize && old[scan+lastoffset] == new[scan] {
+				oldscore--
+			}
+		}
+
+		if ln != oldscore || scan == newsize {
+			// extend forward from last match
+			s, sf, lenf := 0, 0, 0
+			for i := 0; lastscan+i < scan && lastpos+i < oldsize; {
+				if old[lastpos+i] == new[lastscan+i] {
+					s++
+				}
+				i++
+				if s*2-i > sf*2-lenf {
+					sf, lenf = s, i
+				}
+			}
+
+			// extend backward from this match
+			lenb := 0
+			if scan < newsize {
+				s, sb := 0, 0
+				for i := 1; scan >= lastscan+i && pos >= i; i++ {
+					if old[pos-i] == new[scan-i] {
+						s++
+					}
+					if s*2-i > sb*2-lenb {
+						sb, lenb = s, i
+					}
+				}
+			}
+
+			// resolve overlap
+			if lastscan+lenf > scan-lenb {
+				overlap := (lastscan + lenf) - (scan - lenb)
+				s, ss, lens := 0, 0, 0
+				for i := 0; i < overlap; i++ {
+					if new[lastscan+lenf-overlap+i] == old[lastpos+lenf-overlap+i] {
+						s++
+					}
+					if new[scan-lenb+i] == old[pos-lenb+i] {
+						s--
+					}
+					if s > ss {
+						ss, lens = s, i+1
+					}
+				}
+				lenf += lens - overlap
+				lenb -= lens
+			}
+
+			for i := 0; i < lenf; i++ {
+				db = append(db, new[lastscan+i]-old[lastpos+i])
+			}
+			extra := (scan - lenb) - (lastscan + lenf)
+			eb = append(eb, new[lastscan+lenf:lastscan+lenf+extra]...)
+
+			ctrl = binary.AppendUvarint(ctrl, uint64(lenf))
+			ctrl = binary.AppendUvarint(ctrl, uint64(extra))
+			ctrl = binary.AppendVarint(ctrl, int64((pos-lenb)-(lastpos+lenf)))
+			nctrl++
+
+			lastscan = scan - lenb
+			lastpos = pos - lenb
+			lastoffset = pos - scan
+		}
+	}
+
+	out := make([]byte, 0, binary.MaxVarintLen64+len(ctrl)+len(db)+len(eb))
+	out = binary.AppendUvarint(out, nctrl)
+	out = append(out, ctrl...)
+	out = append(out, db...)
+	return append(out, eb...), nil
+}
+
+func bsdiffApply(old, patch []byte) ([]byte, error) {
+	nctrl, n := binary.Uvarint(patch)
+	if n <= 0 {
+		return nil, errBadBsdiff
+	}
+	patch = patch[n:]
+
+	// parse control first to find start of diff and extra blocks
+	type ctrlEnt struct {
+		diff, extra uint64
+		seek        int64
+	}
+	ctrl := make([]ctrlEnt, 0, min(nctrl, uint64(len(patch))))
+	var dlen, elen uint64
+	for range nctrl {
+		var c ctrlEnt
+		if c.diff, n = binary.Uvarint(patch); n <= 0 {
+			return nil, errBadBsdiff
+		}
+		patch = patch[n:]
+		if c.extra, n = binary.Uvarint(patch); n <= 0 {
+			return nil, errBadBsdiff
+		}
+		patch = patch[n:]
+		if c.seek, n = binary.Varint(patch); n <= 0 {
+			return nil, errBadBsdiff
+		}
+		patch = patch[n:]
+		// each length is bounded by the remaining patch, so the sums can't overflow
+		if c.diff > uint64(len(patch)) || c.extra > uint64(len(patch)) {
+			return nil, errBadBsdiff
+		}
+		dlen += c.diff
+		elen += c.extra
+		if dlen+elen > uint64(len(patch)) {
+			return nil, errBadBsdiff
+		}
+		ctrl = append(ctrl, c)
+	}
+	if dlen+elen != uint64(len(patch)) {
+		return nil, errBadBsdiff
+	}
+	db, eb := patch[:dlen], patch[dlen:]
+
+	out := make([]byte, 0, dlen+elen)
+	var oldpos int64
+	for _, c := range ctrl {
+		if oldpos < 0 || oldpos > int64(len(old)) || c.diff > uint64(len(old))-uint64(oldpos) ||
+			c.diff > uint64(len(db)) || c.extra > uint64(len(eb)) {
+			return nil, errBadBsdiff
+		}
+		for i, d := range db[:c.diff] {
+			out = append(out, d+old[oldpos+int64(i)])
+		}
+		db = db[c.diff:]
+		out = append(out, eb[:c.extra]...)
+		eb = eb[c.extra:]
+		oldpos += int64(c.diff)
+		if (c.seek > 0 && oldpos > math.MaxInt64-c.seek) || (c.seek < 0 && oldpos < math.MinInt64-c.seek) {
+			return nil, errBadBsdiff
+		}
+		oldpos += c.seek
+	}
+	return out, nil
+}
+
+func bsMatchLen(old, new []byte) int {
+	i := 0
+	for i < len(old) && i < len(new) && old[i] == new[i] {
+		i++
+	}
+	return i
+}
+
+// returns length and position of longest match of new in old
+func bsSearch(I []int32, old, new []byte, st, en int) (int, int) {
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		m := min(len(old)-int(I[x]), len(new))
+		if bytes.Compare(old[I[x]:int(I[x])+m], new[:m]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+	x := bsMatchLen(old[I[st]:], new)
+	y := bsMatchLen(old[I[en]:], new)
+	if x > y {
+		return x, int(I[st])
+	}
+	return y, int(I[en])
+}
+
+// Larsson-Sadakane suffix sort. Returns suffix array with len(old)+1 entries (including the
+// empty suffix first).
+func qsufsort(old []byte) []int32 {
+	oldsize := int32(len(old))
+	I := make([]int32, oldsize+1)
+	V := make([]int32, oldsize+1)
+
+	var buckets [256]int32
+	for _, c := range old {
+		buckets[c]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i := 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	for i, c := range old {
+		buckets[c]++
+		I[buckets[c]] = int32(i)
+	}
+	I[0] = oldsize
+	for i, c := range old {
+		V[i] = buckets[c]
+	}
+	V[oldsize] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := int32(1); I[0] != -(oldsize + 1); h += h {
+		var ln int32
+		i := int32(0)
+		for i < oldsize+1 {
+			if I[i] < 0 {
+				ln -= I[i]
+				i -= I[i]
+			} else {
+				if ln != 0 {
+					I[i-ln] = -ln
+				}
+				ln = V[I[i]] + 1 - i
+				bsSplit(I, V, i, ln, h)
+				i += ln
+				ln = 0
+			}
+		}
+		if ln != 0 {
+			I[i-ln] = -ln
+		}
+	}
+
+	for i := int32(0); i < oldsize+1; i++ {
+		I[V[i]] = i
+	}
+	return I
+}
+
+func bsSplit(I, V []int32, start, ln, h int32) {
+	if ln < 16 {
+		var j int32
+		for k := start; k < start+ln; k += j {
+			j = 1
+			x := V[I[k]+h]
+			for i := int32(1); k+i < start+ln; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := int32(0); i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+		}
+		return
+	}
+
+	x := V[I[start+ln/2]+h]
+	var jj, kk int32
+	for i := start; i < start+ln; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, int32(0), int32(0)
+	for i < jj {
+		if V[I[i]+h] < x {
+			i++
+		} else if V[I[i]+h] == x {
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		} else {
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		bsSplit(I, V, start, jj-start, h)
+	}
+	for i := int32(0); i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+	if start+ln > kk {
+		bsSplit(I, V, kk, start+ln-kk, h)
+	}
+}
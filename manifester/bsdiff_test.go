@@ -0,0 +1,62 @@
+package manifester
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBsdiff(t *testing.T) {
+	r := require.New(t)
+	rnd := rand.New(rand.NewSource(1))
+	for range 200 {
+		// small alphabet to get lots of repeats
+		alpha := 1 + rnd.Intn(4)
+		old := make([]byte, rnd.Intn(500))
+		for i := range old {
+			old[i] = byte(rnd.Intn(alpha))
+		}
+		new := append([]byte(nil), old...)
+		for k := rnd.Intn(5); k > 0 && len(new) > 0; k-- {
+			new[rnd.Intn(len(new))] = byte(rnd.Intn(256))
+		}
+		mid := len(new) / 2
+		new = append(new[:mid:mid], append([]byte("inserted"), new[mid:]...)...)
+
+		patch, err := bsdiffEncode(old, new)
+		r.NoError(err)
+		got, err := bsdiffApply(old, patch)
+		r.NoError(err)
+		r.Equal(new, got)
+	}
+}
+
+func TestBsdiffBad(t *testing.T) {
+	r := require.New(t)
+	old := []byte("some old data")
+	patch := func(ents ...uint64) []byte {
+		out := binary.AppendUvarint(nil, uint64(len(ents)/3))
+		for i := 0; i < len(ents); i += 3 {
+			out = binary.AppendUvarint(out, ents[i])
+			out = binary.AppendUvarint(out, ents[i+1])
+			out = binary.AppendVarint(out, int64(ents[i+2]))
+		}
+		return out
+	}
+	for _, p := range [][]byte{
+		nil,
+		patch(math.MaxUint64, 1, 0),
+		append(patch(math.MaxUint64, 2, 0, 2, 0, 0), "xx"...),
+		append(patch(1<<63, 1<<63, 0), "xx"...),
+		append(patch(0, 2, 0, 2, 0, 0), "ab"...),
+		append(patch(20, 0, 0), make([]byte, 20)...),
+		append(patch(1, 0, 1<<63-1, 1, 0, 0), "ab"...),
+		append(patch(1, 0, -5&math.MaxUint64, 1, 0, 0), "ab"...),
+	} {
+		_, err := bsdiffApply(old, p)
+		r.ErrorIs(err, errBadBsdiff)
+	}
+}
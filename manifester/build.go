@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"cmp"
 	"context"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/url"
@@ -38,7 +38,8 @@ type (
 		ShardTotal int
 		ShardIndex int
 
-		chunkIndex int // internal use
+		chunkIndex int         // internal use
+		pw         *packWriter // internal use
 	}
 
 	ManifestBuilder struct {
@@ -48,6 +49,11 @@ type (
 		chunkPool *common.ChunkPool
 		pubKeys   []signature.PublicKey
 		signKeys  []signature.SecretKey
+		zp        *common.ZstdCtxPool
+
+		// only if using packs
+		packs    *packIndex
+		packSize int64
 
 		stats atomicStats
 	}
@@ -60,6 +66,11 @@ type (
 		NewChunks       atomic.Int64
 		NewUncmpBytes   atomic.Int64
 		NewCmpBytes     atomic.Int64
+		NewPacks        atomic.Int64
+		DiffCacheReqs   atomic.Int64
+		DiffCacheHits   atomic.Int64
+		DiffCachePuts   atomic.Int64
+		DiffCacheErrs   atomic.Int64
 	}
 
 	Stats struct {
@@ -70,6 +81,11 @@ type (
 		NewChunks       int64
 		NewUncmpBytes   int64
 		NewCmpBytes     int64
+		NewPacks        int64
+		DiffCacheReqs   int64 // diffs looked up in the diff cache (if enabled)
+		DiffCacheHits   int64
+		DiffCachePuts   int64
+		DiffCacheErrs   int64
 	}
 
 	ManifestBuilderConfig struct {
@@ -79,6 +95,14 @@ type (
 		PublicKeys []signature.PublicKey
 		// Sign manifests with these keys.
 		SigningKeys []signature.SecretKey
+
+		// If > 0, write chunks into packs of about this size instead of separate objects.
+		PackSize int64
+
+		// Chunking algorithm for file data (common.ChunkAlgoFixed or ChunkAlgoFastCDC).
+		ChunkAlgo string
+		// Digest algorithm (cdig.Sha256 or cdig.Blake3). Empty means common.DigestAlgo.
+		DigestAlgo string
 	}
 
 	ManifestBuildRes struct {
@@ -91,20 +115,44 @@ var (
 	ErrReq      = errors.New("request err")
 	ErrNotFound = errors.New("not found")
 	ErrInternal = errors.New("internal err")
+
+	// returned from Build for shards other than 0 when using packs, since shard 0 does
+	// all the work
+	ErrShardSkipped = errors.New("shard skipped")
 )
 
 func NewManifestBuilder(cfg ManifestBuilderConfig, cs ChunkStoreWrite) (*ManifestBuilder, error) {
+	switch cfg.ChunkAlgo {
+	case common.ChunkAlgoFixed, common.ChunkAlgoFastCDC:
+	default:
+		return nil, fmt.Errorf("unknown chunk algo %q", cfg.ChunkAlgo)
+	}
+	digestAlgo := cmp.Or(cfg.DigestAlgo, common.DigestAlgo)
+	if !cdig.ValidAlgo(digestAlgo) {
+		return nil, fmt.Errorf("unknown digest algo %q", digestAlgo)
+	}
+	var packs *packIndex
+	if cfg.PackSize > 0 {
+		var err error
+		if packs, err = newPackIndex(cs); err != nil {
+			return nil, err
+		}
+	}
 	return &ManifestBuilder{
 		cs:       cs,
 		chunksem: semaphore.NewWeighted(int64(cmp.Or(cfg.ConcurrentChunkOps, 200))),
 		params: &pb.GlobalParams{
 			ChunkShift: int32(common.ChunkShift),
-			DigestAlgo: common.DigestAlgo,
+			DigestAlgo: digestAlgo,
 			DigestBits: int32(cdig.Bits),
+			ChunkAlgo:  cfg.ChunkAlgo,
 		},
 		chunkPool: common.NewChunkPool(common.ChunkShift),
 		pubKeys:   cfg.PublicKeys,
 		signKeys:  cfg.SigningKeys,
+		zp:        common.GetZstdCtxPool(),
+		packs:     packs,
+		packSize:  cfg.PackSize,
 	}, nil
 }
 
@@ -118,6 +166,11 @@ func (b *ManifestBuilder) Stats() Stats {
 		NewChunks:       b.stats.NewChunks.Load(),
 		NewUncmpBytes:   b.stats.NewUncmpBytes.Load(),
 		NewCmpBytes:     b.stats.NewCmpBytes.Load(),
+		NewPacks:        b.stats.NewPacks.Load(),
+		DiffCacheReqs:   b.stats.DiffCacheReqs.Load(),
+		DiffCacheHits:   b.stats.DiffCacheHits.Load(),
+		DiffCachePuts:   b.stats.DiffCachePuts.Load(),
+		DiffCacheErrs:   b.stats.DiffCacheErrs.Load(),
 	}
 }
 
@@ -129,6 +182,23 @@ func (b *ManifestBuilder) ClearStats() {
 	b.stats.NewChunks.Store(0)
 	b.stats.NewUncmpBytes.Store(0)
 	b.stats.NewCmpBytes.Store(0)
+	b.stats.NewPacks.Store(0)
+	b.stats.DiffCacheReqs.Store(0)
+	b.stats.DiffCacheHits.Store(0)
+	b.stats.DiffCachePuts.Store(0)
+	b.stats.DiffCacheErrs.Store(0)
+}
+
+// manifest cache key for a store path built with this builder's params
+func (b *ManifestBuilder) cacheKey(upstream, storePathHash string) string {
+	return (&ManifestReq{
+		Upstream:      upstream,
+		StorePathHash: storePathHash,
+		ChunkShift:    int(b.params.ChunkShift),
+		DigestAlgo:    b.params.DigestAlgo,
+		DigestBits:    int(b.params.DigestBits),
+		ChunkAlgo:     b.params.ChunkAlgo,
+	}).CacheKey()
 }
 
 func (b *ManifestBuilder) Build(
@@ -138,6 +208,14 @@ func (b *ManifestBuilder) Build(
 	useLocalStoreDump string,
 	writeBuildRoot bool,
 ) (*ManifestBuildRes, error) {
+	if b.packs != nil && shardTotal > 1 {
+		// manifest needs locations of all chunks so shard 0 has to do all the work
+		if shardIndex != 0 {
+			return nil, ErrShardSkipped
+		}
+		shardTotal = 1
+	}
+
 	// get narinfo
 
 	upstreamUrl, err := url.Parse(upstream)
@@ -145,21 +223,14 @@ func (b *ManifestBuilder) Build(
 		return nil, err
 	}
 	narinfoUrl := upstreamUrl.JoinPath(storePathHash + ".narinfo").String()
-	res, err := http.Get(narinfoUrl)
+	body, err := openUpstream(narinfoUrl)
 	if err != nil {
-		return nil, fmt.Errorf("%w: upstream http for %s: %w", ErrReq, narinfoUrl, err)
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		if res.StatusCode == http.StatusNotFound {
-			return nil, fmt.Errorf("%w: upstream http for %s", ErrNotFound, narinfoUrl)
-		}
-		return nil, fmt.Errorf("%w: upstream http for %s: %s", ErrReq, narinfoUrl, res.Status)
+		return nil, err
 	}
+	defer body.Close()
 
 	var rawNarinfo bytes.Buffer
-	ni, err := narinfo.Parse(io.TeeReader(res.Body, &rawNarinfo))
+	ni, err := narinfo.Parse(io.TeeReader(body, &rawNarinfo))
 	if err != nil {
 		return nil, fmt.Errorf("%w: narinfo parse for %s: %w", ErrReq, narinfoUrl, err)
 	}
@@ -171,6 +242,20 @@ func (b *ManifestBuilder) Build(
 	}
 
 	log.Println("manifest", storePathHash, "got narinfo", ni.StorePath[44:], ni.FileSize, ni.NarSize)
+	return b.buildWithNarinfo(ctx, upstream, storePathHash, narinfoUrl, ni, shardTotal, shardIndex, useLocalStoreDump, writeBuildRoot)
+}
+
+// Builds a manifest for a store path whose narinfo we already have. The nar comes from
+// useLocalStoreDump if set, otherwise from upstream.
+func (b *ManifestBuilder) buildWithNarinfo(
+	ctx context.Context,
+	upstream, storePathHash, narinfoUrl string,
+	ni *narinfo.NarInfo,
+	shardTotal, shardIndex int,
+	useLocalStoreDump string,
+	writeBuildRoot bool,
+) (*ManifestBuildRes, error) {
+	var err error
 
 	// download nar
 	var narOut io.Reader
@@ -191,16 +276,17 @@ func (b *ManifestBuilder) Build(
 		}()
 	} else {
 		// start := time.Now()
-		narUrl := upstreamUrl.JoinPath(ni.URL).String()
-		res, err = http.Get(narUrl)
+		upstreamUrl, err := url.Parse(upstream)
 		if err != nil {
-			return nil, fmt.Errorf("%w: nar http error for %s: %w", ErrReq, narUrl, err)
+			return nil, err
 		}
-		defer res.Body.Close()
-		if res.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("%w: nar http status for %s: %s", ErrReq, narUrl, res.Status)
+		narUrl := upstreamUrl.JoinPath(ni.URL).String()
+		body, err := openUpstream(narUrl)
+		if err != nil {
+			return nil, err
 		}
-		narOut = res.Body
+		defer body.Close()
+		narOut = body
 
 		// log.Println("req", storePathHash, "downloading nar")
 
@@ -247,10 +333,21 @@ func (b *ManifestBuilder) Build(
 		ShardTotal:      shardTotal,
 		ShardIndex:      shardIndex,
 	}
+	if b.packs != nil {
+		if args.pw, err = b.newPackWriter(ctx); err != nil {
+			return nil, fmt.Errorf("%w: pack index error: %w", ErrInternal, err)
+		}
+	}
 	manifest, err := b.BuildFromNar(ctx, args, io.TeeReader(narOut, narHasher))
 	if err != nil {
 		return nil, fmt.Errorf("%w: manifest generation error: %w", ErrInternal, err)
 	}
+	if args.pw != nil {
+		if err = args.pw.flush(); err != nil {
+			return nil, fmt.Errorf("%w: pack write error: %w", ErrInternal, err)
+		}
+		manifest.PackLocs = args.pw.manifestLocs(manifest)
+	}
 
 	// verify nar hash
 
@@ -329,13 +426,7 @@ func (b *ManifestBuilder) Build(
 	// work on lambda)
 	// TODO: we shouldn't write to cache unless we know for sure that other shards are done.
 	// (or else change client to re-request manifest on missing)
-	cacheKey := (&ManifestReq{
-		Upstream:      upstream,
-		StorePathHash: storePathHash,
-		ChunkShift:    int(common.ChunkShift),
-		DigestAlgo:    common.DigestAlgo,
-		DigestBits:    int(cdig.Bits),
-	}).CacheKey()
+	cacheKey := b.cacheKey(upstream, storePathHash)
 	cmpSb, err := b.cs.PutIfNotExists(ctx, ManifestCachePath, cacheKey, sb)
 	if err != nil {
 		return nil, fmt.Errorf("%w: manifest cache write error: %w", ErrInternal, err)
@@ -418,7 +509,8 @@ func (b *ManifestBuilder) ManifestAsEntry(ctx context.Context, args *BuildArgs,
 	}
 
 	egCtx := errgroup.WithContext(ctx)
-	entry.Digests, err = b.chunkData(egCtx, args, int64(len(mb)), bytes.NewReader(mb))
+	// manifests are always chunked with fixed size
+	entry.Digests, _, err = b.chunkData(egCtx, args, int64(len(mb)), bytes.NewReader(mb), false)
 
 	return common.ValOrErr(entry, cmp.Or(err, egCtx.Wait()))
 }
@@ -456,7 +548,8 @@ func (b *ManifestBuilder) entry(egCtx *errgroup.Group, args *BuildArgs, m *pb.Ma
 			}
 		} else {
 			var err error
-			e.Digests, err = b.chunkData(egCtx, args, e.Size, dataR)
+			cdc := b.params.ChunkAlgo == common.ChunkAlgoFastCDC
+			e.Digests, e.ChunkSize, err = b.chunkData(egCtx, args, e.Size, dataR, cdc)
 			if err != nil {
 				return err
 			}
@@ -475,30 +568,50 @@ func (b *ManifestBuilder) entry(egCtx *errgroup.Group, args *BuildArgs, m *pb.Ma
 
 // Note that goroutines will continue writing into the returned slice after this returns!
 // Caller should not look at it until after Wait() on the errgroup.
-func (b *ManifestBuilder) chunkData(egCtx *errgroup.Group, args *BuildArgs, dataSize int64, r io.Reader) ([]byte, error) {
-	nChunks := common.ChunkShift.Blocks(dataSize)
-	fullDigests := make([]byte, nChunks*cdig.Bytes)
+// If cdc is true, chunk boundaries are content-defined and chunk sizes are also returned.
+func (b *ManifestBuilder) chunkData(
+	egCtx *errgroup.Group, args *BuildArgs, dataSize int64, r io.Reader, cdc bool,
+) ([]byte, []uint32, error) {
+	maxChunk := common.ChunkShift.Size()
+	maxChunks := common.ChunkShift.Blocks(dataSize)
+	var carry []byte // data read but not chunked yet (cdc only)
+	var sizes []uint32
+	if cdc {
+		// upper bound, we'll truncate when done
+		maxChunks = dataSize/max(maxChunk>>3, common.CdcAlignShift.Size()) + 1
+		carry = make([]byte, 0, maxChunk)
+	}
+	fullDigests := make([]byte, maxChunks*cdig.Bytes)
 	digests := fullDigests
 	remaining := dataSize
+	nChunks := 0
 	b.stats.TotalUncmpBytes.Add(dataSize)
-	b.stats.TotalChunks.Add(nChunks)
-	for remaining > 0 {
+	for remaining > 0 || len(carry) > 0 {
 		if err := b.chunksem.Acquire(egCtx, 1); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		size := min(remaining, common.ChunkShift.Size())
-		remaining -= size
-		_data := b.chunkPool.Get(int(size))
-		data := _data[:size]
+		toRead := min(remaining, maxChunk-int64(len(carry)))
+		remaining -= toRead
+		avail := int(toRead) + len(carry)
+		_data := b.chunkPool.Get(avail)
+		copy(_data, carry)
 
-		if _, err := io.ReadFull(r, data); err != nil {
+		if _, err := io.ReadFull(r, _data[len(carry):avail]); err != nil {
 			b.chunkPool.Put(_data)
 			b.chunksem.Release(1)
-			return nil, err
+			return nil, nil, err
+		}
+		size := avail
+		if cdc {
+			size = CdcCut(_data[:avail], common.ChunkShift)
+			sizes = append(sizes, uint32(size))
+			carry = append(carry[:0], _data[size:avail]...)
 		}
+		data := _data[:size]
 		digest := digests[:cdig.Bytes]
 		digests = digests[cdig.Bytes:]
+		nChunks++
 
 		// check shard
 		putChunk := true
@@ -510,14 +623,18 @@ func (b *ManifestBuilder) chunkData(egCtx *errgroup.Group, args *BuildArgs, data
 		egCtx.Go(func() error {
 			defer b.chunksem.Release(1)
 			defer b.chunkPool.Put(_data)
-			h := sha256.New()
-			h.Write(data)
-			var out [sha256.Size]byte
-			copy(digest, h.Sum(out[0:0]))
+			dig := cdig.Sum(b.params.DigestAlgo, data)
+			copy(digest, dig[:])
 			if !putChunk {
 				return nil
 			}
-			compressed, err := b.cs.PutIfNotExists(egCtx, ChunkReadPath, cdig.FromBytes(digest).String(), data)
+			var compressed []byte
+			var err error
+			if args.pw != nil {
+				compressed, err = args.pw.add(dig, data)
+			} else {
+				compressed, err = b.cs.PutIfNotExists(egCtx, ChunkReadPath, dig.String(), data)
+			}
 			if err != nil {
 				return err
 			}
@@ -529,6 +646,32 @@ func (b *ManifestBuilder) chunkData(egCtx *errgroup.Group, args *BuildArgs, data
 			return nil
 		})
 	}
+	b.stats.TotalChunks.Add(int64(nChunks))
+
+	return fullDigests[:nChunks*cdig.Bytes], sizes, nil
+}
 
-	return fullDigests, nil
+// Opens a narinfo or nar from an http(s) or file:// binary cache.
+func openUpstream(u string) (io.ReadCloser, error) {
+	if p, ok := strings.CutPrefix(u, "file://"); ok {
+		f, err := os.Open(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: upstream file %s", ErrNotFound, u)
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: upstream file %s: %w", ErrReq, u, err)
+		}
+		return f, nil
+	}
+	res, err := http.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("%w: upstream http for %s: %w", ErrReq, u, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: upstream http for %s", ErrNotFound, u)
+		}
+		return nil, fmt.Errorf("%w: upstream http for %s: %s", ErrReq, u, res.Status)
+	}
+	return res.Body, nil
 }
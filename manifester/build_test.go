@@ -0,0 +1,142 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+)
+
+// sets up a binary cache in a local directory with one store path
+func testFileUpstream(t *testing.T) (mb *ManifestBuilder, upstream, sp string) {
+	sk, pk, err := signature.GenerateKeypair("test-1", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := t.TempDir()
+	sp = "/nix/store/00000000000000000000000000000000-a"
+	nb, nh := testNar(t, "file upstream contents")
+	ni := &narinfo.NarInfo{
+		StorePath:   sp,
+		URL:         "nar/" + sp[11:43] + ".nar",
+		Compression: "none",
+		NarHash:     nh,
+		NarSize:     uint64(len(nb)),
+		FileHash:    nh,
+		FileSize:    uint64(len(nb)),
+	}
+	sig, err := sk.Sign(nil, ni.Fingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.Signatures = append(ni.Signatures, sig)
+	os.Mkdir(filepath.Join(cacheDir, "nar"), 0755)
+	os.WriteFile(filepath.Join(cacheDir, sp[11:43]+".narinfo"), []byte(ni.String()), 0644)
+	os.WriteFile(filepath.Join(cacheDir, ni.URL), nb, 0644)
+
+	cs, err := newLocalChunkStoreWrite(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err = NewManifestBuilder(ManifestBuilderConfig{
+		ChunkAlgo:   common.ChunkAlgoFixed,
+		PublicKeys:  []signature.PublicKey{pk},
+		SigningKeys: []signature.SecretKey{sk},
+	}, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mb, "file://" + cacheDir + "/", sp
+}
+
+func testManifestReq(upstream, sp string) *ManifestReq {
+	return &ManifestReq{
+		Upstream:      upstream,
+		StorePathHash: sp[11:43],
+		ChunkShift:    int(common.ChunkShift),
+		DigestAlgo:    common.DigestAlgo,
+		DigestBits:    cdig.Bits,
+		ChunkAlgo:     common.ChunkAlgoFixed,
+	}
+}
+
+func TestFileUpstream(t *testing.T) {
+	ctx := context.Background()
+	mb, upstream, sp := testFileUpstream(t)
+
+	res, err := mb.Build(ctx, upstream, sp[11:43], 0, 0, "", false)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := mb.LoadManifest(ctx, res.CacheKey); err != nil {
+		t.Fatal(err)
+	}
+	_, err = mb.Build(ctx, upstream, "11111111111111111111111111111111", 0, 0, "", false)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing narinfo: got %v", err)
+	}
+
+	// file upstreams are only allowed if configured
+	req := testManifestReq(upstream, sp)
+	srv, _ := NewManifestServer(Config{}, mb)
+	if err := srv.validateManifestReq(req); err == nil {
+		t.Error("file upstream allowed by default")
+	}
+	srv, _ = NewManifestServer(Config{AllowFileUpstreams: true}, mb)
+	if err := srv.validateManifestReq(req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestManifestBatch(t *testing.T) {
+	mb, upstream, sp := testFileUpstream(t)
+	req := testManifestReq(upstream, sp)
+	srv, _ := NewManifestServer(Config{AllowFileUpstreams: true, ManifestBatchParallel: 2}, mb)
+
+	// batch: one good, one missing, one sharded
+	missing, sharded := *req, *req
+	missing.StorePathHash = "11111111111111111111111111111111"
+	sharded.ShardTotal = 2
+	body, _ := json.Marshal(ManifestBatchReq{Reqs: []ManifestReq{*req, missing, sharded}})
+	w := httptest.NewRecorder()
+	srv.handleManifestBatch(w, httptest.NewRequest(http.MethodPost, ManifestBatchPath, bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch status %d", w.Code)
+	}
+	got := make(map[int]ManifestBatchRes)
+	for dec := json.NewDecoder(w.Body); dec.More(); {
+		var res ManifestBatchRes
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		got[res.Index] = res
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d batch responses", len(got))
+	} else if len(got[0].Bytes) == 0 || got[0].Error != "" {
+		t.Errorf("good req: %+v", got[0])
+	} else if got[1].Status != http.StatusNotFound {
+		t.Errorf("missing req: %+v", got[1])
+	} else if got[2].Status != http.StatusBadRequest {
+		t.Errorf("sharded req: %+v", got[2])
+	}
+
+	body, _ = json.Marshal(ManifestBatchReq{Reqs: make([]ManifestReq, ManifestBatchMaxReqs+1)})
+	w = httptest.NewRecorder()
+	srv.handleManifestBatch(w, httptest.NewRequest(http.MethodPost, ManifestBatchPath, bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("too many reqs: status %d", w.Code)
+	}
+}
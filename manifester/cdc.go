@@ -0,0 +1,63 @@
+package manifester
+
+import (
+	"math/bits"
+
+	"github.com/dnr/styx/common"
+)
+
+// FastCDC-style content-defined chunking, with the restriction that chunk boundaries must be
+// at multiples of common.CdcAlignShift (so chunks can be mapped into erofs images). Since we
+// only consider aligned positions, we compute the gear hash over the window just before each
+// candidate instead of rolling it over every byte.
+//
+// Note that this means content that shifts by a non-aligned amount (e.g. after a one-byte
+// insert) won't share chunks. Within the same alignment, inserts and deletes only affect
+// nearby chunks.
+//
+// The gear table and masks are part of the chunk format and must never change.
+
+const (
+	cdcWindow = 64 // gear hash only depends on the last 64 bytes
+
+	// normalized chunking: harder to cut before average size, easier after
+	cdcMaskSmall = uint64(0b111) << 61
+	cdcMaskLarge = uint64(0b1) << 63
+)
+
+var cdcGear = func() (t [256]uint64) {
+	// splitmix64 with fixed seed
+	x := uint64(0x5479_7853_6463_4743)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// CdcCut returns the length of the chunk at the start of data. data should contain at least
+// the max chunk size (1<<maxShift), unless it's the end of the file.
+func CdcCut(data []byte, maxShift common.BlkShift) int {
+	align := int(common.CdcAlignShift.Size())
+	maxSize := min(int(maxShift.Size()), len(data))
+	minSize := max(int(maxShift.Size()>>3), align)
+	avgSize := int(maxShift.Size() >> 1)
+
+	for p := minSize; p < maxSize; p += align {
+		var h uint64
+		for _, b := range data[p-cdcWindow : p] {
+			h = bits.RotateLeft64(h, 1) + cdcGear[b]
+		}
+		mask := cdcMaskLarge
+		if p < avgSize {
+			mask = cdcMaskSmall
+		}
+		if h&mask == 0 {
+			return p
+		}
+	}
+	return maxSize
+}
@@ -2,21 +2,25 @@ package manifester
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	s3 "github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 
 	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/common/tracing"
 )
 
 type (
@@ -31,11 +35,33 @@ type (
 		Get(ctx context.Context, key string, dst []byte) ([]byte, error)
 	}
 
+	PackStoreRead interface {
+		// Reads one chunk from a pack and returns it decompressed. Data will be appended to
+		// dst and returned, as in ChunkStoreRead.Get.
+		GetChunk(ctx context.Context, pack string, off int64, length uint32, dst []byte) ([]byte, error)
+	}
+
+	// packStore is implemented by ChunkStoreWrites that support the packfile layout (and other
+	// objects stored without compression).
+	packStore interface {
+		// data should already be compressed
+		putRaw(ctx context.Context, path, key string, data []byte) error
+		// returns raw bytes of the whole object
+		getRaw(ctx context.Context, path, key string) ([]byte, error)
+		// returns raw bytes from object
+		getRange(ctx context.Context, path, key string, off, n int64) ([]byte, error)
+		// calls f with the final path component of each object under path
+		list(ctx context.Context, path string, f func(key string) error) error
+		zstdLevel() int
+	}
+
 	ChunkStoreWriteConfig struct {
 		// One of these is required:
 		ChunkBucket      string
 		ChunkLocalDir    string
 		ZstdEncoderLevel int
+		// only used with ChunkBucket
+		S3 S3Config
 	}
 
 	localChunkStoreWrite struct {
@@ -54,35 +80,91 @@ type (
 		url string
 		zp  *common.ZstdCtxPool
 	}
+
+	localChunkStoreRead struct {
+		dir  string
+		path string
+		zp   *common.ZstdCtxPool
+	}
 )
 
+// subdirectories of a local chunk store, chunks are in the top level
+var localSubdirs = []string{ManifestCachePath, BuildRootPath, PackPath, PackIndexPath, DiffCachePath, PrecomputedDiffPath}
+
+// marks a local chunk store that has been migrated to the subdirectory layout
+const localLayoutMarker = ".layout-v2"
+
 func newLocalChunkStoreWrite(dir string) (*localChunkStoreWrite, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	for _, d := range append([]string{""}, localSubdirs...) {
+		if err := os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := migrateLocalLayout(dir); err != nil {
 		return nil, err
 	}
 	return &localChunkStoreWrite{dir: dir, zp: common.GetZstdCtxPool()}, nil
 }
 
+// LocalStorePath returns the file name for an object in a local chunk store directory.
+// Chunks are in the top level (there are a lot of them and they were always there),
+// everything else is in a subdirectory named after the path.
+func LocalStorePath(dir, path_, key string) string {
+	if path_ == ChunkReadPath {
+		return path.Join(dir, key)
+	}
+	return path.Join(dir, path_, key)
+}
+
+// Older local stores mixed manifests and build roots in with chunks. Move them to their
+// subdirectories so they can be served and collected separately.
+func migrateLocalLayout(dir string) error {
+	marker := path.Join(dir, localLayoutMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	chunkNameLen := base64.RawURLEncoding.EncodedLen(cdig.Bytes)
+	moved := 0
+	for _, ent := range ents {
+		name := ent.Name()
+		var to string
+		if !ent.Type().IsRegular() || strings.Contains(name, ".tmp") {
+			continue
+		} else if strings.Contains(name, "@") {
+			to = BuildRootPath
+		} else if strings.HasPrefix(name, "v1-") && len(name) != chunkNameLen {
+			to = ManifestCachePath
+		} else {
+			continue
+		}
+		if err := os.Rename(path.Join(dir, name), LocalStorePath(dir, to, name)); err != nil {
+			return err
+		}
+		moved++
+	}
+	if moved > 0 {
+		log.Printf("moved %d manifests and build roots in %s to subdirectories", moved, dir)
+	}
+	return WriteFileAtomic(marker, nil)
+}
+
+func (l *localChunkStoreWrite) fn(path_, key string) string {
+	return LocalStorePath(l.dir, path_, key)
+}
+
 func (l *localChunkStoreWrite) PutIfNotExists(ctx context.Context, path_, key string, data []byte) ([]byte, error) {
-	// ignore path! mix chunks and manifests in same directory
 	z := l.zp.Get()
 	defer l.zp.Put(z)
-	fn := path.Join(l.dir, key)
+	fn := l.fn(path_, key)
 	if _, err := os.Stat(fn); err == nil {
 		return nil, nil
-	} else if d, err := z.CompressLevel(nil, data, 1); err != nil {
+	} else if d, err := z.CompressLevel(nil, data, l.zstdLevel()); err != nil {
 		return nil, err
-	} else if out, err := os.CreateTemp(l.dir, key+".tmp*"); err != nil {
-		return nil, err
-	} else if n, err := out.Write(d); err != nil || n != len(d) {
-		_ = out.Close()
-		_ = os.Remove(out.Name())
-		return nil, err
-	} else if err := out.Close(); err != nil {
-		_ = os.Remove(out.Name())
-		return nil, err
-	} else if err := os.Rename(out.Name(), fn); err != nil {
-		_ = os.Remove(out.Name())
+	} else if err := WriteFileAtomic(fn, d); err != nil {
 		return nil, err
 	} else {
 		return d, nil
@@ -90,8 +172,7 @@ func (l *localChunkStoreWrite) PutIfNotExists(ctx context.Context, path_, key st
 }
 
 func (l *localChunkStoreWrite) Get(ctx context.Context, path_, key string, data []byte) ([]byte, error) {
-	// ignore path! mix chunks and manifests in same directory
-	b, err := os.ReadFile(path.Join(l.dir, key))
+	b, err := os.ReadFile(l.fn(path_, key))
 	if err != nil {
 		return nil, err
 	}
@@ -100,14 +181,68 @@ func (l *localChunkStoreWrite) Get(ctx context.Context, path_, key string, data
 	return z.Decompress(data, b)
 }
 
-func newS3ChunkStoreWrite(bucket string, zlevel int) (*s3ChunkStoreWrite, error) {
-	awscfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithEC2IMDSRegion())
+func (l *localChunkStoreWrite) putRaw(ctx context.Context, path_, key string, data []byte) error {
+	return WriteFileAtomic(l.fn(path_, key), data)
+}
+
+func (l *localChunkStoreWrite) getRaw(ctx context.Context, path_, key string) ([]byte, error) {
+	return os.ReadFile(l.fn(path_, key))
+}
+
+func (l *localChunkStoreWrite) getRange(ctx context.Context, path_, key string, off, n int64) ([]byte, error) {
+	f, err := os.Open(l.fn(path_, key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	_, err = f.ReadAt(b, off)
+	return common.ValOrErr(b, err)
+}
+
+func (l *localChunkStoreWrite) list(ctx context.Context, path_ string, f func(key string) error) error {
+	ents, err := os.ReadDir(path.Join(l.dir, path_))
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if strings.Contains(ent.Name(), ".tmp") {
+			continue
+		} else if err := f(ent.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *localChunkStoreWrite) zstdLevel() int {
+	return 1
+}
+
+// WriteFileAtomic writes d to a temporary file next to fn and renames it into place, so
+// readers (and concurrent writers) never see a partial file.
+func WriteFileAtomic(fn string, d []byte) error {
+	if out, err := os.CreateTemp(path.Dir(fn), path.Base(fn)+".tmp*"); err != nil {
+		return err
+	} else if n, err := out.Write(d); err != nil || n != len(d) {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return cmp.Or(err, io.ErrShortWrite)
+	} else if err := out.Close(); err != nil {
+		_ = os.Remove(out.Name())
+		return err
+	} else if err := os.Rename(out.Name(), fn); err != nil {
+		_ = os.Remove(out.Name())
+		return err
+	}
+	return nil
+}
+
+func newS3ChunkStoreWrite(bucket string, zlevel int, s3cfg S3Config) (*s3ChunkStoreWrite, error) {
+	s3client, err := NewS3Client(context.Background(), s3cfg)
 	if err != nil {
 		return nil, err
 	}
-	s3client := s3.NewFromConfig(awscfg, func(o *s3.Options) {
-		o.EndpointOptions.DisableHTTPS = true
-	})
 	return &s3ChunkStoreWrite{
 		bucket:   bucket,
 		s3client: s3client,
@@ -117,8 +252,9 @@ func newS3ChunkStoreWrite(bucket string, zlevel int) (*s3ChunkStoreWrite, error)
 }
 
 func (s *s3ChunkStoreWrite) PutIfNotExists(ctx context.Context, path, key string, data []byte) ([]byte, error) {
-	if path != ChunkReadPath && path != ManifestCachePath && path != BuildRootPath {
-		panic("path must be ChunkReadPath or ManifestCachePath")
+	if path != ChunkReadPath && path != ManifestCachePath && path != BuildRootPath && path != PackIndexPath &&
+		path != DiffCachePath && path != PrecomputedDiffPath {
+		panic("path must be ChunkReadPath, ManifestCachePath, BuildRootPath, PackIndexPath, DiffCachePath, or PrecomputedDiffPath")
 	}
 	key = path[1:] + key
 	_, err := s.s3client.HeadObject(ctx, &s3.HeadObjectInput{
@@ -165,19 +301,81 @@ func (s *s3ChunkStoreWrite) Get(ctx context.Context, path, key string, data []by
 	return z.Decompress(data, b)
 }
 
+func (s *s3ChunkStoreWrite) putRaw(ctx context.Context, path, key string, data []byte) error {
+	key = path[1:] + key
+	_, err := s.s3client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       &s.bucket,
+		Key:          &key,
+		Body:         bytes.NewReader(data),
+		CacheControl: aws.String("public, max-age=31536000"),
+		ContentType:  aws.String("application/octet-stream"),
+	})
+	return err
+}
+
+func (s *s3ChunkStoreWrite) getRaw(ctx context.Context, path, key string) ([]byte, error) {
+	key = path[1:] + key
+	res, err := s.s3client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
+func (s *s3ChunkStoreWrite) getRange(ctx context.Context, path, key string, off, n int64) ([]byte, error) {
+	key = path[1:] + key
+	res, err := s.s3client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+n-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
+func (s *s3ChunkStoreWrite) list(ctx context.Context, path string, f func(key string) error) error {
+	p := s3.NewListObjectsV2Paginator(s.s3client, &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: aws.String(path[1:]),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, o := range res.Contents {
+			if err := f(strings.TrimPrefix(aws.ToString(o.Key), path[1:])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *s3ChunkStoreWrite) zstdLevel() int {
+	return s.zlevel
+}
+
 func NewChunkStoreWrite(cfg ChunkStoreWriteConfig) (ChunkStoreWrite, error) {
 	if len(cfg.ChunkLocalDir) > 0 {
 		return newLocalChunkStoreWrite(cfg.ChunkLocalDir)
 	} else if len(cfg.ChunkBucket) > 0 {
-		return newS3ChunkStoreWrite(cfg.ChunkBucket, cfg.ZstdEncoderLevel)
+		return newS3ChunkStoreWrite(cfg.ChunkBucket, cfg.ZstdEncoderLevel, cfg.S3)
 	}
 	return nil, errors.New("chunk store configuration is missing")
 }
 
-// path should be either ChunkReadPath or ManifestCachePath
+// path should be ChunkReadPath, ManifestCachePath, or PrecomputedDiffPath
 func NewChunkStoreReadUrl(url, path string) ChunkStoreRead {
-	if path != ChunkReadPath && path != ManifestCachePath {
-		panic("path must be ChunkReadPath or ManifestCachePath")
+	if path != ChunkReadPath && path != ManifestCachePath && path != PrecomputedDiffPath {
+		panic("path must be ChunkReadPath, ManifestCachePath, or PrecomputedDiffPath")
 	}
 	return &urlChunkStoreRead{
 		url: strings.TrimSuffix(url, "/") + path,
@@ -186,8 +384,12 @@ func NewChunkStoreReadUrl(url, path string) ChunkStoreRead {
 }
 
 func (s *urlChunkStoreRead) Get(ctx context.Context, key string, dst []byte) ([]byte, error) {
-	url := s.url + key
-	res, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	tracing.Inject(ctx, req.Header)
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -200,18 +402,7 @@ func (s *urlChunkStoreRead) Get(ctx context.Context, key string, dst []byte) ([]
 		return nil, err
 	}
 	if res.Header.Get("Content-Encoding") == "zstd" {
-		z := s.zp.Get()
-		defer s.zp.Put(z)
-		if dst == nil {
-			return z.Decompress(nil, b)
-		} else {
-			// fast path, assume buffer is big enough
-			n, err := z.DecompressInto(dst[len(dst):cap(dst)], b)
-			if err != nil {
-				return nil, err
-			}
-			return dst[:len(dst)+n], nil
-		}
+		return decompressAppend(s.zp, dst, b)
 	} else if dst == nil {
 		return b, nil
 	} else {
@@ -219,6 +410,73 @@ func (s *urlChunkStoreRead) Get(ctx context.Context, key string, dst []byte) ([]
 	}
 }
 
+func NewPackStoreReadUrl(url string) PackStoreRead {
+	return &urlChunkStoreRead{
+		url: strings.TrimSuffix(url, "/") + PackPath,
+		zp:  common.GetZstdCtxPool(),
+	}
+}
+
+func (s *urlChunkStoreRead) GetChunk(ctx context.Context, pack string, off int64, length uint32, dst []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+pack, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(length)-1))
+	tracing.Inject(ctx, req.Header)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("http error: %s", res.Status)
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	} else if len(b) != int(length) {
+		return nil, fmt.Errorf("short range read: %d != %d", len(b), length)
+	}
+	// each chunk in a pack is a separate zstd frame
+	return decompressAppend(s.zp, dst, b)
+}
+
+// NewChunkStoreReadLocal reads from a local chunk store directory (ChunkLocalDir) without
+// going through a server. path is as for NewChunkStoreReadUrl.
+func NewChunkStoreReadLocal(dir, path string) ChunkStoreRead {
+	if path != ChunkReadPath && path != ManifestCachePath && path != PrecomputedDiffPath {
+		panic("path must be ChunkReadPath, ManifestCachePath, or PrecomputedDiffPath")
+	}
+	return &localChunkStoreRead{
+		dir:  dir,
+		path: path,
+		zp:   common.GetZstdCtxPool(),
+	}
+}
+
+func (s *localChunkStoreRead) Get(ctx context.Context, key string, dst []byte) ([]byte, error) {
+	b, err := os.ReadFile(LocalStorePath(s.dir, s.path, key))
+	if err != nil {
+		return nil, err
+	}
+	return decompressAppend(s.zp, dst, b)
+}
+
+func decompressAppend(zp *common.ZstdCtxPool, dst, b []byte) ([]byte, error) {
+	z := zp.Get()
+	defer zp.Put(z)
+	if dst == nil {
+		return z.Decompress(nil, b)
+	}
+	// fast path, assume buffer is big enough
+	n, err := z.DecompressInto(dst[len(dst):cap(dst)], b)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:len(dst)+n], nil
+}
+
 func IsS3NotFound(err error) bool {
 	// the S3 sdk is inconsistent about these, just check both
 	var nsk *s3types.NoSuchKey
@@ -0,0 +1,84 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLocalLayout(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	chunk := "v1-AAAAAAAAAAAAAAAAAAAAAAAAAAAAA" // looks like a manifest key but isn't
+	manifest := "v1-BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"
+	root := "manifest@2024-01-01T00:00:00Z@m@m"
+	for _, name := range []string{chunk, manifest, root} {
+		if err := os.WriteFile(path.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cs, err := newLocalChunkStoreWrite(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ path_, key string }{
+		{ChunkReadPath, chunk},
+		{ManifestCachePath, manifest},
+		{BuildRootPath, root},
+	} {
+		if b, err := os.ReadFile(cs.fn(c.path_, c.key)); err != nil || string(b) != c.key {
+			t.Errorf("%s%s not migrated: %v", c.path_, c.key, err)
+		}
+	}
+
+	data := bytes.Repeat([]byte("styx"), 1000)
+	if _, err := cs.PutIfNotExists(ctx, ManifestCachePath, "v1-new", data); err != nil {
+		t.Fatal(err)
+	} else if err := cs.putRaw(ctx, PackPath, "p1", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewManifestServer(Config{}, &ManifestBuilder{cs: cs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	for _, p := range []string{ManifestCachePath, PackPath} {
+		mux.HandleFunc(p, s.handleLocal(p))
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	b, err := NewChunkStoreReadUrl(srv.URL, ManifestCachePath).Get(ctx, "v1-new", nil)
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("manifest read: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+PackPath+"p1", nil)
+	req.Header.Set("Range", "bytes=3-5")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || string(b) != "345" {
+		t.Fatalf("range read: %s %q", res.Status, b)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+PackPath+"p1", nil)
+	req.Header.Set("If-None-Match", res.Header.Get("ETag"))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("conditional read: %s", res.Status)
+	}
+}
@@ -0,0 +1,89 @@
+package manifester
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+	"golang.org/x/exp/slices"
+)
+
+// Delta algorithms for chunk diffs. Clients list the ones they accept in
+// ChunkDiffReq.DeltaAlgos and the server picks one per request.
+
+const (
+	DeltaZstd   = "zstd"   // zstd with base as prefix ("patch-from")
+	DeltaBsdiff = "bsdiff" // bsdiff-style, then zstd
+)
+
+type deltaAlgo struct {
+	encode func(base, req []byte, level int) ([]byte, error)
+	decode func(base, delta []byte) ([]byte, error)
+}
+
+var deltaAlgos = map[string]deltaAlgo{
+	DeltaZstd: {
+		encode: func(base, req []byte, level int) ([]byte, error) {
+			var out bytes.Buffer
+			zw := zstd.NewWriterPatcher(&out, level, base, int64(len(req)))
+			if _, err := zw.Write(req); err != nil {
+				return nil, err
+			} else if err = zw.Close(); err != nil {
+				return nil, err
+			}
+			return out.Bytes(), nil
+		},
+		decode: func(base, delta []byte) ([]byte, error) {
+			return io.ReadAll(zstd.NewReaderPatcher(bytes.NewReader(delta), base))
+		},
+	},
+	DeltaBsdiff: {
+		encode: func(base, req []byte, level int) ([]byte, error) {
+			patch, err := bsdiffEncode(base, req)
+			if err != nil {
+				return nil, err
+			}
+			return zstd.CompressLevel(nil, patch, level)
+		},
+		decode: func(base, delta []byte) ([]byte, error) {
+			patch, err := zstd.Decompress(nil, delta)
+			if err != nil {
+				return nil, err
+			}
+			return bsdiffApply(base, patch)
+		},
+	},
+}
+
+// DeltaAlgos returns all supported delta algorithms.
+func DeltaAlgos() []string {
+	return []string{DeltaZstd, DeltaBsdiff}
+}
+
+// DeltaDecode reconstructs data from a delta produced by the server.
+func DeltaDecode(algo string, base, delta []byte) ([]byte, error) {
+	da, ok := deltaAlgos[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown delta algo %q", algo)
+	}
+	return da.decode(base, delta)
+}
+
+// guess at a reasonable algorithm without trying all of them. returns "" if none are acceptable.
+func pickDeltaAlgo(accepted []string, base, req []byte) string {
+	elf := []byte("\x7fELF")
+	if len(base) > 0 && (bytes.HasPrefix(base, elf) || bytes.HasPrefix(req, elf)) &&
+		slices.Contains(accepted, DeltaBsdiff) {
+		// executable-aware delta is usually better for binaries
+		return DeltaBsdiff
+	} else if slices.Contains(accepted, DeltaZstd) {
+		return DeltaZstd
+	}
+	for _, algo := range accepted {
+		if _, ok := deltaAlgos[algo]; ok {
+			return algo
+		}
+	}
+	return ""
+}
@@ -0,0 +1,219 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/storepath"
+
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/common/errgroup"
+	"github.com/dnr/styx/pb"
+)
+
+// Nix binary cache protocol, served from manifests and chunks. This lets plain nix clients
+// substitute from the same storage as styx daemons. NARs are reconstructed and served
+// uncompressed, so signatures from the original narinfo are still valid (they don't cover
+// the url or compression).
+
+const (
+	NixCacheInfoPath = "/nix-cache-info"
+	NarPath          = "/nar/" // store path hash + ".nar" as final path component
+
+	nixCachePriority = 50
+)
+
+// writes nar entries as chunk data arrives
+type narEntryWriter struct {
+	nw   *nar.Writer
+	ents []*pb.Entry
+	left int64 // bytes left in current file
+}
+
+func (s *server) nixCacheEnabled() bool {
+	return len(s.cfg.NixCacheUpstreams) > 0
+}
+
+// tries each configured upstream, since manifest cache keys include the upstream
+func (s *server) loadManifestForSph(ctx context.Context, sph string) (*pb.Manifest, error) {
+	if len(sph) != nixbase32.EncodedLen(storepath.PathHashSize) {
+		return nil, fmt.Errorf("%w: bad store path hash", ErrReq)
+	} else if err := nixbase32.ValidateString(sph); err != nil {
+		return nil, fmt.Errorf("%w: bad store path hash", ErrReq)
+	}
+	for _, upstream := range s.cfg.NixCacheUpstreams {
+		if m, err := s.mb.LoadManifest(ctx, s.mb.cacheKey(upstream, sph)); err == nil {
+			return m, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *server) handleNixCacheInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.nixCacheEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-nix-cache-info")
+	fmt.Fprintf(w, "StoreDir: %s\nWantMassQuery: 1\nPriority: %d\n", storepath.StoreDir, nixCachePriority)
+}
+
+func (s *server) handleNarinfo(w http.ResponseWriter, r *http.Request) {
+	sph, ok := strings.CutSuffix(path.Base(r.URL.Path), ".narinfo")
+	if !ok || !s.nixCacheEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	m, err := s.loadManifestForSph(r.Context(), sph)
+	if err != nil {
+		w.WriteHeader(buildErrStatus(err))
+		return
+	}
+	ni := m.Meta.GetNarinfo()
+	if ni == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-nix-narinfo")
+	w.Write(narinfoForNar(ni, sph))
+}
+
+func (s *server) handleNar(w http.ResponseWriter, r *http.Request) {
+	sph, ok := strings.CutSuffix(path.Base(r.URL.Path), ".nar")
+	if !ok || !s.nixCacheEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	m, err := s.loadManifestForSph(r.Context(), sph)
+	if err != nil {
+		w.WriteHeader(buildErrStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-nix-nar")
+	if size := m.Meta.GetNarinfo().GetNarSize(); size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if err := s.writeNar(r.Context(), m, w); err != nil {
+		// too late to change status, client will see a short nar
+		log.Println("nar", sph, "write error:", err)
+	}
+}
+
+// narinfo for the uncompressed nar that we serve
+func narinfoForNar(ni *pb.NarInfo, sph string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "StorePath: %s\n", ni.StorePath)
+	fmt.Fprintf(&b, "URL: %s\n", NarPath[1:]+sph+".nar")
+	fmt.Fprintf(&b, "Compression: none\n")
+	fmt.Fprintf(&b, "FileHash: %s\n", ni.NarHash)
+	fmt.Fprintf(&b, "FileSize: %d\n", ni.NarSize)
+	fmt.Fprintf(&b, "NarHash: %s\n", ni.NarHash)
+	fmt.Fprintf(&b, "NarSize: %d\n", ni.NarSize)
+	fmt.Fprintf(&b, "References: %s\n", strings.Join(ni.References, " "))
+	if ni.Deriver != "" {
+		fmt.Fprintf(&b, "Deriver: %s\n", ni.Deriver)
+	}
+	if ni.System != "" {
+		fmt.Fprintf(&b, "System: %s\n", ni.System)
+	}
+	for _, sig := range ni.Signatures {
+		fmt.Fprintf(&b, "Sig: %s\n", sig)
+	}
+	if ni.Ca != "" {
+		fmt.Fprintf(&b, "CA: %s\n", ni.Ca)
+	}
+	return b.Bytes()
+}
+
+// writeNar reconstructs a nar from a manifest, fetching chunks in parallel.
+func (s *server) writeNar(ctx context.Context, m *pb.Manifest, out io.Writer) error {
+	nw, err := nar.NewWriter(out)
+	if err != nil {
+		return err
+	}
+	var digests []cdig.CDig
+	for _, e := range m.Entries {
+		if e.Type == pb.EntryType_REGULAR {
+			digests = append(digests, cdig.FromSliceAlias(e.Digests)...)
+		}
+	}
+	ew := &narEntryWriter{nw: nw, ents: m.Entries}
+	if err := ew.advance(); err != nil {
+		return err
+	}
+	egCtx := errgroup.WithContext(ctx)
+	egCtx.SetLimit(s.cfg.ChunkDiffParallel)
+	if err := s.fetchChunkSeries(egCtx, digests, ew); err != nil {
+		return err
+	} else if ew.left > 0 || len(ew.ents) > 0 {
+		return errors.New("chunk data too short for manifest")
+	}
+	return nw.Close()
+}
+
+// writes headers (and inline data) for entries until one needs chunk data
+func (w *narEntryWriter) advance() error {
+	for w.left == 0 && len(w.ents) > 0 {
+		e := w.ents[0]
+		w.ents = w.ents[1:]
+		h := &nar.Header{Path: e.Path}
+		switch e.Type {
+		case pb.EntryType_DIRECTORY:
+			h.Type = nar.TypeDirectory
+		case pb.EntryType_SYMLINK:
+			h.Type = nar.TypeSymlink
+			h.LinkTarget = string(e.InlineData)
+		case pb.EntryType_REGULAR:
+			h.Type = nar.TypeRegular
+			h.Size = e.Size
+			h.Executable = e.Executable
+		default:
+			return fmt.Errorf("unknown entry type %v", e.Type)
+		}
+		if err := w.nw.WriteHeader(h); err != nil {
+			return err
+		}
+		if e.Type != pb.EntryType_REGULAR {
+			continue
+		} else if len(e.Digests) > 0 {
+			w.left = e.Size
+		} else if int64(len(e.InlineData)) != e.Size {
+			return fmt.Errorf("entry %s has wrong inline data size", e.Path)
+		} else if _, err := w.nw.Write(e.InlineData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *narEntryWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if w.left == 0 {
+			return n, errors.New("too much chunk data for manifest")
+		}
+		c := int(min(int64(len(b)), w.left))
+		if _, err := w.nw.Write(b[:c]); err != nil {
+			return n, err
+		}
+		n += c
+		b = b[c:]
+		w.left -= int64(c)
+		if w.left == 0 {
+			if err := w.advance(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,76 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+
+	"github.com/dnr/styx/common"
+)
+
+func TestWriteNar(t *testing.T) {
+	t.Run("fixed", func(t *testing.T) { testWriteNar(t, common.ChunkAlgoFixed) })
+	t.Run("fastcdc", func(t *testing.T) { testWriteNar(t, common.ChunkAlgoFastCDC) })
+}
+
+func testWriteNar(t *testing.T, chunkAlgo string) {
+	ctx := context.Background()
+	cs, err := newLocalChunkStoreWrite(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := NewManifestBuilder(ManifestBuilderConfig{ChunkAlgo: chunkAlgo}, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewManifestServer(Config{ChunkDiffParallel: 4}, mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(big)
+
+	var orig bytes.Buffer
+	nw, err := nar.NewWriter(&orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		h    nar.Header
+		data []byte
+	}{
+		{h: nar.Header{Path: "/", Type: nar.TypeDirectory}},
+		{h: nar.Header{Path: "/bin", Type: nar.TypeDirectory}},
+		{h: nar.Header{Path: "/bin/big", Type: nar.TypeRegular, Executable: true}, data: big},
+		{h: nar.Header{Path: "/bin/empty", Type: nar.TypeRegular}},
+		{h: nar.Header{Path: "/lib", Type: nar.TypeSymlink, LinkTarget: "bin"}},
+		{h: nar.Header{Path: "/small", Type: nar.TypeRegular}, data: []byte("hello\n")},
+		{h: nar.Header{Path: "/zbig", Type: nar.TypeRegular}, data: big[1000:200000]},
+	} {
+		f.h.Size = int64(len(f.data))
+		if err := nw.WriteHeader(&f.h); err != nil {
+			t.Fatal(err)
+		} else if _, err := nw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mb.BuildFromNar(ctx, &BuildArgs{SmallFileCutoff: DefaultSmallFileCutoff}, bytes.NewReader(orig.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := s.writeNar(ctx, m, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(orig.Bytes(), out.Bytes()) {
+		t.Fatalf("nar mismatch: %d != %d bytes", orig.Len(), out.Len())
+	}
+}
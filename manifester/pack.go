@@ -0,0 +1,487 @@
+package manifester
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/common/errgroup"
+	"github.com/dnr/styx/common/tracing"
+	"github.com/dnr/styx/pb"
+)
+
+// Packfile layout: instead of writing each chunk as its own object under ChunkReadPath, chunks
+// from one manifest build are appended to pack objects under PackPath. Each chunk is a separate
+// zstd frame so it can be read with a range request. The index for each pack is written under
+// PackIndexPath with the same name. Manifests include the pack locations of all their chunks
+// (in Manifest.PackLocs) so clients don't need to read indexes.
+//
+// The manifester only keeps a bounded number of pack indexes in memory: new packs, and ones
+// that were used recently. Chunks in other packs are found by loading more indexes on demand.
+// A new build won't notice that a chunk is already in a pack that isn't in memory, and will
+// write it to a new pack.
+//
+// Chunks of manifests themselves are always written as separate objects.
+
+const (
+	packIndexReloadInterval = time.Minute
+	packIndexCacheChunks    = 1 << 21 // max chunks from pack indexes to keep in memory
+	packIndexParallel       = 20
+)
+
+type (
+	PackChunkLoc struct {
+		Pack   string
+		Offset int64
+		Length uint32
+	}
+
+	packLoc struct {
+		pack string
+		off  int64
+		ln   uint32
+	}
+
+	// index of packs in the store, with a bounded cache of pack indexes
+	packIndex struct {
+		ps packStore
+		cs ChunkStoreWrite
+
+		loadLock sync.Mutex // held while loading
+		lastLoad time.Time
+
+		maxChunks int
+
+		lock   sync.Mutex
+		packs  []string // all packs in the store, newest first
+		known  map[string]struct{}
+		cached map[string]*cachedPack
+		chunks int                   // total chunks in cached
+		locs   map[cdig.CDig]packLoc // chunks in cached packs
+		clock  int64
+	}
+
+	cachedPack struct {
+		digests []cdig.CDig
+		used    int64
+	}
+
+	// collects chunks from one build into packs
+	packWriter struct {
+		b    *ManifestBuilder
+		eg   *errgroup.Group // for uploads
+		lock sync.Mutex
+		cur  *openPack
+		locs map[cdig.CDig]packLoc // location of every chunk used in this build
+	}
+
+	openPack struct {
+		name    string
+		data    []byte
+		digests []byte
+		lengths []uint32
+	}
+)
+
+var errPackNotSupported = errors.New("chunk store does not support packs")
+
+func newPackIndex(cs ChunkStoreWrite) (*packIndex, error) {
+	ps, ok := cs.(packStore)
+	if !ok {
+		return nil, errPackNotSupported
+	}
+	return &packIndex{
+		ps:        ps,
+		cs:        cs,
+		maxChunks: packIndexCacheChunks,
+		known:     make(map[string]struct{}),
+		cached:    make(map[string]*cachedPack),
+		locs:      make(map[cdig.CDig]packLoc),
+	}, nil
+}
+
+// lists packs in the store, and loads indexes for new packs and as many others as fit in the
+// cache. forgets packs that were removed.
+func (pi *packIndex) load(ctx context.Context) error {
+	pi.loadLock.Lock()
+	defer pi.loadLock.Unlock()
+
+	if time.Since(pi.lastLoad) < packIndexReloadInterval {
+		return nil
+	}
+
+	var listed []string
+	err := pi.ps.list(ctx, PackIndexPath, func(name string) error {
+		listed = append(listed, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// names start with the date
+	slices.Sort(listed)
+	slices.Reverse(listed)
+
+	pi.lock.Lock()
+	var removed int
+	listedSet := make(map[string]struct{}, len(listed))
+	for _, name := range listed {
+		listedSet[name] = struct{}{}
+	}
+	for name := range pi.known {
+		if _, ok := listedSet[name]; !ok {
+			removed++
+		}
+	}
+	if removed > 0 {
+		// some packs were removed (by gc). other packs may have copies of their chunks, so
+		// rebuild from scratch instead of just dropping entries.
+		pi.cached = make(map[string]*cachedPack)
+		pi.locs = make(map[cdig.CDig]packLoc)
+		pi.chunks = 0
+		log.Printf("%d packs removed, reloading pack indexes", removed)
+	}
+	var newNames, oldNames []string
+	for _, name := range listed {
+		if _, ok := pi.cached[name]; ok {
+			continue
+		} else if _, ok := pi.known[name]; ok || len(pi.known) == 0 {
+			oldNames = append(oldNames, name)
+		} else {
+			newNames = append(newNames, name)
+		}
+	}
+	pi.packs, pi.known = listed, listedSet
+	pi.lock.Unlock()
+
+	// new packs always get loaded, others (and all on the first load) only if there's room
+	loaded, err := pi.loadIndexes(ctx, newNames, false)
+	if err != nil {
+		return err
+	}
+	more, err := pi.loadIndexes(ctx, oldNames, true)
+	if err != nil {
+		return err
+	}
+	pi.lastLoad = time.Now()
+	if loaded+more > 0 {
+		log.Printf("loaded %d pack indexes", loaded+more)
+	}
+	return nil
+}
+
+// loads indexes for names into the cache. if onlyIfRoom is set, stops when the cache is full.
+// returns how many were loaded.
+func (pi *packIndex) loadIndexes(ctx context.Context, names []string, onlyIfRoom bool) (int, error) {
+	var loaded int
+	for len(names) > 0 {
+		if onlyIfRoom && pi.full() {
+			break
+		}
+		batch := names[:min(len(names), packIndexParallel)]
+		names = names[len(batch):]
+
+		idxs := make([]*pb.PackIndex, len(batch))
+		eg := errgroup.WithContext(ctx)
+		for i, name := range batch {
+			eg.Go(func() error {
+				b, err := pi.cs.Get(eg, PackIndexPath, name, nil)
+				if err != nil {
+					return err
+				}
+				idxs[i] = &pb.PackIndex{}
+				return proto.Unmarshal(b, idxs[i])
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return loaded, err
+		}
+		for i, name := range batch {
+			if onlyIfRoom && pi.full() {
+				break
+			} else if err := pi.add(name, idxs[i]); err != nil {
+				return loaded, err
+			}
+			loaded++
+		}
+	}
+	return loaded, nil
+}
+
+func (pi *packIndex) full() bool {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return pi.chunks >= pi.maxChunks
+}
+
+// adds an index to the cache, evicting the least recently used ones if needed
+func (pi *packIndex) add(name string, idx *pb.PackIndex) error {
+	digests := cdig.FromSliceAlias(idx.Digests)
+	if len(digests) != len(idx.Length) {
+		return fmt.Errorf("pack index %s has mismatched lengths", name)
+	}
+
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	pi.clock++
+	if cp := pi.cached[name]; cp != nil {
+		cp.used = pi.clock
+		return nil
+	}
+	for len(pi.cached) > 0 && pi.chunks+len(digests) > pi.maxChunks {
+		pi.evictLocked()
+	}
+	var off int64
+	for i, dig := range digests {
+		if _, ok := pi.locs[dig]; !ok {
+			pi.locs[dig] = packLoc{pack: name, off: off, ln: idx.Length[i]}
+		}
+		off += int64(idx.Length[i])
+	}
+	pi.cached[name] = &cachedPack{digests: digests, used: pi.clock}
+	pi.chunks += len(digests)
+	if _, ok := pi.known[name]; !ok {
+		// we just wrote this one
+		pi.known[name] = struct{}{}
+		pi.packs = slices.Insert(pi.packs, 0, name)
+	}
+	return nil
+}
+
+// call with lock held
+func (pi *packIndex) evictLocked() {
+	var lru string
+	for name, cp := range pi.cached {
+		if lru == "" || cp.used < pi.cached[lru].used {
+			lru = name
+		}
+	}
+	// chunks that are also in other cached packs will be found again when this one is
+	// loaded again. that's fine since it's rare.
+	cp := pi.cached[lru]
+	for _, dig := range cp.digests {
+		if pi.locs[dig].pack == lru {
+			delete(pi.locs, dig)
+		}
+	}
+	pi.chunks -= len(cp.digests)
+	delete(pi.cached, lru)
+}
+
+// only looks in cached indexes
+func (pi *packIndex) get(dig cdig.CDig) (packLoc, bool) {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	loc, ok := pi.locs[dig]
+	if ok {
+		pi.clock++
+		pi.cached[loc.pack].used = pi.clock
+	}
+	return loc, ok
+}
+
+// like get but tries reloading indexes if not found, then loads indexes of packs that aren't
+// cached, newest first, until it finds dig. this may load every index for a chunk that isn't
+// in a pack.
+func (pi *packIndex) lookup(ctx context.Context, dig cdig.CDig) (packLoc, bool) {
+	if loc, ok := pi.get(dig); ok {
+		return loc, true
+	} else if err := pi.load(ctx); err != nil {
+		log.Println("pack index load error:", err)
+	}
+	if loc, ok := pi.get(dig); ok {
+		return loc, true
+	}
+
+	pi.lock.Lock()
+	var names []string
+	for _, name := range pi.packs {
+		if _, ok := pi.cached[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	pi.lock.Unlock()
+
+	for len(names) > 0 {
+		batch := names[:min(len(names), packIndexParallel)]
+		names = names[len(batch):]
+		if _, err := pi.loadIndexes(ctx, batch, false); err != nil {
+			log.Println("pack index load error:", err)
+			return packLoc{}, false
+		} else if loc, ok := pi.get(dig); ok {
+			return loc, true
+		}
+	}
+	return packLoc{}, false
+}
+
+func (b *ManifestBuilder) newPackWriter(ctx context.Context) (*packWriter, error) {
+	if err := b.packs.load(ctx); err != nil {
+		return nil, err
+	}
+	return &packWriter{
+		b:    b,
+		eg:   errgroup.WithContext(ctx),
+		locs: make(map[cdig.CDig]packLoc),
+	}, nil
+}
+
+// Adds chunk to pack if it's not already in one. Returns compressed data if it was added.
+func (pw *packWriter) add(dig cdig.CDig, data []byte) ([]byte, error) {
+	pw.lock.Lock()
+	_, have := pw.locs[dig]
+	pw.lock.Unlock()
+	if have {
+		return nil, nil
+	}
+
+	if loc, ok := pw.b.packs.get(dig); ok {
+		pw.lock.Lock()
+		pw.locs[dig] = loc
+		pw.lock.Unlock()
+		return nil, nil
+	}
+
+	z := pw.b.zp.Get()
+	d, err := z.CompressLevel(nil, data, pw.b.packs.ps.zstdLevel())
+	pw.b.zp.Put(z)
+	if err != nil {
+		return nil, err
+	}
+
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	if _, have := pw.locs[dig]; have {
+		return nil, nil // lost race with identical chunk
+	}
+	if pw.cur == nil {
+		pw.cur = &openPack{name: newPackName()}
+	}
+	pw.locs[dig] = packLoc{pack: pw.cur.name, off: int64(len(pw.cur.data)), ln: uint32(len(d))}
+	pw.cur.data = append(pw.cur.data, d...)
+	pw.cur.digests = append(pw.cur.digests, dig[:]...)
+	pw.cur.lengths = append(pw.cur.lengths, uint32(len(d)))
+	if int64(len(pw.cur.data)) >= pw.b.packSize {
+		pw.startUpload()
+	}
+	return d, nil
+}
+
+// call with lock held
+func (pw *packWriter) startUpload() {
+	op := pw.cur
+	pw.cur = nil
+	pw.eg.Go(func() error {
+		idx := &pb.PackIndex{Digests: op.digests, Length: op.lengths}
+		ib, err := proto.Marshal(idx)
+		if err != nil {
+			return err
+		}
+		// write pack first so that the index never points to a missing pack
+		if err = pw.b.packs.ps.putRaw(pw.eg, PackPath, op.name, op.data); err != nil {
+			return fmt.Errorf("pack write error: %w", err)
+		} else if _, err = pw.b.cs.PutIfNotExists(pw.eg, PackIndexPath, op.name, ib); err != nil {
+			return fmt.Errorf("pack index write error: %w", err)
+		}
+		pw.b.stats.NewPacks.Add(1)
+		log.Printf("wrote pack %s with %d chunks, %d bytes", op.name, len(op.lengths), len(op.data))
+		return pw.b.packs.add(op.name, idx)
+	})
+}
+
+// Writes out any remaining data and waits for all uploads.
+func (pw *packWriter) flush() error {
+	pw.lock.Lock()
+	if pw.cur != nil {
+		pw.startUpload()
+	}
+	pw.lock.Unlock()
+	return pw.eg.Wait()
+}
+
+// Returns pack locations for all chunks in m. Call after flush.
+func (pw *packWriter) manifestLocs(m *pb.Manifest) *pb.PackLocs {
+	pl := &pb.PackLocs{}
+	refs := make(map[string]uint32)
+	for _, e := range m.Entries {
+		for _, dig := range cdig.FromSliceAlias(e.Digests) {
+			loc, ok := pw.locs[dig]
+			var ref uint32
+			if ok {
+				if ref = refs[loc.pack]; ref == 0 {
+					pl.Pack = append(pl.Pack, loc.pack)
+					ref = uint32(len(pl.Pack))
+					refs[loc.pack] = ref
+				}
+			}
+			pl.ChunkPack = append(pl.ChunkPack, ref)
+			pl.ChunkOffset = append(pl.ChunkOffset, loc.off)
+			pl.ChunkLength = append(pl.ChunkLength, loc.ln)
+		}
+	}
+	return pl
+}
+
+// Gets a chunk from either a pack or a separate object.
+func (b *ManifestBuilder) getChunk(ctx context.Context, dig cdig.CDig) (_ []byte, retErr error) {
+	ctx, span := tracing.Start(ctx, "get chunk", attribute.String("digest", dig.String()))
+	defer func() { tracing.End(span, retErr) }()
+	if b.packs != nil {
+		if loc, ok := b.packs.lookup(ctx, dig); ok {
+			d, err := b.packs.ps.getRange(ctx, PackPath, loc.pack, loc.off, int64(loc.ln))
+			if err != nil {
+				return nil, err
+			}
+			z := b.zp.Get()
+			defer b.zp.Put(z)
+			return z.Decompress(nil, d)
+		}
+	}
+	return b.cs.Get(ctx, ChunkReadPath, dig.String(), nil)
+}
+
+func newPackName() string {
+	var b [18]byte
+	rand.Read(b[:])
+	return time.Now().UTC().Format("20060102") + "-" + base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// PackLocsByDigest returns a map of digest to pack location for the chunks in a manifest.
+// Chunks that are not in packs are not included.
+func PackLocsByDigest(m *pb.Manifest) (map[cdig.CDig]PackChunkLoc, error) {
+	pl := m.PackLocs
+	if pl == nil {
+		return nil, nil
+	}
+	out := make(map[cdig.CDig]PackChunkLoc)
+	i := 0
+	for _, e := range m.Entries {
+		for _, dig := range cdig.FromSliceAlias(e.Digests) {
+			if i >= len(pl.ChunkPack) || i >= len(pl.ChunkOffset) || i >= len(pl.ChunkLength) {
+				return nil, errors.New("pack locs too short")
+			}
+			if ref := pl.ChunkPack[i]; ref > 0 {
+				if int(ref) > len(pl.Pack) {
+					return nil, errors.New("pack locs has bad pack ref")
+				}
+				out[dig] = PackChunkLoc{
+					Pack:   pl.Pack[ref-1],
+					Offset: pl.ChunkOffset[i],
+					Length: pl.ChunkLength[i],
+				}
+			}
+			i++
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,120 @@
+package manifester
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/pb"
+)
+
+func TestPackIndexReload(t *testing.T) {
+	ctx := context.Background()
+	cs, err := newLocalChunkStoreWrite(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := newPackIndex(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := cdig.Sum(common.DigestAlgo, []byte("shared"))
+	only1 := cdig.Sum(common.DigestAlgo, []byte("only in p1"))
+	putIdx := func(name string, digs ...cdig.CDig) {
+		idx := &pb.PackIndex{}
+		for _, d := range digs {
+			idx.Digests = append(idx.Digests, d[:]...)
+			idx.Length = append(idx.Length, 10)
+		}
+		b, err := proto.Marshal(idx)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err = cs.PutIfNotExists(ctx, PackIndexPath, name, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putIdx("p1", shared, only1)
+	putIdx("p2", only1, shared)
+
+	if err := pi.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := pi.get(shared)
+	if !ok {
+		t.Fatal("shared chunk not found")
+	}
+
+	// remove whichever pack the index picked for the shared chunk
+	gone := loc.pack
+	if err := os.Remove(cs.fn(PackIndexPath, gone)); err != nil {
+		t.Fatal(err)
+	}
+	pi.lastLoad = time.Time{}
+	if err := pi.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []cdig.CDig{shared, only1} {
+		if loc, ok := pi.get(d); !ok || loc.pack == gone {
+			t.Errorf("%s: got %v %v after removing %s", d, loc, ok, gone)
+		}
+	}
+	if _, ok := pi.cached[gone]; ok {
+		t.Errorf("%s still loaded", gone)
+	}
+}
+
+func TestPackIndexBounded(t *testing.T) {
+	ctx := context.Background()
+	cs, err := newLocalChunkStoreWrite(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := newPackIndex(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi.maxChunks = 2
+
+	names := []string{"20240101-a", "20240102-b", "20240103-c"}
+	var digs []cdig.CDig
+	for _, name := range names {
+		d := cdig.Sum(common.DigestAlgo, []byte(name))
+		digs = append(digs, d)
+		b, err := proto.Marshal(&pb.PackIndex{Digests: d[:], Length: []uint32{10}})
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err = cs.PutIfNotExists(ctx, PackIndexPath, name, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the newest fit
+	if err := pi.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pi.get(digs[0]); ok {
+		t.Error("oldest pack should not be cached")
+	}
+	for _, d := range digs[1:] {
+		if _, ok := pi.get(d); !ok {
+			t.Errorf("%s not cached", d)
+		}
+	}
+
+	// found on demand, evicting the least recently used
+	if loc, ok := pi.lookup(ctx, digs[0]); !ok || loc.pack != names[0] {
+		t.Fatalf("lookup got %v %v", loc, ok)
+	}
+	if len(pi.cached) != 2 || pi.chunks != 2 || len(pi.locs) != 2 {
+		t.Errorf("cache has %d packs, %d chunks, %d locs", len(pi.cached), pi.chunks, len(pi.locs))
+	}
+	if _, ok := pi.get(digs[1]); ok {
+		t.Error("least recently used pack should be evicted")
+	}
+}
@@ -0,0 +1,297 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/common/errgroup"
+	"github.com/dnr/styx/pb"
+)
+
+// Precomputed diffs: after a release is manifested, we can guess which diffs daemons will ask
+// for when upgrading and compute them ahead of time. Two shapes are precomputed:
+//
+//   - Whole-file recompress diffs. These are the most expensive and daemons always request
+//     them in the same shape.
+//   - The first diff for each changed file, for a daemon that has all of the previous version
+//     of the store path and reads the file from the start. See firstReadDiff.
+//
+// Later diffs for the same file depend on read patterns and which chunks the daemon already
+// has, so they're still computed on demand.
+//
+// Precomputed diffs are stored in PrecomputedDiffPath under PrecomputedDiffKey, which doesn't
+// depend on server settings, so daemons can read them directly from the chunk read url.
+
+// Max chunks on each side of a first read diff. Must match daemon.InitOpSize.
+const PrecomputeOpSize = 8
+
+var (
+	reManPage   = regexp.MustCompile(`^/share/man/.*[.]gz$`)
+	reLinuxKoXz = regexp.MustCompile(`^/lib/modules/[^/]+/kernel/.*[.]ko[.]xz$`)
+)
+
+type (
+	PrecomputeStats struct {
+		Pairs     int64 // changed store paths with a diff base
+		Diffs     int64 // diffs computed
+		Existing  int64 // diffs that were already present
+		Errors    int64 // diffs that failed (not fatal)
+		ReqBytes  int64 // size of files that got new diffs
+		DiffBytes int64 // size of new diffs
+	}
+
+	precomputeStats struct {
+		pairs, diffs, existing, errors, reqBytes, diffBytes atomic.Int64
+	}
+)
+
+// ExpandForEntry returns the expander that daemons use for recompress diffs of this entry,
+// or "" if it's diffed as-is.
+func ExpandForEntry(ent *pb.Entry) string {
+	if ent.Type != pb.EntryType_REGULAR {
+		return ""
+	} else if reManPage.MatchString(ent.Path) {
+		return ExpandGz
+	} else if reLinuxKoXz.MatchString(ent.Path) && path.Base(ent.Path) != "kheaders.ko.xz" {
+		// kheaders.ko.xz is mostly an embedded .tar.xz file (yes, again), so expanding it won't help.
+		return ExpandXz
+	}
+	return ""
+}
+
+// LoadManifest reads a manifest from the manifest cache. Signatures are not verified.
+func (b *ManifestBuilder) LoadManifest(ctx context.Context, cacheKey string) (*pb.Manifest, error) {
+	var sm pb.SignedMessage
+	if data, err := b.cs.Get(ctx, ManifestCachePath, cacheKey, nil); err != nil {
+		return nil, err
+	} else if err = proto.Unmarshal(data, &sm); err != nil {
+		return nil, err
+	} else if sm.Msg == nil {
+		return nil, fmt.Errorf("manifest %s missing entry", cacheKey)
+	}
+
+	data := sm.Msg.InlineData
+	if len(sm.Msg.Digests) > 0 {
+		var buf bytes.Buffer
+		for _, dig := range cdig.FromSliceAlias(sm.Msg.Digests) {
+			// manifest chunks are never in packs
+			chunk, err := b.cs.Get(ctx, ChunkReadPath, dig.String(), nil)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(chunk)
+		}
+		data = buf.Bytes()
+	}
+	if int64(len(data)) != sm.Msg.Size {
+		return nil, fmt.Errorf("manifest %s has wrong size", cacheKey)
+	}
+
+	var m pb.Manifest
+	return common.ValOrErr(&m, proto.Unmarshal(data, &m))
+}
+
+// PrecomputeUpgradeDiffs computes diffs that daemons upgrading from the store paths in prev
+// to the ones in next are likely to request. Arguments are manifest cache keys.
+func (s *server) PrecomputeUpgradeDiffs(ctx context.Context, prev, next []string, parallel int) (PrecomputeStats, error) {
+	var stats precomputeStats
+
+	// unchanged store paths have the same cache key, skip those
+	prevSet := make(map[string]struct{}, len(prev))
+	for _, key := range prev {
+		prevSet[key] = struct{}{}
+	}
+	nextSet := make(map[string]struct{}, len(next))
+	for _, key := range next {
+		nextSet[key] = struct{}{}
+	}
+
+	eg := errgroup.WithContext(ctx)
+	eg.SetLimit(parallel)
+	var lock sync.Mutex
+	load := func(keys []string, skip map[string]struct{}) map[string]*pb.Manifest {
+		out := make(map[string]*pb.Manifest) // by store path name
+		for _, key := range keys {
+			if _, ok := skip[key]; ok || key == "" {
+				continue
+			}
+			eg.Go(func() error {
+				m, err := s.mb.LoadManifest(eg, key)
+				if err != nil {
+					log.Println("precompute: load manifest", key, "error:", err)
+					return nil
+				} else if m.Meta.GetNarinfo().GetStorePath() == "" {
+					return nil
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				out[path.Base(m.Meta.Narinfo.StorePath)[33:]] = m
+				return nil
+			})
+		}
+		return out
+	}
+	prevByName := load(prev, nextSet)
+	nextByName := load(next, prevSet)
+	if err := eg.Wait(); err != nil {
+		return PrecomputeStats{}, err
+	}
+
+	prevNames := make([]string, 0, len(prevByName))
+	for name := range prevByName {
+		prevNames = append(prevNames, name)
+	}
+
+	eg = errgroup.WithContext(ctx)
+	eg.SetLimit(parallel)
+	for name, m := range nextByName {
+		baseName := common.DiffBaseName(name, prevNames)
+		if baseName == "" {
+			continue
+		}
+		stats.pairs.Add(1)
+		base := prevByName[baseName]
+		baseEnts := make(map[string]*pb.Entry)
+		have := make(map[cdig.CDig]struct{})
+		for _, ent := range base.Entries {
+			if len(ent.Digests) > 0 {
+				baseEnts[ent.Path] = ent
+			}
+			for _, d := range cdig.FromSliceAlias(ent.Digests) {
+				have[d] = struct{}{}
+			}
+		}
+		for i, ent := range m.Entries {
+			baseEnt := baseEnts[ent.Path]
+			if len(ent.Digests) == 0 || baseEnt == nil || bytes.Equal(baseEnt.Digests, ent.Digests) {
+				continue
+			}
+			expand := ExpandForEntry(ent)
+			bases, reqs := baseEnt.Digests, ent.Digests
+			if expand == "" {
+				bases, reqs = firstReadDiff(base, m, i, have)
+				if len(reqs) == 0 {
+					continue
+				}
+			}
+			eg.Go(func() error {
+				if n, err := s.PrecomputeDiff(eg, bases, reqs, expand); err != nil {
+					stats.errors.Add(1)
+					log.Printf("precompute %s%s error: %v", name, ent.Path, err)
+				} else if n == 0 {
+					stats.existing.Add(1)
+				} else {
+					stats.diffs.Add(1)
+					stats.reqBytes.Add(ent.Size)
+					stats.diffBytes.Add(int64(n))
+				}
+				return nil
+			})
+		}
+	}
+	err := eg.Wait()
+	return PrecomputeStats{
+		Pairs:     stats.pairs.Load(),
+		Diffs:     stats.diffs.Load(),
+		Existing:  stats.existing.Load(),
+		Errors:    stats.errors.Load(),
+		ReqBytes:  stats.reqBytes.Load(),
+		DiffBytes: stats.diffBytes.Load(),
+	}, err
+}
+
+// firstReadDiff returns the bases and reqs of the diff that a daemon with all chunks in have
+// requests when it first reads m.Entries[idx]: it starts at the first missing chunk of the
+// file and takes up to PrecomputeOpSize missing chunks from there, with base chunks from the
+// same offset in the same file of base. This mirrors the first op from buildExtendDiff in
+// daemon/diff.go, and has to be kept in sync with it.
+func firstReadDiff(base, m *pb.Manifest, idx int, have map[cdig.CDig]struct{}) (bases, reqs []byte) {
+	var baseDigs, reqDigs []cdig.CDig
+	var baseStart, reqStart int
+	for _, ent := range base.Entries {
+		if ent.Path == m.Entries[idx].Path && len(ent.Digests) > 0 {
+			baseStart = len(baseDigs)
+		}
+		baseDigs = append(baseDigs, cdig.FromSliceAlias(ent.Digests)...)
+	}
+	for i, ent := range m.Entries {
+		if i == idx {
+			reqStart = len(reqDigs)
+		}
+		reqDigs = append(reqDigs, cdig.FromSliceAlias(ent.Digests)...)
+	}
+
+	// find first missing chunk in file
+	off := 0
+	for ; off < len(m.Entries[idx].Digests)/cdig.Bytes; off++ {
+		if _, ok := have[reqDigs[reqStart+off]]; !ok {
+			break
+		}
+	}
+	if off == len(m.Entries[idx].Digests)/cdig.Bytes {
+		return nil, nil
+	}
+
+	using := make(map[cdig.CDig]struct{})
+	var nb, nr int
+	for r, b := reqStart+off, baseStart+off; ; r, b = r+1, b+1 {
+		if r < len(reqDigs) && nr < PrecomputeOpSize {
+			d := reqDigs[r]
+			_, isUsing := using[d]
+			if _, ok := have[d]; !ok && !isUsing {
+				using[d] = struct{}{}
+				reqs = append(reqs, d[:]...)
+				nr++
+			}
+		}
+		if b < len(baseDigs) && nb < PrecomputeOpSize {
+			d := baseDigs[b]
+			if _, isUsing := using[d]; !isUsing {
+				using[d] = struct{}{}
+				bases = append(bases, d[:]...)
+				nb++
+			}
+		}
+		if (b >= len(baseDigs) || nb >= PrecomputeOpSize) && (r >= len(reqDigs) || nr >= PrecomputeOpSize) {
+			return bases, reqs
+		}
+	}
+}
+
+// PrecomputeDiff computes a diff and stores it under PrecomputedDiffKey. Returns the size of
+// the delta, or zero if it was already present.
+func (s *server) PrecomputeDiff(ctx context.Context, bases, reqs []byte, expand string) (int, error) {
+	key := PrecomputedDiffKey(bases, reqs, expand)
+	if _, err := s.mb.cs.Get(ctx, PrecomputedDiffPath, key, nil); err == nil {
+		return 0, nil
+	}
+	baseData, reqData, err := s.loadDiffData(ctx, bases, reqs, expand)
+	if err != nil {
+		return 0, err
+	}
+	delta, algo, err := s.encodeDelta(DeltaAlgos(), baseData, reqData)
+	if err != nil {
+		return 0, err
+	}
+	data, err := proto.Marshal(&pb.ChunkDiffCacheEntry{
+		DeltaAlgo: algo,
+		Delta:     delta,
+		BaseBytes: int64(len(baseData)),
+		ReqBytes:  int64(len(reqData)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.mb.cs.PutIfNotExists(ctx, PrecomputedDiffPath, key, data)
+	return len(delta), err
+}
@@ -0,0 +1,180 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common/errgroup"
+	"github.com/dnr/styx/pb"
+)
+
+// Prewarming builds manifests ahead of time so daemons don't have to wait for them. It
+// finishes by writing a build root that references all the manifests, so gc keeps them.
+//
+// Manifests that are already in the cache are skipped, so an interrupted prewarm can be
+// resumed by running it again with the same paths. (If gc runs in between, it may remove
+// manifests that aren't referenced by a root yet. They'll just be built again.)
+
+type (
+	BatchBuildStats struct {
+		Paths    int64 // distinct store paths requested
+		Existing int64 // manifests that were already cached
+		Built    int64 // manifests built
+		Errors   int64 // failed builds (not fatal)
+		RootKey  string
+	}
+
+	batchBuildStats struct {
+		existing, built, errors atomic.Int64
+	}
+
+	// one element of the output of "nix path-info --json" (older nix versions)
+	prewarmPathInfo struct {
+		Path string `json:"path"`
+	}
+)
+
+// ParsePrewarmPaths parses a list of store paths from the output of
+// "nix path-info -r --json" (either the list or object form) or a plain list of store paths
+// separated by whitespace (e.g. a channel's store-paths file).
+func ParsePrewarmPaths(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+	var paths []string
+	switch {
+	case len(data) == 0:
+	case data[0] == '[':
+		var pis []prewarmPathInfo
+		if err := json.Unmarshal(data, &pis); err != nil {
+			return nil, err
+		}
+		for _, pi := range pis {
+			paths = append(paths, pi.Path)
+		}
+	case data[0] == '{':
+		// newer nix versions: object keyed by store path
+		var pis map[string]json.RawMessage
+		if err := json.Unmarshal(data, &pis); err != nil {
+			return nil, err
+		}
+		for p := range pis {
+			paths = append(paths, p)
+		}
+	default:
+		paths = strings.Fields(string(data))
+	}
+	for _, p := range paths {
+		if _, err := storepath.FromAbsolutePath(p); err != nil {
+			return nil, fmt.Errorf("bad store path %q: %w", p, err)
+		}
+	}
+	return paths, nil
+}
+
+// Prewarm builds and caches manifests for storePaths from upstream, then writes a build root
+// for them. name is included in the build root key. Failures to build individual paths are
+// logged and counted but don't stop the rest.
+func (b *ManifestBuilder) Prewarm(
+	ctx context.Context,
+	upstream string,
+	storePaths []string,
+	name string,
+	parallel int,
+) (BatchBuildStats, error) {
+	return b.buildBatch(ctx, upstream, storePaths, "prewarm", name, parallel,
+		func(ctx context.Context, storePath, sph string) (*ManifestBuildRes, error) {
+			return b.Build(ctx, upstream, sph, 0, 0, "", false)
+		})
+}
+
+// Builds manifests for storePaths that aren't already cached, then writes a build root of
+// type kind that references all of them.
+func (b *ManifestBuilder) buildBatch(
+	ctx context.Context,
+	upstream string,
+	storePaths []string,
+	kind, name string,
+	parallel int,
+	build func(ctx context.Context, storePath, sph string) (*ManifestBuildRes, error),
+) (BatchBuildStats, error) {
+	if name == "" || strings.ContainsAny(name, "@/") {
+		return BatchBuildStats{}, fmt.Errorf("bad build root name %q", name)
+	}
+	storePaths = slices.Clone(storePaths)
+	slices.Sort(storePaths)
+	storePaths = slices.Compact(storePaths)
+
+	var stats batchBuildStats
+	cacheKeys := make([]string, len(storePaths))
+	eg := errgroup.WithContext(ctx)
+	eg.SetLimit(parallel)
+	for i, sp := range storePaths {
+		eg.Go(func() error {
+			p, err := storepath.FromAbsolutePath(sp)
+			if err != nil {
+				return err
+			}
+			sph := nixbase32.EncodeToString(p.Digest)
+			key := b.cacheKey(upstream, sph)
+			if _, err := b.cs.Get(eg, ManifestCachePath, key, nil); err == nil {
+				stats.existing.Add(1)
+				cacheKeys[i] = key
+				return nil
+			}
+			res, err := build(eg, sp, sph)
+			if err != nil {
+				if eg.Err() != nil {
+					return err // interrupted
+				}
+				stats.errors.Add(1)
+				log.Println(kind, sp, "error:", err)
+				return nil
+			}
+			stats.built.Add(1)
+			cacheKeys[i] = res.CacheKey
+			return nil
+		})
+	}
+	err := eg.Wait()
+	out := BatchBuildStats{
+		Paths:    int64(len(storePaths)),
+		Existing: stats.existing.Load(),
+		Built:    stats.built.Load(),
+		Errors:   stats.errors.Load(),
+	}
+	if err != nil {
+		return out, err
+	}
+
+	cacheKeys = slices.DeleteFunc(cacheKeys, func(k string) bool { return k == "" })
+	if len(cacheKeys) == 0 {
+		return out, errors.New("no manifests to write build root for")
+	}
+	btime := time.Now()
+	root := &pb.BuildRoot{
+		Meta: &pb.BuildRootMeta{
+			BuildTime:        btime.Unix(),
+			ManifestUpstream: upstream,
+		},
+		Manifest: cacheKeys,
+	}
+	data, err := proto.Marshal(root)
+	if err != nil {
+		return out, err
+	}
+	// gc parses "type@time@..." and needs at least four parts
+	out.RootKey = strings.Join([]string{kind, btime.Format(time.RFC3339), name, "p"}, "@")
+	_, err = b.cs.PutIfNotExists(ctx, BuildRootPath, out.RootKey, data)
+	return out, err
+}
@@ -0,0 +1,141 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/pb"
+)
+
+func TestParsePrewarmPaths(t *testing.T) {
+	p1 := "/nix/store/00000000000000000000000000000000-a"
+	p2 := "/nix/store/11111111111111111111111111111111-b"
+	for _, in := range []string{
+		`[{"path":"` + p1 + `","narSize":1},{"path":"` + p2 + `"}]`,
+		`{"` + p1 + `":{"narSize":1},"` + p2 + `":{}}`,
+		"\n" + p1 + "\n" + p2 + "\n",
+	} {
+		paths, err := ParsePrewarmPaths([]byte(in))
+		slices.Sort(paths)
+		if err != nil || !slices.Equal(paths, []string{p1, p2}) {
+			t.Errorf("%q: got %v %v", in, paths, err)
+		}
+	}
+	if _, err := ParsePrewarmPaths([]byte("/tmp/foo")); err == nil {
+		t.Error("expected error for non-store path")
+	}
+}
+
+// returns a nar with a single regular file and its hash
+func testNar(t *testing.T, contents string) ([]byte, *hash.Hash) {
+	var nb bytes.Buffer
+	nw, _ := nar.NewWriter(&nb)
+	nw.WriteHeader(&nar.Header{Path: "/", Type: nar.TypeRegular, Size: int64(len(contents))})
+	nw.Write([]byte(contents))
+	nw.Close()
+	sum := sha256.Sum256(nb.Bytes())
+	nh, err := hash.ParseNixBase32("sha256:" + nixbase32.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nb.Bytes(), nh
+}
+
+func TestPrewarm(t *testing.T) {
+	ctx := context.Background()
+	sk, pk, err := signature.GenerateKeypair("test-1", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fake binary cache with two store paths, one missing
+	paths := []string{
+		"/nix/store/00000000000000000000000000000000-a",
+		"/nix/store/11111111111111111111111111111111-b",
+		"/nix/store/22222222222222222222222222222222-missing",
+	}
+	files := make(map[string][]byte)
+	for _, sp := range paths[:2] {
+		nb, nh := testNar(t, "contents of "+sp)
+		ni := &narinfo.NarInfo{
+			StorePath:   sp,
+			URL:         "nar/" + sp[11:43] + ".nar",
+			Compression: "none",
+			NarHash:     nh,
+			NarSize:     uint64(len(nb)),
+			FileHash:    nh,
+			FileSize:    uint64(len(nb)),
+		}
+		sig, err := sk.Sign(nil, ni.Fingerprint())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ni.Signatures = append(ni.Signatures, sig)
+		files["/"+sp[11:43]+".narinfo"] = []byte(ni.String())
+		files["/"+ni.URL] = nb
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b, ok := files[r.URL.Path]; ok {
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	cs, err := newLocalChunkStoreWrite(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := NewManifestBuilder(ManifestBuilderConfig{
+		ChunkAlgo:   common.ChunkAlgoFixed,
+		PublicKeys:  []signature.PublicKey{pk},
+		SigningKeys: []signature.SecretKey{sk},
+	}, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := mb.Prewarm(ctx, upstream.URL+"/", paths, "test", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if stats.Paths != 3 || stats.Built != 2 || stats.Existing != 0 || stats.Errors != 1 {
+		t.Fatalf("first prewarm: %+v", stats)
+	}
+
+	// running again (e.g. after an interruption) skips existing manifests
+	stats, err = mb.Prewarm(ctx, upstream.URL+"/", paths, "test", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if stats.Built != 0 || stats.Existing != 2 || stats.Errors != 1 {
+		t.Fatalf("second prewarm: %+v", stats)
+	}
+
+	var root pb.BuildRoot
+	if b, err := cs.Get(ctx, BuildRootPath, stats.RootKey, nil); err != nil {
+		t.Fatal(err)
+	} else if err := proto.Unmarshal(b, &root); err != nil {
+		t.Fatal(err)
+	} else if len(root.Manifest) != 2 {
+		t.Fatalf("build root has %d manifests", len(root.Manifest))
+	}
+	for _, key := range root.Manifest {
+		if _, err := mb.LoadManifest(ctx, key); err != nil {
+			t.Error(err)
+		}
+	}
+}
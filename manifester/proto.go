@@ -1,19 +1,37 @@
 package manifester
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/pb"
 )
 
 const (
-	ChunkDiffMaxDigests = 256
+	ChunkDiffMaxDigests  = 256
+	ChunkDiffMaxOps      = 64
+	ChunkDiffVersion     = 1
+	ManifestBatchMaxReqs = 1000
+
+	chunkDiffFrameSize = 1 << 20
 )
 
 var (
 	// protocol is (mostly) json over http
-	ManifestPath  = "/manifest"
-	ChunkDiffPath = "/chunkdiff"
+	ManifestPath      = "/manifest"
+	ManifestBatchPath = "/manifestbatch"
+	ChunkDiffPath     = "/chunkdiff"
+	ChunkDiffV2Path   = "/chunkdiff2" // protobuf request and framed response, see pb.ChunkDiffReq
+
+	ChunkDiffAlgoHeader = "X-Styx-Delta-Algo"
 
 	// chunk read protocol
 	ChunkReadPath     = "/chunk/"    // digest as final path component
@@ -21,6 +39,13 @@ var (
 
 	BuildRootPath = "/buildroot/" // written by manifester, read only by gc
 
+	// packfile layout (optional)
+	PackPath      = "/pack/"    // pack name as final path component, read with range requests
+	PackIndexPath = "/packidx/" // pack name as final path component, read only by manifester and gc
+
+	DiffCachePath       = "/diffcache/"   // diff cache key as final path component
+	PrecomputedDiffPath = "/precomputed/" // precomputed diff key as final path component
+
 	ExpandGz = "gz"
 	ExpandXz = "xz"
 )
@@ -34,6 +59,7 @@ type (
 		ChunkShift int
 		DigestAlgo string
 		DigestBits int
+		ChunkAlgo  string `json:",omitempty"` // empty means fixed-size chunks
 
 		// sharded manifesting (not in cache key, only shard 0 writes to cache)
 		ShardTotal int `json:",omitempty"`
@@ -41,7 +67,19 @@ type (
 	}
 	// response is SignedManifest
 
-	// TODO: move this to pb so we don't have to use base64?
+	ManifestBatchReq struct {
+		Reqs []ManifestReq // sharding is not supported in batch requests
+	}
+	// Response is a stream of json-encoded ManifestBatchRes, one per line, in order of
+	// completion (not request order). Each request gets exactly one response.
+	ManifestBatchRes struct {
+		Index  int    // index into Reqs
+		Status int    `json:",omitempty"` // http status that the single request would have returned
+		Error  string `json:",omitempty"`
+		Bytes  []byte `json:",omitempty"` // zstd-compressed SignedManifest, if no error
+	}
+
+	// Old json protocol. See pb.ChunkDiffReq for the newer binary one.
 	ChunkDiffReq struct {
 		Bases []byte
 		Reqs  []byte
@@ -49,16 +87,25 @@ type (
 		// If set: Bases and Reqs each comprise one single file in the given compression
 		// format. Pass each one through this decompressor before diffing.
 		ExpandBeforeDiff string `json:",omitempty"`
+
+		// Delta algorithms that the client accepts (see DeltaZstd, etc.). If empty, the
+		// response uses the old zstd-only format described below.
+		DeltaAlgos []string `json:",omitempty"`
 	}
-	// Response is compressed concatenation of reqs, using bases as compression base,
+	// If DeltaAlgos is set: The chosen algorithm is in the ChunkDiffAlgoHeader header. The
+	// body is the uvarint length of the delta, the delta itself (which decodes to the
+	// concatenation of reqs), and then ChunkDiffStats (json, uncompressed).
+	//
+	// Otherwise: Response is compressed concatenation of reqs, using bases as compression base,
 	// with ChunkDiffStats (json) appended after that (also compressed).
+	//
 	// Bases and Reqs do not need to be the same length.
 	// (Caller must know the lengths of reqs ahead of time to be able to split the result.)
 	// Max number of digests in each is 256. With 64KiB chunks, that makes 16MiB total data.
 	//
-	// ChunkDiffStats must contain only integers! (For now, since we sometimes scan backwards
-	// to find the start of the stats. We can relax this requirement if we write a reverse json
-	// parser.)
+	// ChunkDiffStats must contain only integers and strings without braces! (For now, since
+	// we sometimes scan backwards to find the start of the stats. We can relax this
+	// requirement if we write a reverse json parser.)
 	ChunkDiffStats struct {
 		BaseChunks int   `json:"baseC"`
 		BaseBytes  int   `json:"baseB"`
@@ -66,7 +113,10 @@ type (
 		ReqBytes   int   `json:"reqB"`
 		DiffBytes  int   `json:"diffB"`
 		DlTotalMs  int64 `json:"dlMs"`
-		ZstdMs     int64 `json:"zstdMs"`
+		ZstdMs     int64 `json:"zstdMs"` // time spent encoding (any algo)
+
+		DeltaAlgo string `json:"algo,omitempty"`
+		Cached    bool   `json:"cached,omitempty"`
 	}
 )
 
@@ -76,6 +126,65 @@ func (r *ManifestReq) CacheKey() string {
 	h.Write([]byte(fmt.Sprintf("u=%s\n", r.Upstream)))
 	h.Write([]byte(fmt.Sprintf("h=%s\n", r.StorePathHash)))
 	h.Write([]byte(fmt.Sprintf("p=%d:%s:%d\n", r.ChunkShift, r.DigestAlgo, r.DigestBits)))
+	if r.ChunkAlgo != "" {
+		// only included if present to preserve existing keys
+		h.Write([]byte(fmt.Sprintf("a=%s\n", r.ChunkAlgo)))
+	}
 	// note: SmallFileCutoff is not part of key, client may get different one from requested
 	return "v1-" + base64.RawURLEncoding.EncodeToString(h.Sum(nil))[:36]
 }
+
+// Key for the server-side diff cache. This includes everything that can affect the output.
+func diffCacheKey(accepted []string, bases, reqs []byte, expand string, level int, tryAll bool) string {
+	h := sha256.New()
+	h.Write([]byte("styx-diff-cache-v2\n"))
+	h.Write([]byte(fmt.Sprintf("a=%s:%d:%t\n", strings.Join(accepted, ","), level, tryAll)))
+	h.Write([]byte(fmt.Sprintf("e=%s\n", expand)))
+	h.Write([]byte(fmt.Sprintf("b=%d\n", len(bases))))
+	h.Write(bases)
+	h.Write([]byte(fmt.Sprintf("r=%d\n", len(reqs))))
+	h.Write(reqs)
+	return "d2-" + base64.RawURLEncoding.EncodeToString(h.Sum(nil))[:36]
+}
+
+// Key for precomputed diffs (see precompute.go). This doesn't depend on server settings since
+// daemons read these directly.
+func PrecomputedDiffKey(bases, reqs []byte, expand string) string {
+	h := sha256.New()
+	h.Write([]byte("styx-diff-precomputed-v1\n"))
+	h.Write([]byte(fmt.Sprintf("e=%s\n", expand)))
+	h.Write([]byte(fmt.Sprintf("b=%d\n", len(bases))))
+	h.Write(bases)
+	h.Write([]byte(fmt.Sprintf("r=%d\n", len(reqs))))
+	h.Write(reqs)
+	return "p1-" + base64.RawURLEncoding.EncodeToString(h.Sum(nil))[:36]
+}
+
+// Reads one length-prefixed frame of a chunk diff v2 response. Returns the number of bytes read.
+func ReadChunkDiffFrame(r *bufio.Reader) (*pb.ChunkDiffFrame, int, error) {
+	ln, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err
+	} else if ln > 2*chunkDiffFrameSize {
+		return nil, 0, errors.New("chunk diff frame too big")
+	}
+	buf := make([]byte, ln)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, 0, err
+	}
+	var f pb.ChunkDiffFrame
+	if err = proto.Unmarshal(buf, &f); err != nil {
+		return nil, 0, err
+	}
+	return &f, int(ln) + uvarintLen(ln), nil
+}
+
+func appendChunkDiffFrame(buf []byte, f *pb.ChunkDiffFrame) ([]byte, error) {
+	buf = binary.AppendUvarint(buf, uint64(proto.Size(f)))
+	return proto.MarshalOptions{}.MarshalAppend(buf, f)
+}
+
+func uvarintLen(v uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], v)
+}
@@ -0,0 +1,151 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+
+	"github.com/dnr/styx/common"
+)
+
+// Publishing builds manifests for paths in the local nix store, so they don't have to be in
+// any binary cache. Chunks go to the chunk store as usual and the signed manifest goes to the
+// manifest cache under the given upstream, so daemons that mount the path with that upstream
+// find it there without asking a manifester.
+
+// output of "nix path-info --json" for one path
+type localPathInfo struct {
+	Path       string   `json:"path"`
+	NarHash    string   `json:"narHash"`
+	NarSize    uint64   `json:"narSize"`
+	References []string `json:"references"`
+	Deriver    string   `json:"deriver"`
+	Signatures []string `json:"signatures"`
+	CA         string   `json:"ca"`
+}
+
+// Publish builds manifests for storePaths (and their closures if recursive) from the local
+// nix store and writes a build root for them.
+func (b *ManifestBuilder) Publish(
+	ctx context.Context,
+	upstream string,
+	storePaths []string,
+	recursive bool,
+	name string,
+	parallel int,
+) (BatchBuildStats, error) {
+	if len(b.signKeys) == 0 {
+		return BatchBuildStats{}, errors.New("publish requires a styx signing key")
+	}
+	infos, err := getLocalPathInfo(ctx, storePaths, recursive)
+	if err != nil {
+		return BatchBuildStats{}, err
+	}
+	paths := make([]string, 0, len(infos))
+	for p := range infos {
+		paths = append(paths, p)
+	}
+	return b.buildBatch(ctx, upstream, paths, "publish", name, parallel,
+		func(ctx context.Context, storePath, sph string) (*ManifestBuildRes, error) {
+			ni, err := infos[storePath].toNarinfo()
+			if err != nil {
+				return nil, err
+			}
+			narinfoUrl := strings.TrimSuffix(upstream, "/") + "/" + sph + ".narinfo"
+			return b.buildWithNarinfo(ctx, upstream, sph, narinfoUrl, ni, 0, 0, storePath, false)
+		})
+}
+
+func getLocalPathInfo(ctx context.Context, storePaths []string, recursive bool) (map[string]*localPathInfo, error) {
+	args := []string{"--extra-experimental-features", "nix-command", "path-info", "--json"}
+	if recursive {
+		args = append(args, "--recursive")
+	}
+	cmd := exec.CommandContext(ctx, common.NixBin, append(args, storePaths...)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nix path-info: %w", err)
+	}
+	return parseLocalPathInfo(out)
+}
+
+func parseLocalPathInfo(data []byte) (map[string]*localPathInfo, error) {
+	out := make(map[string]*localPathInfo)
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var list []*localPathInfo
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, pi := range list {
+			out[pi.Path] = pi
+		}
+	} else {
+		// newer nix versions: object keyed by store path, null for invalid paths
+		if err := json.Unmarshal(data, &out); err != nil {
+			return nil, err
+		}
+		for p, pi := range out {
+			if pi == nil {
+				return nil, fmt.Errorf("%s is not valid in the local store", p)
+			}
+			pi.Path = p
+		}
+	}
+	return out, nil
+}
+
+func (pi *localPathInfo) toNarinfo() (*narinfo.NarInfo, error) {
+	narHash, err := parseNarHash(pi.NarHash)
+	if err != nil {
+		return nil, fmt.Errorf("bad nar hash for %s: %w", pi.Path, err)
+	}
+	ni := &narinfo.NarInfo{
+		StorePath:   pi.Path,
+		URL:         "nar/" + path.Base(pi.Path)[:32] + ".nar",
+		Compression: "none",
+		FileHash:    narHash,
+		FileSize:    pi.NarSize,
+		NarHash:     narHash,
+		NarSize:     pi.NarSize,
+		CA:          pi.CA,
+	}
+	for _, ref := range pi.References {
+		ni.References = append(ni.References, path.Base(ref))
+	}
+	if pi.Deriver != "" {
+		ni.Deriver = path.Base(pi.Deriver)
+	}
+	for _, s := range pi.Signatures {
+		// keep any signatures from the local store, they're still valid for the narinfo
+		if sig, err := signature.ParseSignature(s); err == nil {
+			ni.Signatures = append(ni.Signatures, sig)
+		}
+	}
+	return ni, nil
+}
+
+// accepts "sha256:<nixbase32>" (older nix) or "sha256-<base64>" (sri, newer nix)
+func parseNarHash(s string) (*hash.Hash, error) {
+	if algo, b64, ok := strings.Cut(s, "-"); ok && !strings.Contains(algo, ":") {
+		digest, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, err
+		}
+		s = algo + ":" + nixbase32.EncodeToString(digest)
+	}
+	return hash.ParseNixBase32(s)
+}
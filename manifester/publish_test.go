@@ -0,0 +1,103 @@
+package manifester
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+
+	"github.com/dnr/styx/common"
+)
+
+func TestParseLocalPathInfo(t *testing.T) {
+	// same path as reported by older and newer nix versions
+	for _, in := range []string{
+		`[{"path":"/nix/store/7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d-hello-2.12.1","narHash":"sha256:1k2b8mx3bpnxhjvjzq9a5w3ymkjnp0wmj5wb2jm7vq0n3vbqfmd7","narSize":226560,"references":["/nix/store/7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d-hello-2.12.1","/nix/store/aw2fw9ag10wr9pf0qk4nk5sxi0q0bn56-glibc-2.37-8"],"deriver":"/nix/store/p8k2h3hmfvjbk4kba5lb4s8ycfxlwmbb-hello-2.12.1.drv","signatures":["cache.nixos.org-1:abc"]}]`,
+		`{"/nix/store/7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d-hello-2.12.1":{"narHash":"sha256-p1WH1x4W4H2qFIsXWTm4Vs7qBy8q4S+3hN3eNXpFS8w=","narSize":226560,"references":["/nix/store/7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d-hello-2.12.1","/nix/store/aw2fw9ag10wr9pf0qk4nk5sxi0q0bn56-glibc-2.37-8"],"deriver":"/nix/store/p8k2h3hmfvjbk4kba5lb4s8ycfxlwmbb-hello-2.12.1.drv","signatures":[]}}`,
+	} {
+		infos, err := parseLocalPathInfo([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pi := infos["/nix/store/7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d-hello-2.12.1"]
+		if pi == nil {
+			t.Fatalf("missing path in %v", infos)
+		}
+		ni, err := pi.toNarinfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ni.Fingerprint(); got != "1;/nix/store/7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d-hello-2.12.1;"+
+			"sha256:1k2b8mx3bpnxhjvjzq9a5w3ymkjnp0wmj5wb2jm7vq0n3vbqfmd7;226560;"+
+			"/nix/store/7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d-hello-2.12.1,/nix/store/aw2fw9ag10wr9pf0qk4nk5sxi0q0bn56-glibc-2.37-8" {
+			t.Errorf("fingerprint: %s", got)
+		} else if ni.Deriver != "p8k2h3hmfvjbk4kba5lb4s8ycfxlwmbb-hello-2.12.1.drv" {
+			t.Errorf("deriver: %s", ni.Deriver)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	sp := "/nix/store/7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d-private"
+	nb, nh := testNar(t, "private build output")
+
+	// stand-ins for nix and nix-store
+	bin := t.TempDir()
+	narFile := filepath.Join(bin, "out.nar")
+	if err := os.WriteFile(narFile, nb, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pathInfo := fmt.Sprintf(`[{"path":%q,"narHash":%q,"narSize":%d,"references":[]}]`, sp, nh.NixString(), len(nb))
+	for name, script := range map[string]string{
+		"nix":       "#!/bin/sh\necho '" + pathInfo + "'\n",
+		"nix-store": "#!/bin/sh\ncat " + narFile + "\n",
+	} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(old string) { common.NixBin = old }(common.NixBin)
+	common.NixBin = filepath.Join(bin, "nix")
+
+	sk, pk, err := signature.GenerateKeypair("styx-test-1", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := newLocalChunkStoreWrite(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := NewManifestBuilder(ManifestBuilderConfig{ChunkAlgo: common.ChunkAlgoFixed, SigningKeys: []signature.SecretKey{sk}}, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := "https://private.example.com/"
+	stats, err := mb.Publish(ctx, upstream, []string{sp}, false, "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if stats.Built != 1 || stats.Errors != 0 {
+		t.Fatalf("publish: %+v", stats)
+	}
+
+	// daemons find it in the manifest cache under the upstream they mount with
+	key := mb.cacheKey(upstream, "7zq0ysxqwrclgrlmpbc3xq5rkcxqnf6d")
+	b, err := cs.Get(ctx, ManifestCachePath, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := common.VerifyMessageAsEntry([]signature.PublicKey{pk}, common.ManifestContext, b); err != nil {
+		t.Fatal("manifest signature:", err)
+	}
+	m, err := mb.LoadManifest(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	} else if m.Meta.Narinfo.StorePath != sp || m.Meta.Narinfo.NarHash != nh.NixString() {
+		t.Fatalf("bad narinfo in manifest: %v", m.Meta.Narinfo)
+	}
+}
@@ -0,0 +1,85 @@
+package manifester
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	s3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/spf13/pflag"
+)
+
+// S3Config selects an s3 or s3-compatible service (MinIO, Ceph, R2, etc.).
+// The zero value means aws s3 with the default configuration.
+type S3Config struct {
+	// base url of an s3-compatible service, e.g. "http://minio:9000". Empty means aws.
+	Endpoint string
+	// region, if not set by the environment. Defaults to ec2 metadata for aws, or
+	// "us-east-1" (which most s3-compatible services accept) with Endpoint.
+	Region string
+	// use path-style addressing (endpoint/bucket/key), most s3-compatible services need this
+	PathStyle bool
+	// where to get credentials:
+	//   "" or "default": default aws credential chain
+	//   "env": only AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN
+	//   "profile:<name>": named profile from shared config files
+	//   "anonymous": unsigned requests, for public buckets
+	Credentials string
+	// use plain http to aws instead of https. cheaper on cpu for large transfers within a
+	// region. ignored with Endpoint (use an http url instead).
+	PlainHTTP bool
+}
+
+// AddS3Flags registers flags for cfg on fs.
+func AddS3Flags(fs *pflag.FlagSet, cfg *S3Config) {
+	fs.StringVar(&cfg.Endpoint, "s3_endpoint", "", "url of s3-compatible service (empty for aws)")
+	fs.StringVar(&cfg.Region, "s3_region", "", "s3 region (default from environment)")
+	fs.BoolVar(&cfg.PathStyle, "s3_path_style", false, "use path-style s3 addressing")
+	fs.StringVar(&cfg.Credentials, "s3_credentials", "", "s3 credential source: default, env, anonymous, or profile:<name>")
+	fs.BoolVar(&cfg.PlainHTTP, "s3_plain_http", false, "use http instead of https for aws s3")
+}
+
+func NewS3Client(ctx context.Context, cfg S3Config) (*s3.Client, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	} else if cfg.Endpoint != "" {
+		opts = append(opts, awsconfig.WithDefaultRegion("us-east-1"))
+	} else {
+		opts = append(opts, awsconfig.WithEC2IMDSRegion())
+	}
+
+	switch creds := cfg.Credentials; {
+	case creds == "" || creds == "default":
+	case creds == "env":
+		key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if key == "" || secret == "" {
+			return nil, errors.New("s3 credentials from env: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+		}
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(key, secret, os.Getenv("AWS_SESSION_TOKEN"))))
+	case creds == "anonymous":
+		opts = append(opts, awsconfig.WithCredentialsProvider(aws.AnonymousCredentials{}))
+	case strings.HasPrefix(creds, "profile:"):
+		opts = append(opts, awsconfig.WithSharedConfigProfile(strings.TrimPrefix(creds, "profile:")))
+	default:
+		return nil, errors.New("unknown s3 credential source " + creds)
+	}
+
+	awscfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(awscfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		} else if cfg.PlainHTTP {
+			o.EndpointOptions.DisableHTTPS = true
+		}
+		o.UsePathStyle = cfg.PathStyle
+	}), nil
+}
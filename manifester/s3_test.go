@@ -0,0 +1,69 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/dnr/styx/common/fakes3"
+)
+
+func TestS3ChunkStore(t *testing.T) {
+	ctx := context.Background()
+	srv := fakes3.New("styx")
+	defer srv.Close()
+	srv.AccessKey = "minio-key"
+	srv.PublicRead = true
+	srv.PageSize = 2
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio-secret")
+
+	s3cfg := S3Config{Endpoint: srv.URL, PathStyle: true, Credentials: "env"}
+	csw, err := NewChunkStoreWrite(ChunkStoreWriteConfig{ChunkBucket: "styx", ZstdEncoderLevel: 3, S3: s3cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := csw.(*s3ChunkStoreWrite)
+
+	data := bytes.Repeat([]byte("chunk data "), 100)
+	if d, err := cs.PutIfNotExists(ctx, ChunkReadPath, "c1", data); err != nil || d == nil {
+		t.Fatalf("put: %v", err)
+	} else if d, err := cs.PutIfNotExists(ctx, ChunkReadPath, "c1", data); err != nil || d != nil {
+		t.Fatalf("second put should be no-op: %v", err)
+	} else if b, err := cs.Get(ctx, ChunkReadPath, "c1", nil); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("get: %v", err)
+	} else if _, err := cs.Get(ctx, ChunkReadPath, "missing", nil); !IsS3NotFound(err) {
+		t.Fatalf("get missing: %v", err)
+	}
+
+	// clients read directly from the bucket
+	if b, err := NewChunkStoreReadUrl(srv.URL+"/styx", ChunkReadPath).Get(ctx, "c1", nil); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("read url: %v", err)
+	}
+
+	for _, p := range []string{"p1", "p2", "p3"} {
+		if err := cs.putRaw(ctx, PackPath, p, []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, err := cs.getRange(ctx, PackPath, "p2", 3, 4); err != nil || string(b) != "3456" {
+		t.Fatalf("range: %q %v", b, err)
+	}
+	var packs []string
+	if err := cs.list(ctx, PackPath, func(k string) error { packs = append(packs, k); return nil }); err != nil {
+		t.Fatal(err)
+	} else if !slices.Equal(packs, []string{"p1", "p2", "p3"}) {
+		t.Fatalf("list: %v", packs)
+	}
+
+	// anonymous credentials can read but not write
+	anon, err := NewChunkStoreWrite(ChunkStoreWriteConfig{ChunkBucket: "styx", S3: S3Config{Endpoint: srv.URL, PathStyle: true, Credentials: "anonymous"}})
+	if err != nil {
+		t.Fatal(err)
+	} else if b, err := anon.Get(ctx, ChunkReadPath, "c1", nil); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("anonymous get: %v", err)
+	} else if _, err := anon.PutIfNotExists(ctx, ChunkReadPath, "c2", data); err == nil {
+		t.Fatal("anonymous put should fail")
+	}
+}
@@ -5,27 +5,32 @@ import (
 	"cmp"
 	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
-	"path"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/DataDog/zstd"
 	"github.com/aws/aws-lambda-go/lambdaurl"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/exp/slices"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/dnr/styx/common"
 	"github.com/dnr/styx/common/cdig"
 	"github.com/dnr/styx/common/errgroup"
+	"github.com/dnr/styx/common/tracing"
+	"github.com/dnr/styx/pb"
 )
 
 const (
@@ -33,6 +38,9 @@ const (
 	// maxSmallFileCutoff = 480
 
 	SmallManifestCutoff = 32 * 1024
+
+	// don't bother caching diffs of small requests, they're cheap to recompute
+	diffCacheMinReqBytes = 64 * 1024
 )
 
 var (
@@ -53,6 +61,19 @@ type (
 
 		ChunkDiffZstdLevel int
 		ChunkDiffParallel  int
+		ChunkDiffTryAll    bool // try all accepted delta algos and use the smallest
+
+		// Cache computed deltas in the chunk store. Deltas larger than this are not cached.
+		// Zero disables the cache.
+		DiffCacheMaxBytes int
+
+		ManifestBatchParallel int
+
+		// If set, also act as a nix binary cache for manifests from these upstreams.
+		NixCacheUpstreams []string
+
+		// Allow file:// upstreams (only for a manifester embedded in a daemon).
+		AllowFileUpstreams bool
 	}
 )
 
@@ -63,20 +84,32 @@ func NewManifestServer(cfg Config, mb *ManifestBuilder) (*server, error) {
 	}, nil
 }
 
-func (s *server) validateManifestReq(r *ManifestReq, upstreamHost string) error {
+func (s *server) validateManifestReq(r *ManifestReq) error {
+	upstreamUrl, err := url.Parse(r.Upstream)
+	if err != nil {
+		return fmt.Errorf("bad upstream url %q", r.Upstream)
+	}
+
 	if r.ChunkShift != int(s.mb.params.ChunkShift) {
 		return fmt.Errorf("mismatched chunk shift (this server uses %d, not %d)",
 			s.mb.params.ChunkShift, r.ChunkShift)
 	} else if r.DigestAlgo != s.mb.params.DigestAlgo {
-		return fmt.Errorf("mismatched chunk shift (this server uses %s, not %s)",
+		return fmt.Errorf("mismatched digest algo (this server uses %s, not %s)",
 			s.mb.params.DigestAlgo, r.DigestAlgo)
 	} else if r.DigestBits != cdig.Bits {
-		return fmt.Errorf("mismatched chunk shift (this server uses %d, not %d)",
+		return fmt.Errorf("mismatched digest bits (this server uses %d, not %d)",
 			cdig.Bits, r.DigestBits)
+	} else if r.ChunkAlgo != s.mb.params.ChunkAlgo {
+		return fmt.Errorf("mismatched chunk algo (this server uses %q, not %q)",
+			s.mb.params.ChunkAlgo, r.ChunkAlgo)
 	}
 
-	if !slices.Contains(s.cfg.AllowedUpstreams, upstreamHost) {
-		return fmt.Errorf("invalid upstream %q", upstreamHost)
+	if upstreamUrl.Scheme == "file" {
+		if !s.cfg.AllowFileUpstreams {
+			return fmt.Errorf("file upstreams not allowed %q", r.Upstream)
+		}
+	} else if !slices.Contains(s.cfg.AllowedUpstreams, upstreamUrl.Host) {
+		return fmt.Errorf("invalid upstream %q", upstreamUrl.Host)
 	}
 
 	return nil
@@ -90,12 +123,7 @@ func (s *server) handleManifest(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	upstreamUrl, err := url.Parse(r.Upstream)
-	if err != nil {
-		log.Println("bad upstream url:", r.Upstream)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	} else if err := s.validateManifestReq(&r, upstreamUrl.Host); err != nil {
+	if err := s.validateManifestReq(&r); err != nil {
 		log.Println("validation error:", err, "for", r)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -105,19 +133,13 @@ func (s *server) handleManifest(w http.ResponseWriter, req *http.Request) {
 
 	mres, err := s.mb.Build(req.Context(), r.Upstream, r.StorePathHash, r.ShardTotal, r.ShardIndex, "", true)
 
+	if errors.Is(err, ErrShardSkipped) {
+		err = nil // shard 0 will include our chunks
+	}
 	if err != nil {
 		log.Println("build error:", err)
 		w.Header().Set("Content-Type", "text/plain")
-		switch {
-		case errors.Is(err, ErrReq):
-			w.WriteHeader(http.StatusExpectationFailed)
-		case errors.Is(err, ErrNotFound):
-			w.WriteHeader(http.StatusNotFound)
-		case errors.Is(err, ErrInternal):
-			w.WriteHeader(http.StatusInternalServerError)
-		default:
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		w.WriteHeader(buildErrStatus(err))
 		w.Write([]byte(err.Error()))
 		return
 	}
@@ -131,42 +153,91 @@ func (s *server) handleManifest(w http.ResponseWriter, req *http.Request) {
 	w.Write(mres.Bytes)
 }
 
-func (s *server) handleChunkDiff(w http.ResponseWriter, req *http.Request) {
-	var r ChunkDiffReq
+func (s *server) handleManifestBatch(w http.ResponseWriter, req *http.Request) {
+	var r ManifestBatchReq
 	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
 		log.Println("json parse error:", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
+	} else if len(r.Reqs) > ManifestBatchMaxReqs {
+		log.Println("too many reqs in batch:", len(r.Reqs))
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	// load requested chunks
-	start := time.Now()
+	log.Println("batch req with", len(r.Reqs), "paths")
 
-	var baseData, reqData []byte
-	var baseErr, reqErr error
-	var wg sync.WaitGroup
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	var wLock sync.Mutex
+	wEnc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(res *ManifestBatchRes) {
+		wLock.Lock()
+		defer wLock.Unlock()
+		if err := wEnc.Encode(res); err != nil {
+			log.Println("batch write error:", err)
+		} else if flusher != nil {
+			flusher.Flush()
+		}
+	}
 
-	// fetch both in parallel
 	egCtx := errgroup.WithContext(req.Context())
-	egCtx.SetLimit(s.cfg.ChunkDiffParallel)
-	wg.Add(2)
-	go func() {
-		baseData, baseErr = s.expand(egCtx, cdig.FromSliceAlias(r.Bases), r.ExpandBeforeDiff)
-		wg.Done()
-	}()
-	go func() {
-		reqData, reqErr = s.expand(egCtx, cdig.FromSliceAlias(r.Reqs), r.ExpandBeforeDiff)
-		wg.Done()
-	}()
-	// wait for both
-	wg.Wait()
-	if baseErr != nil {
-		log.Println("chunk read (base) error", baseErr)
-		w.WriteHeader(http.StatusInternalServerError)
+	egCtx.SetLimit(s.cfg.ManifestBatchParallel)
+	for i := range r.Reqs {
+		egCtx.Go(func() error {
+			res := &ManifestBatchRes{Index: i}
+			r := &r.Reqs[i]
+			if err := s.validateManifestReq(r); err != nil {
+				log.Println("validation error:", err, "for", *r)
+				res.Status, res.Error = http.StatusBadRequest, err.Error()
+			} else if r.ShardTotal > 1 {
+				res.Status, res.Error = http.StatusBadRequest, "sharding not supported in batch"
+			} else if mres, err := s.mb.Build(egCtx, r.Upstream, r.StorePathHash, 0, 0, "", true); err != nil {
+				log.Println("build error:", err)
+				res.Status, res.Error = buildErrStatus(err), err.Error()
+			} else {
+				res.Bytes = mres.Bytes
+			}
+			send(res)
+			return nil
+		})
+	}
+	egCtx.Wait()
+}
+
+func buildErrStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrReq):
+		return http.StatusExpectationFailed
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInternal):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (s *server) handleChunkDiff(w http.ResponseWriter, req *http.Request) {
+	var r ChunkDiffReq
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		log.Println("json parse error:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(r.DeltaAlgos) > 0 {
+		s.writeDelta(w, req.Context(), &r)
 		return
 	}
-	if reqErr != nil {
-		log.Println("chunk read (req) error", reqErr)
+
+	// load requested chunks
+	start := time.Now()
+	baseData, reqData, err := s.loadDiffData(req.Context(), r.Bases, r.Reqs, r.ExpandBeforeDiff)
+	if err != nil {
+		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -222,6 +293,274 @@ func (s *server) handleChunkDiff(w http.ResponseWriter, req *http.Request) {
 	log.Printf("diff done %#v", stats)
 }
 
+func (s *server) writeDelta(w http.ResponseWriter, ctx context.Context, r *ChunkDiffReq) {
+	delta, st, err := s.diff(ctx, r.DeltaAlgos, r.Bases, r.Reqs, r.ExpandBeforeDiff)
+	if err != nil {
+		log.Println(err)
+		if errors.Is(err, ErrReq) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	stats := ChunkDiffStats{
+		BaseChunks: int(st.BaseChunks),
+		BaseBytes:  int(st.BaseBytes),
+		ReqChunks:  int(st.ReqChunks),
+		ReqBytes:   int(st.ReqBytes),
+		DiffBytes:  int(st.DiffBytes),
+		DlTotalMs:  st.DlTotalMs,
+		ZstdMs:     st.EncodeMs,
+		DeltaAlgo:  st.DeltaAlgo,
+		Cached:     st.Cached,
+	}
+	statsEnc, err := json.Marshal(stats)
+	if err != nil {
+		statsEnc = []byte("{}")
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(ChunkDiffAlgoHeader, st.DeltaAlgo)
+	w.Write(binary.AppendUvarint(nil, uint64(len(delta))))
+	w.Write(delta)
+	w.Write(statsEnc)
+
+	log.Printf("diff done %#v", stats)
+}
+
+func (s *server) handleChunkDiffV2(w http.ResponseWriter, req *http.Request) {
+	var r pb.ChunkDiffReq
+	if body, err := io.ReadAll(req.Body); err != nil {
+		log.Println("read error:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err = proto.Unmarshal(body, &r); err != nil {
+		log.Println("proto parse error:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if r.Version != ChunkDiffVersion {
+		log.Println("unsupported chunk diff version", r.Version)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if len(r.Op) == 0 || len(r.Op) > ChunkDiffMaxOps {
+		log.Println("bad number of ops", len(r.Op))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	flusher, _ := w.(http.Flusher)
+
+	var buf []byte
+	writeFrame := func(f *pb.ChunkDiffFrame) (err error) {
+		if buf, err = appendChunkDiffFrame(buf[:0], f); err == nil {
+			_, err = w.Write(buf)
+		}
+		return
+	}
+
+	for i, op := range r.Op {
+		var frameErr error
+		delta, stats, err := s.diff(req.Context(), r.DeltaAlgos, op.Bases, op.Reqs, op.ExpandBeforeDiff)
+		if err == nil {
+			f := &pb.ChunkDiffFrame{Op: int32(i), DeltaAlgo: stats.DeltaAlgo}
+			for frameErr == nil && len(delta) > chunkDiffFrameSize {
+				f.Data, delta = delta[:chunkDiffFrameSize], delta[chunkDiffFrameSize:]
+				frameErr = writeFrame(f)
+				f = &pb.ChunkDiffFrame{Op: int32(i)}
+			}
+			if frameErr == nil {
+				f.Data, f.Stats = delta, stats
+				frameErr = writeFrame(f)
+			}
+			log.Printf("diff done %v", stats)
+		} else {
+			log.Println("diff error:", err)
+			frameErr = writeFrame(&pb.ChunkDiffFrame{Op: int32(i), Error: err.Error()})
+		}
+		if frameErr != nil {
+			log.Println("diff write error:", frameErr)
+			return
+		} else if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// Computes a delta for one set of bases and reqs, using the diff cache if enabled.
+func (s *server) diff(ctx context.Context, accepted []string, bases, reqs []byte, expand string) ([]byte, *pb.ChunkDiffStats, error) {
+	stats := &pb.ChunkDiffStats{
+		BaseChunks: int32(len(bases) / cdig.Bytes),
+		ReqChunks:  int32(len(reqs) / cdig.Bytes),
+	}
+	start := time.Now()
+
+	var cacheKey string
+	if s.cfg.DiffCacheMaxBytes > 0 {
+		cacheKey = diffCacheKey(accepted, bases, reqs, expand, s.cfg.ChunkDiffZstdLevel, s.cfg.ChunkDiffTryAll)
+		s.mb.stats.DiffCacheReqs.Add(1)
+		ent := s.getDiffCache(ctx, DiffCachePath, cacheKey)
+		if ent == nil {
+			// may have been precomputed
+			if ent = s.getDiffCache(ctx, PrecomputedDiffPath, PrecomputedDiffKey(bases, reqs, expand)); ent != nil &&
+				!slices.Contains(accepted, ent.DeltaAlgo) {
+				ent = nil
+			}
+		}
+		if ent != nil {
+			s.mb.stats.DiffCacheHits.Add(1)
+			log.Println("diff cache hit", s.diffCacheStats())
+			stats.BaseBytes = ent.BaseBytes
+			stats.ReqBytes = ent.ReqBytes
+			stats.DiffBytes = int64(len(ent.Delta))
+			stats.DlTotalMs = time.Since(start).Milliseconds()
+			stats.DeltaAlgo = ent.DeltaAlgo
+			stats.Cached = true
+			return ent.Delta, stats, nil
+		}
+	}
+
+	lctx, span := tracing.Start(ctx, "load diff data", attribute.String("expand", expand))
+	baseData, reqData, err := s.loadDiffData(lctx, bases, reqs, expand)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	dlDone := time.Now()
+	_, span = tracing.Start(ctx, "encode delta")
+	delta, algo, err := s.encodeDelta(accepted, baseData, reqData)
+	span.SetAttributes(attribute.String("algo", algo), attribute.Int("diff_bytes", len(delta)))
+	tracing.End(span, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.BaseBytes = int64(len(baseData))
+	stats.ReqBytes = int64(len(reqData))
+	stats.DiffBytes = int64(len(delta))
+	stats.DlTotalMs = dlDone.Sub(start).Milliseconds()
+	stats.EncodeMs = time.Since(dlDone).Milliseconds()
+	stats.DeltaAlgo = algo
+
+	if cacheKey != "" && len(reqData) >= diffCacheMinReqBytes && len(delta) <= s.cfg.DiffCacheMaxBytes {
+		s.putDiffCache(ctx, cacheKey, &pb.ChunkDiffCacheEntry{
+			DeltaAlgo: algo,
+			Delta:     delta,
+			BaseBytes: stats.BaseBytes,
+			ReqBytes:  stats.ReqBytes,
+		})
+	}
+	return delta, stats, nil
+}
+
+// Returns nil on miss or any error. Entries under DiffCachePath are stored without compression
+// since the delta is compressed already.
+func (s *server) getDiffCache(ctx context.Context, path, key string) *pb.ChunkDiffCacheEntry {
+	var b []byte
+	var err error
+	if ps, ok := s.mb.cs.(packStore); ok && path == DiffCachePath {
+		b, err = ps.getRaw(ctx, path, key)
+	} else {
+		b, err = s.mb.cs.Get(ctx, path, key, nil)
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && !IsS3NotFound(err) {
+			s.mb.stats.DiffCacheErrs.Add(1)
+			log.Println("diff cache get error:", err)
+		}
+		return nil
+	}
+	var ent pb.ChunkDiffCacheEntry
+	if err = proto.Unmarshal(b, &ent); err != nil {
+		s.mb.stats.DiffCacheErrs.Add(1)
+		log.Println("diff cache unmarshal error:", err)
+		return nil
+	} else if _, ok := deltaAlgos[ent.DeltaAlgo]; !ok {
+		return nil
+	}
+	return &ent
+}
+
+func (s *server) putDiffCache(ctx context.Context, key string, ent *pb.ChunkDiffCacheEntry) {
+	b, err := proto.Marshal(ent)
+	if err == nil {
+		if ps, ok := s.mb.cs.(packStore); ok {
+			err = ps.putRaw(ctx, DiffCachePath, key, b)
+		} else {
+			_, err = s.mb.cs.PutIfNotExists(ctx, DiffCachePath, key, b)
+		}
+	}
+	if err != nil {
+		s.mb.stats.DiffCacheErrs.Add(1)
+		log.Println("diff cache put error:", err)
+		return
+	}
+	s.mb.stats.DiffCachePuts.Add(1)
+	log.Println("diff cache put", s.diffCacheStats())
+}
+
+func (s *server) diffCacheStats() string {
+	st := s.mb.Stats()
+	return fmt.Sprintf("(%d/%d hits, %.1f%%, %d puts, %d errors)",
+		st.DiffCacheHits, st.DiffCacheReqs, 100*float64(st.DiffCacheHits)/float64(max(st.DiffCacheReqs, 1)),
+		st.DiffCachePuts, st.DiffCacheErrs)
+}
+
+func (s *server) loadDiffData(ctx context.Context, bases, reqs []byte, expand string) ([]byte, []byte, error) {
+	var baseData, reqData []byte
+	var baseErr, reqErr error
+	var wg sync.WaitGroup
+
+	// fetch both in parallel
+	egCtx := errgroup.WithContext(ctx)
+	egCtx.SetLimit(s.cfg.ChunkDiffParallel)
+	wg.Add(2)
+	go func() {
+		baseData, baseErr = s.expand(egCtx, cdig.FromSliceAlias(bases), expand)
+		wg.Done()
+	}()
+	go func() {
+		reqData, reqErr = s.expand(egCtx, cdig.FromSliceAlias(reqs), expand)
+		wg.Done()
+	}()
+	// wait for both
+	wg.Wait()
+	if baseErr != nil {
+		return nil, nil, fmt.Errorf("chunk read (base) error: %w", baseErr)
+	} else if reqErr != nil {
+		return nil, nil, fmt.Errorf("chunk read (req) error: %w", reqErr)
+	}
+	return baseData, reqData, nil
+}
+
+func (s *server) encodeDelta(accepted []string, baseData, reqData []byte) ([]byte, string, error) {
+	algos := []string{pickDeltaAlgo(accepted, baseData, reqData)}
+	if algos[0] == "" {
+		return nil, "", fmt.Errorf("%w: no acceptable delta algo in %v", ErrReq, accepted)
+	} else if s.cfg.ChunkDiffTryAll && len(baseData) > 0 {
+		algos = algos[:0]
+		for _, algo := range accepted {
+			if _, ok := deltaAlgos[algo]; ok && !slices.Contains(algos, algo) {
+				algos = append(algos, algo)
+			}
+		}
+	}
+
+	var best []byte
+	var bestAlgo string
+	for _, algo := range algos {
+		delta, err := deltaAlgos[algo].encode(baseData, reqData, s.cfg.ChunkDiffZstdLevel)
+		if err != nil {
+			return nil, "", fmt.Errorf("delta %s error: %w", algo, err)
+		}
+		if best == nil || len(delta) < len(best) {
+			best, bestAlgo = delta, algo
+		}
+	}
+	return best, bestAlgo, nil
+}
+
 func (s *server) expand(egCtx *errgroup.Group, digests []cdig.CDig, expand string) ([]byte, error) {
 	if len(digests) == 0 {
 		return nil, nil
@@ -270,18 +609,15 @@ func (s *server) expand(egCtx *errgroup.Group, digests []cdig.CDig, expand strin
 }
 
 func (s *server) fetchChunkSeries(egCtx *errgroup.Group, digests []cdig.CDig, out io.Writer) error {
-	// TODO: ew, use separate setting?
-	cs := s.mb.cs
-
 	chs := make(chan chan []byte, egCtx.Limit())
 	go func() {
 		for i := 0; i < len(digests) && egCtx.Err() == nil; i++ {
 			digest := digests[i]
-			digestStr := digest.String()
 			ch := make(chan []byte)
 			chs <- ch
 			egCtx.Go(func() error {
-				b, err := cs.Get(egCtx, ChunkReadPath, digestStr, nil)
+				// TODO: ew, use separate setting?
+				b, err := s.mb.getChunk(egCtx, digest)
 				ch <- b
 				return err
 			})
@@ -299,55 +635,83 @@ func (s *server) fetchChunkSeries(egCtx *errgroup.Group, digests []cdig.CDig, ou
 	return context.Cause(egCtx)
 }
 
-func (s *server) handleChunk(w http.ResponseWriter, r *http.Request) {
-	// This is for local testing only, real usage goes to s3 directly!
-	localWrite, ok := s.mb.cs.(*localChunkStoreWrite)
-	if !ok {
-		w.WriteHeader(http.StatusNotImplemented)
-		return
-	}
-
-	parts := strings.Split(r.URL.Path, "/")
-	if l := len(parts); l < 2 {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	} else if parts[l-2] != "chunk" {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	key := parts[len(parts)-1]
-
-	fn := path.Join(localWrite.dir, key)
-	f, err := os.Open(fn)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+// Serves objects from a local chunk store, so a single node can run without s3. Responses
+// should look like what s3 would return for the same objects.
+func (s *server) handleLocal(path_ string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		localWrite, ok := s.mb.cs.(*localChunkStoreWrite)
+		if !ok {
+			// with s3, clients read these from the bucket directly
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		} else if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		key, ok := strings.CutPrefix(r.URL.Path, path_)
+		if !ok || key == "" || strings.Contains(key, "/") || strings.HasPrefix(key, ".") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f, err := os.Open(localWrite.fn(path_, key))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil || !st.Mode().IsRegular() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Cache-Control", "public, max-age=31536000") // all keys are immutable
+		h.Set("ETag", fmt.Sprintf(`"%x-%x"`, st.ModTime().UnixNano(), st.Size()))
+		if path_ != PackPath {
+			// packs are read with range requests and decompressed per chunk
+			h.Set("Content-Encoding", "zstd")
+		}
+		// handles range and conditional requests
+		http.ServeContent(w, r, "", st.ModTime(), f)
 	}
-	defer f.Close()
-	// log.Println("get chunk", key)
-	w.Header().Set("Content-Encoding", "zstd")
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, f)
 }
 
-func (s *server) Run() error {
+func (s *server) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc(ManifestPath, s.handleManifest)
+	mux.HandleFunc(ManifestBatchPath, s.handleManifestBatch)
 	mux.HandleFunc(ChunkDiffPath, s.handleChunkDiff)
-	mux.HandleFunc(ChunkReadPath, s.handleChunk)
+	mux.HandleFunc(ChunkDiffV2Path, s.handleChunkDiffV2)
+	// DiffCachePath is only read by the manifester
+	for _, p := range []string{ChunkReadPath, ManifestCachePath, BuildRootPath, PackPath, PrecomputedDiffPath} {
+		mux.HandleFunc(p, s.handleLocal(p))
+	}
+	mux.HandleFunc(NixCacheInfoPath, s.handleNixCacheInfo)
+	mux.HandleFunc(NarPath, s.handleNar)
+	mux.HandleFunc("/", s.handleNarinfo)
+	return tracing.Handler(mux)
+}
 
+func (s *server) Run() error {
 	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
-		lambdaurl.Start(mux)
+		lambdaurl.Start(s.handler())
 		return nil
 	}
 
 	s.httpServer = &http.Server{
 		Addr:    s.cfg.Bind,
-		Handler: mux,
+		Handler: s.handler(),
 	}
 	return s.httpServer.ListenAndServe()
 }
 
+// Serve is like Run but serves on an existing listener.
+func (s *server) Serve(l net.Listener) error {
+	s.httpServer = &http.Server{Handler: s.handler()}
+	return s.httpServer.Serve(l)
+}
+
 func (s *server) Stop() {
 	_ = s.httpServer.Close()
 }
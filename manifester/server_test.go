@@ -0,0 +1,84 @@
+package manifester
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dnr/styx/common"
+	"github.com/dnr/styx/common/cdig"
+	"github.com/dnr/styx/pb"
+)
+
+func TestDiffCache(t *testing.T) {
+	ctx := context.Background()
+	cs, err := newLocalChunkStoreWrite(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := NewManifestBuilder(ManifestBuilderConfig{ChunkAlgo: common.ChunkAlgoFixed}, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewManifestServer(Config{ChunkDiffParallel: 2, DiffCacheMaxBytes: 1 << 20}, mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two chunks, each with a small change
+	var bases, reqs []byte
+	rnd := rand.New(rand.NewSource(1))
+	for range 2 {
+		base := make([]byte, common.ChunkShift.Size())
+		rnd.Read(base)
+		req := bytes.Clone(base)
+		copy(req[1000:], "a small change")
+		for _, c := range []struct {
+			data []byte
+			out  *[]byte
+		}{{base, &bases}, {req, &reqs}} {
+			d := cdig.Sum(common.DigestAlgo, c.data)
+			if _, err := cs.PutIfNotExists(ctx, ChunkReadPath, d.String(), c.data); err != nil {
+				t.Fatal(err)
+			}
+			*c.out = append(*c.out, d[:]...)
+		}
+	}
+
+	delta1, st1, err := s.diff(ctx, DeltaAlgos(), bases, reqs, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if st1.Cached {
+		t.Error("first diff should not be cached")
+	}
+	delta2, st2, err := s.diff(ctx, DeltaAlgos(), bases, reqs, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if !st2.Cached || !bytes.Equal(delta1, delta2) {
+		t.Error("second diff should be cached")
+	}
+
+	want := Stats{DiffCacheReqs: 2, DiffCacheHits: 1, DiffCachePuts: 1}
+	if got := mb.Stats(); got != want {
+		t.Errorf("stats %+v != %+v", got, want)
+	}
+
+	// entry is stored without compression
+	var keys []string
+	if err := cs.list(ctx, DiffCachePath, func(k string) error { keys = append(keys, k); return nil }); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 1 {
+		t.Fatalf("diff cache has %v", keys)
+	}
+	b, err := cs.getRaw(ctx, DiffCachePath, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ent pb.ChunkDiffCacheEntry
+	if err := proto.Unmarshal(b, &ent); err != nil || !bytes.Equal(ent.Delta, delta1) {
+		t.Errorf("raw entry: %v", err)
+	}
+}
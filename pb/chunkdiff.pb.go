@@ -0,0 +1,600 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.1
+// 	protoc        v4.24.4
+// source: chunkdiff.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Request for the binary chunk diff protocol.
+type ChunkDiffReq struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// protocol version, currently 1
+	Version int32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	// delta algorithms that the client accepts
+	DeltaAlgos []string `protobuf:"bytes,2,rep,name=delta_algos,json=deltaAlgos,proto3" json:"delta_algos,omitempty"`
+	// ops are processed in order and results are streamed in the same order
+	Op []*ChunkDiffOp `protobuf:"bytes,3,rep,name=op,proto3" json:"op,omitempty"`
+}
+
+func (x *ChunkDiffReq) Reset() {
+	*x = ChunkDiffReq{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_chunkdiff_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ChunkDiffReq) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChunkDiffReq) ProtoMessage() {}
+
+func (x *ChunkDiffReq) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkdiff_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChunkDiffReq.ProtoReflect.Descriptor instead.
+func (*ChunkDiffReq) Descriptor() ([]byte, []int) {
+	return file_chunkdiff_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ChunkDiffReq) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *ChunkDiffReq) GetDeltaAlgos() []string {
+	if x != nil {
+		return x.DeltaAlgos
+	}
+	return nil
+}
+
+func (x *ChunkDiffReq) GetOp() []*ChunkDiffOp {
+	if x != nil {
+		return x.Op
+	}
+	return nil
+}
+
+type ChunkDiffOp struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// digests, concatenated
+	Bases []byte `protobuf:"bytes,1,opt,name=bases,proto3" json:"bases,omitempty"`
+	Reqs  []byte `protobuf:"bytes,2,opt,name=reqs,proto3" json:"reqs,omitempty"`
+	// If set: bases and reqs each comprise one single file in the given compression
+	// format. Pass each one through this decompressor before diffing.
+	ExpandBeforeDiff string `protobuf:"bytes,3,opt,name=expand_before_diff,json=expandBeforeDiff,proto3" json:"expand_before_diff,omitempty"`
+}
+
+func (x *ChunkDiffOp) Reset() {
+	*x = ChunkDiffOp{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_chunkdiff_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ChunkDiffOp) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChunkDiffOp) ProtoMessage() {}
+
+func (x *ChunkDiffOp) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkdiff_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChunkDiffOp.ProtoReflect.Descriptor instead.
+func (*ChunkDiffOp) Descriptor() ([]byte, []int) {
+	return file_chunkdiff_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ChunkDiffOp) GetBases() []byte {
+	if x != nil {
+		return x.Bases
+	}
+	return nil
+}
+
+func (x *ChunkDiffOp) GetReqs() []byte {
+	if x != nil {
+		return x.Reqs
+	}
+	return nil
+}
+
+func (x *ChunkDiffOp) GetExpandBeforeDiff() string {
+	if x != nil {
+		return x.ExpandBeforeDiff
+	}
+	return ""
+}
+
+// Response is a sequence of frames, each one preceded by its length as a uvarint.
+// Each op gets one or more frames with data, where the last one has stats or error set.
+// The concatenated data of an op is a delta (using delta_algo) that decodes to the
+// concatenation of its reqs.
+type ChunkDiffFrame struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// index into ops
+	Op int32 `protobuf:"varint,1,opt,name=op,proto3" json:"op,omitempty"`
+	// set on first frame of each op
+	DeltaAlgo string `protobuf:"bytes,2,opt,name=delta_algo,json=deltaAlgo,proto3" json:"delta_algo,omitempty"`
+	Data      []byte `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	// set on last frame of each op
+	Stats *ChunkDiffStats `protobuf:"bytes,4,opt,name=stats,proto3" json:"stats,omitempty"`
+	Error string          `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *ChunkDiffFrame) Reset() {
+	*x = ChunkDiffFrame{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_chunkdiff_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ChunkDiffFrame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChunkDiffFrame) ProtoMessage() {}
+
+func (x *ChunkDiffFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkdiff_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChunkDiffFrame.ProtoReflect.Descriptor instead.
+func (*ChunkDiffFrame) Descriptor() ([]byte, []int) {
+	return file_chunkdiff_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ChunkDiffFrame) GetOp() int32 {
+	if x != nil {
+		return x.Op
+	}
+	return 0
+}
+
+func (x *ChunkDiffFrame) GetDeltaAlgo() string {
+	if x != nil {
+		return x.DeltaAlgo
+	}
+	return ""
+}
+
+func (x *ChunkDiffFrame) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *ChunkDiffFrame) GetStats() *ChunkDiffStats {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+func (x *ChunkDiffFrame) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type ChunkDiffStats struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	BaseChunks int32  `protobuf:"varint,1,opt,name=base_chunks,json=baseChunks,proto3" json:"base_chunks,omitempty"`
+	BaseBytes  int64  `protobuf:"varint,2,opt,name=base_bytes,json=baseBytes,proto3" json:"base_bytes,omitempty"`
+	ReqChunks  int32  `protobuf:"varint,3,opt,name=req_chunks,json=reqChunks,proto3" json:"req_chunks,omitempty"`
+	ReqBytes   int64  `protobuf:"varint,4,opt,name=req_bytes,json=reqBytes,proto3" json:"req_bytes,omitempty"`
+	DiffBytes  int64  `protobuf:"varint,5,opt,name=diff_bytes,json=diffBytes,proto3" json:"diff_bytes,omitempty"`
+	DlTotalMs  int64  `protobuf:"varint,6,opt,name=dl_total_ms,json=dlTotalMs,proto3" json:"dl_total_ms,omitempty"`
+	EncodeMs   int64  `protobuf:"varint,7,opt,name=encode_ms,json=encodeMs,proto3" json:"encode_ms,omitempty"`
+	DeltaAlgo  string `protobuf:"bytes,8,opt,name=delta_algo,json=deltaAlgo,proto3" json:"delta_algo,omitempty"`
+	// result was served from the server's diff cache
+	Cached bool `protobuf:"varint,9,opt,name=cached,proto3" json:"cached,omitempty"`
+}
+
+func (x *ChunkDiffStats) Reset() {
+	*x = ChunkDiffStats{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_chunkdiff_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ChunkDiffStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChunkDiffStats) ProtoMessage() {}
+
+func (x *ChunkDiffStats) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkdiff_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChunkDiffStats.ProtoReflect.Descriptor instead.
+func (*ChunkDiffStats) Descriptor() ([]byte, []int) {
+	return file_chunkdiff_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ChunkDiffStats) GetBaseChunks() int32 {
+	if x != nil {
+		return x.BaseChunks
+	}
+	return 0
+}
+
+func (x *ChunkDiffStats) GetBaseBytes() int64 {
+	if x != nil {
+		return x.BaseBytes
+	}
+	return 0
+}
+
+func (x *ChunkDiffStats) GetReqChunks() int32 {
+	if x != nil {
+		return x.ReqChunks
+	}
+	return 0
+}
+
+func (x *ChunkDiffStats) GetReqBytes() int64 {
+	if x != nil {
+		return x.ReqBytes
+	}
+	return 0
+}
+
+func (x *ChunkDiffStats) GetDiffBytes() int64 {
+	if x != nil {
+		return x.DiffBytes
+	}
+	return 0
+}
+
+func (x *ChunkDiffStats) GetDlTotalMs() int64 {
+	if x != nil {
+		return x.DlTotalMs
+	}
+	return 0
+}
+
+func (x *ChunkDiffStats) GetEncodeMs() int64 {
+	if x != nil {
+		return x.EncodeMs
+	}
+	return 0
+}
+
+func (x *ChunkDiffStats) GetDeltaAlgo() string {
+	if x != nil {
+		return x.DeltaAlgo
+	}
+	return ""
+}
+
+func (x *ChunkDiffStats) GetCached() bool {
+	if x != nil {
+		return x.Cached
+	}
+	return false
+}
+
+// Stored in the chunk store under DiffCachePath (without compression, since the delta is
+// compressed already) or PrecomputedDiffPath.
+type ChunkDiffCacheEntry struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	DeltaAlgo string `protobuf:"bytes,1,opt,name=delta_algo,json=deltaAlgo,proto3" json:"delta_algo,omitempty"`
+	Delta     []byte `protobuf:"bytes,2,opt,name=delta,proto3" json:"delta,omitempty"`
+	BaseBytes int64  `protobuf:"varint,3,opt,name=base_bytes,json=baseBytes,proto3" json:"base_bytes,omitempty"`
+	ReqBytes  int64  `protobuf:"varint,4,opt,name=req_bytes,json=reqBytes,proto3" json:"req_bytes,omitempty"`
+}
+
+func (x *ChunkDiffCacheEntry) Reset() {
+	*x = ChunkDiffCacheEntry{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_chunkdiff_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ChunkDiffCacheEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChunkDiffCacheEntry) ProtoMessage() {}
+
+func (x *ChunkDiffCacheEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkdiff_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChunkDiffCacheEntry.ProtoReflect.Descriptor instead.
+func (*ChunkDiffCacheEntry) Descriptor() ([]byte, []int) {
+	return file_chunkdiff_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ChunkDiffCacheEntry) GetDeltaAlgo() string {
+	if x != nil {
+		return x.DeltaAlgo
+	}
+	return ""
+}
+
+func (x *ChunkDiffCacheEntry) GetDelta() []byte {
+	if x != nil {
+		return x.Delta
+	}
+	return nil
+}
+
+func (x *ChunkDiffCacheEntry) GetBaseBytes() int64 {
+	if x != nil {
+		return x.BaseBytes
+	}
+	return 0
+}
+
+func (x *ChunkDiffCacheEntry) GetReqBytes() int64 {
+	if x != nil {
+		return x.ReqBytes
+	}
+	return 0
+}
+
+var File_chunkdiff_proto protoreflect.FileDescriptor
+
+var file_chunkdiff_proto_rawDesc = []byte{
+	0x0a, 0x0f, 0x63, 0x68, 0x75, 0x6e, 0x6b, 0x64, 0x69, 0x66, 0x66, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x12, 0x02, 0x70, 0x62, 0x22, 0x6a, 0x0a, 0x0c, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x69,
+	0x66, 0x66, 0x52, 0x65, 0x71, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12,
+	0x1f, 0x0a, 0x0b, 0x64, 0x65, 0x6c, 0x74, 0x61, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x73, 0x18, 0x02,
+	0x20, 0x03, 0x28, 0x09, 0x52, 0x0a, 0x64, 0x65, 0x6c, 0x74, 0x61, 0x41, 0x6c, 0x67, 0x6f, 0x73,
+	0x12, 0x1f, 0x0a, 0x02, 0x6f, 0x70, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x70,
+	0x62, 0x2e, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x69, 0x66, 0x66, 0x4f, 0x70, 0x52, 0x02, 0x6f,
+	0x70, 0x22, 0x65, 0x0a, 0x0b, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x69, 0x66, 0x66, 0x4f, 0x70,
+	0x12, 0x14, 0x0a, 0x05, 0x62, 0x61, 0x73, 0x65, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x05, 0x62, 0x61, 0x73, 0x65, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x72, 0x65, 0x71, 0x73, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x72, 0x65, 0x71, 0x73, 0x12, 0x2c, 0x0a, 0x12, 0x65, 0x78,
+	0x70, 0x61, 0x6e, 0x64, 0x5f, 0x62, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x5f, 0x64, 0x69, 0x66, 0x66,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x10, 0x65, 0x78, 0x70, 0x61, 0x6e, 0x64, 0x42, 0x65,
+	0x66, 0x6f, 0x72, 0x65, 0x44, 0x69, 0x66, 0x66, 0x22, 0x93, 0x01, 0x0a, 0x0e, 0x43, 0x68, 0x75,
+	0x6e, 0x6b, 0x44, 0x69, 0x66, 0x66, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x6f,
+	0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x02, 0x6f, 0x70, 0x12, 0x1d, 0x0a, 0x0a, 0x64,
+	0x65, 0x6c, 0x74, 0x61, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x09, 0x64, 0x65, 0x6c, 0x74, 0x61, 0x41, 0x6c, 0x67, 0x6f, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61,
+	0x74, 0x61, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x28,
+	0x0a, 0x05, 0x73, 0x74, 0x61, 0x74, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e,
+	0x70, 0x62, 0x2e, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x69, 0x66, 0x66, 0x53, 0x74, 0x61, 0x74,
+	0x73, 0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f,
+	0x72, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x9f,
+	0x02, 0x0a, 0x0e, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x69, 0x66, 0x66, 0x53, 0x74, 0x61, 0x74,
+	0x73, 0x12, 0x1f, 0x0a, 0x0b, 0x62, 0x61, 0x73, 0x65, 0x5f, 0x63, 0x68, 0x75, 0x6e, 0x6b, 0x73,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x62, 0x61, 0x73, 0x65, 0x43, 0x68, 0x75, 0x6e,
+	0x6b, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x61, 0x73, 0x65, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x62, 0x61, 0x73, 0x65, 0x42, 0x79, 0x74, 0x65,
+	0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x72, 0x65, 0x71, 0x5f, 0x63, 0x68, 0x75, 0x6e, 0x6b, 0x73, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x72, 0x65, 0x71, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x73,
+	0x12, 0x1b, 0x0a, 0x09, 0x72, 0x65, 0x71, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x08, 0x72, 0x65, 0x71, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1d, 0x0a,
+	0x0a, 0x64, 0x69, 0x66, 0x66, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x09, 0x64, 0x69, 0x66, 0x66, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1e, 0x0a, 0x0b,
+	0x64, 0x6c, 0x5f, 0x74, 0x6f, 0x74, 0x61, 0x6c, 0x5f, 0x6d, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x09, 0x64, 0x6c, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x4d, 0x73, 0x12, 0x1b, 0x0a, 0x09,
+	0x65, 0x6e, 0x63, 0x6f, 0x64, 0x65, 0x5f, 0x6d, 0x73, 0x18, 0x07, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x08, 0x65, 0x6e, 0x63, 0x6f, 0x64, 0x65, 0x4d, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x64, 0x65, 0x6c,
+	0x74, 0x61, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x64,
+	0x65, 0x6c, 0x74, 0x61, 0x41, 0x6c, 0x67, 0x6f, 0x12, 0x16, 0x0a, 0x06, 0x63, 0x61, 0x63, 0x68,
+	0x65, 0x64, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x63, 0x61, 0x63, 0x68, 0x65, 0x64,
+	0x22, 0x86, 0x01, 0x0a, 0x13, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x69, 0x66, 0x66, 0x43, 0x61,
+	0x63, 0x68, 0x65, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x1d, 0x0a, 0x0a, 0x64, 0x65, 0x6c, 0x74,
+	0x61, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x64, 0x65,
+	0x6c, 0x74, 0x61, 0x41, 0x6c, 0x67, 0x6f, 0x12, 0x14, 0x0a, 0x05, 0x64, 0x65, 0x6c, 0x74, 0x61,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x05, 0x64, 0x65, 0x6c, 0x74, 0x61, 0x12, 0x1d, 0x0a,
+	0x0a, 0x62, 0x61, 0x73, 0x65, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x09, 0x62, 0x61, 0x73, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1b, 0x0a, 0x09,
+	0x72, 0x65, 0x71, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x08, 0x72, 0x65, 0x71, 0x42, 0x79, 0x74, 0x65, 0x73, 0x42, 0x18, 0x5a, 0x16, 0x67, 0x69, 0x74,
+	0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x64, 0x6e, 0x72, 0x2f, 0x73, 0x74, 0x79, 0x78,
+	0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_chunkdiff_proto_rawDescOnce sync.Once
+	file_chunkdiff_proto_rawDescData = file_chunkdiff_proto_rawDesc
+)
+
+func file_chunkdiff_proto_rawDescGZIP() []byte {
+	file_chunkdiff_proto_rawDescOnce.Do(func() {
+		file_chunkdiff_proto_rawDescData = protoimpl.X.CompressGZIP(file_chunkdiff_proto_rawDescData)
+	})
+	return file_chunkdiff_proto_rawDescData
+}
+
+var file_chunkdiff_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_chunkdiff_proto_goTypes = []interface{}{
+	(*ChunkDiffReq)(nil),        // 0: pb.ChunkDiffReq
+	(*ChunkDiffOp)(nil),         // 1: pb.ChunkDiffOp
+	(*ChunkDiffFrame)(nil),      // 2: pb.ChunkDiffFrame
+	(*ChunkDiffStats)(nil),      // 3: pb.ChunkDiffStats
+	(*ChunkDiffCacheEntry)(nil), // 4: pb.ChunkDiffCacheEntry
+}
+var file_chunkdiff_proto_depIdxs = []int32{
+	1, // 0: pb.ChunkDiffReq.op:type_name -> pb.ChunkDiffOp
+	3, // 1: pb.ChunkDiffFrame.stats:type_name -> pb.ChunkDiffStats
+	2, // [2:2] is the sub-list for method output_type
+	2, // [2:2] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_chunkdiff_proto_init() }
+func file_chunkdiff_proto_init() {
+	if File_chunkdiff_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_chunkdiff_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ChunkDiffReq); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_chunkdiff_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ChunkDiffOp); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_chunkdiff_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ChunkDiffFrame); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_chunkdiff_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ChunkDiffStats); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_chunkdiff_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ChunkDiffCacheEntry); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_chunkdiff_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_chunkdiff_proto_goTypes,
+		DependencyIndexes: file_chunkdiff_proto_depIdxs,
+		MessageInfos:      file_chunkdiff_proto_msgTypes,
+	}.Build()
+	File_chunkdiff_proto = out.File
+	file_chunkdiff_proto_rawDesc = nil
+	file_chunkdiff_proto_goTypes = nil
+	file_chunkdiff_proto_depIdxs = nil
+}
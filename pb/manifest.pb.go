@@ -29,6 +29,8 @@ type Manifest struct {
 	Entries []*Entry      `protobuf:"bytes,3,rep,name=entries,proto3" json:"entries,omitempty"`
 	// build parameters
 	SmallFileCutoff int32 `protobuf:"varint,2,opt,name=small_file_cutoff,json=smallFileCutoff,proto3" json:"small_file_cutoff,omitempty"`
+	// If chunks are stored in packs, locations of chunks in packs.
+	PackLocs *PackLocs `protobuf:"bytes,4,opt,name=pack_locs,json=packLocs,proto3" json:"pack_locs,omitempty"`
 	// Metadata on how this was generated
 	Meta *ManifestMeta `protobuf:"bytes,10,opt,name=meta,proto3" json:"meta,omitempty"`
 }
@@ -86,6 +88,13 @@ func (x *Manifest) GetSmallFileCutoff() int32 {
 	return 0
 }
 
+func (x *Manifest) GetPackLocs() *PackLocs {
+	if x != nil {
+		return x.PackLocs
+	}
+	return nil
+}
+
 func (x *Manifest) GetMeta() *ManifestMeta {
 	if x != nil {
 		return x.Meta
@@ -93,6 +102,82 @@ func (x *Manifest) GetMeta() *ManifestMeta {
 	return nil
 }
 
+// Locations of all chunks referenced by entries, in order of entries and digests.
+// The chunk_* fields should all be the same length.
+type PackLocs struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// pack object names (relative to pack path)
+	Pack []string `protobuf:"bytes,1,rep,name=pack,proto3" json:"pack,omitempty"`
+	// index into pack plus one, or zero if chunk is not in a pack
+	ChunkPack []uint32 `protobuf:"varint,2,rep,packed,name=chunk_pack,json=chunkPack,proto3" json:"chunk_pack,omitempty"`
+	// offset and length of the compressed chunk in the pack
+	ChunkOffset []int64  `protobuf:"varint,3,rep,packed,name=chunk_offset,json=chunkOffset,proto3" json:"chunk_offset,omitempty"`
+	ChunkLength []uint32 `protobuf:"varint,4,rep,packed,name=chunk_length,json=chunkLength,proto3" json:"chunk_length,omitempty"`
+}
+
+func (x *PackLocs) Reset() {
+	*x = PackLocs{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_manifest_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PackLocs) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PackLocs) ProtoMessage() {}
+
+func (x *PackLocs) ProtoReflect() protoreflect.Message {
+	mi := &file_manifest_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PackLocs.ProtoReflect.Descriptor instead.
+func (*PackLocs) Descriptor() ([]byte, []int) {
+	return file_manifest_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PackLocs) GetPack() []string {
+	if x != nil {
+		return x.Pack
+	}
+	return nil
+}
+
+func (x *PackLocs) GetChunkPack() []uint32 {
+	if x != nil {
+		return x.ChunkPack
+	}
+	return nil
+}
+
+func (x *PackLocs) GetChunkOffset() []int64 {
+	if x != nil {
+		return x.ChunkOffset
+	}
+	return nil
+}
+
+func (x *PackLocs) GetChunkLength() []uint32 {
+	if x != nil {
+		return x.ChunkLength
+	}
+	return nil
+}
+
 type ManifestMeta struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -108,7 +193,7 @@ type ManifestMeta struct {
 func (x *ManifestMeta) Reset() {
 	*x = ManifestMeta{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_manifest_proto_msgTypes[1]
+		mi := &file_manifest_proto_msgTypes[2]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -121,7 +206,7 @@ func (x *ManifestMeta) String() string {
 func (*ManifestMeta) ProtoMessage() {}
 
 func (x *ManifestMeta) ProtoReflect() protoreflect.Message {
-	mi := &file_manifest_proto_msgTypes[1]
+	mi := &file_manifest_proto_msgTypes[2]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -134,7 +219,7 @@ func (x *ManifestMeta) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ManifestMeta.ProtoReflect.Descriptor instead.
 func (*ManifestMeta) Descriptor() ([]byte, []int) {
-	return file_manifest_proto_rawDescGZIP(), []int{1}
+	return file_manifest_proto_rawDescGZIP(), []int{2}
 }
 
 func (x *ManifestMeta) GetNarinfoUrl() string {
@@ -171,7 +256,7 @@ var file_manifest_proto_rawDesc = []byte{
 	0x0a, 0x0e, 0x6d, 0x61, 0x6e, 0x69, 0x66, 0x65, 0x73, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
 	0x12, 0x02, 0x70, 0x62, 0x1a, 0x0c, 0x70, 0x61, 0x72, 0x61, 0x6d, 0x73, 0x2e, 0x70, 0x72, 0x6f,
 	0x74, 0x6f, 0x1a, 0x0b, 0x65, 0x6e, 0x74, 0x72, 0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a,
-	0x0d, 0x6e, 0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xab,
+	0x0d, 0x6e, 0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xd6,
 	0x01, 0x0a, 0x08, 0x4d, 0x61, 0x6e, 0x69, 0x66, 0x65, 0x73, 0x74, 0x12, 0x28, 0x0a, 0x06, 0x70,
 	0x61, 0x72, 0x61, 0x6d, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x70, 0x62,
 	0x2e, 0x47, 0x6c, 0x6f, 0x62, 0x61, 0x6c, 0x50, 0x61, 0x72, 0x61, 0x6d, 0x73, 0x52, 0x06, 0x70,
@@ -180,21 +265,32 @@ var file_manifest_proto_rawDesc = []byte{
 	0x79, 0x52, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x12, 0x2a, 0x0a, 0x11, 0x73, 0x6d,
 	0x61, 0x6c, 0x6c, 0x5f, 0x66, 0x69, 0x6c, 0x65, 0x5f, 0x63, 0x75, 0x74, 0x6f, 0x66, 0x66, 0x18,
 	0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0f, 0x73, 0x6d, 0x61, 0x6c, 0x6c, 0x46, 0x69, 0x6c, 0x65,
-	0x43, 0x75, 0x74, 0x6f, 0x66, 0x66, 0x12, 0x24, 0x0a, 0x04, 0x6d, 0x65, 0x74, 0x61, 0x18, 0x0a,
-	0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x70, 0x62, 0x2e, 0x4d, 0x61, 0x6e, 0x69, 0x66, 0x65,
-	0x73, 0x74, 0x4d, 0x65, 0x74, 0x61, 0x52, 0x04, 0x6d, 0x65, 0x74, 0x61, 0x22, 0x9b, 0x01, 0x0a,
-	0x0c, 0x4d, 0x61, 0x6e, 0x69, 0x66, 0x65, 0x73, 0x74, 0x4d, 0x65, 0x74, 0x61, 0x12, 0x1f, 0x0a,
-	0x0b, 0x6e, 0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x5f, 0x75, 0x72, 0x6c, 0x18, 0x01, 0x20, 0x01,
-	0x28, 0x09, 0x52, 0x0a, 0x6e, 0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x55, 0x72, 0x6c, 0x12, 0x25,
-	0x0a, 0x07, 0x6e, 0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
-	0x0b, 0x2e, 0x70, 0x62, 0x2e, 0x4e, 0x61, 0x72, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x07, 0x6e, 0x61,
-	0x72, 0x69, 0x6e, 0x66, 0x6f, 0x12, 0x1c, 0x0a, 0x09, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74,
-	0x6f, 0x72, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x61,
-	0x74, 0x6f, 0x72, 0x12, 0x25, 0x0a, 0x0e, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x64,
-	0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x67, 0x65, 0x6e,
-	0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x54, 0x69, 0x6d, 0x65, 0x42, 0x18, 0x5a, 0x16, 0x67, 0x69,
-	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x64, 0x6e, 0x72, 0x2f, 0x73, 0x74, 0x79,
-	0x78, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x43, 0x75, 0x74, 0x6f, 0x66, 0x66, 0x12, 0x29, 0x0a, 0x09, 0x70, 0x61, 0x63, 0x6b, 0x5f, 0x6c,
+	0x6f, 0x63, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x70, 0x62, 0x2e, 0x50,
+	0x61, 0x63, 0x6b, 0x4c, 0x6f, 0x63, 0x73, 0x52, 0x08, 0x70, 0x61, 0x63, 0x6b, 0x4c, 0x6f, 0x63,
+	0x73, 0x12, 0x24, 0x0a, 0x04, 0x6d, 0x65, 0x74, 0x61, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x10, 0x2e, 0x70, 0x62, 0x2e, 0x4d, 0x61, 0x6e, 0x69, 0x66, 0x65, 0x73, 0x74, 0x4d, 0x65, 0x74,
+	0x61, 0x52, 0x04, 0x6d, 0x65, 0x74, 0x61, 0x22, 0x83, 0x01, 0x0a, 0x08, 0x50, 0x61, 0x63, 0x6b,
+	0x4c, 0x6f, 0x63, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x61, 0x63, 0x6b, 0x18, 0x01, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x04, 0x70, 0x61, 0x63, 0x6b, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x68, 0x75, 0x6e,
+	0x6b, 0x5f, 0x70, 0x61, 0x63, 0x6b, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x09, 0x63, 0x68,
+	0x75, 0x6e, 0x6b, 0x50, 0x61, 0x63, 0x6b, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x68, 0x75, 0x6e, 0x6b,
+	0x5f, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18, 0x03, 0x20, 0x03, 0x28, 0x03, 0x52, 0x0b, 0x63,
+	0x68, 0x75, 0x6e, 0x6b, 0x4f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x68,
+	0x75, 0x6e, 0x6b, 0x5f, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0d,
+	0x52, 0x0b, 0x63, 0x68, 0x75, 0x6e, 0x6b, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x22, 0x9b, 0x01,
+	0x0a, 0x0c, 0x4d, 0x61, 0x6e, 0x69, 0x66, 0x65, 0x73, 0x74, 0x4d, 0x65, 0x74, 0x61, 0x12, 0x1f,
+	0x0a, 0x0b, 0x6e, 0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x5f, 0x75, 0x72, 0x6c, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x0a, 0x6e, 0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x55, 0x72, 0x6c, 0x12,
+	0x25, 0x0a, 0x07, 0x6e, 0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x0b, 0x2e, 0x70, 0x62, 0x2e, 0x4e, 0x61, 0x72, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x07, 0x6e,
+	0x61, 0x72, 0x69, 0x6e, 0x66, 0x6f, 0x12, 0x1c, 0x0a, 0x09, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x61,
+	0x74, 0x6f, 0x72, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x67, 0x65, 0x6e, 0x65, 0x72,
+	0x61, 0x74, 0x6f, 0x72, 0x12, 0x25, 0x0a, 0x0e, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x65,
+	0x64, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x67, 0x65,
+	0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x54, 0x69, 0x6d, 0x65, 0x42, 0x18, 0x5a, 0x16, 0x67,
+	0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x64, 0x6e, 0x72, 0x2f, 0x73, 0x74,
+	0x79, 0x78, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -209,24 +305,26 @@ func file_manifest_proto_rawDescGZIP() []byte {
 	return file_manifest_proto_rawDescData
 }
 
-var file_manifest_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_manifest_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_manifest_proto_goTypes = []interface{}{
 	(*Manifest)(nil),     // 0: pb.Manifest
-	(*ManifestMeta)(nil), // 1: pb.ManifestMeta
-	(*GlobalParams)(nil), // 2: pb.GlobalParams
-	(*Entry)(nil),        // 3: pb.Entry
-	(*NarInfo)(nil),      // 4: pb.NarInfo
+	(*PackLocs)(nil),     // 1: pb.PackLocs
+	(*ManifestMeta)(nil), // 2: pb.ManifestMeta
+	(*GlobalParams)(nil), // 3: pb.GlobalParams
+	(*Entry)(nil),        // 4: pb.Entry
+	(*NarInfo)(nil),      // 5: pb.NarInfo
 }
 var file_manifest_proto_depIdxs = []int32{
-	2, // 0: pb.Manifest.params:type_name -> pb.GlobalParams
-	3, // 1: pb.Manifest.entries:type_name -> pb.Entry
-	1, // 2: pb.Manifest.meta:type_name -> pb.ManifestMeta
-	4, // 3: pb.ManifestMeta.narinfo:type_name -> pb.NarInfo
-	4, // [4:4] is the sub-list for method output_type
-	4, // [4:4] is the sub-list for method input_type
-	4, // [4:4] is the sub-list for extension type_name
-	4, // [4:4] is the sub-list for extension extendee
-	0, // [0:4] is the sub-list for field type_name
+	3, // 0: pb.Manifest.params:type_name -> pb.GlobalParams
+	4, // 1: pb.Manifest.entries:type_name -> pb.Entry
+	1, // 2: pb.Manifest.pack_locs:type_name -> pb.PackLocs
+	2, // 3: pb.Manifest.meta:type_name -> pb.ManifestMeta
+	5, // 4: pb.ManifestMeta.narinfo:type_name -> pb.NarInfo
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_manifest_proto_init() }
@@ -251,6 +349,18 @@ func file_manifest_proto_init() {
 			}
 		}
 		file_manifest_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PackLocs); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_manifest_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*ManifestMeta); i {
 			case 0:
 				return &v.state
@@ -269,7 +379,7 @@ func file_manifest_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_manifest_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
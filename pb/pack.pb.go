@@ -0,0 +1,156 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.1
+// 	protoc        v4.24.4
+// source: pack.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Index for one pack object, stored alongside the pack with the same name.
+// Chunks are stored in the pack as independent zstd frames, consecutively.
+type PackIndex struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// digests of chunks in pack, concatenated
+	Digests []byte `protobuf:"bytes,1,opt,name=digests,proto3" json:"digests,omitempty"`
+	// compressed length of each chunk (offsets are the cumulative sum)
+	Length []uint32 `protobuf:"varint,2,rep,packed,name=length,proto3" json:"length,omitempty"`
+}
+
+func (x *PackIndex) Reset() {
+	*x = PackIndex{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pack_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PackIndex) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PackIndex) ProtoMessage() {}
+
+func (x *PackIndex) ProtoReflect() protoreflect.Message {
+	mi := &file_pack_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PackIndex.ProtoReflect.Descriptor instead.
+func (*PackIndex) Descriptor() ([]byte, []int) {
+	return file_pack_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PackIndex) GetDigests() []byte {
+	if x != nil {
+		return x.Digests
+	}
+	return nil
+}
+
+func (x *PackIndex) GetLength() []uint32 {
+	if x != nil {
+		return x.Length
+	}
+	return nil
+}
+
+var File_pack_proto protoreflect.FileDescriptor
+
+var file_pack_proto_rawDesc = []byte{
+	0x0a, 0x0a, 0x70, 0x61, 0x63, 0x6b, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x02, 0x70, 0x62,
+	0x22, 0x3d, 0x0a, 0x09, 0x50, 0x61, 0x63, 0x6b, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x18, 0x0a,
+	0x07, 0x64, 0x69, 0x67, 0x65, 0x73, 0x74, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07,
+	0x64, 0x69, 0x67, 0x65, 0x73, 0x74, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x65, 0x6e, 0x67, 0x74,
+	0x68, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x06, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x42,
+	0x18, 0x5a, 0x16, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x64, 0x6e,
+	0x72, 0x2f, 0x73, 0x74, 0x79, 0x78, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x33,
+}
+
+var (
+	file_pack_proto_rawDescOnce sync.Once
+	file_pack_proto_rawDescData = file_pack_proto_rawDesc
+)
+
+func file_pack_proto_rawDescGZIP() []byte {
+	file_pack_proto_rawDescOnce.Do(func() {
+		file_pack_proto_rawDescData = protoimpl.X.CompressGZIP(file_pack_proto_rawDescData)
+	})
+	return file_pack_proto_rawDescData
+}
+
+var file_pack_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_pack_proto_goTypes = []interface{}{
+	(*PackIndex)(nil), // 0: pb.PackIndex
+}
+var file_pack_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_pack_proto_init() }
+func file_pack_proto_init() {
+	if File_pack_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_pack_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PackIndex); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_pack_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_pack_proto_goTypes,
+		DependencyIndexes: file_pack_proto_depIdxs,
+		MessageInfos:      file_pack_proto_msgTypes,
+	}.Build()
+	File_pack_proto = out.File
+	file_pack_proto_rawDesc = nil
+	file_pack_proto_goTypes = nil
+	file_pack_proto_depIdxs = nil
+}
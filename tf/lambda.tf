@@ -131,6 +131,7 @@ resource "aws_lambda_function" "manifester" {
       "manifester",
       # must be in the same region:
       "--chunkbucket=${aws_s3_bucket.styx.id}",
+      "--s3_plain_http",
       "--styx_ssm_signkey=${aws_ssm_parameter.manifester_signkey.name}",
       # Uncomment these to allow manifester to build from styx nix cache on-demand.
       # This shouldn't be necessary since CI pre-builds manifests and they should